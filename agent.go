@@ -4,6 +4,11 @@ package ice
 
 import (
 	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
@@ -13,15 +18,27 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/mdns"
 	"github.com/pion/stun"
-	"github.com/pion/transport/packetio"
 	"github.com/pion/transport/vnet"
+	"golang.org/x/net/proxy"
 )
 
+// connectionStateChange is delivered to the OnConnectionStateChange and
+// OnFailed handlers
+type connectionStateChange struct {
+	state  ConnectionState
+	reason FailureReason
+}
+
 type bindingRequest struct {
 	timestamp      time.Time
 	transactionID  [stun.TransactionIDSize]byte
 	destination    net.Addr
 	isUseCandidate bool
+	isControlling  bool
+
+	// timeout is how long a response is accepted, maxBindingRequestTimeout when
+	// shorter than that.
+	timeout time.Duration
 }
 
 // Agent represents the ICE agent
@@ -33,20 +50,66 @@ type Agent struct {
 	onConnectionStateChangeHdlr       atomic.Value // func(ConnectionState)
 	onSelectedCandidatePairChangeHdlr atomic.Value // func(Candidate, Candidate)
 	onCandidateHdlr                   atomic.Value // func(Candidate)
+	onGatheringStateChangeHdlr        atomic.Value // func(GatheringState)
+	onCheckHdlr                       atomic.Value // func(Candidate, Candidate, CheckResult, time.Duration)
+	onFailedHdlr                      atomic.Value // func(FailureReason)
+
+	onConnectionStateChangeRoutineOnce sync.Once
 
 	// State owned by the taskLoop
 	onConnected     chan struct{}
 	onConnectedOnce sync.Once
+	// connectionStateChanged is closed, and replaced, on every change of the
+	// connection state
+	connectionStateChanged chan struct{}
 
-	connectivityTicker *time.Ticker
+	// onConnectionTimeout is closed when checks time out before connecting
+	onConnectionTimeout     chan struct{}
+	onConnectionTimeoutOnce sync.Once
+
+	// clock is AgentConfig.Clock, or the wall clock
+	clock              Clock
+	connectivityTicker Ticker
 	// force candidate to be contacted immediately (instead of waiting for connectivityTicker)
 	forceCandidateContact chan bool
 
-	tieBreaker uint64
-	lite       bool
+	// rand is AgentConfig.Rand, or crypto/rand
+	rand io.Reader
+	// mathRand is seeded from rand, for the randomness that isn't crypto
+	mathRand             *mathRandomGenerator
+	tieBreaker           uint64
+	lite                 bool
+	aggressiveNomination bool
+	enableRenomination   bool
+	// remoteLite is set by SetRemoteLite when the remote is an ICE-lite agent
+	remoteLite bool
+	// messageIntegritySHA256 is set by AgentConfig.MessageIntegritySHA256, or
+	// once the remote sent a request with MESSAGE-INTEGRITY-SHA256
+	messageIntegritySHA256 bool
+	strictICE              bool
+	onBuildRequest         requestHook
+	onValidateRequest      func(*stun.Message) error
+
+	softwareName softwareAttr
+
+	// dscp is set by SetDSCP, and applied to the local candidates of the
+	// selected pairs
+	dscp    int
+	dscpSet bool
 
 	connectionState ConnectionState
 	gatheringState  GatheringState
+	// failureReason is the FailureReason of the failed state, it is accessed
+	// atomically so it can be read once the Agent is closed
+	failureReason int32
+	// gatheringDone is closed once the gathering goroutines returned
+	gatheringDone <-chan struct{}
+	// gatheringErrors are the last failures of the current gathering by
+	// candidate type, they are reported by GatheringErrors
+	gatheringErrors map[CandidateType]error
+	// duplicateCandidates counts the local candidates that were not added
+	// because an equivalent one was already gathered
+	duplicateCandidates uint64
 
 	mDNSMode MulticastDNSMode
 	mDNSName string
@@ -58,6 +121,24 @@ type Agent struct {
 	isControlling bool
 
 	maxBindingRequests uint16
+	initialRTO         time.Duration
+	rtoMultiplier      float64
+
+	// checkInterval is the time between two new checks, nextCheck is when
+	// pingAllCandidates can start the next one
+	checkInterval time.Duration
+	nextCheck     time.Time
+	// maxConcurrentChecks bounds the pairs in progress, 0 is unbounded
+	maxConcurrentChecks int
+
+	preferLowLatency     bool
+	nominationHysteresis time.Duration
+
+	// checkLimiter paces the STUN messages sent on the pairs, if set
+	checkLimiter         *tokenBucket
+	checkBandwidthPolicy RateLimitPolicy
+	// pacedSTUN are the STUN messages delayed by checkLimiter, in order
+	pacedSTUN []pacedSTUN
 
 	candidateSelectionTimeout time.Duration
 	hostAcceptanceMinWait     time.Duration
@@ -65,9 +146,14 @@ type Agent struct {
 	prflxAcceptanceMinWait    time.Duration
 	relayAcceptanceMinWait    time.Duration
 
+	stunGatherTimeout time.Duration
+
 	portmin uint16
 	portmax uint16
 
+	receiveBufferSize int
+	sendBufferSize    int
+
 	candidateTypes []CandidateType
 
 	// How long connectivity checks can fail before the ICE Agent
@@ -78,10 +164,20 @@ type Agent struct {
 	// goes to failed
 	failedTimeout time.Duration
 
+	// How long connectivity checks can run without selecting a pair
+	// before the ICE Agent goes to failed
+	connectionTimeout time.Duration
+
 	// How often should we send keepalive packets?
 	// 0 means never
 	keepaliveInterval time.Duration
 
+	// How often should we send consent freshness checks, and how long
+	// until consent expires. A consentTimeout of 0 means never
+	consentCheckInterval time.Duration
+	consentTimeout       time.Duration
+	nextConsentCheck     time.Time
+
 	// How after should we run our internal taskLoop
 	taskLoopInterval time.Duration
 
@@ -96,13 +192,32 @@ type Agent struct {
 	checklist []*candidatePair
 	selector  pairCandidateSelector
 
-	selectedPair atomic.Value // *candidatePair
+	// components is the number of components of the stream, selectedPairs
+	// and buffers are indexed by component ID - 1
+	components    uint16
+	selectedPairs []atomic.Value // *candidatePair
+
+	networkConditioner atomic.Value // *networkConditioner
+	buffers            []*packetBuffer
+
+	// pinnedPairs are the pairs selected by SelectCandidatePair, keyed by
+	// component. No other pair is selected for these components until released.
+	pinnedPairs map[uint16]*candidatePair
+	// pendingSwitches are the pairs waiting for NominationHysteresis to replace
+	// the selected pair, keyed by component
+	pendingSwitches map[uint16]pendingSwitch
+	// checksCancelled are the components whose checks were cancelled by
+	// cancelChecks, the pairs added to them later are not checked either
+	checksCancelled map[uint16]bool
+	// remoteCandidatesDone is set by RemoteCandidatesDone until a Restart
+	remoteCandidatesDone bool
+	// remoteICEOptions are the ice-options set by SetRemoteICEOptions, nil
+	// until it is called
+	remoteICEOptions map[string]bool
 
 	urls         []*URL
 	networkTypes []NetworkType
 
-	buffer *packetio.Buffer
-
 	// LRU of outbound Binding request Transaction IDs
 	pendingBindingRequests []bindingRequest
 
@@ -114,16 +229,68 @@ type Agent struct {
 	err  atomicError
 
 	chanCandidate chan Candidate
-	chanState     chan ConnectionState
+	chanState     chan connectionStateChange
+	pairChanges   *pairChangeQueue
+	chanCheck     chan checkEvent
+
+	// checkWaiters are notified of the outcome of the next check of their pair
+	checkWaiters []checkWaiter
 
 	loggerFactory logging.LoggerFactory
 	log           logging.LeveledLogger
 
-	net *vnet.Net
+	net    Net
+	udpMux UDPMux
+
+	udpConns      []*net.UDPConn
+	closeUDPConns bool
 
 	interfaceFilter func(string) bool
+	ipFilter        func(net.IP) bool
+
+	allowPrivateRemoteCandidates bool
+	remoteCandidateFilter        func(Candidate) bool
+
+	candidatePriorityFunc func(Candidate) uint32
+	packetTrace           func(dir Direction, data []byte, local, remote net.Addr)
+
+	batchWrites bool
+
+	maxPacketSize int
+
+	ipv4LocalPreference uint16
+	ipv6LocalPreference uint16
 
 	insecureSkipVerify bool
+	tlsConfig          *tls.Config
+	proxyDialer        proxy.Dialer
+
+	onTURNCredentialRefresh func(url string) (username, password string, err error)
+	turnRefreshInterval     time.Duration
+
+	networkChangeDetection bool
+	networkChangeInterval  time.Duration
+	// hostLocalAddrs are the local IPs enumerated to gather the host
+	// candidates on, the starting point of the network change detection
+	hostLocalAddrs map[string]net.IPAddr
+
+	// interfaceTier is the last tier of interfacePriority host candidates are
+	// gathered on, interfaceTierSince is when checks started on it
+	interfacePriority        []string
+	interfacePriorityTimeout time.Duration
+	interfaceTier            int32
+	interfaceTierSince       time.Time
+
+	relayOnly bool
+
+	// receivingPairs and inboundStats are indexed like selectedPairs
+	receivingPairs           []receivingPair
+	inboundStats             []*inboundStats
+	asymmetricRoutingTimeout time.Duration
+
+	// prewarmedRelays are the allocations made by PrewarmRelay keyed by TURN
+	// URL, gathering takes them instead of allocating
+	prewarmedRelays map[string][]*relayAllocation
 }
 
 func (a *Agent) ok() error {
@@ -177,9 +344,14 @@ func NewAgent(config *AgentConfig) (*Agent, error) {
 		return nil, ErrPort
 	}
 
+	var randReader io.Reader = crand.Reader
+	if config.Rand != nil {
+		randReader = &lockedReader{r: config.Rand}
+	}
+
 	mDNSName := config.MulticastDNSHostName
 	if mDNSName == "" {
-		if mDNSName, err = generateMulticastDNSName(); err != nil {
+		if mDNSName, err = generateMulticastDNSName(randReader); err != nil {
 			return nil, err
 		}
 	}
@@ -214,30 +386,64 @@ func NewAgent(config *AgentConfig) (*Agent, error) {
 		}
 	}
 
+	tieBreaker, err := generateTieBreaker(randReader)
+	if err != nil {
+		closeMDNSConn()
+		return nil, err
+	}
+
+	mathRand, err := newMathRandomGeneratorFrom(randReader)
+	if err != nil {
+		closeMDNSConn()
+		return nil, err
+	}
+
 	startedCtx, startedFn := context.WithCancel(context.Background())
 
 	a := &Agent{
-		tieBreaker:       globalMathRandomGenerator.Uint64(),
+		rand:             randReader,
+		mathRand:         mathRand,
+		tieBreaker:       tieBreaker,
 		lite:             config.Lite,
 		gatheringState:   GatheringStateNew,
+		gatheringErrors:  map[CandidateType]error{},
 		connectionState:  ConnectionStateNew,
 		localCandidates:  make(map[NetworkType][]Candidate),
 		remoteCandidates: make(map[NetworkType][]Candidate),
 		urls:             config.Urls,
-		networkTypes:     config.NetworkTypes,
 		onConnected:      make(chan struct{}),
-		buffer:           packetio.NewBuffer(),
 		done:             make(chan struct{}),
 		startedCh:        startedCtx.Done(),
 		startedFn:        startedFn,
-		chanState:        make(chan ConnectionState, 1),
+		chanState:        make(chan connectionStateChange, 1),
+		pairChanges:      newPairChangeQueue(),
+		chanCheck:        make(chan checkEvent, checkBufferSize),
 		portmin:          config.PortMin,
 		portmax:          config.PortMax,
 		loggerFactory:    loggerFactory,
 		log:              log,
 		net:              config.Net,
+		udpMux:           config.UDPMux,
+		udpConns:         config.UDPConns,
+		closeUDPConns:    config.CloseUDPConns,
 		muChan:           make(chan struct{}, 1),
 
+		onConnectionTimeout:    make(chan struct{}),
+		connectionStateChanged: make(chan struct{}),
+
+		receiveBufferSize: config.ReceiveBufferSize,
+		sendBufferSize:    config.SendBufferSize,
+
+		aggressiveNomination: config.AggressiveNomination,
+		enableRenomination:   config.EnableRenomination,
+
+		messageIntegritySHA256: config.MessageIntegritySHA256,
+		strictICE:              config.StrictICE,
+		onBuildRequest:         requestHook(config.OnBuildRequest),
+		onValidateRequest:      config.OnValidateRequest,
+
+		softwareName: softwareAttr(config.SoftwareName),
+
 		mDNSMode: mDNSMode,
 		mDNSName: mDNSName,
 		mDNSConn: mDNSConn,
@@ -245,11 +451,27 @@ func NewAgent(config *AgentConfig) (*Agent, error) {
 		forceCandidateContact: make(chan bool, 1),
 
 		interfaceFilter: config.InterfaceFilter,
+		ipFilter:        config.IPFilter,
+
+		allowPrivateRemoteCandidates: config.AllowPrivateRemoteCandidates,
+		remoteCandidateFilter:        config.RemoteCandidateFilter,
+
+		candidatePriorityFunc: config.CandidatePriorityFunc,
+		packetTrace:           config.PacketTrace,
+
+		batchWrites: config.BatchWrites,
+
+		preferLowLatency:     config.PreferLowLatency,
+		nominationHysteresis: config.NominationHysteresis,
 
 		insecureSkipVerify: config.InsecureSkipVerify,
+		tlsConfig:          config.TLSConfig,
+		proxyDialer:        config.ProxyDialer,
+
+		onTURNCredentialRefresh: config.OnTURNCredentialRefresh,
 	}
 
-	if a.net == nil {
+	if a.net == nil || a.net == Net((*vnet.Net)(nil)) {
 		a.net = vnet.NewNet(nil)
 	} else if a.net.IsVirtual() {
 		a.log.Warn("vnet is enabled")
@@ -260,16 +482,72 @@ func NewAgent(config *AgentConfig) (*Agent, error) {
 
 	config.initWithDefaults(a)
 
-	// Make sure the buffer doesn't grow indefinitely.
-	// NOTE: We actually won't get anywhere close to this limit.
-	// SRTP will constantly read from the endpoint and drop packets if it's full.
-	a.buffer.SetLimitSize(maxBufferSize)
+	if a.initialRTO <= 0 {
+		closeMDNSConn()
+		return nil, ErrInvalidInitialRTO
+	} else if a.rtoMultiplier < 1 {
+		closeMDNSConn()
+		return nil, ErrInvalidRTOMultiplier
+	}
+
+	if a.components > maxComponents {
+		closeMDNSConn()
+		return nil, ErrInvalidComponents
+	}
+
+	if len([]rune(a.softwareName)) >= maxSoftwareNameLength {
+		closeMDNSConn()
+		return nil, ErrInvalidSoftwareName
+	}
+
+	if config.MaxPacketSize < 0 || config.MaxPacketSize > receiveMTU {
+		closeMDNSConn()
+		return nil, ErrInvalidMaxPacketSize
+	}
+	a.maxPacketSize = config.MaxPacketSize
+	if a.maxPacketSize == 0 {
+		a.maxPacketSize = defaultMaxPacketSize
+	}
+
+	a.selectedPairs = make([]atomic.Value, a.components)
+	a.receivingPairs = make([]receivingPair, a.components)
+	a.inboundStats = make([]*inboundStats, a.components)
+	for i := range a.inboundStats {
+		a.inboundStats[i] = &inboundStats{}
+	}
+	a.pinnedPairs = map[uint16]*candidatePair{}
+	a.pendingSwitches = map[uint16]pendingSwitch{}
+	a.checksCancelled = map[uint16]bool{}
+	maxBufferSize := config.MaxBufferSize
+	if maxBufferSize == 0 {
+		maxBufferSize = defaultMaxBufferSize
+	}
+	bufferOverflowPolicy := config.BufferOverflowPolicy
+	if bufferOverflowPolicy == 0 {
+		bufferOverflowPolicy = BufferOverflowDropNewest
+	}
+	a.buffers = make([]*packetBuffer, a.components)
+	for i := range a.buffers {
+		// Make sure the buffer doesn't grow indefinitely.
+		// NOTE: We actually won't get anywhere close to the default limit.
+		// SRTP will constantly read from the endpoint and drop packets if it's full.
+		a.buffers[i] = newPacketBuffer(maxBufferSize, bufferOverflowPolicy)
+	}
 
 	if a.lite && (len(a.candidateTypes) != 1 || a.candidateTypes[0] != CandidateTypeHost) {
 		closeMDNSConn()
 		return nil, ErrLiteUsingNonHostCandidates
 	}
 
+	if config.RelayOnly {
+		for _, t := range config.CandidateTypes {
+			if t != CandidateTypeRelay {
+				closeMDNSConn()
+				return nil, ErrRelayOnlyCandidateTypes
+			}
+		}
+	}
+
 	if config.Urls != nil && len(config.Urls) > 0 && !containsCandidateType(CandidateTypeServerReflexive, a.candidateTypes) && !containsCandidateType(CandidateTypeRelay, a.candidateTypes) {
 		closeMDNSConn()
 		return nil, ErrUselessUrlsProvided
@@ -286,6 +564,10 @@ func NewAgent(config *AgentConfig) (*Agent, error) {
 		return nil, err
 	}
 
+	if a.networkChangeDetection {
+		go a.watchNetworkChanges()
+	}
+
 	return a, nil
 }
 
@@ -295,8 +577,8 @@ func (a *Agent) OnConnectionStateChange(f func(ConnectionState)) error {
 	return nil
 }
 
-// OnSelectedCandidatePairChange sets a handler that is fired when the final candidate
-// pair is selected
+// OnSelectedCandidatePairChange sets a handler that is fired every time a new
+// candidate pair is selected, including the first selection
 func (a *Agent) OnSelectedCandidatePairChange(f func(Candidate, Candidate)) error {
 	a.onSelectedCandidatePairChangeHdlr.Store(f)
 	return nil
@@ -309,22 +591,119 @@ func (a *Agent) OnCandidate(f func(Candidate)) error {
 	return nil
 }
 
-func (a *Agent) onSelectedCandidatePairChange(p *candidatePair) {
-	if p != nil {
-		if h, ok := a.onSelectedCandidatePairChangeHdlr.Load().(func(Candidate, Candidate)); ok {
-			h(p.local, p.remote)
+// OnCheck sets a handler that is fired when a connectivity check completes,
+// including the consent checks of the selected pairs. rtt is the time since
+// the request was sent, or 0 on CheckResultTimeout. The handler is fired from
+// a goroutine of its own, checks are dropped while it is too slow to keep up.
+func (a *Agent) OnCheck(f func(local, remote Candidate, result CheckResult, rtt time.Duration)) error {
+	a.onCheckHdlr.Store(f)
+	return nil
+}
+
+// checkDone reports a check to the OnCheck handler
+// Note: the caller should hold the agent lock.
+func (a *Agent) checkDone(local, remote Candidate, result CheckResult, rtt time.Duration) {
+	waiters := a.checkWaiters[:0]
+	for _, w := range a.checkWaiters {
+		if w.local.Equal(local) && w.remote.Equal(remote) {
+			w.result <- result
+		} else {
+			waiters = append(waiters, w)
 		}
 	}
+	a.checkWaiters = waiters
+
+	if a.onCheckHdlr.Load() == nil {
+		return
+	}
+
+	select {
+	case a.chanCheck <- checkEvent{local: local, remote: remote, result: result, rtt: rtt}:
+	default:
+		a.log.Debugf("OnCheck handler is too slow, dropping %s check from %s to %s", result, local, remote)
+	}
+}
+
+func (a *Agent) onSelectedCandidatePairChange(p *candidatePair) {
+	if h, ok := a.onSelectedCandidatePairChangeHdlr.Load().(func(Candidate, Candidate)); ok {
+		h(p.local, p.remote)
+	}
 }
 
+// startOnConnectionStateChangeRoutine starts delivering connection state and selected
+// pair changes to the handlers, it is started once by either connect or Close
 func (a *Agent) startOnConnectionStateChangeRoutine() {
-	go func() {
-		for s := range a.chanState {
-			if hdlr, ok := a.onConnectionStateChangeHdlr.Load().(func(ConnectionState)); ok {
-				hdlr(s)
+	a.onConnectionStateChangeRoutineOnce.Do(func() {
+		go func() {
+			for {
+				pairs, ok := a.pairChanges.pop()
+				if !ok {
+					return
+				}
+				for _, p := range pairs {
+					a.onSelectedCandidatePairChange(p)
+				}
+			}
+		}()
+		go func() {
+			for c := range a.chanCheck {
+				if hdlr, ok := a.onCheckHdlr.Load().(func(Candidate, Candidate, CheckResult, time.Duration)); ok {
+					hdlr(c.local, c.remote, c.result, c.rtt)
+				}
+			}
+		}()
+		go func() {
+			for s := range a.chanState {
+				if hdlr, ok := a.onConnectionStateChangeHdlr.Load().(func(ConnectionState)); ok {
+					hdlr(s.state)
+				}
+				if hdlr, ok := a.onFailedHdlr.Load().(func(FailureReason)); ok && s.state == ConnectionStateFailed {
+					hdlr(s.reason)
+				}
 			}
+		}()
+	})
+}
+
+// StartConnectivityChecks starts the connectivity checks like Dial, when
+// isControlling is set, or Accept, without blocking until a pair is selected,
+// e.g. to gather and check independently with trickle ICE and to await the
+// connection with WaitUntilConnected. The first call sets the role and the
+// remote credentials. The later calls check the pairs added since at once, set
+// the credentials after a Restart, and return ErrRemoteCredentialsConflict if
+// they differ from the current ones. The role they pass is ignored, it may have
+// changed to resolve a role conflict. Dial and Accept return ErrMultipleStart
+// once it was called.
+func (a *Agent) StartConnectivityChecks(isControlling bool, remoteUfrag, remotePwd string) error {
+	switch {
+	case remoteUfrag == "":
+		return ErrRemoteUfragEmpty
+	case remotePwd == "":
+		return ErrRemotePwdEmpty
+	}
+
+	if err := a.startConnectivityChecks(isControlling, remoteUfrag, remotePwd); err != ErrMultipleStart {
+		return err
+	}
+
+	var conflict bool
+	if err := a.run(func(agent *Agent) {
+		if agent.remoteUfrag == "" && agent.remotePwd == "" {
+			// Cleared by Restart, the checks go on with the new credentials
+			agent.remoteUfrag, agent.remotePwd = remoteUfrag, remotePwd
+		} else if agent.remoteUfrag != remoteUfrag || agent.remotePwd != remotePwd {
+			conflict = true
+			return
 		}
-	}()
+		agent.requestConnectivityCheck()
+	}, nil); err != nil {
+		return err
+	}
+
+	if conflict {
+		return ErrRemoteCredentialsConflict
+	}
+	return nil
 }
 
 func (a *Agent) startConnectivityChecks(isControlling bool, remoteUfrag, remotePwd string) error {
@@ -342,43 +721,147 @@ func (a *Agent) startConnectivityChecks(isControlling bool, remoteUfrag, remoteP
 	a.startOnConnectionStateChangeRoutine()
 	a.log.Debugf("Started agent: isControlling? %t, remoteUfrag: %q, remotePwd: %q", isControlling, remoteUfrag, remotePwd)
 
-	return a.run(func(agent *Agent) {
-		agent.isControlling = isControlling
-		agent.remoteUfrag = remoteUfrag
-		agent.remotePwd = remotePwd
-
-		if isControlling {
-			a.selector = &controllingSelector{agent: a, log: a.log}
-		} else {
-			a.selector = &controlledSelector{agent: a, log: a.log}
+	var relayErr error
+	if err := a.run(func(agent *Agent) {
+		if agent.relayGatheringFailed() {
+			relayErr = ErrRelayGatheringFailed
+			return
 		}
 
-		if a.lite {
-			a.selector = &liteSelector{pairCandidateSelector: a.selector}
+		if agent.controlsLiteRemote() && !isControlling {
+			a.log.Debug("Remote is ICE-lite, taking the controlling role")
+			isControlling = true
 		}
+		agent.isControlling = isControlling
+		agent.remoteUfrag = remoteUfrag
+		agent.remotePwd = remotePwd
 
-		a.selector.Start()
+		a.startSelector()
 		a.startedFn()
 
 		agent.updateConnectionState(ConnectionStateChecking)
 
 		// TODO this should be dynamic, and grow when the connection is stable
 		a.requestConnectivityCheck()
-		agent.connectivityTicker = time.NewTicker(a.taskLoopInterval)
+		agent.connectivityTicker = a.clock.NewTicker(a.taskLoopInterval)
 		go a.connectivityChecks()
-	}, nil)
+	}, nil); err != nil {
+		return err
+	}
+	return relayErr
+}
+
+// startSelector creates and starts the pairCandidateSelector for the current role
+func (a *Agent) startSelector() {
+	if a.isControlling {
+		a.selector = &controllingSelector{agent: a, log: a.log}
+	} else {
+		a.selector = &controlledSelector{agent: a, log: a.log}
+	}
+
+	if a.lite {
+		a.selector = &liteSelector{pairCandidateSelector: a.selector}
+	}
+
+	a.selector.Start()
+}
+
+// controlsLiteRemote returns whether the remote is lite and we are not, so we must
+// always be controlling and do the nomination
+// https://tools.ietf.org/html/rfc8445#section-6.1.1
+func (a *Agent) controlsLiteRemote() bool {
+	return a.remoteLite && !a.lite
+}
+
+// switchRole changes the role of the Agent after a role conflict, the priority
+// of every pair is recomputed and a new selector is started for the new role.
+// https://tools.ietf.org/html/rfc8445#section-7.3.1.1
+func (a *Agent) switchRole(isControlling bool) {
+	a.log.Infof("role conflict, switching from isControlling: %t to %t", a.isControlling, isControlling)
+
+	a.isControlling = isControlling
+	for _, p := range a.checklist {
+		p.iceRoleControlling = isControlling
+	}
+	a.startSelector()
+}
+
+// resolveRoleConflict compares the tie-breaker of an inbound Binding request
+// carrying the same role as ours with our own. It returns false if we keep
+// our role, in that case a 487 (Role Conflict) has been sent and the request
+// must not be processed any further.
+// https://tools.ietf.org/html/rfc8445#section-7.3.1.1
+func (a *Agent) resolveRoleConflict(m *stun.Message, local Candidate, remote net.Addr) bool {
+	var control AttrControl
+	if err := control.GetFrom(m); err != nil {
+		return true
+	}
+
+	switch {
+	case a.isControlling && control.Role == Controlling:
+		if a.tieBreaker >= control.Tiebreaker || a.controlsLiteRemote() {
+			a.sendBindingError(m, local, remote, stun.CodeRoleConflict)
+			return false
+		}
+		a.switchRole(false)
+	case !a.isControlling && control.Role == Controlled:
+		if a.tieBreaker < control.Tiebreaker {
+			a.sendBindingError(m, local, remote, stun.CodeRoleConflict)
+			return false
+		}
+		a.switchRole(true)
+	}
+	return true
+}
+
+// roleAttr is the ICE-CONTROLLING or ICE-CONTROLLED attribute of our role
+func (a *Agent) roleAttr() AttrControl {
+	if a.isControlling {
+		return AttrControl{Role: Controlling, Tiebreaker: a.tieBreaker}
+	}
+	return AttrControl{Role: Controlled, Tiebreaker: a.tieBreaker}
+}
+
+// assertStrictRequest returns an error if a Binding request lacks an
+// attribute StrictICE requires, it is then rejected with a 400 (Bad Request)
+func assertStrictRequest(m *stun.Message) error {
+	var priority PriorityAttr
+	if err := priority.GetFrom(m); err != nil {
+		return fmt.Errorf("invalid PRIORITY: %w", err)
+	}
+
+	var control AttrControl
+	if m.Contains(stun.AttrICEControlling) && m.Contains(stun.AttrICEControlled) {
+		return errors.New("both ICE-CONTROLLING and ICE-CONTROLLED")
+	} else if err := control.GetFrom(m); err != nil {
+		return fmt.Errorf("invalid role attribute: %w", err)
+	} else if control.Role == Controlled && m.Contains(stun.AttrUseCandidate) {
+		return errors.New("USE-CANDIDATE from the controlled agent")
+	}
+	return nil
 }
 
 func (a *Agent) connectivityChecks() {
 	lastConnectionState := ConnectionState(0)
 	checkingDuration := time.Time{}
 
+	// retransmitTimer fires when a binding request has to be retransmitted, or
+	// the connection state times out, before the next tick of the connectivityTicker
+	retransmitTimer := a.clock.NewTimer(0)
+	defer retransmitTimer.Stop()
+	<-retransmitTimer.C()
+
 	contact := func() {
+		var next time.Time
+		var ok bool
+
 		if err := a.run(func(a *Agent) {
 			defer func() {
 				lastConnectionState = a.connectionState
 			}()
 
+			a.sendPacedSTUN()
+
 			switch a.connectionState {
 			case ConnectionStateFailed:
 				// The connection is currently failed so don't send any checks
@@ -387,27 +870,69 @@ func (a *Agent) connectivityChecks() {
 			case ConnectionStateChecking:
 				// We have just entered checking for the first time so update our checking timer
 				if lastConnectionState != a.connectionState {
-					checkingDuration = time.Now()
+					checkingDuration = a.clock.Now()
 				}
 
-				// We have been in checking longer then Disconnect+Failed timeout, set the connection to Failed
-				if time.Since(checkingDuration) > a.disconnectedTimeout+a.failedTimeout {
-					a.updateConnectionState(ConnectionStateFailed)
+				// We have been in checking longer then the connection timeout, set the connection to Failed
+				if a.connectionTimeout != 0 && a.clock.Now().Sub(checkingDuration) >= a.connectionTimeout {
+					a.log.Warnf("no candidate pair selected after %s of checks, %d pairs checked", a.connectionTimeout, len(a.checklist))
+					a.fail(a.connectionTimeoutReason())
+					a.onConnectionTimeoutOnce.Do(func() { close(a.onConnectionTimeout) })
 					return
 				}
 			}
 
 			a.selector.ContactCandidates()
+			a.switchDwelledPairs()
+			a.checkInterfaceTier()
+			a.checkAsymmetricRouting()
+			if a.connectionState == ConnectionStateChecking && a.checksExhausted() {
+				a.log.Warnf("every candidate pair failed and the remote has no more candidates, %d pairs checked", len(a.checklist))
+				a.fail(FailureReasonNoValidPairs)
+				a.onConnectionTimeoutOnce.Do(func() { close(a.onConnectionTimeout) })
+				return
+			}
+
+			next, ok = a.nextRetransmission()
+			if timeout, hasTimeout := a.nextConnectionStateTimeout(); hasTimeout && (!ok || timeout.Before(next)) {
+				next, ok = timeout, true
+			}
+			if at, hasSwitch := a.nextPendingSwitch(); hasSwitch && (!ok || at.Before(next)) {
+				next, ok = at, true
+			}
+			if at, hasTier := a.nextInterfaceTier(); hasTier && (!ok || at.Before(next)) {
+				next, ok = at, true
+			}
+			if at, hasPaced := a.nextPacedSTUN(); hasPaced && (!ok || at.Before(next)) {
+				next, ok = at, true
+			}
+			if a.connectionState == ConnectionStateChecking && a.connectionTimeout != 0 {
+				if timeout := checkingDuration.Add(a.connectionTimeout); !ok || timeout.Before(next) {
+					next, ok = timeout, true
+				}
+			}
 		}, nil); err != nil {
 			a.log.Warnf("taskLoop failed: %v", err)
 		}
+
+		if !retransmitTimer.Stop() {
+			select {
+			case <-retransmitTimer.C():
+			default:
+			}
+		}
+		if ok {
+			retransmitTimer.Reset(next.Sub(a.clock.Now()))
+		}
 	}
 
 	for {
 		select {
 		case <-a.forceCandidateContact:
 			contact()
-		case <-a.connectivityTicker.C:
+		case <-a.connectivityTicker.C():
+			contact()
+		case <-retransmitTimer.C():
 			contact()
 		case <-a.done:
 			return
@@ -419,31 +944,134 @@ func (a *Agent) updateConnectionState(newState ConnectionState) {
 	if a.connectionState != newState {
 		// Connection has gone to failed, release all gathered candidates
 		if newState == ConnectionStateFailed {
-			a.deleteAllCandidates()
+			if err := a.deleteAllCandidates(); err != nil {
+				a.log.Warnf("Failed to close candidates: %v", err)
+			}
+		} else if newState != ConnectionStateClosed {
+			atomic.StoreInt32(&a.failureReason, 0)
 		}
 
 		a.log.Infof("Setting new connection state: %s", newState)
 		a.connectionState = newState
+		close(a.connectionStateChanged)
+		a.connectionStateChanged = make(chan struct{})
 
 		// Call handler in different routine since we may be holding the agent lock
 		// and the handler may also require it
-		a.chanState <- newState
+		a.chanState <- connectionStateChange{state: newState, reason: a.FailureReason()}
+	}
+}
+
+// fail moves the connection state to failed because of reason
+func (a *Agent) fail(reason FailureReason) {
+	if a.connectionState == ConnectionStateFailed {
+		return
+	}
+
+	atomic.StoreInt32(&a.failureReason, int32(reason))
+	a.updateConnectionState(ConnectionStateFailed)
+}
+
+// FailureReason returns why the connection state became failed, it stays
+// available once the Agent is closed. It is 0 while the state is not failed,
+// or closed after failing.
+func (a *Agent) FailureReason() FailureReason {
+	return FailureReason(atomic.LoadInt32(&a.failureReason))
+}
+
+// WaitUntilConnected blocks until the connection state is connected or
+// completed, e.g. to await the connectivity checks started by Dial or Accept
+// in another goroutine. It returns ErrConnectionFailed with the FailureReason
+// when the state is failed, ctx.Err() when ctx is done first, and ErrClosed
+// once the Agent is closed. It returns at once when already connected.
+func (a *Agent) WaitUntilConnected(ctx context.Context) error {
+	for {
+		var state ConnectionState
+		var changed chan struct{}
+		if err := a.run(func(agent *Agent) {
+			state = agent.connectionState
+			changed = agent.connectionStateChanged
+		}, nil); err != nil {
+			return err
+		}
+
+		switch state {
+		case ConnectionStateConnected, ConnectionStateCompleted:
+			return nil
+		case ConnectionStateFailed:
+			return fmt.Errorf("%w: %s", ErrConnectionFailed, a.FailureReason())
+		case ConnectionStateClosed:
+			return a.getErr()
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.done:
+			return a.getErr()
+		}
 	}
 }
 
+// OnFailed sets a handler that is fired with the reason of the failure when
+// the connection state becomes failed, right after the OnConnectionStateChange
+// handler
+func (a *Agent) OnFailed(f func(FailureReason)) error {
+	a.onFailedHdlr.Store(f)
+	return nil
+}
+
 func (a *Agent) setSelectedPair(p *candidatePair) {
 	a.log.Tracef("Set selected candidate pair: %s", p)
-	// Notify when the selected pair changes
-	a.onSelectedCandidatePairChange(p)
 
 	if p == nil {
 		var nilPair *candidatePair
-		a.selectedPair.Store(nilPair)
+		for i := range a.selectedPairs {
+			a.selectedPairs[i].Store(nilPair)
+		}
+		a.pendingSwitches = map[uint16]pendingSwitch{}
+		return
+	}
+
+	component := p.local.Component()
+	if !a.hasComponent(component) {
+		a.log.Warnf("Can not select %s, the agent has no component %d", p, component)
+		return
+	} else if p.Equal(a.getComponentSelectedPair(component)) {
+		return
+	} else if pinnedPair := a.pinnedPairs[component]; pinnedPair != nil && pinnedPair != p {
+		a.log.Debugf("Not selecting %s, %s was selected by SelectCandidatePair", p, pinnedPair)
 		return
 	}
 
+	// Notify when the selected pair changes, in a different routine since we
+	// are holding the agent lock and the handler may also require it
+	a.pairChanges.push(p)
+	delete(a.pendingSwitches, component)
+
 	p.nominated = true
-	a.selectedPair.Store(p)
+	p.consentTime = a.clock.Now()
+	p.selectedTime = p.consentTime
+	a.selectedPairs[component-1].Store(p)
+	if a.dscpSet {
+		if err := p.local.setDSCP(a.dscp); err != nil {
+			a.log.Warnf("Failed to set DSCP on %s: %v", p.local, err)
+		}
+	}
+	a.scheduleConsentCheck()
+
+	// A controlling agent using aggressive nomination keeps checking until the
+	// remote granted consent on the selected pair, a higher priority pair may
+	// still be nominated
+	if !a.isControlling || !a.aggressiveNomination {
+		a.cancelChecks(component)
+	}
+
+	// The stream is connected once every component has a selected pair
+	if a.getSelectedPairs() == nil {
+		return
+	}
 
 	a.updateConnectionState(ConnectionStateConnected)
 
@@ -458,79 +1086,327 @@ func (a *Agent) pingAllCandidates() {
 		a.log.Warn("pingAllCandidates called with no candidate pairs. Connection is not possible yet.")
 	}
 
+	now := a.clock.Now()
 	for _, p := range a.checklist {
-		if p.state == CandidatePairStateWaiting {
-			p.state = CandidatePairStateInProgress
-		} else if p.state != CandidatePairStateInProgress {
+		if p.state != CandidatePairStateInProgress || now.Before(p.nextBindingRequest) {
 			continue
 		}
 
-		if p.bindingRequestCount > a.maxBindingRequests {
-			a.log.Tracef("max requests reached for pair %s, marking it as failed\n", p)
+		if p.bindingRequestCount >= a.maxBindingRequests {
+			a.log.Debugf("no response to %d binding requests on pair %s, marking it as failed", p.bindingRequestCount, p)
 			p.state = CandidatePairStateFailed
-		} else {
-			a.selector.PingCandidate(p.local, p.remote)
-			p.bindingRequestCount++
+			a.checkDone(p.local, p.remote, CheckResultTimeout, 0)
+			continue
 		}
+
+		a.sendCheck(p, now)
 	}
-}
 
-func (a *Agent) getBestAvailableCandidatePair() *candidatePair {
-	var best *candidatePair
-	for _, p := range a.checklist {
-		if p.state == CandidatePairStateFailed {
-			continue
+	// The pairs that were not checked yet start one at a time, by priority
+	// https://tools.ietf.org/html/rfc8445#section-6.1.4.2
+	for !now.Before(a.nextCheck) && !a.maxChecksInProgress() {
+		p := a.nextPairToCheck()
+		if p == nil {
+			break
 		}
 
-		if best == nil {
-			best = p
-		} else if best.Priority() < p.Priority() {
-			best = p
-		}
+		p.state = CandidatePairStateInProgress
+		a.sendCheck(p, now)
+		a.nextCheck = now.Add(a.checkInterval)
 	}
-	return best
 }
 
-func (a *Agent) getBestValidCandidatePair() *candidatePair {
-	var best *candidatePair
+// maxChecksInProgress returns true if MaxConcurrentChecks pairs are being
+// checked, no other check starts until one of them completes
+func (a *Agent) maxChecksInProgress() bool {
+	if a.maxConcurrentChecks <= 0 {
+		return false
+	}
+
+	inProgress := 0
 	for _, p := range a.checklist {
-		if p.state != CandidatePairStateSucceeded {
-			continue
+		if p.state == CandidatePairStateInProgress {
+			inProgress++
 		}
+	}
+	return inProgress >= a.maxConcurrentChecks
+}
 
-		if best == nil {
-			best = p
-		} else if best.Priority() < p.Priority() {
-			best = p
-		}
+// checkCompleted is called when the check of a pair succeeded, the next
+// waiting pair is checked at once when MaxConcurrentChecks was reached
+func (a *Agent) checkCompleted() {
+	if a.maxConcurrentChecks > 0 {
+		a.requestConnectivityCheck()
 	}
-	return best
 }
 
-func (a *Agent) addPair(local, remote Candidate) *candidatePair {
-	p := newCandidatePair(local, remote, a.isControlling)
-	a.checklist = append(a.checklist, p)
-	return p
+// sendCheck sends a binding request on p, and schedules its retransmission
+func (a *Agent) sendCheck(p *candidatePair, now time.Time) {
+	if p.rto == 0 {
+		p.rto = a.initialRTO
+	} else {
+		p.rto = time.Duration(float64(p.rto) * a.rtoMultiplier)
+	}
+	p.nextBindingRequest = now.Add(p.rto)
+
+	a.selector.PingCandidate(p.local, p.remote)
+	p.bindingRequestCount++
 }
 
-func (a *Agent) findPair(local, remote Candidate) *candidatePair {
+// nextPairToCheck returns the highest priority waiting pair or, if there is
+// none, the highest priority frozen pair that no other pair of its foundation
+// is being checked for
+func (a *Agent) nextPairToCheck() *candidatePair {
+	var waiting, frozen *candidatePair
 	for _, p := range a.checklist {
-		if p.local.Equal(local) && p.remote.Equal(remote) {
-			return p
+		switch {
+		case p.state == CandidatePairStateWaiting:
+			if waiting == nil || p.Priority() > waiting.Priority() {
+				waiting = p
+			}
+		case p.state == CandidatePairStateFrozen && !a.isFoundationChecked(p.foundation()):
+			if frozen == nil || p.Priority() > frozen.Priority() {
+				frozen = p
+			}
+		}
+	}
+
+	if waiting != nil {
+		return waiting
+	}
+	return frozen
+}
+
+// cancelChecks stops checking the pairs of component that are waiting, frozen
+// or in progress, once it has a selected pair. The valid pairs keep their
+// state, they can still be renominated.
+// https://tools.ietf.org/html/rfc8445#section-8.1.2
+func (a *Agent) cancelChecks(component uint16) {
+	a.checksCancelled[component] = true
+	for _, p := range a.checklist {
+		if p.local.Component() != component {
+			continue
+		}
+
+		switch p.state {
+		case CandidatePairStateWaiting, CandidatePairStateFrozen, CandidatePairStateInProgress:
+			p.state = CandidatePairStateCancelled
+			p.bindingRequestCount = 0
+			p.rto = 0
+			p.nextBindingRequest = time.Time{}
+		}
+	}
+}
+
+// resumeChecks checks the cancelled pairs of component again, once its
+// selected pair was removed
+func (a *Agent) resumeChecks(component uint16) {
+	delete(a.checksCancelled, component)
+	for _, p := range a.checklist {
+		if p.local.Component() == component && p.state == CandidatePairStateCancelled {
+			p.state = CandidatePairStateWaiting
+		}
+	}
+	a.requestConnectivityCheck()
+}
+
+// isFoundationChecked returns true if a pair with foundation is waiting for
+// its check, or for the response to it
+func (a *Agent) isFoundationChecked(foundation string) bool {
+	for _, p := range a.checklist {
+		if (p.state == CandidatePairStateWaiting || p.state == CandidatePairStateInProgress) && p.foundation() == foundation {
+			return true
+		}
+	}
+	return false
+}
+
+// unfreezePairs lets the frozen pairs sharing the foundation of p be checked,
+// once a check on p succeeded
+// https://tools.ietf.org/html/rfc8445#section-7.2.5.3.3
+func (a *Agent) unfreezePairs(p *candidatePair) {
+	foundation := p.foundation()
+	for _, frozen := range a.checklist {
+		if frozen.state == CandidatePairStateFrozen && frozen.foundation() == foundation {
+			frozen.state = CandidatePairStateWaiting
+		}
+	}
+}
+
+// nextRetransmission returns when pingAllCandidates must run again to retransmit
+// or fail a pair that is still in progress, or to start checking the next pair.
+// Times that already passed are ignored, pingAllCandidates would have moved
+// them if it was still running, e.g. it stops once a pair is selected.
+func (a *Agent) nextRetransmission() (next time.Time, ok bool) {
+	now := a.clock.Now()
+	for _, p := range a.checklist {
+		if p.state != CandidatePairStateInProgress || !p.nextBindingRequest.After(now) {
+			continue
+		}
+
+		if !ok || p.nextBindingRequest.Before(next) {
+			next, ok = p.nextBindingRequest, true
+		}
+	}
+
+	if a.nextCheck.After(now) && (!ok || a.nextCheck.Before(next)) && !a.maxChecksInProgress() && a.nextPairToCheck() != nil {
+		next, ok = a.nextCheck, true
+	}
+	return next, ok
+}
+
+func (a *Agent) getBestAvailableCandidatePair(component uint16) *candidatePair {
+	var best *candidatePair
+	for _, p := range a.checklist {
+		if p.state == CandidatePairStateFailed || p.local.Component() != component {
+			continue
+		}
+
+		if a.isBetterPair(p, best) {
+			best = p
+		}
+	}
+	return best
+}
+
+func (a *Agent) getBestValidCandidatePair(component uint16) *candidatePair {
+	var best *candidatePair
+	for _, p := range a.checklist {
+		if p.state != CandidatePairStateSucceeded || p.local.Component() != component {
+			continue
+		}
+
+		if a.isBetterPair(p, best) {
+			best = p
+		}
+	}
+	return best
+}
+
+// getValidCandidatePairTo returns the best valid pair of component with addr as remote address
+func (a *Agent) getValidCandidatePairTo(component uint16, addr net.Addr) *candidatePair {
+	var best *candidatePair
+	for _, p := range a.checklist {
+		if p.state != CandidatePairStateSucceeded || p.local.Component() != component ||
+			!addrEqual(addr, createAddr(p.remote.NetworkType(), p.remote.addr().IP, p.remote.Port())) {
+			continue
+		}
+
+		if a.isBetterPair(p, best) {
+			best = p
+		}
+	}
+	return best
+}
+
+// isBetterPair returns true if p has a higher priority than best, or is the
+// first pair. With PreferLowLatency, p is also better than a pair of the same
+// priority with a higher RTT, or whose RTT wasn't measured yet.
+func (a *Agent) isBetterPair(p, best *candidatePair) bool {
+	switch {
+	case best == nil:
+		return true
+	case p.Priority() != best.Priority():
+		return p.Priority() > best.Priority()
+	case !a.preferLowLatency:
+		return false
+	}
+
+	rtt, bestRTT := p.rtt(), best.rtt()
+	return rtt > 0 && (bestRTT == 0 || rtt < bestRTT)
+}
+
+func (a *Agent) addPair(local, remote Candidate) *candidatePair {
+	p := newCandidatePair(local, remote, a.isControlling)
+	switch {
+	case a.checksCancelled[local.Component()]:
+		p.state = CandidatePairStateCancelled
+	case a.isFoundationChecked(p.foundation()):
+		p.state = CandidatePairStateFrozen
+	}
+	a.checklist = append(a.checklist, p)
+	return p
+}
+
+func (a *Agent) findPair(local, remote Candidate) *candidatePair {
+	for _, p := range a.checklist {
+		if p.local.Equal(local) && p.remote.Equal(remote) {
+			return p
 		}
 	}
 	return nil
 }
 
-// validateSelectedPair checks if the selected pair is (still) valid
+// findLocalCandidate returns the local candidate equal to c, or nil
+func (a *Agent) findLocalCandidate(c Candidate) Candidate {
+	for _, local := range a.localCandidates[c.NetworkType()] {
+		if local.Equal(c) {
+			return local
+		}
+	}
+	return nil
+}
+
+// relayGatheringFailed returns true if the Agent is RelayOnly and gathering
+// completed without a relay candidate
+// Note: the caller should hold the agent lock.
+func (a *Agent) relayGatheringFailed() bool {
+	if !a.relayOnly || a.gatheringState != GatheringStateComplete {
+		return false
+	}
+	for _, candidates := range a.localCandidates {
+		if len(candidates) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// connectionTimeoutReason returns why no pair was selected before the
+// connection timeout
+// Note: the caller should hold the agent lock.
+func (a *Agent) connectionTimeoutReason() FailureReason {
+	gathered := false
+	for _, candidates := range a.localCandidates {
+		gathered = gathered || len(candidates) > 0
+	}
+	if !gathered {
+		return FailureReasonGatheringFailed
+	}
+
+	for _, p := range a.checklist {
+		if p.state == CandidatePairStateSucceeded {
+			return FailureReasonTimeout
+		}
+	}
+	return FailureReasonNoValidPairs
+}
+
+// checksExhausted returns true once both sides are done gathering and every
+// pair failed, until then more pairs may still succeed
+func (a *Agent) checksExhausted() bool {
+	if !a.remoteCandidatesComplete() || a.gatheringState != GatheringStateComplete || len(a.checklist) == 0 {
+		return false
+	}
+
+	for _, p := range a.checklist {
+		if p.state != CandidatePairStateFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// validateSelectedPair checks if the selected pairs are (still) valid, the
+// connection state follows the component that has been silent the longest
 // Note: the caller should hold the agent lock.
 func (a *Agent) validateSelectedPair() bool {
-	selectedPair := a.getSelectedPair()
-	if selectedPair == nil {
+	selectedPairs := a.getSelectedPairs()
+	if selectedPairs == nil {
 		return false
 	}
 
-	disconnectedTime := time.Since(selectedPair.remote.LastReceived())
+	disconnectedTime := a.clock.Now().Sub(oldestLastReceived(selectedPairs))
 
 	// Only allow transitions to failed if a.failedTimeout is non-zero
 	totalTimeToFailure := a.failedTimeout
@@ -540,7 +1416,7 @@ func (a *Agent) validateSelectedPair() bool {
 
 	switch {
 	case totalTimeToFailure != 0 && disconnectedTime > totalTimeToFailure:
-		a.updateConnectionState(ConnectionStateFailed)
+		a.fail(FailureReasonTimeout)
 	case a.disconnectedTimeout != 0 && disconnectedTime > a.disconnectedTimeout:
 		a.updateConnectionState(ConnectionStateDisconnected)
 	default:
@@ -550,24 +1426,134 @@ func (a *Agent) validateSelectedPair() bool {
 	return true
 }
 
-// checkKeepalive sends STUN Binding Indications to the selected pair
-// if no packet has been sent on that pair in the last keepaliveInterval
+// nextConnectionStateTimeout returns when the selected pairs go to disconnected,
+// or from disconnected to failed, if nothing is received on them until then
+// Note: the caller should hold the agent lock.
+func (a *Agent) nextConnectionStateTimeout() (time.Time, bool) {
+	selectedPairs := a.getSelectedPairs()
+	if selectedPairs == nil {
+		return time.Time{}, false
+	}
+
+	lastReceived := oldestLastReceived(selectedPairs)
+	switch {
+	case a.connectionState == ConnectionStateConnected && a.disconnectedTimeout != 0:
+		return lastReceived.Add(a.disconnectedTimeout), true
+	case a.connectionState == ConnectionStateDisconnected && a.failedTimeout != 0:
+		return lastReceived.Add(a.disconnectedTimeout + a.failedTimeout), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// reconnectOnTraffic goes back to connected as soon as a selected pair
+// receives traffic while disconnected, instead of on the next check
+// Note: the caller should hold the agent lock.
+func (a *Agent) reconnectOnTraffic(remote Candidate) {
+	if a.connectionState != ConnectionStateDisconnected {
+		return
+	}
+
+	for _, selectedPair := range a.getSelectedPairs() {
+		if selectedPair.remote.Equal(remote) {
+			a.validateSelectedPair()
+			return
+		}
+	}
+}
+
+// checkKeepalive sends STUN Binding Indications to the selected pairs
+// if no packet has been sent on a pair in the last keepaliveInterval
 // Note: the caller should hold the agent lock.
 func (a *Agent) checkKeepalive() {
-	selectedPair := a.getSelectedPair()
-	if selectedPair == nil {
+	if a.keepaliveInterval == 0 {
 		return
 	}
 
-	if (a.keepaliveInterval != 0) &&
-		(time.Since(selectedPair.local.LastSent()) > a.keepaliveInterval) {
-		// we use binding request instead of indication to support refresh consent schemas
-		// see https://tools.ietf.org/html/rfc7675
-		a.selector.PingCandidate(selectedPair.local, selectedPair.remote)
+	for _, selectedPair := range a.getSelectedPairs() {
+		if a.clock.Now().Sub(selectedPair.local.LastSent()) <= a.keepaliveInterval {
+			continue
+		}
+
+		// Consent is refreshed by checkConsent, keepalives don't expect a response
+		// https://tools.ietf.org/html/rfc8445#section-11
+		msg, err := stun.Build(stun.NewType(stun.MethodBinding, stun.ClassIndication), a.transactionID(),
+			stun.Fingerprint,
+		)
+		if err != nil {
+			a.log.Error(err.Error())
+			return
+		}
+
+		a.log.Tracef("keepalive STUN from %s to %s", selectedPair.local, selectedPair.remote)
+		a.sendSTUN(msg, selectedPair.local, selectedPair.remote)
+	}
+}
+
+// checkConsent sends consent freshness checks on the selected pairs, and returns
+// false if consent expired on any of them. The Agent is then closed with ErrConsentExpired.
+// https://tools.ietf.org/html/rfc7675
+// Note: the caller should hold the agent lock.
+func (a *Agent) checkConsent() bool {
+	selectedPairs := a.getSelectedPairs()
+	if selectedPairs == nil || a.consentTimeout == 0 {
+		return true
+	}
+
+	for _, selectedPair := range selectedPairs {
+		if a.clock.Now().Sub(selectedPair.consentTime) <= a.consentTimeout {
+			continue
+		}
+
+		a.log.Warnf("consent expired for %s", selectedPair)
+		a.fail(FailureReasonConsentExpired)
+
+		// Closing requires the agent lock
+		go func() {
+			if err := a.close(ErrConsentExpired); err != nil {
+				a.log.Debugf("failed to close agent after consent expired: %v", err)
+			}
+		}()
+		return false
 	}
+
+	if !a.clock.Now().Before(a.nextConsentCheck) {
+		for _, selectedPair := range selectedPairs {
+			a.selector.PingCandidate(selectedPair.local, selectedPair.remote)
+			selectedPair.consentRequestsSent++
+		}
+		a.scheduleConsentCheck()
+	}
+	return true
+}
+
+// scheduleConsentCheck picks the time of the next consent freshness check
+// The interval is randomized to prevent synchronization
+// https://tools.ietf.org/html/rfc7675#section-5.1
+func (a *Agent) scheduleConsentCheck() {
+	base := a.consentCheckInterval * 8 / 10
+	jitter := time.Duration(a.mathRand.Intn(int(a.consentCheckInterval*4/10) + 1))
+	a.nextConsentCheck = a.clock.Now().Add(base + jitter)
+}
+
+// RemoteCandidatesDone signals the end of the remote candidates, e.g. once
+// the remote trickled its end-of-candidates indication. Until then a failure
+// of every pair only fails the connection after ConnectionTimeout, as the pairs
+// of the candidates still to come may succeed. Once it is called, and local
+// gathering is complete, the connection fails as soon as every pair failed.
+// It applies until the next Restart.
+func (a *Agent) RemoteCandidatesDone() error {
+	return a.run(func(agent *Agent) {
+		agent.remoteCandidatesDone = true
+		agent.requestConnectivityCheck()
+	}, nil)
 }
 
 // AddRemoteCandidate adds a new remote candidate
+//
+// Candidates may be trickled at any time, including after Dial or Accept
+// have been called. They are paired with all local candidates of the same
+// network type and connectivity checks are scheduled immediately.
 func (a *Agent) AddRemoteCandidate(c Candidate) error {
 	// If we have a mDNS Candidate lets fully resolve it before adding it locally
 	if c.Type() == CandidateTypeHost && strings.HasSuffix(c.Address(), ".local") {
@@ -600,7 +1586,11 @@ func (a *Agent) resolveAndAddMulticastCandidate(c *CandidateHost) {
 	if a.mDNSConn == nil {
 		return
 	}
-	_, src, err := a.mDNSConn.Query(context.TODO(), c.Address())
+	// Unresolvable candidates are dropped, this doesn't affect the other candidates
+	ctx, cancel := context.WithTimeout(context.Background(), multicastDNSQueryTimeout)
+	defer cancel()
+
+	_, src, err := a.mDNSConn.Query(ctx, c.Address())
 	if err != nil {
 		a.log.Warnf("Failed to discover mDNS candidate %s: %v", c.Address(), err)
 		return
@@ -632,8 +1622,31 @@ func (a *Agent) requestConnectivityCheck() {
 	}
 }
 
+// remoteCandidateAllowed returns false if the network type of c is not enabled,
+// if its address is private or loopback and AllowPrivateRemoteCandidates is
+// not set, or if c is rejected by the RemoteCandidateFilter
+func (a *Agent) remoteCandidateAllowed(c Candidate) bool {
+	if !containsNetworkType(c.NetworkType(), a.networkTypes) {
+		a.log.Debugf("Dropping remote candidate %s, %s is not enabled in NetworkTypes", c, c.NetworkType())
+		return false
+	}
+	if addr := c.addr(); !a.allowPrivateRemoteCandidates && addr != nil && isPrivateOrLoopbackIP(addr.IP) {
+		a.log.Infof("Dropping remote candidate %s, its address is private, see AllowPrivateRemoteCandidates", c)
+		return false
+	}
+	if a.remoteCandidateFilter == nil || a.remoteCandidateFilter(c) {
+		return true
+	}
+	a.log.Infof("Dropping remote candidate %s, rejected by RemoteCandidateFilter", c)
+	return false
+}
+
 // addRemoteCandidate assumes you are holding the lock (must be execute using a.run)
 func (a *Agent) addRemoteCandidate(c Candidate) {
+	if !a.remoteCandidateAllowed(c) {
+		return
+	}
+
 	set := a.remoteCandidates[c.NetworkType()]
 
 	for _, candidate := range set {
@@ -642,18 +1655,150 @@ func (a *Agent) addRemoteCandidate(c Candidate) {
 		}
 	}
 
+	if a.supersedePeerReflexive(c) {
+		a.requestConnectivityCheck()
+		return
+	}
+
 	set = append(set, c)
 	a.remoteCandidates[c.NetworkType()] = set
 
-	if localCandidates, ok := a.localCandidates[c.NetworkType()]; ok {
+	localCandidates, ok := a.localCandidates[c.NetworkType()]
+	if !ok {
+		a.log.Debugf("no local %s candidate to pair remote candidate %s with yet", c.NetworkType(), c)
+	} else {
 		for _, localCandidate := range localCandidates {
-			a.addPair(localCandidate, c)
+			if localCandidate.Component() == c.Component() && tcpTypesCompatible(localCandidate, c) && linkLocalCompatible(localCandidate, c) {
+				a.addPair(localCandidate, c)
+			}
 		}
 	}
 
 	a.requestConnectivityCheck()
 }
 
+// supersedePeerReflexive replaces the peer-reflexive remote candidate learned
+// from the transport address of c, now that c has been signaled. The pairs of
+// the peer-reflexive candidate are moved to c with their state, so checks and
+// the selection are not started over.
+func (a *Agent) supersedePeerReflexive(c Candidate) bool {
+	if c.Type() == CandidateTypePeerReflexive || c.addr() == nil {
+		return false
+	}
+
+	set := a.remoteCandidates[c.NetworkType()]
+	for i, prflx := range set {
+		if prflx.Type() != CandidateTypePeerReflexive || prflx.Component() != c.Component() ||
+			prflx.Port() != c.Port() || !prflx.addr().IP.Equal(c.addr().IP) {
+			continue
+		}
+
+		a.log.Debugf("remote candidate %s supersedes peer-reflexive candidate %s", c, prflx)
+		set[i] = c
+		if lastReceived := prflx.LastReceived(); lastReceived.After(c.LastReceived()) {
+			c.setLastReceived(lastReceived)
+		}
+
+		// Conn uses the pairs without holding the agent lock, so they are
+		// replaced rather than modified
+		for j, p := range a.checklist {
+			if p.remote != prflx {
+				continue
+			}
+
+			np := p.withRemote(c)
+			a.checklist[j] = np
+
+			component := p.local.Component()
+			if a.pinnedPairs[component] == p {
+				a.pinnedPairs[component] = np
+			}
+			if s := a.getControllingSelector(); s != nil && s.nominatedPairs[component] == p {
+				s.nominatedPairs[component] = np
+			}
+			if s := a.getControlledSelector(); s != nil && s.renominatedPairs[component] == p {
+				s.renominatedPairs[component] = np
+			}
+			if a.hasComponent(component) && a.getComponentSelectedPair(component) == p {
+				a.pairChanges.push(np)
+				a.selectedPairs[component-1].Store(np)
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// failPair fails p and forgets it was pinned or nominated, it returns true if
+// p was the selected pair of its component, which is then unselected.
+// Note: the caller should hold the agent lock.
+func (a *Agent) failPair(p *candidatePair) bool {
+	p.state = CandidatePairStateFailed
+
+	component := p.local.Component()
+	if a.pinnedPairs[component] == p {
+		delete(a.pinnedPairs, component)
+	}
+	if s := a.getControllingSelector(); s != nil && s.nominatedPairs[component] == p {
+		delete(s.nominatedPairs, component)
+	}
+	if s := a.getControlledSelector(); s != nil && s.renominatedPairs[component] == p {
+		delete(s.renominatedPairs, component)
+	}
+	if a.hasComponent(component) && a.getComponentSelectedPair(component) == p {
+		var nilPair *candidatePair
+		a.selectedPairs[component-1].Store(nilPair)
+		return true
+	}
+	return false
+}
+
+// reselectPair replaces the selected pair of component after failPair: the
+// controlled agent falls back to another nominated pair, the controlling agent
+// nominates the best valid one again once the checks run.
+// Note: the caller should hold the agent lock.
+func (a *Agent) reselectPair(component uint16) {
+	a.resumeChecks(component)
+	if s := a.getControlledSelector(); s != nil {
+		s.selectNominatedPair(component)
+	}
+}
+
+// removeLocalCandidate closes c and removes it with its pairs, the components
+// whose selected pair used it select another one.
+// Note: the caller should hold the agent lock.
+func (a *Agent) removeLocalCandidate(c Candidate) {
+	set := a.localCandidates[c.NetworkType()]
+	for i, candidate := range set {
+		if candidate == c {
+			a.localCandidates[c.NetworkType()] = append(set[:i], set[i+1:]...)
+			break
+		}
+	}
+
+	reselect := false
+	checklist := a.checklist[:0]
+	for _, p := range a.checklist {
+		if p.local != c {
+			checklist = append(checklist, p)
+			continue
+		}
+		if a.failPair(p) {
+			reselect = true
+		}
+	}
+	a.checklist = checklist
+
+	if reselect {
+		a.reselectPair(c.Component())
+	}
+
+	if err := c.close(); err != nil {
+		a.log.Warnf("Failed to close candidate %s: %v", c, err)
+	}
+}
+
 func (a *Agent) addCandidate(c Candidate, candidateConn net.PacketConn) error {
 	return a.run(func(agent *Agent) {
 		c.start(a, candidateConn, a.startedCh)
@@ -661,6 +1806,8 @@ func (a *Agent) addCandidate(c Candidate, candidateConn net.PacketConn) error {
 		set := a.localCandidates[c.NetworkType()]
 		for _, candidate := range set {
 			if candidate.Equal(c) {
+				a.log.Debugf("Discarding candidate %s, %s was gathered first", c, candidate)
+				a.duplicateCandidates++
 				if err := c.close(); err != nil {
 					a.log.Warnf("Failed to close duplicate candidate: %v", err)
 				}
@@ -668,12 +1815,18 @@ func (a *Agent) addCandidate(c Candidate, candidateConn net.PacketConn) error {
 			}
 		}
 
+		if a.candidatePriorityFunc != nil {
+			a.setLocalCandidatePriority(c)
+		}
+
 		set = append(set, c)
 		a.localCandidates[c.NetworkType()] = set
 
 		if remoteCandidates, ok := a.remoteCandidates[c.NetworkType()]; ok {
 			for _, remoteCandidate := range remoteCandidates {
-				a.addPair(c, remoteCandidate)
+				if c.Component() == remoteCandidate.Component() && tcpTypesCompatible(c, remoteCandidate) && linkLocalCompatible(c, remoteCandidate) {
+					a.addPair(c, remoteCandidate)
+				}
 			}
 		}
 
@@ -683,6 +1836,34 @@ func (a *Agent) addCandidate(c Candidate, candidateConn net.PacketConn) error {
 	}, nil)
 }
 
+// setLocalCandidatePriority sets the priority of c returned by
+// candidatePriorityFunc, lowered until no other local candidate of the
+// component has it. It must be called with the lock held, before c is added.
+func (a *Agent) setLocalCandidatePriority(c Candidate) {
+	priority := a.candidatePriorityFunc(c)
+	if priority == 0 {
+		return
+	}
+
+	used := map[uint32]bool{}
+	for _, set := range a.localCandidates {
+		for _, candidate := range set {
+			if candidate.Component() == c.Component() {
+				used[candidate.Priority()] = true
+			}
+		}
+	}
+
+	requested := priority
+	for used[priority] && priority > 1 {
+		priority--
+	}
+	if priority != requested {
+		a.log.Warnf("Priority %d of candidate %s is already used, lowered to %d", requested, c, priority)
+	}
+	c.setPriority(priority)
+}
+
 // GetLocalCandidates returns the local candidates
 func (a *Agent) GetLocalCandidates() ([]Candidate, error) {
 	res := make(chan []Candidate, 1)
@@ -701,6 +1882,174 @@ func (a *Agent) GetLocalCandidates() ([]Candidate, error) {
 	return <-res, nil
 }
 
+// GetRemoteCandidates returns the remote candidates, the signaled ones and the
+// peer-reflexive ones learned from connectivity checks
+func (a *Agent) GetRemoteCandidates() ([]Candidate, error) {
+	res := make(chan []Candidate, 1)
+
+	err := a.run(func(agent *Agent) {
+		var candidates []Candidate
+		for _, set := range agent.remoteCandidates {
+			candidates = append(candidates, set...)
+		}
+		res <- candidates
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return <-res, nil
+}
+
+// GetSelectedCandidatePair returns the selected candidate pair of ComponentRTP,
+// or nil if no pair has been selected yet
+func (a *Agent) GetSelectedCandidatePair() (*CandidatePair, error) {
+	return a.getSelectedCandidatePair(ComponentRTP)
+}
+
+func (a *Agent) getSelectedCandidatePair(component uint16) (*CandidatePair, error) {
+	res := make(chan *CandidatePair, 1)
+
+	err := a.run(func(agent *Agent) {
+		var pair *CandidatePair
+		if selectedPair := agent.getComponentSelectedPair(component); selectedPair != nil {
+			pair = &CandidatePair{Local: selectedPair.local, Remote: selectedPair.remote}
+		}
+		res <- pair
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return <-res, nil
+}
+
+// SetRemoteLite tells the Agent whether the remote is an ICE-lite agent, e.g.
+// because its description has the a=ice-lite attribute. A lite remote has only
+// host candidates and doesn't send checks, so a full Agent takes the controlling
+// role whether Dial or Accept is called, and doesn't gather relay candidates.
+// It must be called before GatherCandidates and Dial or Accept.
+func (a *Agent) SetRemoteLite(lite bool) error {
+	return a.run(func(agent *Agent) {
+		agent.remoteLite = lite
+	}, nil)
+}
+
+// Renominate nominates the valid pair of local and remote for their component
+// again, so that the remote selects it instead of the pair nominated before,
+// e.g. to move from a relay to a direct pair once it validated. It requires
+// EnableRenomination on both Agents, and is only available to the controlling one.
+// ErrCandidatePairNotValid is returned if no connectivity check succeeded on the pair.
+func (a *Agent) Renominate(local, remote Candidate) error {
+	errChan := make(chan error, 1)
+	if err := a.run(func(agent *Agent) {
+		s := agent.getControllingSelector()
+		switch {
+		case !agent.enableRenomination:
+			errChan <- ErrRenominationDisabled
+			return
+		case s == nil:
+			errChan <- ErrRenominationNotControlling
+			return
+		}
+
+		p := agent.findPair(local, remote)
+		if p == nil || p.state != CandidatePairStateSucceeded {
+			errChan <- ErrCandidatePairNotValid
+			return
+		}
+
+		s.startNomination(p)
+		errChan <- nil
+	}, nil); err != nil {
+		return err
+	}
+	return <-errChan
+}
+
+// getControllingSelector returns the selector of a controlling Agent, or nil
+// Note: the caller should hold the agent lock.
+func (a *Agent) getControllingSelector() *controllingSelector {
+	selector := a.selector
+	if lite, ok := selector.(*liteSelector); ok {
+		selector = lite.pairCandidateSelector
+	}
+	s, _ := selector.(*controllingSelector)
+	return s
+}
+
+func (a *Agent) getControlledSelector() *controlledSelector {
+	selector := a.selector
+	if lite, ok := selector.(*liteSelector); ok {
+		selector = lite.pairCandidateSelector
+	}
+	s, _ := selector.(*controlledSelector)
+	return s
+}
+
+// SetDSCP sets the DSCP field of the packets sent on the selected candidate
+// pairs, and on the pairs selected later, e.g. 46 (EF) for audio. Only host and
+// server reflexive UDP candidates support it, ErrDSCPNotSupported is returned if
+// a selected pair can't be marked, its packets are still sent unmarked.
+func (a *Agent) SetDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return ErrInvalidDSCP
+	}
+
+	errChan := make(chan error, 1)
+	if err := a.run(func(agent *Agent) {
+		agent.dscp, agent.dscpSet = dscp, true
+
+		var markErr error
+		for component := uint16(1); component <= agent.components; component++ {
+			p := agent.getComponentSelectedPair(component)
+			if p == nil {
+				continue
+			}
+			if err := p.local.setDSCP(dscp); err != nil && markErr == nil {
+				markErr = err
+			}
+		}
+		errChan <- markErr
+	}, nil); err != nil {
+		return err
+	}
+	return <-errChan
+}
+
+// SelectCandidatePair selects the valid pair of local and remote for their
+// component, and stops the Agent from selecting any other pair for it until
+// ReleaseCandidatePairSelection is called. Only the local choice is affected, the
+// remote Agent keeps sending on the pair it selected.
+// ErrCandidatePairNotValid is returned if no connectivity check succeeded on the pair.
+func (a *Agent) SelectCandidatePair(local, remote Candidate) error {
+	errChan := make(chan error, 1)
+	if err := a.run(func(agent *Agent) {
+		p := agent.findPair(local, remote)
+		if p == nil || p.state != CandidatePairStateSucceeded {
+			errChan <- ErrCandidatePairNotValid
+			return
+		}
+
+		agent.pinnedPairs[p.local.Component()] = p
+		agent.setSelectedPair(p)
+		errChan <- nil
+	}, nil); err != nil {
+		return err
+	}
+
+	return <-errChan
+}
+
+// ReleaseCandidatePairSelection undoes SelectCandidatePair, the Agent selects
+// pairs again as connectivity checks and nominations complete. The selected pairs
+// are kept until then.
+func (a *Agent) ReleaseCandidatePairSelection() error {
+	return a.run(func(agent *Agent) {
+		agent.pinnedPairs = map[uint16]*candidatePair{}
+	}, nil)
+}
+
 // GetLocalUserCredentials returns the local user credentials
 func (a *Agent) GetLocalUserCredentials() (frag string, pwd string, err error) {
 	valSet := make(chan struct{})
@@ -732,47 +2081,90 @@ func (a *Agent) GetRemoteUserCredentials() (frag string, pwd string, err error)
 }
 
 // Close cleans up the Agent
+// The connection state always moves to ConnectionStateClosed, even if the Agent was
+// never started, and the handler is fired exactly once for it.
+// Sockets of every candidate are closed and TURN allocations are released,
+// pending gathering is stopped and any blocked Read or Write returns ErrClosed.
+// Closing an Agent that is already closed is a no-op and returns nil, also when
+// it was torn down by the Agent itself (e.g. ErrConsentExpired), see FailureReason.
+// Every step of the teardown is attempted even if one fails, a socket that fails
+// to close or a TURN allocation that fails to be released doesn't keep the others
+// open. The failures are then returned together, errors.Is and errors.As match
+// each of them.
 func (a *Agent) Close() error {
+	return a.close(ErrClosed)
+}
+
+// close cleans up the Agent, reason is returned by any later call except Close
+func (a *Agent) close(reason error) error {
+	if err := a.ok(); err != nil {
+		return nil
+	}
+
+	// Make sure ConnectionStateClosed is delivered if Dial/Accept were never called
+	a.startOnConnectionStateChangeRoutine()
+
 	done := make(chan struct{})
+	var gatheringDone <-chan struct{}
+	var errs []error
 	err := a.run(func(agent *Agent) {
 		defer func() {
 			close(done)
 			close(agent.chanState)
+			agent.pairChanges.close()
+			close(agent.chanCheck)
 		}()
-		agent.err.Store(ErrClosed)
+		agent.err.Store(reason)
 		close(agent.done)
+		gatheringDone = agent.gatheringDone
 
-		a.deleteAllCandidates()
-		a.startedFn()
+		// Close the buffers first, the candidates can't be closed while
+		// BufferOverflowBlock blocks them in a write
+		for _, buffer := range a.buffers {
+			if err := buffer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to close buffer: %w", err))
+			}
+		}
 
-		if err := a.buffer.Close(); err != nil {
-			a.log.Warnf("failed to close buffer: %v", err)
+		errs = append(errs, a.deleteAllCandidates(), a.closePrewarmedRelays(a.prewarmedRelays))
+		a.prewarmedRelays = nil
+		if a.udpMux != nil {
+			a.udpMux.RemoveConnByUfrag(a.localUfrag)
 		}
+		a.startedFn()
 
 		if a.connectivityTicker != nil {
 			a.connectivityTicker.Stop()
 		}
 
-		a.closeMulticastConn()
+		errs = append(errs, a.closeMulticastConn())
 		a.updateConnectionState(ConnectionStateClosed)
 	}, nil)
 	if err != nil {
-		return err
+		// Closed concurrently
+		return nil
 	}
 
 	<-done
-	return nil
+
+	// Candidates gathered from now on are closed by addCandidate, and the
+	// STUN and TURN transactions in flight are aborted as closing cancels gathering
+	if gatheringDone != nil {
+		<-gatheringDone
+	}
+	return joinErrors(errs...)
 }
 
 // Remove all candidates. This closes any listening sockets
 // and removes both the local and remote candidate lists.
 //
 // This is used for restarts, failures and on close
-func (a *Agent) deleteAllCandidates() {
+func (a *Agent) deleteAllCandidates() error {
+	var errs []error
 	for net, cs := range a.localCandidates {
 		for _, c := range cs {
 			if err := c.close(); err != nil {
-				a.log.Warnf("Failed to close candidate %s: %v", c, err)
+				errs = append(errs, fmt.Errorf("failed to close candidate %s: %w", c, err))
 			}
 		}
 		delete(a.localCandidates, net)
@@ -780,11 +2172,12 @@ func (a *Agent) deleteAllCandidates() {
 	for net, cs := range a.remoteCandidates {
 		for _, c := range cs {
 			if err := c.close(); err != nil {
-				a.log.Warnf("Failed to close candidate %s: %v", c, err)
+				errs = append(errs, fmt.Errorf("failed to close candidate %s: %w", c, err))
 			}
 		}
 		delete(a.remoteCandidates, net)
 	}
+	return joinErrors(errs...)
 }
 
 func (a *Agent) findRemoteCandidate(networkType NetworkType, addr net.Addr) Candidate {
@@ -796,7 +2189,9 @@ func (a *Agent) findRemoteCandidate(networkType NetworkType, addr net.Addr) Cand
 
 	set := a.remoteCandidates[networkType]
 	for _, c := range set {
-		if c.Address() == ip.String() && c.Port() == port {
+		// The IP is compared rather than the address, which has a zone for
+		// IPv6 link-local candidates
+		if addr := c.addr(); addr != nil && addr.IP.Equal(ip) && c.Port() == port {
 			return c
 		}
 	}
@@ -806,34 +2201,75 @@ func (a *Agent) findRemoteCandidate(networkType NetworkType, addr net.Addr) Cand
 func (a *Agent) sendBindingRequest(m *stun.Message, local, remote Candidate) {
 	a.log.Tracef("ping STUN from %s to %s\n", local.String(), remote.String())
 
-	a.invalidatePendingBindingRequests(time.Now())
-	a.pendingBindingRequests = append(a.pendingBindingRequests, bindingRequest{
-		timestamp:      time.Now(),
+	request := bindingRequest{
+		timestamp:      a.clock.Now(),
 		transactionID:  m.TransactionID,
-		destination:    remote.addr(),
+		destination:    createAddr(remote.NetworkType(), remote.addr().IP, remote.addr().Port),
 		isUseCandidate: m.Contains(stun.AttrUseCandidate),
-	})
+		isControlling:  m.Contains(stun.AttrICEControlling),
+	}
+
+	if p := a.findPair(local, remote); p != nil {
+		p.requestSent(request.timestamp)
+		// Responses to a check are accepted until it is retransmitted
+		request.timeout = p.rto
+	}
+
+	a.invalidatePendingBindingRequests(a.clock.Now())
+	a.pendingBindingRequests = append(a.pendingBindingRequests, request)
 
 	a.sendSTUN(m, local, remote)
 }
 
 func (a *Agent) sendBindingSuccess(m *stun.Message, local, remote Candidate) {
 	base := remote
-	if out, err := stun.Build(m, stun.BindingSuccess,
+	setters := []stun.Setter{m, stun.BindingSuccess,
 		&stun.XORMappedAddress{
 			IP:   base.addr().IP,
 			Port: base.addr().Port,
 		},
-		stun.NewShortTermIntegrity(a.localPwd),
-		stun.Fingerprint,
-	); err != nil {
+		a.softwareName,
+	}
+	if a.strictICE {
+		setters = append(setters, a.roleAttr())
+	}
+	setters = append(setters, responseIntegrity(m, a.localPwd), stun.Fingerprint)
+
+	if out, err := stun.Build(setters...); err != nil {
 		a.log.Warnf("Failed to handle inbound ICE from: %s to: %s error: %s", local, remote, err)
 	} else {
 		a.sendSTUN(out, local, remote)
+		if p := a.findPair(local, remote); p != nil {
+			p.responsesSent++
+		}
+	}
+}
+
+// sendBindingError rejects a Binding request, used when the request can't be
+// authenticated with the current credentials (e.g. during an ICE restart)
+func (a *Agent) sendBindingError(m *stun.Message, local Candidate, remote net.Addr, errorCode stun.ErrorCode) {
+	setters := []stun.Setter{m, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), errorCode, a.softwareName}
+	if a.strictICE {
+		setters = append(setters, a.roleAttr())
+	}
+	// A 401 is sent when the credentials are wrong, so it can not be signed
+	if errorCode != stun.CodeUnauthorized {
+		setters = append(setters, responseIntegrity(m, a.localPwd))
+	}
+	setters = append(setters, stun.Fingerprint)
+
+	if out, err := stun.Build(setters...); err != nil {
+		a.log.Warnf("Failed to build error response from: %s to: %s error: %s", local, remote, err)
+	} else {
+		a.paceSTUN(out, local, remote, func() {
+			if _, err := local.writeToAddr(out.Raw, remote); err != nil {
+				a.log.Debugf("failed to send STUN error response from %s to %s: %s", local, remote, err)
+			}
+		})
 	}
 }
 
-/* Removes pending binding requests that are over maxBindingRequestTimeout old
+/* Removes pending binding requests that are over their timeout, or maxBindingRequestTimeout, old
 
    Let HTO be the transaction timeout, which SHOULD be 2*RTT if
    RTT is known or 500 ms otherwise.
@@ -844,7 +2280,12 @@ func (a *Agent) invalidatePendingBindingRequests(filterTime time.Time) {
 
 	temp := a.pendingBindingRequests[:0]
 	for _, bindingRequest := range a.pendingBindingRequests {
-		if filterTime.Sub(bindingRequest.timestamp) < maxBindingRequestTimeout {
+		timeout := bindingRequest.timeout
+		if timeout < maxBindingRequestTimeout {
+			timeout = maxBindingRequestTimeout
+		}
+
+		if filterTime.Sub(bindingRequest.timestamp) < timeout {
 			temp = append(temp, bindingRequest)
 		}
 	}
@@ -855,10 +2296,21 @@ func (a *Agent) invalidatePendingBindingRequests(filterTime time.Time) {
 	}
 }
 
+// pendingBindingRequest returns the pending request with the TransactionID id,
+// without removing it like handleInboundBindingSuccess
+func (a *Agent) pendingBindingRequest(id [stun.TransactionIDSize]byte) *bindingRequest {
+	for i := range a.pendingBindingRequests {
+		if a.pendingBindingRequests[i].transactionID == id {
+			return &a.pendingBindingRequests[i]
+		}
+	}
+	return nil
+}
+
 // Assert that the passed TransactionID is in our pendingBindingRequests and returns the destination
 // If the bindingRequest was valid remove it from our pending cache
 func (a *Agent) handleInboundBindingSuccess(id [stun.TransactionIDSize]byte) (bool, *bindingRequest) {
-	a.invalidatePendingBindingRequests(time.Now())
+	a.invalidatePendingBindingRequests(a.clock.Now())
 	for i := range a.pendingBindingRequests {
 		if a.pendingBindingRequests[i].transactionID == id {
 			validBindingRequest := a.pendingBindingRequests[i]
@@ -876,31 +2328,44 @@ func (a *Agent) handleInbound(m *stun.Message, local Candidate, remote net.Addr)
 		return
 	}
 
+	// FINGERPRINT is optional, a message with a wrong one is discarded
+	// https://tools.ietf.org/html/rfc8445#section-7.3
+	if m.Contains(stun.AttrFingerprint) {
+		if err = stun.Fingerprint.Check(m); err != nil {
+			a.log.Warnf("discard message from (%s), %v", remote, err)
+			return
+		}
+	}
+
 	if m.Type.Method != stun.MethodBinding ||
 		!(m.Type.Class == stun.ClassSuccessResponse ||
 			m.Type.Class == stun.ClassRequest ||
+			m.Type.Class == stun.ClassErrorResponse ||
 			m.Type.Class == stun.ClassIndication) {
 		a.log.Tracef("unhandled STUN from %s to %s class(%s) method(%s)", remote, local, m.Type.Class, m.Type.Method)
 		return
 	}
 
-	if a.isControlling {
-		if m.Contains(stun.AttrICEControlling) {
-			a.log.Debug("inbound isControlling && a.isControlling == true")
+	// Role conflicts in requests are resolved below with the tie-breaker
+	if m.Type.Class != stun.ClassRequest {
+		var control AttrControl
+		if controlErr := control.GetFrom(m); controlErr == nil && (control.Role == Controlling) == a.isControlling {
+			if a.strictICE {
+				a.log.Warnf("discard response from (%s) claiming our role %s, tie-breakers local %d remote %d", remote, control.Role, a.tieBreaker, control.Tiebreaker)
+			} else {
+				a.log.Debugf("discard response from (%s) claiming our role %s", remote, control.Role)
+			}
 			return
-		} else if m.Contains(stun.AttrUseCandidate) {
-			a.log.Debug("useCandidate && a.isControlling == true")
-			return
-		}
-	} else {
-		if m.Contains(stun.AttrICEControlled) {
-			a.log.Debug("inbound isControlled && a.isControlling == false")
+		} else if a.strictICE && controlErr != nil && controlErr != stun.ErrAttributeNotFound {
+			a.log.Warnf("discard response from (%s), invalid role attribute: %v", remote, controlErr)
 			return
 		}
 	}
 
 	remoteCandidate := a.findRemoteCandidate(local.NetworkType(), remote)
-	if m.Type.Class == stun.ClassSuccessResponse {
+	if m.Type.Class == stun.ClassErrorResponse {
+		a.handleInboundBindingError(m, local, remoteCandidate, remote)
+	} else if m.Type.Class == stun.ClassSuccessResponse {
 		if err = assertInboundMessageIntegrity(m, []byte(a.remotePwd)); err != nil {
 			a.log.Warnf("discard message from (%s), %v", remote, err)
 			return
@@ -915,9 +2380,37 @@ func (a *Agent) handleInbound(m *stun.Message, local Candidate, remote net.Addr)
 	} else if m.Type.Class == stun.ClassRequest {
 		if err = assertInboundUsername(m, a.localUfrag+":"+a.remoteUfrag); err != nil {
 			a.log.Warnf("discard message from (%s), %v", remote, err)
+			a.sendBindingError(m, local, remote, stun.CodeUnauthorized)
 			return
 		} else if err = assertInboundMessageIntegrity(m, []byte(a.localPwd)); err != nil {
 			a.log.Warnf("discard message from (%s), %v", remote, err)
+			a.sendBindingError(m, local, remote, stun.CodeUnauthorized)
+			return
+		}
+		if m.Contains(attrMessageIntegritySHA256) {
+			a.messageIntegritySHA256 = true
+		}
+
+		if a.strictICE {
+			if err = assertStrictRequest(m); err != nil {
+				a.log.Warnf("reject Binding request from (%s), %v", remote, err)
+				a.sendBindingError(m, local, remote, stun.CodeBadRequest)
+				return
+			}
+		}
+
+		if a.onValidateRequest != nil {
+			if err = a.onValidateRequest(m); err != nil {
+				a.log.Warnf("reject Binding request from (%s), %v", remote, err)
+				a.sendBindingError(m, local, remote, stun.CodeForbidden)
+				return
+			}
+		}
+
+		if !a.resolveRoleConflict(m, local, remote) {
+			return
+		} else if a.isControlling && m.Contains(stun.AttrUseCandidate) {
+			a.log.Debug("useCandidate && a.isControlling == true")
 			return
 		}
 
@@ -928,13 +2421,22 @@ func (a *Agent) handleInbound(m *stun.Message, local Candidate, remote net.Addr)
 				return
 			}
 
+			// The priority of the candidate is the one the peer computed for
+			// the check, it is known from the PRIORITY attribute
+			var priority PriorityAttr
+			if err = priority.GetFrom(m); err != nil {
+				a.log.Debugf("no PRIORITY in Binding request from %s: %v", remote, err)
+			}
+
 			prflxCandidateConfig := CandidatePeerReflexiveConfig{
 				Network:   networkType.String(),
 				Address:   ip.String(),
 				Port:      port,
 				Component: local.Component(),
+				Priority:  uint32(priority),
 				RelAddr:   "",
 				RelPort:   0,
+				TCPType:   local.TCPType().peerTCPType(),
 			}
 
 			prflxCandidate, err := NewCandidatePeerReflexive(&prflxCandidateConfig)
@@ -942,6 +2444,9 @@ func (a *Agent) handleInbound(m *stun.Message, local Candidate, remote net.Addr)
 				a.log.Errorf("Failed to create new remote prflx candidate (%s)", err)
 				return
 			}
+			if !a.remoteCandidateAllowed(prflxCandidate) {
+				return
+			}
 			remoteCandidate = prflxCandidate
 
 			a.log.Debugf("adding a new peer-reflexive candidate: %s ", remote)
@@ -951,32 +2456,100 @@ func (a *Agent) handleInbound(m *stun.Message, local Candidate, remote net.Addr)
 		a.log.Tracef("inbound STUN (Request) from %s to %s", remote.String(), local.String())
 
 		a.selector.HandleBindingRequest(m, local, remoteCandidate)
+		if p := a.findPair(local, remoteCandidate); p != nil {
+			p.requestsReceived++
+		}
 	}
 
 	if remoteCandidate != nil {
 		remoteCandidate.seen(false)
+		a.reconnectOnTraffic(remoteCandidate)
+	}
+}
+
+// handleInboundBindingError processes an error response to one of our Binding requests,
+// on a 487 (Role Conflict) we switch role and check the pair again.
+// https://tools.ietf.org/html/rfc8445#section-7.2.5.1
+func (a *Agent) handleInboundBindingError(m *stun.Message, local, remote Candidate, remoteAddr net.Addr) {
+	var errorCode stun.ErrorCodeAttribute
+	if err := errorCode.GetFrom(m); err != nil {
+		a.log.Warnf("discard error response from (%s), %v", remoteAddr, err)
+		return
+	} else if errorCode.Code != stun.CodeRoleConflict {
+		a.log.Debugf("error response from (%s): %s", remoteAddr, errorCode)
+		if request := a.pendingBindingRequest(m.TransactionID); request != nil && remote != nil {
+			a.checkDone(local, remote, CheckResultFailure, a.clock.Now().Sub(request.timestamp))
+		}
+		return
+	}
+
+	if err := assertInboundMessageIntegrity(m, []byte(a.remotePwd)); err != nil {
+		a.log.Warnf("discard message from (%s), %v", remoteAddr, err)
+		return
+	} else if remote == nil {
+		a.log.Warnf("discard error response from (%s), no such remote", remoteAddr)
+		return
 	}
+
+	ok, pendingRequest := a.handleInboundBindingSuccess(m.TransactionID)
+	if !ok {
+		a.log.Warnf("discard error response from (%s), unknown TransactionID 0x%x", remoteAddr, m.TransactionID)
+		return
+	}
+	a.checkDone(local, remote, CheckResultFailure, a.clock.Now().Sub(pendingRequest.timestamp))
+
+	// The remote keeps the role the request was sent with, we may already
+	// have switched after a request from the remote
+	if a.controlsLiteRemote() {
+		a.log.Warnf("ignoring role conflict from (%s), the remote is ICE-lite", remoteAddr)
+	} else if a.isControlling == pendingRequest.isControlling {
+		a.switchRole(!pendingRequest.isControlling)
+	}
+	if p := a.findPair(local, remote); p != nil && p.state != CandidatePairStateCancelled {
+		p.state = CandidatePairStateWaiting
+		p.bindingRequestCount = 0
+		p.rto = 0
+		p.nextBindingRequest = time.Time{}
+	}
+	a.requestConnectivityCheck()
 }
 
 // validateNonSTUNTraffic processes non STUN traffic from a remote candidate,
-// and returns true if it is an actual remote candidate
-func (a *Agent) validateNonSTUNTraffic(local Candidate, remote net.Addr) bool {
-	var isValidCandidate uint64
+// and returns true if it is an actual remote candidate. It also returns the
+// local and the remote candidate of the pair the traffic arrived on, the local
+// one is the candidate the socket belongs to when there is no such pair.
+func (a *Agent) validateNonSTUNTraffic(local Candidate, remote net.Addr, n int) (Candidate, Candidate, bool) {
+	var pairLocal, pairRemote Candidate
 	if err := a.run(func(agent *Agent) {
 		remoteCandidate := a.findRemoteCandidate(local.NetworkType(), remote)
 		if remoteCandidate != nil {
 			remoteCandidate.seen(false)
-			atomic.AddUint64(&isValidCandidate, 1)
+			pairLocal, pairRemote = local, remoteCandidate
+			if p := a.findPair(local, remoteCandidate); p != nil {
+				p.packetReceived(n)
+				a.dataReceived(p)
+				pairLocal = p.local
+			}
+			a.reconnectOnTraffic(remoteCandidate)
 		}
 	}, nil); err != nil {
 		a.log.Warnf("failed to validate remote candidate: %v", err)
 	}
 
-	return atomic.LoadUint64(&isValidCandidate) == 1
+	return pairLocal, pairRemote, pairRemote != nil
 }
 
+// getSelectedPair returns the selected pair of ComponentRTP
 func (a *Agent) getSelectedPair() *candidatePair {
-	selectedPair := a.selectedPair.Load()
+	return a.getComponentSelectedPair(ComponentRTP)
+}
+
+func (a *Agent) getComponentSelectedPair(component uint16) *candidatePair {
+	if !a.hasComponent(component) {
+		return nil
+	}
+
+	selectedPair := a.selectedPairs[component-1].Load()
 
 	if selectedPair == nil {
 		return nil
@@ -985,15 +2558,54 @@ func (a *Agent) getSelectedPair() *candidatePair {
 	return selectedPair.(*candidatePair)
 }
 
-func (a *Agent) closeMulticastConn() {
+// getSelectedPairs returns the selected pair of every component, or nil
+// until a pair has been selected for each of them
+func (a *Agent) getSelectedPairs() []*candidatePair {
+	selectedPairs := make([]*candidatePair, 0, a.components)
+	for component := uint16(1); component <= a.components; component++ {
+		selectedPair := a.getComponentSelectedPair(component)
+		if selectedPair == nil {
+			return nil
+		}
+		selectedPairs = append(selectedPairs, selectedPair)
+	}
+	return selectedPairs
+}
+
+func (a *Agent) hasComponent(component uint16) bool {
+	return component >= 1 && component <= a.components
+}
+
+// getBuffer returns the buffer of the data received on component
+func (a *Agent) getBuffer(component uint16) *packetBuffer {
+	return a.buffers[component-1]
+}
+
+// oldestLastReceived returns when the pair that has been silent the longest last received
+func oldestLastReceived(pairs []*candidatePair) time.Time {
+	oldest := pairs[0].remote.LastReceived()
+	for _, p := range pairs[1:] {
+		if lastReceived := p.remote.LastReceived(); lastReceived.Before(oldest) {
+			oldest = lastReceived
+		}
+	}
+	return oldest
+}
+
+func (a *Agent) closeMulticastConn() error {
 	if a.mDNSConn != nil {
 		if err := a.mDNSConn.Close(); err != nil {
-			a.log.Warnf("failed to close mDNS Conn: %v", err)
+			return fmt.Errorf("failed to close mDNS Conn: %w", err)
 		}
 	}
+	return nil
 }
 
 // SetRemoteCredentials sets the credentials of the remote agent
+//
+// This can be called at any time to follow an ICE restart initiated by the remote.
+// Once set, inbound Binding requests are only accepted if they carry the new
+// credentials, requests using the previous ones are rejected with 401 Unauthorized.
 func (a *Agent) SetRemoteCredentials(remoteUfrag, remotePwd string) error {
 	switch {
 	case remoteUfrag == "":
@@ -1013,46 +2625,63 @@ func (a *Agent) SetRemoteCredentials(remoteUfrag, remotePwd string) error {
 //
 // Restart must only be called when GatheringState is GatheringStateComplete
 // a user must then call GatherCandidates explicitly to start generating new ones
+//
+// Any Conn returned by Dial or Accept stays usable across a Restart, and data
+// that was already received but not yet read is not discarded.
 func (a *Agent) Restart(ufrag, pwd string) error {
 	if ufrag == "" {
 		var err error
-		ufrag, err = generateUFrag()
+		ufrag, err = generateUFrag(a.rand)
 		if err != nil {
 			return err
 		}
 	}
 	if pwd == "" {
 		var err error
-		pwd, err = generatePwd()
+		pwd, err = generatePwd(a.rand)
 		if err != nil {
 			return err
 		}
 	}
 
-	if len([]rune(ufrag))*8 < 24 {
+	if len([]rune(ufrag)) < minLenUFrag {
 		return ErrLocalUfragInsufficientBits
 	}
-	if len([]rune(pwd))*8 < 128 {
+	if len([]rune(pwd)) < minLenPwd {
 		return ErrLocalPwdInsufficientBits
 	}
 
 	err := make(chan error, 1)
+	var gatheringStateChanged bool
 	if runErr := a.run(func(agent *Agent) {
 		if agent.gatheringState == GatheringStateGathering {
 			err <- ErrRestartWhenGathering
 			return
 		}
+		gatheringStateChanged = agent.gatheringState != GatheringStateNew
 
 		// Clear all agent needed to take back to fresh state
 		agent.localUfrag = ufrag
 		agent.localPwd = pwd
 		agent.remoteUfrag = ""
 		agent.remotePwd = ""
+		agent.remoteCandidatesDone = false
 		a.gatheringState = GatheringStateNew
+		a.hostLocalAddrs = nil
+		atomic.StoreInt32(&a.interfaceTier, 0)
+		a.interfaceTierSince = time.Time{}
 		a.checklist = make([]*candidatePair, 0)
 		a.pendingBindingRequests = make([]bindingRequest, 0)
+		a.pacedSTUN = nil
 		a.setSelectedPair(nil)
-		a.deleteAllCandidates()
+		for i := range a.receivingPairs {
+			a.receivingPairs[i] = receivingPair{}
+		}
+		a.pinnedPairs = map[uint16]*candidatePair{}
+		a.checksCancelled = map[uint16]bool{}
+		if err := a.deleteAllCandidates(); err != nil {
+			a.log.Warnf("Failed to close candidates: %v", err)
+		}
 		if a.selector != nil {
 			a.selector.Start()
 		}
@@ -1067,5 +2696,12 @@ func (a *Agent) Restart(ufrag, pwd string) error {
 	}, nil); runErr != nil {
 		return runErr
 	}
-	return <-err
+	if restartErr := <-err; restartErr != nil {
+		return restartErr
+	}
+
+	if gatheringStateChanged {
+		a.onGatheringStateChange(GatheringStateNew)
+	}
+	return nil
 }
@@ -1,10 +1,14 @@
 package ice
 
 import (
+	"crypto/tls"
+	"io"
+	"net"
 	"time"
 
 	"github.com/pion/logging"
-	"github.com/pion/transport/vnet"
+	"github.com/pion/stun"
+	"golang.org/x/net/proxy"
 )
 
 const (
@@ -35,33 +39,107 @@ const (
 	// wait time before nominating a relay candidate
 	defaultRelayAcceptanceMinWait = 2000 * time.Millisecond
 
-	// max binding request before considering a pair failed
+	// defaultSTUNGatherTimeout is how long a STUN server is waited for when gathering
+	defaultSTUNGatherTimeout = 5 * time.Second
+
+	// defaultConsentCheckInterval is the base interval between consent freshness checks
+	defaultConsentCheckInterval = 5 * time.Second
+
+	// defaultConsentTimeout is the default time after which consent expires when no
+	// consent freshness check succeeded
+	defaultConsentTimeout = 30 * time.Second
+
+	// max binding request before considering a pair failed, this is Rc
+	// https://tools.ietf.org/html/rfc5389#section-7.2.1
 	defaultMaxBindingRequests = 7
 
-	// the number of bytes that can be buffered before we start to error
-	maxBufferSize = 1000 * 1000 // 1MB
+	// defaultInitialRTO is the retransmission timeout of the first binding request on a pair
+	defaultInitialRTO = 500 * time.Millisecond
+
+	// defaultRTOMultiplier is how much the RTO grows after every binding request
+	defaultRTOMultiplier = 2
+
+	// defaultCheckInterval is the Ta of RFC 8445, the time between two new checks
+	defaultCheckInterval = 50 * time.Millisecond
+
+	// maxComponents is the largest component ID, the low 8 bits of a candidate
+	// priority are 256 - component ID
+	// https://tools.ietf.org/html/rfc8445#section-5.1.2.1
+	maxComponents = 256
+
+	// defaultMaxBufferSize is the default number of bytes that can be
+	// buffered for a component before the BufferOverflowPolicy applies
+	defaultMaxBufferSize = 1000 * 1000 // 1MB
+
+	// defaultMaxPacketSize is the largest packet written to a Conn by default,
+	// the payload of a UDP datagram that fits the IPv6 minimum MTU of 1280 bytes
+	// with room for tunnel headers, like WebRTC implementations do
+	defaultMaxPacketSize = 1200
 
 	// wait time before binding requests can be deleted
 	maxBindingRequestTimeout = 500 * time.Millisecond
+
+	// the time TryExistingPair waits for the response to its check
+	existingPairCheckTimeout = time.Second
 )
 
 var (
 	defaultCandidateTypes = []CandidateType{CandidateTypeHost, CandidateTypeServerReflexive, CandidateTypeRelay}
+	defaultNetworkTypes   = []NetworkType{NetworkTypeUDP4, NetworkTypeUDP6}
 )
 
 // AgentConfig collects the arguments to ice.Agent construction into
 // a single structure, for future-proofness of the interface
 type AgentConfig struct {
+	// Urls are the STUN and TURN servers used to gather candidates. Every server
+	// is queried concurrently for a server reflexive candidate, and one candidate
+	// is gathered per distinct reflexive address. A server that can't be reached
+	// only loses its own candidates.
 	Urls []*URL
 
+	// STUNGatherTimeout is how long each server in Urls is waited for when
+	// gathering server reflexive candidates. When this is nil, it defaults to 5 seconds.
+	STUNGatherTimeout *time.Duration
+
 	// PortMin and PortMax are optional. Leave them 0 for the default UDP port allocation strategy.
+	// When set, the host sockets and the UDP sockets used to reach STUN and
+	// TURN servers are bound to a port in the range. A candidate is not gathered
+	// when every port of the range is in use, and an error wrapping ErrPort that
+	// names the range is logged.
 	PortMin uint16
 	PortMax uint16
 
+	// ReceiveBufferSize and SendBufferSize are the sizes in bytes of the kernel
+	// buffers of the sockets the Agent gathers candidates on, including the
+	// sockets connected to TURN servers. Leave them 0 to keep the OS defaults.
+	// The kernel may clamp the sizes, e.g. to net.core.rmem_max on Linux.
+	ReceiveBufferSize int
+	SendBufferSize    int
+
+	// MaxBufferSize is the number of bytes received on a component that can
+	// be buffered until they are read from its Conn. It defaults to 1MB when
+	// this property is 0.
+	MaxBufferSize int
+
+	// BufferOverflowPolicy is applied to the packets received while the buffer
+	// of their component is full, Conn.PacketsDropped counts the dropped ones.
+	// It defaults to BufferOverflowDropNewest when this property is 0.
+	BufferOverflowPolicy BufferOverflowPolicy
+
+	// MaxPacketSize is the largest datagram a Conn sends, Write returns
+	// ErrPacketTooLarge for the larger packets instead of letting them be
+	// fragmented or dropped. On relay pairs the TURN framing is sent in the same
+	// datagram, so Conn.MTU is lower. It defaults to 1200 bytes when this
+	// property is 0, and can be at most 8192 bytes.
+	MaxPacketSize int
+
 	// LocalUfrag and LocalPwd values used to perform connectivity
 	// checks.  The values MUST be unguessable, with at least 128 bits of
 	// random number generator output used to generate the password, and
 	// at least 24 bits of output to generate the username fragment.
+	// The username fragment is at least 4 characters long, and the password
+	// at least 22. Random ones are generated when they are empty,
+	// GetLocalUserCredentials returns them to be signaled to the remote.
 	LocalUfrag string
 	LocalPwd   string
 
@@ -71,28 +149,80 @@ type AgentConfig struct {
 	// MulticastDNSHostName controls the hostname for this agent. If none is specified a random one will be generated
 	MulticastDNSHostName string
 
+	// SoftwareName is the SOFTWARE attribute of the Binding requests and
+	// responses of the connectivity checks, of the Binding requests sent to
+	// STUN servers and of the requests sent to TURN servers. It must be fewer
+	// than 128 characters, the attribute is omitted when it is empty.
+	// https://tools.ietf.org/html/rfc8489#section-14.14
+	SoftwareName string
+
 	// DisconnectedTimeout defaults to 5 seconds when this property is nil.
-	// If the duration is 0, the ICE Agent will never go to disconnected
+	// If the duration is 0, the ICE Agent will never go to disconnected.
+	// The Agent goes to disconnected when nothing was received on the selected
+	// pair for this long, and back to connected on the next packet received.
 	DisconnectedTimeout *time.Duration
 
 	// FailedTimeout defaults to 25 seconds when this property is nil.
 	// If the duration is 0, we will never go to failed.
+	// This is the time spent in disconnected before going to failed.
 	FailedTimeout *time.Duration
 
+	// ConnectionTimeout is how long connectivity checks run without selecting
+	// a candidate pair before the Agent goes to failed, Dial and Accept then
+	// return ErrConnectionTimeout. It defaults to DisconnectedTimeout+FailedTimeout
+	// when this property is nil. If the duration is 0, checks run until the
+	// context of Dial or Accept is done. The Agent fails earlier when every pair
+	// failed after RemoteCandidatesDone.
+	ConnectionTimeout *time.Duration
+
 	// KeepaliveInterval determines how often should we send ICE
 	// keepalives (should be less then connectiontimeout above)
-	// when this is nil, it defaults to 10 seconds.
-	// A keepalive interval of 0 means we never send keepalive packets
+	// when this is nil, it defaults to 2 seconds.
+	// A keepalive interval of 0 means we never send keepalive packets.
+	// Keepalives are STUN Binding indications sent on the selected pair when
+	// nothing else was sent on it for KeepaliveInterval, they are not answered.
+	// Consent freshness checks are sent regardless, see ConsentCheckInterval.
 	KeepaliveInterval *time.Duration
 
+	// ConsentCheckInterval is how often consent freshness checks (RFC 7675) are sent
+	// on the selected pair, each interval is randomized between 0.8 and 1.2 times
+	// this value. When this is nil, it defaults to 5 seconds.
+	ConsentCheckInterval *time.Duration
+
+	// ConsentTimeout defaults to 30 seconds when this property is nil.
+	// If no consent freshness check succeeded for this long, the Agent goes to failed
+	// and is closed, unblocking any Read or Write with ErrConsentExpired.
+	// If the duration is 0, consent never expires.
+	ConsentTimeout *time.Duration
+
+	// IPv4LocalPreference and IPv6LocalPreference are the local preferences used
+	// in the priority of the UDP candidates gathered on each IP family, both default
+	// to 65535. Lowering IPv4LocalPreference biases selection towards IPv6 on
+	// dual-stack hosts. TCP candidates use the local preference of RFC 6544.
+	IPv4LocalPreference *uint16
+	IPv6LocalPreference *uint16
+
+	// Components is the number of components of the stream, e.g. 2 when RTP and
+	// RTCP are not multiplexed on a single component. Candidates are gathered and
+	// checked for every component, and the Agent is connected once a pair has been
+	// selected for each of them. When this is 0, it defaults to 1.
+	Components uint16
+
 	// NetworkTypes is an optional configuration for disabling or enabling
-	// support for specific network types.
+	// support for specific network types. Candidates are only gathered for the
+	// enabled types, and the remote candidates of the others are ignored. When
+	// this is empty, it defaults to NetworkTypeUDP4 and NetworkTypeUDP6.
 	NetworkTypes []NetworkType
 
 	// CandidateTypes is an optional configuration for disabling or enabling
 	// support for specific candidate types.
 	CandidateTypes []CandidateType
 
+	// LoggerFactory creates the "ice" logger every diagnostic of the Agent goes
+	// through: gathering and STUN transaction failures, discarded messages and
+	// candidates, role switches and state transitions. When this is nil, it
+	// defaults to logging.NewDefaultLoggerFactory, which only prints errors
+	// unless the PION_LOG_* environment variables enable more levels.
 	LoggerFactory logging.LoggerFactory
 
 	// taskLoopInterval controls how often our internal task loop runs, this
@@ -102,9 +232,46 @@ type AgentConfig struct {
 
 	// MaxBindingRequests is the max amount of binding requests the agent will send
 	// over a candidate pair for validation or nomination, if after MaxBindingRequests
-	// the candidate is yet to answer a binding request or a nomination we set the pair as failed
+	// the candidate is yet to answer a binding request or a nomination we set the pair as failed.
+	// This is the Rc of RFC 5389 and defaults to 7.
 	MaxBindingRequests *uint16
 
+	// InitialRTO is how long the agent waits for a response to the first binding request
+	// on a candidate pair before retransmitting it. When this is nil, it defaults to 500ms.
+	InitialRTO *time.Duration
+
+	// RTOMultiplier is applied to the RTO after every retransmission, the pair is marked
+	// as failed once the last of MaxBindingRequests requests timed out.
+	// When this is 0, it defaults to 2 which doubles the RTO as described in RFC 5389.
+	RTOMultiplier float64
+
+	// CheckInterval is the Ta of RFC 8445, the time between the first checks of
+	// two different candidate pairs. Pairs sharing a foundation are frozen until
+	// a check on one of them succeeded or failed, so checks that would likely
+	// fail together are not all sent at once. When this is nil, it defaults to
+	// 50ms. If the duration is 0, every pair that is not frozen is checked at once.
+	// https://tools.ietf.org/html/rfc8445#section-6.1.4.2
+	CheckInterval *time.Duration
+
+	// MaxConcurrentChecks bounds the number of pairs being checked at once, to
+	// smooth the burst of checks of an Agent with many candidates, e.g. on a
+	// mobile device. The other pairs wait in priority order, the first one is
+	// checked as soon as a check succeeds or fails. The triggered checks
+	// answering the checks of the remote are not bounded. If it is 0, every
+	// pair may be checked at once, one every CheckInterval.
+	MaxConcurrentChecks int
+
+	// MaxCheckBandwidth paces the STUN messages the Agent sends on its
+	// candidate pairs, the connectivity checks, their responses, keepalives and
+	// consent checks, to this number of bytes per second, in bursts of up to
+	// one second of it. Gathering and the data sent by Conn are not paced, see
+	// Conn.SetMaxBandwidth. If it is 0, the STUN messages are not paced.
+	MaxCheckBandwidth int
+
+	// CheckBandwidthPolicy is applied to the STUN messages over
+	// MaxCheckBandwidth. It defaults to RateLimitDrop when this property is 0.
+	CheckBandwidthPolicy RateLimitPolicy
+
 	// CandidatesSelectionTimeout specify a timeout for selecting candidates, if no nomination has happen
 	// before this timeout, once hit we will nominate the best valid candidate available,
 	// or mark the connection as failed if no valid candidate is available
@@ -113,18 +280,102 @@ type AgentConfig struct {
 	// Lite agents do not perform connectivity check and only provide host candidates.
 	Lite bool
 
+	// AggressiveNomination makes a controlling Agent include USE-CANDIDATE in every
+	// connectivity check instead of nominating a single pair once checks are done.
+	// The first pair that validates is selected, and selection moves to any higher
+	// priority pair that validates later. The acceptance min waits are ignored.
+	// https://tools.ietf.org/html/rfc5245#section-8.1.1.2
+	AggressiveNomination bool
+
+	// PreferLowLatency breaks the ties between candidate pairs of the same
+	// priority, e.g. of the IPv4 and IPv6 candidates of dual-stack hosts, with
+	// the RTT of their connectivity checks. The controlling Agent nominates the
+	// pair with the lowest RTT, and the controlled Agent selects it among the
+	// nominated pairs. Without it the first pair of the checklist is used.
+	PreferLowLatency bool
+
+	// NominationHysteresis is how long a valid pair must have been better than
+	// the selected pair before the Agent switches to it, for the pairs that a
+	// controlling Agent using AggressiveNomination or a controlled Agent select
+	// on their own, so that selection doesn't flap between pairs whose priority
+	// or RTT are close. The pair is dropped as soon as it is no longer better.
+	// Renomination, SelectCandidatePair and the replacement of a failed pair
+	// switch at once. If it is 0, the Agent switches to a better pair at once.
+	NominationHysteresis time.Duration
+
+	// EnableRenomination lets a controlling Agent nominate another pair after one
+	// is selected with Agent.Renominate, and makes a controlled Agent select the
+	// pair nominated with the highest NOMINATION value. Both Agents must enable it,
+	// e.g. after exchanging the "renomination" ice-options.
+	// https://tools.ietf.org/html/draft-thatcher-ice-renomination-01
+	EnableRenomination bool
+
+	// MessageIntegritySHA256 adds the MESSAGE-INTEGRITY-SHA256 attribute to the
+	// connectivity checks, after MESSAGE-INTEGRITY. It is comprehension-required,
+	// so peers predating RFC 8489 may reject the checks. When unset, the checks
+	// carry it once the remote used it. Responses always carry the integrity
+	// attributes of the request they answer.
+	// https://tools.ietf.org/html/rfc8489#section-14.6
+	MessageIntegritySHA256 bool
+
+	// StrictICE is for interop testing against peers that may not follow RFC
+	// 8445. The Binding requests lacking PRIORITY or a role attribute, or
+	// carrying USE-CANDIDATE from the controlled agent, are rejected with a
+	// 400 (Bad Request) instead of being answered. The responses carry
+	// ICE-CONTROLLING or ICE-CONTROLLED with our tie-breaker, and the responses
+	// of the remote claiming our role are logged with both tie-breakers.
+	// https://tools.ietf.org/html/rfc8445#section-7.1.1
+	StrictICE bool
+
+	// Rand is the source of the local credentials, the tie-breaker, the mDNS
+	// host name, the transaction IDs of the connectivity checks and the jitter
+	// of the consent checks. When this is nil, it defaults to crypto/rand. A
+	// seeded reader makes agents reproducible in tests, e.g. two agents with
+	// the same seed have the same credentials and tie-breaker. Ports and
+	// candidate IDs aren't read from it.
+	Rand io.Reader
+
+	// Clock is the time source of the connectivity checks, consent freshness,
+	// keepalives and connection state timeouts. When this is nil, it defaults
+	// to the wall clock. A Clock advanced by a test fires the timeouts at once,
+	// e.g. to assert that consent expires after exactly ConsentTimeout.
+	Clock Clock
+
+	// OnBuildRequest is called with every Binding request of the connectivity
+	// checks before it is signed, e.g. to add an application specific attribute.
+	// The attributes it adds are covered by MESSAGE-INTEGRITY and FINGERPRINT.
+	OnBuildRequest func(*stun.Message)
+
+	// OnValidateRequest is called with every authenticated Binding request of
+	// the remote. When it returns an error the request is answered with a 403
+	// (Forbidden), so the check of the remote fails, and it doesn't trigger a
+	// check or add a peer-reflexive candidate.
+	OnValidateRequest func(*stun.Message) error
+
+	// RelayOnly gathers only relay candidates, like the "relay" ICE transport
+	// policy of WebRTC, so that all the traffic goes through TURN and the peer
+	// never learns the local or reflexive IPs. The related address of the relay
+	// candidates is 0.0.0.0:0, and they are gathered for an ICE-lite remote too.
+	// When gathering completes without a relay candidate the Agent fails with
+	// FailureReasonGatheringFailed, and Dial and Accept return
+	// ErrRelayGatheringFailed. CandidateTypes must be empty or only contain
+	// CandidateTypeRelay.
+	RelayOnly bool
+
 	// NAT1To1IPCandidateType is used along with NAT1To1IPs to specify which candidate type
 	// the 1:1 NAT IP addresses should be mapped to.
 	// If unspecified or CandidateTypeHost, NAT1To1IPs are used to replace host candidate IPs.
-	// If CandidateTypeServerReflexive, it will insert a srflx candidate (as if it was dervied
+	// If CandidateTypeServerReflexive, it will insert a srflx candidate (as if it was derived
 	// from a STUN server) with its port number being the one for the actual host candidate.
+	// No STUN server is contacted for these srflx candidates.
 	// Other values will result in an error.
 	NAT1To1IPCandidateType CandidateType
 
 	// NAT1To1IPs contains a list of public IP addresses that are to be used as a host
 	// candidate or srflx candidate. This is used typically for servers that are behind
-	// 1:1 D-NAT (e.g. AWS EC2 instances) and to eliminate the need of server reflexisive
-	// candidate gathering.
+	// 1:1 D-NAT (e.g. AWS EC2 instances) and to eliminate the need of server reflexive
+	// candidate gathering. An entry is either a sole external IP used for every local IP
+	// of its family, or an "external/local" pair mapping a single local IP.
 	NAT1To1IPs []string
 
 	// HostAcceptanceMinWait specify a minimum wait time before selecting host candidates
@@ -136,17 +387,135 @@ type AgentConfig struct {
 	// HostAcceptanceMinWait specify a minimum wait time before selecting relay candidates
 	RelayAcceptanceMinWait *time.Duration
 
-	// Net is the our abstracted network interface for internal development purpose only
-	// (see github.com/pion/transport/vnet)
-	Net *vnet.Net
+	// Net is the network stack used for every socket the Agent creates, it defaults
+	// to the OS network. This can be a *vnet.Net (see github.com/pion/transport/vnet)
+	// or any other implementation of Net, like a userspace network stack.
+	Net Net
+
+	// UDPMux is used for host UDP candidates instead of binding a port per Agent,
+	// a single host UDP candidate is gathered on the address of the UDPMux.
+	// When that address is unspecified the first matching local interface IP is used.
+	// Only ComponentRTP is gathered on the UDPMux, other components bind their own port.
+	UDPMux UDPMux
+
+	// UDPConns are sockets owned by the application, e.g. to share a port with
+	// other traffic. A host UDP candidate of ComponentRTP is gathered for each of
+	// them on its local address, in addition to the host candidates the Agent binds.
+	// The Agent reads the sockets while it uses them, and demultiplexes STUN from
+	// the data read by the Conn. They stay open when their candidates are closed,
+	// e.g. by Restart, unless CloseUDPConns is set.
+	UDPConns      []*net.UDPConn
+	CloseUDPConns bool
 
 	// InterfaceFilter is a function that you can use in order to  whitelist or blacklist
 	// the interfaces which are used to gather ICE candidates.
 	InterfaceFilter func(string) bool
 
+	// IPFilter is a function that you can use in order to whitelist or blacklist
+	// the IPs which are used to gather host candidates, it is called for every IP
+	// of the interfaces accepted by InterfaceFilter.
+	IPFilter func(net.IP) bool
+
+	// InterfacePriority stages the gathering of host candidates by interface
+	// name, e.g. []string{"wlan0"} to check the Wi-Fi candidates before waking
+	// up the cellular radio. The host candidates of the first interface are
+	// gathered first, and if no pair succeeds within InterfacePriorityTimeout
+	// of checks, the ones of the next interface are, and so on. The interfaces
+	// it doesn't list are gathered last. Server reflexive and relay candidates
+	// are not staged. If it is empty, every interface is gathered at once.
+	InterfacePriority []string
+
+	// InterfacePriorityTimeout is how long the checks of an InterfacePriority
+	// tier are waited for before the next tier is gathered, defaults to 2 seconds
+	InterfacePriorityTimeout *time.Duration
+
+	// AllowPrivateRemoteCandidates accepts the remote candidates whose address
+	// is in the private ranges of RFC 1918 or loopback. By default they are
+	// dropped like the ones rejected by RemoteCandidateFilter, so a peer can't
+	// direct the connectivity checks at the internal network of the Agent.
+	// It must be set to connect to peers on a LAN or the same host.
+	AllowPrivateRemoteCandidates bool
+
+	// RemoteCandidateFilter is called with every remote candidate, the ones
+	// added with AddRemoteCandidate once their mDNS name is resolved, and the
+	// peer-reflexive ones learned from connectivity checks. The candidates it
+	// rejects are dropped, they are not paired and their checks are not
+	// answered. PublicRemoteCandidateFilter rejects the candidates in private,
+	// link-local and loopback ranges. When nil, all the candidates allowed by
+	// AllowPrivateRemoteCandidates are accepted.
+	RemoteCandidateFilter func(Candidate) bool
+
+	// CandidatePriorityFunc computes the priority of the local candidates
+	// instead of the formula of RFC 8445 section 5.1.2.1 when set, e.g. to
+	// only use the candidates of an interface as a last resort. Returning 0
+	// keeps the default priority. The priorities must be unique within a
+	// component, so the pair priorities are strictly ordered: a priority
+	// already used by another local candidate of the component is lowered
+	// until it is unique.
+	CandidatePriorityFunc func(Candidate) uint32
+
+	// PacketTrace is called with every packet read from or written to the
+	// sockets of the local candidates, STUN and data alike, e.g. to write a
+	// capture file. local is the address of the socket, which is shared with
+	// other Agents for UDPMux candidates. It is called from the goroutines
+	// reading and writing, so it must return quickly. data is only valid during
+	// the call, it must be copied to be kept.
+	PacketTrace func(dir Direction, data []byte, local, remote net.Addr)
+
+	// BatchWrites makes Conn.WriteBatch send its packets with a single sendmmsg
+	// system call on Linux, instead of a sendto call per packet, when the local
+	// candidate of the selected pair has its own UDP socket. The packets are
+	// written one by one on the other candidates: the ones sharing a UDPMux,
+	// TCP and relay candidates.
+	BatchWrites bool
+
 	// InsecureSkipVerify controls if self-signed certificates are accepted when connecting
 	// to TURN servers via TLS or DTLS
 	InsecureSkipVerify bool
+
+	// TLSConfig is used for the connections to turns: servers, to verify their
+	// certificate with custom RootCAs or to present a client certificate. When
+	// its ServerName is empty, the host of the URL is used. Over DTLS, only its
+	// RootCAs, ServerName and Certificates are used.
+	TLSConfig *tls.Config
+
+	// ProxyDialer dials the TCP connections to the TURN servers of Urls, e.g.
+	// a SOCKS5 dialer from golang.org/x/net/proxy to reach them from behind a
+	// corporate proxy. Only TURN over TCP and TLS is proxied: the turn: and
+	// turns: URLs with transport=udp, and STUN servers, are still reached
+	// directly. Setting CandidateTypes to CandidateTypeRelay alone skips the
+	// host and server reflexive candidates, which can't be reached through
+	// the proxy either. The proxy resolves the host of the URLs.
+	ProxyDialer proxy.Dialer
+
+	// OnTURNCredentialRefresh is called with the URL of a TURN server before the
+	// allocation of a relay candidate on it is refreshed, and returns the
+	// credentials to refresh it with. This keeps the allocations alive when the
+	// credentials are time-limited, like the ones of the TURN REST API. When it
+	// returns an error, the relay candidate is closed and removed, the other
+	// candidates are not affected.
+	OnTURNCredentialRefresh func(url string) (username, password string, err error)
+
+	// turnRefreshInterval is how often the relay candidates are refreshed when
+	// OnTURNCredentialRefresh is set. This is only configurable for testing.
+	turnRefreshInterval time.Duration
+
+	// NetworkChangeDetection polls the local interfaces once gathering is
+	// complete, e.g. to follow a Wi-Fi to Ethernet handoff. Host candidates are
+	// gathered on the IPs that appear and delivered to the OnCandidate handler,
+	// followed by nil, as gathering goes through GatheringStateGathering again.
+	// The host candidates of the IPs that go away are removed and their pairs
+	// failed. Server reflexive and relay candidates are not regathered.
+	NetworkChangeDetection bool
+
+	// networkChangeInterval is how often the local interfaces are polled when
+	// NetworkChangeDetection is set. This is only configurable for testing.
+	networkChangeInterval time.Duration
+
+	// asymmetricRoutingTimeout is how long the data has to be received on
+	// another pair than the selected one before a warning is logged. This is
+	// only configurable for testing.
+	asymmetricRoutingTimeout time.Duration
 }
 
 // initWithDefaults populates an agent and falls back to defaults if fields are unset
@@ -157,12 +526,54 @@ func (config *AgentConfig) initWithDefaults(a *Agent) {
 		a.maxBindingRequests = *config.MaxBindingRequests
 	}
 
+	if config.InitialRTO == nil {
+		a.initialRTO = defaultInitialRTO
+	} else {
+		a.initialRTO = *config.InitialRTO
+	}
+
+	if config.RTOMultiplier == 0 {
+		a.rtoMultiplier = defaultRTOMultiplier
+	} else {
+		a.rtoMultiplier = config.RTOMultiplier
+	}
+
+	if config.CheckInterval == nil {
+		a.checkInterval = defaultCheckInterval
+	} else {
+		a.checkInterval = *config.CheckInterval
+	}
+
+	a.maxConcurrentChecks = config.MaxConcurrentChecks
+
+	if config.Clock == nil {
+		a.clock = realClock{}
+	} else {
+		a.clock = config.Clock
+	}
+
+	if config.MaxCheckBandwidth > 0 {
+		a.checkLimiter = newTokenBucket(config.MaxCheckBandwidth)
+	}
+
+	if config.CheckBandwidthPolicy == 0 {
+		a.checkBandwidthPolicy = RateLimitDrop
+	} else {
+		a.checkBandwidthPolicy = config.CheckBandwidthPolicy
+	}
+
 	if config.CandidateSelectionTimeout == nil {
 		a.candidateSelectionTimeout = defaultCandidateSelectionTimeout
 	} else {
 		a.candidateSelectionTimeout = *config.CandidateSelectionTimeout
 	}
 
+	if config.STUNGatherTimeout == nil {
+		a.stunGatherTimeout = defaultSTUNGatherTimeout
+	} else {
+		a.stunGatherTimeout = *config.STUNGatherTimeout
+	}
+
 	if config.HostAcceptanceMinWait == nil {
 		a.hostAcceptanceMinWait = defaultHostAcceptanceMinWait
 	} else {
@@ -199,19 +610,90 @@ func (config *AgentConfig) initWithDefaults(a *Agent) {
 		a.failedTimeout = *config.FailedTimeout
 	}
 
+	if config.ConnectionTimeout == nil {
+		a.connectionTimeout = a.disconnectedTimeout + a.failedTimeout
+	} else {
+		a.connectionTimeout = *config.ConnectionTimeout
+	}
+
 	if config.KeepaliveInterval == nil {
 		a.keepaliveInterval = defaultKeepaliveInterval
 	} else {
 		a.keepaliveInterval = *config.KeepaliveInterval
 	}
 
+	if config.ConsentCheckInterval == nil {
+		a.consentCheckInterval = defaultConsentCheckInterval
+	} else {
+		a.consentCheckInterval = *config.ConsentCheckInterval
+	}
+
+	if config.ConsentTimeout == nil {
+		a.consentTimeout = defaultConsentTimeout
+	} else {
+		a.consentTimeout = *config.ConsentTimeout
+	}
+
+	if config.IPv4LocalPreference == nil {
+		a.ipv4LocalPreference = defaultLocalPreference
+	} else {
+		a.ipv4LocalPreference = *config.IPv4LocalPreference
+	}
+
+	if config.IPv6LocalPreference == nil {
+		a.ipv6LocalPreference = defaultLocalPreference
+	} else {
+		a.ipv6LocalPreference = *config.IPv6LocalPreference
+	}
+
+	if config.Components == 0 {
+		a.components = 1
+	} else {
+		a.components = config.Components
+	}
+
 	if config.taskLoopInterval == 0 {
 		a.taskLoopInterval = defaultTaskLoopInterval
 	} else {
 		a.taskLoopInterval = config.taskLoopInterval
 	}
 
-	if config.CandidateTypes == nil || len(config.CandidateTypes) == 0 {
+	if config.turnRefreshInterval == 0 {
+		a.turnRefreshInterval = defaultTURNRefreshInterval
+	} else {
+		a.turnRefreshInterval = config.turnRefreshInterval
+	}
+
+	a.interfacePriority = config.InterfacePriority
+	if config.InterfacePriorityTimeout == nil {
+		a.interfacePriorityTimeout = defaultInterfacePriorityTimeout
+	} else {
+		a.interfacePriorityTimeout = *config.InterfacePriorityTimeout
+	}
+
+	a.networkChangeDetection = config.NetworkChangeDetection
+	if config.networkChangeInterval == 0 {
+		a.networkChangeInterval = defaultNetworkChangeInterval
+	} else {
+		a.networkChangeInterval = config.networkChangeInterval
+	}
+
+	if config.asymmetricRoutingTimeout == 0 {
+		a.asymmetricRoutingTimeout = defaultAsymmetricRoutingTimeout
+	} else {
+		a.asymmetricRoutingTimeout = config.asymmetricRoutingTimeout
+	}
+
+	if len(config.NetworkTypes) == 0 {
+		a.networkTypes = defaultNetworkTypes
+	} else {
+		a.networkTypes = config.NetworkTypes
+	}
+
+	a.relayOnly = config.RelayOnly
+	if config.RelayOnly {
+		a.candidateTypes = []CandidateType{CandidateTypeRelay}
+	} else if config.CandidateTypes == nil || len(config.CandidateTypes) == 0 {
 		a.candidateTypes = defaultCandidateTypes
 	} else {
 		a.candidateTypes = config.CandidateTypes
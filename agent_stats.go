@@ -1,6 +1,36 @@
 package ice
 
-import "time"
+import (
+	"sync/atomic"
+)
+
+// pairCounters are the data traffic counters of a candidate pair
+type pairCounters struct {
+	pair *candidatePair
+	ConnCounters
+}
+
+// getPairCounters returns the data traffic counters of every pair of component
+func (a *Agent) getPairCounters(component uint16) ([]pairCounters, error) {
+	resultChan := make(chan []pairCounters, 1)
+	if err := a.run(func(agent *Agent) {
+		result := []pairCounters{}
+		for _, cp := range agent.checklist {
+			if cp.local.Component() != component {
+				continue
+			}
+			result = append(result, pairCounters{cp, ConnCounters{
+				BytesSent:     atomic.LoadUint64(&cp.bytesSent),
+				BytesReceived: atomic.LoadUint64(&cp.bytesReceived),
+			}})
+		}
+		resultChan <- result
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	return <-resultChan, nil
+}
 
 // GetCandidatePairsStats returns a list of candidate pair stats
 func (a *Agent) GetCandidatePairsStats() []CandidatePairStats {
@@ -9,33 +39,34 @@ func (a *Agent) GetCandidatePairsStats() []CandidatePairStats {
 		result := make([]CandidatePairStats, 0, len(agent.checklist))
 		for _, cp := range agent.checklist {
 			stat := CandidatePairStats{
-				Timestamp:         time.Now(),
-				LocalCandidateID:  cp.local.ID(),
-				RemoteCandidateID: cp.remote.ID(),
-				State:             cp.state,
-				Nominated:         cp.nominated,
-				// PacketsSent uint32
-				// PacketsReceived uint32
-				// BytesSent uint64
-				// BytesReceived uint64
-				// LastPacketSentTimestamp time.Time
-				// LastPacketReceivedTimestamp time.Time
-				// FirstRequestTimestamp time.Time
-				// LastRequestTimestamp time.Time
-				// LastResponseTimestamp time.Time
-				// TotalRoundTripTime float64
-				// CurrentRoundTripTime float64
+				Timestamp:                   a.clock.Now(),
+				LocalCandidateID:            cp.local.ID(),
+				RemoteCandidateID:           cp.remote.ID(),
+				State:                       cp.state,
+				Nominated:                   cp.nominated,
+				PacketsSent:                 atomic.LoadUint32(&cp.packetsSent),
+				PacketsReceived:             atomic.LoadUint32(&cp.packetsReceived),
+				BytesSent:                   atomic.LoadUint64(&cp.bytesSent),
+				BytesReceived:               atomic.LoadUint64(&cp.bytesReceived),
+				LastPacketSentTimestamp:     loadTime(&cp.lastPacketSent),
+				LastPacketReceivedTimestamp: loadTime(&cp.lastPacketReceived),
+				FirstRequestTimestamp:       cp.firstRequestTime,
+				LastRequestTimestamp:        cp.lastRequestTime,
+				LastResponseTimestamp:       cp.lastResponseTime,
+				TotalRoundTripTime:          cp.totalRoundTripTime.Seconds(),
+				CurrentRoundTripTime:        cp.currentRoundTripTime.Seconds(),
 				// AvailableOutgoingBitrate float64
 				// AvailableIncomingBitrate float64
 				// CircuitBreakerTriggerCount uint32
-				// RequestsReceived uint64
-				// RequestsSent uint64
-				// ResponsesReceived uint64
-				// ResponsesSent uint64
+				RequestsReceived:  cp.requestsReceived,
+				RequestsSent:      cp.requestsSent,
+				ResponsesReceived: cp.responsesReceived,
+				ResponsesSent:     cp.responsesSent,
 				// RetransmissionsReceived uint64
 				// RetransmissionsSent uint64
-				// ConsentRequestsSent uint64
+				ConsentRequestsSent: cp.consentRequestsSent,
 				// ConsentExpiredTimestamp time.Time
+				ChannelBound: cp.channelBound(),
 			}
 			result = append(result, stat)
 		}
@@ -56,7 +87,7 @@ func (a *Agent) GetLocalCandidatesStats() []CandidateStats {
 		for networkType, localCandidates := range agent.localCandidates {
 			for _, c := range localCandidates {
 				stat := CandidateStats{
-					Timestamp:     time.Now(),
+					Timestamp:     a.clock.Now(),
 					ID:            c.ID(),
 					NetworkType:   networkType,
 					IP:            c.Address(),
@@ -87,7 +118,7 @@ func (a *Agent) GetRemoteCandidatesStats() []CandidateStats {
 		for networkType, localCandidates := range agent.remoteCandidates {
 			for _, c := range localCandidates {
 				stat := CandidateStats{
-					Timestamp:     time.Now(),
+					Timestamp:     a.clock.Now(),
 					ID:            c.ID(),
 					NetworkType:   networkType,
 					IP:            c.Address(),
@@ -4,8 +4,13 @@ package ice
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -29,6 +34,17 @@ func (m *mockPacketConn) SetDeadline(t time.Time) error                       {
 func (m *mockPacketConn) SetReadDeadline(t time.Time) error                   { return nil }
 func (m *mockPacketConn) SetWriteDeadline(t time.Time) error                  { return nil }
 
+// recordingPacketConn is a mockPacketConn that hands every written packet to sent
+type recordingPacketConn struct {
+	mockPacketConn
+	sent chan []byte
+}
+
+func (r *recordingPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	r.sent <- append([]byte{}, p...)
+	return len(p), nil
+}
+
 func TestPairSearch(t *testing.T) {
 	report := test.CheckRoutines(t)
 	defer report()
@@ -48,7 +64,7 @@ func TestPairSearch(t *testing.T) {
 		t.Fatalf("TestPairSearch is only a valid test if a.validPairs is empty on construction")
 	}
 
-	cp := a.getBestAvailableCandidatePair()
+	cp := a.getBestAvailableCandidatePair(ComponentRTP)
 
 	if cp != nil {
 		t.Fatalf("No Candidate pairs should exist")
@@ -138,7 +154,7 @@ func TestPairPriority(t *testing.T) {
 		}
 
 		p.state = CandidatePairStateSucceeded
-		bestPair := a.getBestValidCandidatePair()
+		bestPair := a.getBestValidCandidatePair(ComponentRTP)
 		if bestPair.String() != (&candidatePair{remote: remote, local: hostLocal}).String() {
 			t.Fatalf("Unexpected bestPair %s (expected remote: %s)", bestPair, remote)
 		}
@@ -162,6 +178,9 @@ func TestOnSelectedCandidatePairChange(t *testing.T) {
 
 	callbackCalled := make(chan struct{}, 1)
 	if err = a.OnSelectedCandidatePairChange(func(local, remote Candidate) {
+		// The handler is free to call back into the Agent
+		_, candidatesErr := a.GetLocalCandidates()
+		assert.NoError(t, candidatesErr)
 		close(callbackCalled)
 	}); err != nil {
 		t.Fatalf("Failed to set agent OnCandidatePairChange callback: %s", err)
@@ -201,6 +220,53 @@ func TestOnSelectedCandidatePairChange(t *testing.T) {
 
 	// ensure that the callback fired on setting the pair
 	<-callbackCalled
+
+	// selecting the same pair again must not fire the callback
+	if err = a.run(func(agent *Agent) {
+		agent.setSelectedPair(newCandidatePair(hostLocal, relayRemote, false))
+	}, nil); err != nil {
+		t.Fatalf("Failed to setValidPair(): %s", err)
+	}
+
+	assert.NoError(t, a.Close())
+}
+
+func TestOnSelectedCandidatePairChangeBackToBack(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	defer test.TimeOut(5 * time.Second).Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	assert.NoError(t, err)
+	a.startOnConnectionStateChangeRoutine()
+
+	changes := make(chan Candidate, 3)
+	assert.NoError(t, a.OnSelectedCandidatePairChange(func(local, remote Candidate) {
+		_, candidatesErr := a.GetLocalCandidates()
+		assert.NoError(t, candidatesErr)
+		changes <- remote
+	}))
+
+	local, err := NewCandidateHost(&CandidateHostConfig{Network: "udp", Address: "192.168.1.1", Port: 19216, Component: 1})
+	assert.NoError(t, err)
+	var remotes []Candidate
+	for i := 0; i < 3; i++ {
+		remote, err := NewCandidateHost(&CandidateHostConfig{Network: "udp", Address: "10.0.0.1", Port: 5000 + i, Component: 1})
+		assert.NoError(t, err)
+		remotes = append(remotes, remote)
+	}
+
+	// The pairs are selected before the handler can take the lock
+	assert.NoError(t, a.run(func(agent *Agent) {
+		for _, remote := range remotes {
+			agent.setSelectedPair(newCandidatePair(local, remote, false))
+		}
+	}, nil))
+
+	for _, remote := range remotes {
+		assert.Equal(t, remote, <-changes)
+	}
 	assert.NoError(t, a.Close())
 }
 
@@ -227,6 +293,372 @@ func runAgentTest(t *testing.T, config *AgentConfig, task func(a *Agent)) {
 	assert.NoError(t, a.Close())
 }
 
+func TestAggressiveNomination(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	t.Run("Connects", func(t *testing.T) {
+		aConn, bConn := pipe(&AgentConfig{AggressiveNomination: true})
+		assert.NotNil(t, aConn.agent.getSelectedPair())
+		assert.NotNil(t, bConn.agent.getSelectedPair())
+		assert.NoError(t, aConn.Close())
+		assert.NoError(t, bConn.Close())
+	})
+
+	t.Run("Selection moves to a higher priority pair", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AggressiveNomination: true}, func(a *Agent) {
+			a.startOnConnectionStateChangeRoutine()
+			a.isControlling = true
+			a.selector = &controllingSelector{agent: a, log: a.log}
+			a.selector.Start()
+
+			local, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   "192.168.0.2",
+				Port:      777,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+			local.conn = &mockPacketConn{}
+
+			relayRemote, err := NewCandidateRelay(&CandidateRelayConfig{
+				Network:   "udp",
+				Address:   "1.2.3.4",
+				Port:      12340,
+				Component: 1,
+				RelAddr:   "4.3.2.1",
+				RelPort:   43210,
+			})
+			assert.NoError(t, err)
+
+			hostRemote, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   "192.168.0.3",
+				Port:      888,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+
+			relayPair := a.addPair(local, relayRemote)
+			hostPair := a.addPair(local, hostRemote)
+
+			// Every check carries USE-CANDIDATE, so each success response nominates
+			succeed := func(remote Candidate) {
+				a.selector.PingCandidate(local, remote)
+				request := a.pendingBindingRequests[len(a.pendingBindingRequests)-1]
+				assert.True(t, request.isUseCandidate)
+
+				a.selector.HandleSuccessResponse(&stun.Message{TransactionID: request.transactionID}, local, remote, remote.addr())
+			}
+
+			succeed(relayRemote)
+			assert.Equal(t, relayPair, a.getSelectedPair())
+
+			succeed(hostRemote)
+			assert.Equal(t, hostPair, a.getSelectedPair())
+
+			// Lower priority pairs never replace the selected pair
+			succeed(relayRemote)
+			assert.Equal(t, hostPair, a.getSelectedPair())
+		})
+	})
+}
+
+func TestSelectCandidatePair(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	assert.NoError(t, err)
+	a.startOnConnectionStateChangeRoutine()
+
+	local, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.2",
+		Port:      777,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+	local.conn = &mockPacketConn{}
+
+	relayRemote, err := NewCandidateRelay(&CandidateRelayConfig{
+		Network:   "udp",
+		Address:   "1.2.3.4",
+		Port:      12340,
+		Component: 1,
+		RelAddr:   "4.3.2.1",
+		RelPort:   43210,
+	})
+	assert.NoError(t, err)
+
+	hostRemote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.3",
+		Port:      888,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+
+	waitingRemote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.4",
+		Port:      999,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+
+	var relayPair, hostPair *candidatePair
+	assert.NoError(t, a.run(func(a *Agent) {
+		relayPair = a.addPair(local, relayRemote)
+		relayPair.state = CandidatePairStateSucceeded
+		hostPair = a.addPair(local, hostRemote)
+		hostPair.state = CandidatePairStateSucceeded
+		a.addPair(local, waitingRemote)
+	}, nil))
+
+	// Only valid pairs can be selected
+	assert.Equal(t, ErrCandidatePairNotValid, a.SelectCandidatePair(local, waitingRemote))
+	assert.Equal(t, ErrCandidatePairNotValid, a.SelectCandidatePair(hostRemote, local))
+
+	assert.NoError(t, a.SelectCandidatePair(local, relayRemote))
+	assert.Equal(t, relayPair, a.getSelectedPair())
+
+	// Automatic selection is disabled until the selection is released
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.setSelectedPair(hostPair)
+	}, nil))
+	assert.Equal(t, relayPair, a.getSelectedPair())
+
+	assert.NoError(t, a.ReleaseCandidatePairSelection())
+	assert.Equal(t, relayPair, a.getSelectedPair())
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.setSelectedPair(hostPair)
+	}, nil))
+	assert.Equal(t, hostPair, a.getSelectedPair())
+
+	assert.NoError(t, a.Close())
+	assert.Equal(t, ErrClosed, a.SelectCandidatePair(local, hostRemote))
+}
+
+func TestRoleConflict(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	remote := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+	newLocal := func(t *testing.T) (*CandidateHost, chan []byte) {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		sent := make(chan []byte, 10)
+		local.conn = &recordingPacketConn{sent: sent}
+		return local, sent
+	}
+
+	buildRequest := func(t *testing.T, a *Agent, control stun.Setter) *stun.Message {
+		msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+			stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+			control,
+			PriorityAttr(1),
+			stun.NewShortTermIntegrity(a.localPwd),
+			stun.Fingerprint,
+		)
+		assert.NoError(t, err)
+		return msg
+	}
+
+	startAs := func(a *Agent, isControlling bool) {
+		a.startOnConnectionStateChangeRoutine()
+		a.isControlling = isControlling
+		a.tieBreaker = 10
+		a.startSelector()
+	}
+
+	t.Run("Controlling agent with the larger tie-breaker sends 487", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			startAs(a, true)
+			local, sent := newLocal(t)
+
+			a.handleInbound(buildRequest(t, a, AttrControlling(5)), local, remote)
+			assert.True(t, a.isControlling)
+			assert.Equal(t, 0, len(a.remoteCandidates))
+
+			resp := &stun.Message{Raw: <-sent}
+			assert.NoError(t, resp.Decode())
+			assert.Equal(t, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), resp.Type)
+			assert.NoError(t, assertInboundMessageIntegrity(resp, []byte(a.localPwd)))
+
+			var errorCode stun.ErrorCodeAttribute
+			assert.NoError(t, errorCode.GetFrom(resp))
+			assert.Equal(t, stun.CodeRoleConflict, errorCode.Code)
+		})
+	})
+
+	t.Run("Controlling agent with the smaller tie-breaker becomes controlled", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			startAs(a, true)
+			local, sent := newLocal(t)
+
+			a.handleInbound(buildRequest(t, a, AttrControlling(20)), local, remote)
+			assert.False(t, a.isControlling)
+			assert.Equal(t, 1, len(a.remoteCandidates[local.NetworkType()]))
+
+			resp := &stun.Message{Raw: <-sent}
+			assert.NoError(t, resp.Decode())
+			assert.Equal(t, stun.BindingSuccess, resp.Type)
+
+			for _, p := range a.checklist {
+				assert.False(t, p.iceRoleControlling)
+			}
+		})
+	})
+
+	t.Run("Controlled agent with the larger tie-breaker becomes controlling", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			startAs(a, false)
+			local, _ := newLocal(t)
+
+			a.handleInbound(buildRequest(t, a, AttrControlled(5)), local, remote)
+			assert.True(t, a.isControlling)
+			assert.Equal(t, 1, len(a.remoteCandidates[local.NetworkType()]))
+		})
+	})
+
+	t.Run("Controlled agent with the smaller tie-breaker sends 487", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			startAs(a, false)
+			local, sent := newLocal(t)
+
+			a.handleInbound(buildRequest(t, a, AttrControlled(20)), local, remote)
+			assert.False(t, a.isControlling)
+			assert.Equal(t, 0, len(a.remoteCandidates))
+
+			resp := &stun.Message{Raw: <-sent}
+			assert.NoError(t, resp.Decode())
+
+			var errorCode stun.ErrorCodeAttribute
+			assert.NoError(t, errorCode.GetFrom(resp))
+			assert.Equal(t, stun.CodeRoleConflict, errorCode.Code)
+		})
+	})
+
+	t.Run("487 response switches role", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			startAs(a, true)
+			local, sent := newLocal(t)
+
+			remoteCandidate, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   remote.IP.String(),
+				Port:      remote.Port,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+			a.addRemoteCandidate(remoteCandidate)
+
+			p := a.addPair(local, remoteCandidate)
+			p.state = CandidatePairStateFailed
+
+			a.selector.PingCandidate(local, remoteCandidate)
+			request := &stun.Message{Raw: <-sent}
+			assert.NoError(t, request.Decode())
+
+			resp, err := stun.Build(request, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+				stun.CodeRoleConflict,
+				stun.NewShortTermIntegrity(a.remotePwd),
+				stun.Fingerprint,
+			)
+			assert.NoError(t, err)
+
+			a.handleInbound(resp, local, remote)
+			assert.False(t, a.isControlling)
+			assert.Equal(t, CandidatePairStateWaiting, p.state)
+			assert.False(t, p.iceRoleControlling)
+
+			// A late 487 for a request sent before the switch keeps the role
+			p.state = CandidatePairStateFailed
+			a.switchRole(true)
+			a.selector.PingCandidate(local, remoteCandidate)
+			request = &stun.Message{Raw: <-sent}
+			assert.NoError(t, request.Decode())
+			a.switchRole(false)
+
+			resp, err = stun.Build(request, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+				stun.CodeRoleConflict,
+				stun.NewShortTermIntegrity(a.remotePwd),
+				stun.Fingerprint,
+			)
+			assert.NoError(t, err)
+
+			a.handleInbound(resp, local, remote)
+			assert.False(t, a.isControlling)
+			assert.Equal(t, CandidatePairStateWaiting, p.state)
+		})
+	})
+
+	t.Run("Both agents controlling connect", func(t *testing.T) {
+		aNotifier, aConnected := onConnected()
+		bNotifier, bConnected := onConnected()
+
+		cfg := &AgentConfig{
+			NetworkTypes:     supportedNetworkTypes,
+			MulticastDNSMode: MulticastDNSModeDisabled,
+
+			AllowPrivateRemoteCandidates: true,
+		}
+
+		aAgent, err := NewAgent(cfg)
+		assert.NoError(t, err)
+		assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+
+		bAgent, err := NewAgent(cfg)
+		assert.NoError(t, err)
+		assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+		gatherAndExchangeCandidates(aAgent, bAgent)
+
+		aUfrag, aPwd, err := aAgent.GetLocalUserCredentials()
+		assert.NoError(t, err)
+		bUfrag, bPwd, err := bAgent.GetLocalUserCredentials()
+		assert.NoError(t, err)
+
+		dialed := make(chan *Conn)
+		go func() {
+			conn, dialErr := aAgent.Dial(context.TODO(), bUfrag, bPwd)
+			assert.NoError(t, dialErr)
+			dialed <- conn
+		}()
+
+		bConn, err := bAgent.Dial(context.TODO(), aUfrag, aPwd)
+		assert.NoError(t, err)
+		aConn := <-dialed
+
+		<-aConnected
+		<-bConnected
+
+		var aControlling, bControlling bool
+		assert.NoError(t, aAgent.run(func(a *Agent) { aControlling = a.isControlling }, nil))
+		assert.NoError(t, bAgent.run(func(a *Agent) { bControlling = a.isControlling }, nil))
+		assert.NotEqual(t, aControlling, bControlling)
+
+		assert.NoError(t, aConn.Close())
+		assert.NoError(t, bConn.Close())
+	})
+}
+
 func TestHandlePeerReflexive(t *testing.T) {
 	report := test.CheckRoutines(t)
 	defer report()
@@ -236,10 +668,10 @@ func TestHandlePeerReflexive(t *testing.T) {
 	defer lim.Stop()
 
 	t.Run("UDP pflx candidate from handleInbound()", func(t *testing.T) {
-		var config AgentConfig
+		config := AgentConfig{AllowPrivateRemoteCandidates: true}
 		runAgentTest(t, &config, func(a *Agent) {
 			a.selector = &controllingSelector{agent: a, log: a.log}
-			a.connectivityTicker = time.NewTicker(a.taskLoopInterval)
+			a.connectivityTicker = a.clock.NewTicker(a.taskLoopInterval)
 
 			hostConfig := CandidateHostConfig{
 				Network:   "udp",
@@ -296,11 +728,96 @@ func TestHandlePeerReflexive(t *testing.T) {
 		})
 	})
 
+	t.Run("prflx candidate superseded by the signaled candidate", func(t *testing.T) {
+		config := AgentConfig{AllowPrivateRemoteCandidates: true}
+		changes := make(chan Candidate, 2)
+		var superseded []Candidate
+		runAgentTest(t, &config, func(a *Agent) {
+			a.startOnConnectionStateChangeRoutine()
+			a.selector = &controlledSelector{agent: a, log: a.log}
+			assert.NoError(t, a.OnSelectedCandidatePairChange(func(_, remote Candidate) {
+				// The handler waits for the lock held by the test
+				_, _ = a.GetLocalCandidates()
+				changes <- remote
+			}))
+
+			local, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   "192.168.0.2",
+				Port:      777,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+			local.conn = &mockPacketConn{}
+			a.localCandidates[local.NetworkType()] = []Candidate{local}
+
+			remote := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+			msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+				stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+				AttrControlling(a.tieBreaker+1),
+				PriorityAttr(12345),
+				stun.NewShortTermIntegrity(a.localPwd),
+				stun.Fingerprint,
+			)
+			assert.NoError(t, err)
+
+			a.handleInbound(msg, local, remote)
+
+			set := a.remoteCandidates[local.NetworkType()]
+			assert.Equal(t, 1, len(set))
+			prflx := set[0]
+			assert.Equal(t, CandidateTypePeerReflexive, prflx.Type())
+			assert.Equal(t, uint32(12345), prflx.Priority())
+
+			p := a.findPair(local, prflx)
+			assert.NotNil(t, p)
+			p.state = CandidatePairStateSucceeded
+			a.setSelectedPair(p)
+
+			// The host candidate trickles in with the same transport address
+			host, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   "172.17.0.3",
+				Port:      999,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+			a.addRemoteCandidate(host)
+
+			set = a.remoteCandidates[local.NetworkType()]
+			assert.Equal(t, 1, len(set))
+			assert.Equal(t, host, set[0])
+			assert.Equal(t, prflx.LastReceived(), host.LastReceived())
+			assert.Equal(t, 1, len(a.checklist))
+			assert.Nil(t, a.findPair(local, prflx))
+
+			selected := a.getSelectedPair()
+			assert.NotNil(t, selected)
+			assert.Equal(t, host, selected.remote)
+			assert.Equal(t, CandidatePairStateSucceeded, selected.state)
+			assert.Equal(t, uint64(1), selected.requestsReceived)
+			assert.Equal(t, a.findPair(local, host), selected)
+
+			// Inbound checks now come from the signaled candidate
+			a.handleInbound(msg, local, remote)
+			assert.Equal(t, 1, len(a.remoteCandidates[local.NetworkType()]))
+			assert.Equal(t, uint64(2), selected.requestsReceived)
+
+			// local was never started, it can't be closed with the agent
+			delete(a.localCandidates, local.NetworkType())
+			superseded = []Candidate{prflx, host}
+		})
+
+		// The replaced selected pair is notified without blocking
+		assert.Equal(t, superseded[0], <-changes)
+		assert.Equal(t, superseded[1], <-changes)
+	})
+
 	t.Run("Bad network type with handleInbound()", func(t *testing.T) {
-		var config AgentConfig
+		config := AgentConfig{AllowPrivateRemoteCandidates: true}
 		runAgentTest(t, &config, func(a *Agent) {
 			a.selector = &controllingSelector{agent: a, log: a.log}
-			a.connectivityTicker = time.NewTicker(a.taskLoopInterval)
+			a.connectivityTicker = a.clock.NewTicker(a.taskLoopInterval)
 
 			hostConfig := CandidateHostConfig{
 				Network:   "tcp",
@@ -324,14 +841,14 @@ func TestHandlePeerReflexive(t *testing.T) {
 	})
 
 	t.Run("Success from unknown remote, prflx candidate MUST only be created via Binding Request", func(t *testing.T) {
-		var config AgentConfig
+		config := AgentConfig{AllowPrivateRemoteCandidates: true}
 		runAgentTest(t, &config, func(a *Agent) {
 			a.selector = &controllingSelector{agent: a, log: a.log}
-			a.connectivityTicker = time.NewTicker(a.taskLoopInterval)
+			a.connectivityTicker = a.clock.NewTicker(a.taskLoopInterval)
 			tID := [stun.TransactionIDSize]byte{}
 			copy(tID[:], []byte("ABC"))
 			a.pendingBindingRequests = []bindingRequest{
-				{time.Now(), tID, &net.UDPAddr{}, false},
+				{time.Now(), tID, &net.UDPAddr{}, false, false, 0},
 			}
 
 			hostConfig := CandidateHostConfig{
@@ -397,6 +914,8 @@ func TestConnectivityOnStartup(t *testing.T) {
 		Net:              net0,
 
 		taskLoopInterval: time.Hour,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg0)
@@ -408,6 +927,8 @@ func TestConnectivityOnStartup(t *testing.T) {
 		MulticastDNSMode: MulticastDNSModeDisabled,
 		Net:              net1,
 		taskLoopInterval: time.Hour,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	bAgent, err := NewAgent(cfg1)
@@ -530,24 +1051,129 @@ func TestConnectivityLite(t *testing.T) {
 	}
 }
 
-func TestInboundValidity(t *testing.T) {
+func TestRemoteLite(t *testing.T) {
 	report := test.CheckRoutines(t)
 	defer report()
 
-	buildMsg := func(class stun.MessageClass, username, key string) *stun.Message {
-		msg, err := stun.Build(stun.NewType(stun.MethodBinding, class), stun.TransactionID,
-			stun.NewUsername(username),
-			stun.NewShortTermIntegrity(key),
-			stun.Fingerprint,
-		)
-		if err != nil {
-			t.Fatal(err)
-		}
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
 
-		return msg
-	}
+	t.Run("Full agent takes the controlling role", func(t *testing.T) {
+		// The lite agent is publicly reachable, the full agent is behind a NAT
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		}, &vnet.NATType{
+			Mode: vnet.NATModeNAT1To1,
+		})
+		require.NoError(t, err, "should succeed")
+		defer v.close()
 
-	remote := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+		aNotifier, aConnected := onConnected()
+		bNotifier, bConnected := onConnected()
+
+		aAgent, err := NewAgent(&AgentConfig{
+			Urls:             []*URL{{Scheme: SchemeTypeSTUN, Host: "1.2.3.4", Port: 3478, Proto: ProtoTypeUDP}},
+			NetworkTypes:     supportedNetworkTypes,
+			MulticastDNSMode: MulticastDNSModeDisabled,
+			Net:              v.net0,
+		})
+		require.NoError(t, err)
+		require.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+		require.NoError(t, aAgent.SetRemoteLite(true))
+
+		bAgent, err := NewAgent(&AgentConfig{
+			Lite:             true,
+			CandidateTypes:   []CandidateType{CandidateTypeHost},
+			NAT1To1IPs:       []string{"28.1.1.1"},
+			NetworkTypes:     supportedNetworkTypes,
+			MulticastDNSMode: MulticastDNSModeDisabled,
+			Net:              v.net1,
+		})
+		require.NoError(t, err)
+		require.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+		aUfrag, aPwd, err := aAgent.GetLocalUserCredentials()
+		require.NoError(t, err)
+		bUfrag, bPwd, err := bAgent.GetLocalUserCredentials()
+		require.NoError(t, err)
+		gatherAndExchangeCandidates(aAgent, bAgent)
+
+		// Both sides Accept, nothing would ever be nominated if the full agent stayed controlled
+		accepted := make(chan *Conn)
+		go func() {
+			aConn, acceptErr := aAgent.Accept(context.TODO(), bUfrag, bPwd)
+			check(acceptErr)
+			accepted <- aConn
+		}()
+		bConn, err := bAgent.Accept(context.TODO(), aUfrag, aPwd)
+		require.NoError(t, err)
+		aConn := <-accepted
+
+		<-aConnected
+		<-bConnected
+		assert.True(t, aAgent.isControlling)
+
+		closePipe(t, aConn, bConn)
+	})
+
+	t.Run("No relay candidates are gathered", func(t *testing.T) {
+		// Nothing answers on this socket, a TURN allocation would only fail after its retransmissions
+		blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		a, err := NewAgent(&AgentConfig{
+			NetworkTypes:   []NetworkType{NetworkTypeUDP4},
+			CandidateTypes: []CandidateType{CandidateTypeRelay},
+			Urls: []*URL{{
+				Scheme:   SchemeTypeTURN,
+				Proto:    ProtoTypeUDP,
+				Host:     "127.0.0.1",
+				Port:     blackhole.LocalAddr().(*net.UDPAddr).Port,
+				Username: "username",
+				Password: "password",
+			}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, a.SetRemoteLite(true))
+
+		gathered := make(chan struct{})
+		require.NoError(t, a.OnCandidate(func(c Candidate) {
+			if c == nil {
+				close(gathered)
+			}
+		}))
+		require.NoError(t, a.GatherCandidates(context.Background()))
+
+		select {
+		case <-gathered:
+		case <-time.After(2 * time.Second):
+			t.Fatal("relay candidates were gathered for a lite remote")
+		}
+
+		assert.NoError(t, a.Close())
+		assert.NoError(t, blackhole.Close())
+	})
+}
+
+func TestInboundValidity(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	buildMsg := func(class stun.MessageClass, username, key string) *stun.Message {
+		msg, err := stun.Build(stun.NewType(stun.MethodBinding, class), stun.TransactionID,
+			stun.NewUsername(username),
+			stun.NewShortTermIntegrity(key),
+			stun.Fingerprint,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return msg
+	}
+
+	remote := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
 	hostConfig := CandidateHostConfig{
 		Network:   "udp",
 		Address:   "192.168.0.2",
@@ -579,6 +1205,36 @@ func TestInboundValidity(t *testing.T) {
 		assert.NoError(t, a.Close())
 	})
 
+	t.Run("Binding requests with old credentials should be rejected", func(t *testing.T) {
+		a, err := NewAgent(&AgentConfig{})
+		if err != nil {
+			t.Fatalf("Error constructing ice.Agent")
+		}
+
+		assert.NoError(t, a.SetRemoteCredentials("oldUfrag", "oldPwd"))
+		assert.NoError(t, a.SetRemoteCredentials("newUfrag", "newPwd"))
+
+		sent := make(chan []byte, 1)
+		local, err := NewCandidateHost(&hostConfig)
+		assert.NoError(t, err)
+		local.conn = &recordingPacketConn{sent: sent}
+
+		a.handleInbound(buildMsg(stun.ClassRequest, a.localUfrag+":oldUfrag", a.localPwd), local, remote)
+		if len(a.remoteCandidates) == 1 {
+			t.Fatal("Binding with old credentials was able to create prflx candidate")
+		}
+
+		resp := &stun.Message{Raw: <-sent}
+		assert.NoError(t, resp.Decode())
+		assert.Equal(t, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), resp.Type)
+
+		var errorCode stun.ErrorCodeAttribute
+		assert.NoError(t, errorCode.GetFrom(resp))
+		assert.Equal(t, stun.CodeUnauthorized, errorCode.Code)
+
+		assert.NoError(t, a.Close())
+	})
+
 	t.Run("Invalid Binding success responses should be discarded", func(t *testing.T) {
 		a, err := NewAgent(&AgentConfig{})
 		if err != nil {
@@ -608,14 +1264,14 @@ func TestInboundValidity(t *testing.T) {
 	})
 
 	t.Run("Valid bind request", func(t *testing.T) {
-		a, err := NewAgent(&AgentConfig{})
+		a, err := NewAgent(&AgentConfig{AllowPrivateRemoteCandidates: true})
 		if err != nil {
 			t.Fatalf("Error constructing ice.Agent")
 		}
 
 		err = a.run(func(a *Agent) {
 			a.selector = &controllingSelector{agent: a, log: a.log}
-			a.connectivityTicker = time.NewTicker(a.taskLoopInterval)
+			a.connectivityTicker = a.clock.NewTicker(a.taskLoopInterval)
 			a.handleInbound(buildMsg(stun.ClassRequest, a.localUfrag+":"+a.remoteUfrag, a.localPwd), local, remote)
 			if len(a.remoteCandidates) != 1 {
 				t.Fatal("Binding with valid values was unable to create prflx candidate")
@@ -627,10 +1283,10 @@ func TestInboundValidity(t *testing.T) {
 	})
 
 	t.Run("Valid bind without fingerprint", func(t *testing.T) {
-		var config AgentConfig
+		config := AgentConfig{AllowPrivateRemoteCandidates: true}
 		runAgentTest(t, &config, func(a *Agent) {
 			a.selector = &controllingSelector{agent: a, log: a.log}
-			a.connectivityTicker = time.NewTicker(a.taskLoopInterval)
+			a.connectivityTicker = a.clock.NewTicker(a.taskLoopInterval)
 			msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
 				stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
 				stun.NewShortTermIntegrity(a.localPwd),
@@ -731,6 +1387,8 @@ func TestConnectionStateCallback(t *testing.T) {
 		FailedTimeout:       &failedDuration,
 		KeepaliveInterval:   &KeepaliveInterval,
 		taskLoopInterval:    500 * time.Millisecond,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg)
@@ -779,6 +1437,129 @@ func TestConnectionStateCallback(t *testing.T) {
 	<-isClosed
 }
 
+// The connection state times out without waiting for the task loop, and
+// traffic received while disconnected goes back to connected right away
+func TestConnectionStateTimeouts(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	disconnectedTimeout := 300 * time.Millisecond
+	failedTimeout := 300 * time.Millisecond
+	keepaliveInterval := time.Duration(0)
+
+	cfg := &AgentConfig{
+		NetworkTypes:        []NetworkType{NetworkTypeUDP4},
+		MulticastDNSMode:    MulticastDNSModeDisabled,
+		DisconnectedTimeout: &disconnectedTimeout,
+		FailedTimeout:       &failedTimeout,
+		KeepaliveInterval:   &keepaliveInterval,
+		taskLoopInterval:    time.Hour,
+
+		AllowPrivateRemoteCandidates: true,
+	}
+
+	aAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+
+	bAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+
+	states := make(chan ConnectionState, 10)
+	assert.NoError(t, aAgent.OnConnectionStateChange(func(c ConnectionState) {
+		states <- c
+	}))
+
+	waitFor := func(expected ConnectionState) {
+		for s := range states {
+			if s == expected {
+				return
+			}
+		}
+	}
+
+	_, bConn := connect(aAgent, bAgent)
+	waitFor(ConnectionStateConnected)
+	waitFor(ConnectionStateDisconnected)
+
+	_, err = bConn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, ConnectionStateConnected, <-states)
+
+	waitFor(ConnectionStateDisconnected)
+	waitFor(ConnectionStateFailed)
+
+	assert.NoError(t, aAgent.Close())
+	assert.NoError(t, bAgent.Close())
+}
+
+func TestConnectionStateClosedWithoutStart(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	assert.NoError(t, err)
+
+	states := make(chan ConnectionState, 2)
+	assert.NoError(t, a.OnConnectionStateChange(func(c ConnectionState) {
+		states <- c
+	}))
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, a.Close())
+
+	assert.Equal(t, ConnectionStateClosed, <-states)
+	select {
+	case s := <-states:
+		t.Fatalf("Unexpected ConnectionState after Close: %s", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCloseWhileGathering(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	// Queries to this server never get an answer, Close must not wait for them to time out
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:   []NetworkType{NetworkTypeUDP4},
+		CandidateTypes: []CandidateType{CandidateTypeHost, CandidateTypeServerReflexive},
+		Urls:           []*URL{{Scheme: SchemeTypeSTUN, Host: "127.0.0.1", Port: randomPort(t)}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, a.OnCandidate(func(Candidate) {}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+
+	conn := newConn(a, ComponentRTP)
+	readErr := make(chan error)
+	go func() {
+		_, readErrr := conn.Read(make([]byte, receiveMTU))
+		readErr <- readErrr
+	}()
+
+	start := time.Now()
+	assert.NoError(t, a.Close())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	err = <-readErr
+	assert.Equal(t, ErrClosed, err)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && !netErr.Timeout() && !netErr.Temporary(), err)
+
+	_, err = conn.Write([]byte("data"))
+	assert.True(t, errors.Is(err, ErrClosed))
+
+	assert.NoError(t, conn.Close())
+}
+
 func TestInvalidGather(t *testing.T) {
 	t.Run("Gather with no OnCandidate should error", func(t *testing.T) {
 		a, err := NewAgent(&AgentConfig{})
@@ -786,7 +1567,7 @@ func TestInvalidGather(t *testing.T) {
 			t.Fatalf("Error constructing ice.Agent")
 		}
 
-		err = a.GatherCandidates()
+		err = a.GatherCandidates(context.Background())
 		if err != ErrNoOnCandidateHandler {
 			t.Fatal("trickle GatherCandidates succeeded without OnCandidate")
 		}
@@ -927,6 +1708,56 @@ func TestCandidatePairStats(t *testing.T) {
 	assert.NoError(t, a.Close())
 }
 
+func TestCandidatePairStatsCounters(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	aConn, bConn := pipe(nil)
+
+	const payload = "data"
+	_, err := aConn.Write([]byte(payload))
+	assert.NoError(t, err)
+	_, err = bConn.Read(make([]byte, len(payload)))
+	assert.NoError(t, err)
+
+	selectedStats := func(a *Agent) CandidatePairStats {
+		pair := a.getSelectedPair()
+		for _, stat := range a.GetCandidatePairsStats() {
+			if stat.LocalCandidateID == pair.local.ID() && stat.RemoteCandidateID == pair.remote.ID() {
+				return stat
+			}
+		}
+		t.Fatal("no stats for the selected pair")
+		return CandidatePairStats{}
+	}
+
+	aStats := selectedStats(aConn.agent)
+	assert.Equal(t, CandidatePairStateSucceeded, aStats.State)
+	assert.True(t, aStats.Nominated)
+	assert.NotZero(t, aStats.RequestsSent)
+	assert.NotZero(t, aStats.ResponsesReceived)
+	assert.NotZero(t, aStats.RequestsReceived)
+	assert.NotZero(t, aStats.ResponsesSent)
+	assert.True(t, aStats.CurrentRoundTripTime > 0)
+	assert.True(t, aStats.TotalRoundTripTime >= aStats.CurrentRoundTripTime)
+	assert.False(t, aStats.FirstRequestTimestamp.After(aStats.LastRequestTimestamp))
+	assert.False(t, aStats.LastResponseTimestamp.IsZero())
+	assert.Equal(t, uint32(1), aStats.PacketsSent)
+	assert.Equal(t, uint64(len(payload)), aStats.BytesSent)
+	assert.False(t, aStats.LastPacketSentTimestamp.IsZero())
+
+	bStats := selectedStats(bConn.agent)
+	assert.Equal(t, uint32(1), bStats.PacketsReceived)
+	assert.Equal(t, uint64(len(payload)), bStats.BytesReceived)
+	assert.False(t, bStats.LastPacketReceivedTimestamp.IsZero())
+
+	assert.NoError(t, aConn.Close())
+	assert.NoError(t, bConn.Close())
+}
+
 func TestLocalCandidateStats(t *testing.T) {
 	report := test.CheckRoutines(t)
 	defer report()
@@ -1226,6 +2057,232 @@ func TestBindingRequestTimeout(t *testing.T) {
 	assert.NoError(t, a.Close())
 }
 
+func TestBindingRequestRetransmission(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	initialRTO := 100 * time.Millisecond
+	maxBindingRequests := uint16(3)
+	config := &AgentConfig{
+		InitialRTO:         &initialRTO,
+		RTOMultiplier:      3,
+		MaxBindingRequests: &maxBindingRequests,
+	}
+
+	newPair := func(t *testing.T, a *Agent) *candidatePair {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		local.conn = &mockPacketConn{}
+
+		remote, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.3",
+			Port:      888,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		return a.addPair(local, remote)
+	}
+
+	t.Run("RTO grows until the pair fails", func(t *testing.T) {
+		runAgentTest(t, config, func(a *Agent) {
+			a.startSelector()
+			p := newPair(t, a)
+
+			for i, rto := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond} {
+				a.pingAllCandidates()
+				assert.Equal(t, uint16(i+1), p.bindingRequestCount)
+				assert.Equal(t, rto, p.rto)
+				assert.Equal(t, rto, a.pendingBindingRequests[len(a.pendingBindingRequests)-1].timeout)
+
+				next, ok := a.nextRetransmission()
+				assert.True(t, ok)
+				assert.Equal(t, p.nextBindingRequest, next)
+
+				// Nothing is sent before the RTO elapsed
+				a.pingAllCandidates()
+				assert.Equal(t, uint16(i+1), p.bindingRequestCount)
+
+				p.nextBindingRequest = time.Now()
+			}
+
+			assert.Equal(t, CandidatePairStateInProgress, p.state)
+			a.pingAllCandidates()
+			assert.Equal(t, CandidatePairStateFailed, p.state)
+			assert.Equal(t, maxBindingRequests, p.bindingRequestCount)
+
+			_, ok := a.nextRetransmission()
+			assert.False(t, ok)
+		})
+	})
+
+	t.Run("Response stops retransmissions", func(t *testing.T) {
+		runAgentTest(t, config, func(a *Agent) {
+			a.startSelector()
+			p := newPair(t, a)
+
+			a.pingAllCandidates()
+			request := a.pendingBindingRequests[len(a.pendingBindingRequests)-1]
+			a.selector.HandleSuccessResponse(&stun.Message{TransactionID: request.transactionID}, p.local, p.remote, p.remote.addr())
+			assert.Equal(t, CandidatePairStateSucceeded, p.state)
+
+			p.nextBindingRequest = time.Now()
+			a.pingAllCandidates()
+			assert.Equal(t, uint16(1), p.bindingRequestCount)
+
+			_, ok := a.nextRetransmission()
+			assert.False(t, ok)
+		})
+	})
+
+	t.Run("Invalid config", func(t *testing.T) {
+		zero := time.Duration(0)
+		_, err := NewAgent(&AgentConfig{InitialRTO: &zero})
+		assert.Equal(t, ErrInvalidInitialRTO, err)
+
+		_, err = NewAgent(&AgentConfig{RTOMultiplier: 0.5})
+		assert.Equal(t, ErrInvalidRTOMultiplier, err)
+	})
+}
+
+func TestCandidatePairFreezing(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	checkInterval := time.Hour
+	config := &AgentConfig{CheckInterval: &checkInterval}
+
+	runAgentTest(t, config, func(a *Agent) {
+		a.startSelector()
+
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		local.conn = &mockPacketConn{}
+
+		newRemote := func(address string, port int) Candidate {
+			remote, remoteErr := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   address,
+				Port:      port,
+				Component: 1,
+			})
+			assert.NoError(t, remoteErr)
+			return remote
+		}
+
+		// Both pairs to 192.168.0.3 share a foundation, the second one is frozen
+		first := a.addPair(local, newRemote("192.168.0.3", 1000))
+		second := a.addPair(local, newRemote("192.168.0.3", 1001))
+		other := a.addPair(local, newRemote("192.168.0.4", 1000))
+		assert.Equal(t, CandidatePairStateWaiting, first.state)
+		assert.Equal(t, CandidatePairStateFrozen, second.state)
+		assert.Equal(t, CandidatePairStateWaiting, other.state)
+
+		// A single new check starts every CheckInterval
+		a.pingAllCandidates()
+		assert.Equal(t, 1, len(a.pendingBindingRequests))
+		a.pingAllCandidates()
+		assert.Equal(t, 1, len(a.pendingBindingRequests))
+
+		next, ok := a.nextRetransmission()
+		assert.True(t, ok)
+		assert.True(t, next.Before(a.nextCheck), "the retransmission comes before the next check")
+
+		a.nextCheck = time.Now()
+		a.pingAllCandidates()
+		assert.Equal(t, 2, len(a.pendingBindingRequests))
+		assert.Equal(t, CandidatePairStateInProgress, first.state)
+		assert.Equal(t, CandidatePairStateInProgress, other.state)
+		assert.Equal(t, CandidatePairStateFrozen, second.state)
+
+		// The frozen pair is not checked while its foundation is
+		a.nextCheck = time.Now()
+		a.pingAllCandidates()
+		assert.Equal(t, 2, len(a.pendingBindingRequests))
+		assert.Equal(t, CandidatePairStateFrozen, second.state)
+
+		// Once the first check failed, the frozen pair is checked
+		first.state = CandidatePairStateFailed
+		assert.Equal(t, second, a.nextPairToCheck())
+
+		// A success unfreezes the whole foundation
+		first.state = CandidatePairStateSucceeded
+		a.unfreezePairs(first)
+		assert.Equal(t, CandidatePairStateWaiting, second.state)
+	})
+}
+
+func TestKeepaliveIndication(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	newSelectedPair := func(t *testing.T, a *Agent) (*candidatePair, chan []byte) {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		sent := make(chan []byte, 10)
+		local.conn = &recordingPacketConn{sent: sent}
+
+		remote, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.3",
+			Port:      888,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		a.startOnConnectionStateChangeRoutine()
+		a.startSelector()
+		p := a.addPair(local, remote)
+		a.setSelectedPair(p)
+		return p, sent
+	}
+
+	t.Run("Keepalive is a Binding indication", func(t *testing.T) {
+		keepaliveInterval := time.Second
+		runAgentTest(t, &AgentConfig{KeepaliveInterval: &keepaliveInterval}, func(a *Agent) {
+			p, sent := newSelectedPair(t, a)
+			requestsSent := p.requestsSent
+
+			a.checkKeepalive()
+			msg := &stun.Message{Raw: <-sent}
+			assert.NoError(t, msg.Decode())
+			assert.Equal(t, stun.NewType(stun.MethodBinding, stun.ClassIndication), msg.Type)
+			assert.Equal(t, 0, len(a.pendingBindingRequests))
+			assert.Equal(t, requestsSent, p.requestsSent)
+
+			// Nothing is sent until KeepaliveInterval elapsed
+			a.checkKeepalive()
+			assert.Equal(t, 0, len(sent))
+		})
+	})
+
+	t.Run("Keepalive is disabled by a zero interval", func(t *testing.T) {
+		keepaliveInterval := time.Duration(0)
+		runAgentTest(t, &AgentConfig{KeepaliveInterval: &keepaliveInterval}, func(a *Agent) {
+			_, sent := newSelectedPair(t, a)
+
+			a.checkKeepalive()
+			assert.Equal(t, 0, len(sent))
+		})
+	})
+}
+
 // TestAgentCredentials checks if local username fragments and passwords (if set) meet RFC standard
 // and ensure it's backwards compatible with previous versions of the pion/ice
 func TestAgentCredentials(t *testing.T) {
@@ -1252,6 +2309,21 @@ func TestAgentCredentials(t *testing.T) {
 
 	_, err = NewAgent(&AgentConfig{LocalPwd: "xxxxxx", LoggerFactory: log})
 	assert.EqualError(t, err, ErrLocalPwdInsufficientBits.Error())
+
+	// The ice-ufrag and ice-pwd attributes are at least 4 and 22 characters long
+	_, err = NewAgent(&AgentConfig{LocalUfrag: "xxx", LoggerFactory: log})
+	assert.EqualError(t, err, ErrLocalUfragInsufficientBits.Error())
+
+	_, err = NewAgent(&AgentConfig{LocalPwd: strings.Repeat("x", 21), LoggerFactory: log})
+	assert.EqualError(t, err, ErrLocalPwdInsufficientBits.Error())
+
+	agent, err = NewAgent(&AgentConfig{LocalUfrag: "xxxx", LocalPwd: strings.Repeat("x", 22), LoggerFactory: log})
+	assert.NoError(t, err)
+	ufrag, pwd, err := agent.GetLocalUserCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "xxxx", ufrag)
+	assert.Equal(t, strings.Repeat("x", 22), pwd)
+	assert.NoError(t, agent.Close())
 }
 
 // Assert that Agent on Failure deletes all existing candidates
@@ -1272,6 +2344,8 @@ func TestConnectionStateFailedDeleteAllCandidates(t *testing.T) {
 		FailedTimeout:       &oneSecond,
 		KeepaliveInterval:   &KeepaliveInterval,
 		taskLoopInterval:    250 * time.Millisecond,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg)
@@ -1364,28 +2438,261 @@ func TestConnectionStateConnectingToFailed(t *testing.T) {
 	assert.NoError(t, bAgent.Close())
 }
 
-func TestAgentRestart(t *testing.T) {
+// Assert that an Agent is torn down once the remote stops granting consent
+func TestConsentExpired(t *testing.T) {
 	report := test.CheckRoutines(t)
 	defer report()
 
-	lim := test.TimeOut(time.Second * 30)
+	lim := test.TimeOut(time.Second * 10)
 	defer lim.Stop()
 
-	oneSecond := time.Second
-
-	t.Run("Restart During Gather", func(t *testing.T) {
-		agent, err := NewAgent(&AgentConfig{})
-		assert.NoError(t, err)
-
-		agent.gatheringState = GatheringStateGathering
+	consentCheckInterval := 100 * time.Millisecond
+	consentTimeout := time.Second
+	KeepaliveInterval := time.Duration(0)
 
-		assert.Equal(t, ErrRestartWhenGathering, agent.Restart("", ""))
-		assert.NoError(t, agent.Close())
+	aConn, bConn := pipe(&AgentConfig{
+		ConsentCheckInterval: &consentCheckInterval,
+		ConsentTimeout:       &consentTimeout,
+		KeepaliveInterval:    &KeepaliveInterval,
+		taskLoopInterval:     100 * time.Millisecond,
 	})
 
-	t.Run("Restart When Closed", func(t *testing.T) {
-		agent, err := NewAgent(&AgentConfig{})
-		assert.NoError(t, err)
+	isFailed := make(chan interface{})
+	isClosed := make(chan interface{})
+	assert.NoError(t, aConn.agent.OnConnectionStateChange(func(c ConnectionState) {
+		switch c {
+		case ConnectionStateFailed:
+			close(isFailed)
+		case ConnectionStateClosed:
+			close(isClosed)
+		}
+	}))
+
+	// Consent is refreshed while the remote answers
+	time.Sleep(2 * consentTimeout)
+	assert.NoError(t, aConn.agent.ok())
+
+	readErr := make(chan error)
+	go func() {
+		_, err := aConn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	assert.NoError(t, bConn.Close())
+	<-isFailed
+	<-isClosed
+
+	assert.Error(t, <-readErr)
+
+	_, err := aConn.Write([]byte("data"))
+	assert.Equal(t, ErrConsentExpired, err)
+	assert.NoError(t, aConn.Close())
+	assert.Equal(t, FailureReasonConsentExpired, aConn.agent.FailureReason())
+}
+
+func TestFailureReason(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	runAgentTest(t, &AgentConfig{}, func(a *Agent) {
+		a.startOnConnectionStateChangeRoutine()
+		failed := make(chan FailureReason, 1)
+		assert.NoError(t, a.OnFailed(func(reason FailureReason) {
+			failed <- reason
+		}))
+
+		assert.Equal(t, FailureReasonGatheringFailed, a.connectionTimeoutReason())
+
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		remote, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.3",
+			Port:      999,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		a.localCandidates[local.NetworkType()] = []Candidate{local}
+		p := a.addPair(local, remote)
+		assert.Equal(t, FailureReasonNoValidPairs, a.connectionTimeoutReason())
+
+		p.state = CandidatePairStateSucceeded
+		assert.Equal(t, FailureReasonTimeout, a.connectionTimeoutReason())
+
+		a.updateConnectionState(ConnectionStateChecking)
+		assert.Equal(t, FailureReason(0), a.FailureReason())
+		a.fail(FailureReasonNoValidPairs)
+		assert.Equal(t, FailureReasonNoValidPairs, <-failed)
+		assert.Equal(t, FailureReasonNoValidPairs, a.FailureReason())
+
+		// Only the first failure is reported
+		a.fail(FailureReasonTimeout)
+		assert.Equal(t, FailureReasonNoValidPairs, a.FailureReason())
+
+		// Checking again after a Restart
+		a.updateConnectionState(ConnectionStateChecking)
+		assert.Equal(t, FailureReason(0), a.FailureReason())
+	})
+
+	assert.Equal(t, "NoValidPairs", FailureReasonNoValidPairs.String())
+	assert.Equal(t, "Invalid", FailureReason(0).String())
+}
+
+func TestRemoteCandidatesDone(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	oneHour := time.Hour
+	maxBindingRequests := uint16(1)
+	checkInterval := 10 * time.Millisecond
+	a, err := NewAgent(&AgentConfig{
+		ConnectionTimeout:  &oneHour,
+		MaxBindingRequests: &maxBindingRequests,
+		InitialRTO:         &checkInterval,
+		CheckInterval:      &checkInterval,
+	})
+	assert.NoError(t, err)
+
+	failed := make(chan FailureReason, 1)
+	assert.NoError(t, a.OnFailed(func(reason FailureReason) {
+		failed <- reason
+	}))
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	local, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "127.0.0.1",
+		Port:      conn.LocalAddr().(*net.UDPAddr).Port,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+	// Nothing answers on the discard port
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "127.0.0.1",
+		Port:      9,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+
+	var p *candidatePair
+	assert.NoError(t, a.run(func(agent *Agent) {
+		agent.gatheringState = GatheringStateComplete
+		local.start(agent, conn, agent.startedCh)
+		agent.localCandidates[local.NetworkType()] = []Candidate{local}
+		p = agent.addPair(local, remote)
+	}, nil))
+	assert.NoError(t, a.startConnectivityChecks(true, "remoteUfrag", "remotePasswordWith128Bits"))
+
+	// The remote may still trickle candidates once the only pair failed
+	assert.Eventually(t, func() bool {
+		state := CandidatePairStateWaiting
+		assert.NoError(t, a.run(func(agent *Agent) {
+			state = p.state
+		}, nil))
+		return state == CandidatePairStateFailed
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, a.run(func(agent *Agent) {
+		assert.Equal(t, ConnectionStateChecking, agent.connectionState)
+	}, nil))
+
+	assert.NoError(t, a.RemoteCandidatesDone())
+	assert.Equal(t, FailureReasonNoValidPairs, <-failed)
+	<-a.onConnectionTimeout
+
+	assert.NoError(t, a.Close())
+	assert.Equal(t, ErrClosed, a.RemoteCandidatesDone())
+}
+
+func TestWaitUntilConnected(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	t.Run("Connected", func(t *testing.T) {
+		aAgent, err := NewAgent(&AgentConfig{NetworkTypes: supportedNetworkTypes, AllowPrivateRemoteCandidates: true})
+		assert.NoError(t, err)
+		bAgent, err := NewAgent(&AgentConfig{NetworkTypes: supportedNetworkTypes, AllowPrivateRemoteCandidates: true})
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		assert.Equal(t, context.DeadlineExceeded, aAgent.WaitUntilConnected(ctx))
+		cancel()
+
+		// The checks are started in another goroutine
+		conns := make(chan [2]*Conn)
+		go func() {
+			aConn, bConn := connect(aAgent, bAgent)
+			conns <- [2]*Conn{aConn, bConn}
+		}()
+		assert.NoError(t, aAgent.WaitUntilConnected(context.Background()))
+		assert.NoError(t, bAgent.WaitUntilConnected(context.Background()))
+
+		c := <-conns
+		assert.NoError(t, c[0].Close())
+		assert.NoError(t, c[1].Close())
+		assert.Equal(t, ErrClosed, aAgent.WaitUntilConnected(context.Background()))
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		a, err := NewAgent(&AgentConfig{})
+		assert.NoError(t, err)
+		a.startOnConnectionStateChangeRoutine()
+
+		waitErr := make(chan error)
+		go func() {
+			waitErr <- a.WaitUntilConnected(context.Background())
+		}()
+
+		assert.NoError(t, a.run(func(agent *Agent) {
+			agent.updateConnectionState(ConnectionStateChecking)
+			agent.fail(FailureReasonNoValidPairs)
+		}, nil))
+		err = <-waitErr
+		assert.True(t, errors.Is(err, ErrConnectionFailed))
+		assert.Contains(t, err.Error(), FailureReasonNoValidPairs.String())
+
+		assert.NoError(t, a.Close())
+	})
+}
+
+func TestAgentRestart(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	oneSecond := time.Second
+
+	t.Run("Restart During Gather", func(t *testing.T) {
+		agent, err := NewAgent(&AgentConfig{})
+		assert.NoError(t, err)
+
+		agent.gatheringState = GatheringStateGathering
+
+		assert.Equal(t, ErrRestartWhenGathering, agent.Restart("", ""))
+		assert.NoError(t, agent.Close())
+	})
+
+	t.Run("Restart When Closed", func(t *testing.T) {
+		agent, err := NewAgent(&AgentConfig{})
+		assert.NoError(t, err)
 		assert.NoError(t, agent.Close())
 
 		assert.Equal(t, ErrClosed, agent.Restart("", ""))
@@ -1464,6 +2771,55 @@ func TestAgentRestart(t *testing.T) {
 		assert.NoError(t, connA.agent.Close())
 		assert.NoError(t, connB.agent.Close())
 	})
+
+	t.Run("Restart Keeps Conn", func(t *testing.T) {
+		connA, connB := pipe(&AgentConfig{
+			DisconnectedTimeout: &oneSecond,
+			FailedTimeout:       &oneSecond,
+			taskLoopInterval:    50 * time.Millisecond,
+		})
+
+		// Leave a packet buffered on B across the restart
+		_, err := connA.Write([]byte("before"))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return connB.agent.getBuffer(ComponentRTP).Count() == 1 }, time.Second, 10*time.Millisecond)
+
+		aNotifier, aConnected := onConnected()
+		assert.NoError(t, connA.agent.OnConnectionStateChange(aNotifier))
+
+		bNotifier, bConnected := onConnected()
+		assert.NoError(t, connB.agent.OnConnectionStateChange(bNotifier))
+
+		assert.NoError(t, connA.agent.Restart("", ""))
+		assert.NoError(t, connB.agent.Restart("", ""))
+
+		ufrag, pwd, err := connB.agent.GetLocalUserCredentials()
+		assert.NoError(t, err)
+		assert.NoError(t, connA.agent.SetRemoteCredentials(ufrag, pwd))
+
+		ufrag, pwd, err = connA.agent.GetLocalUserCredentials()
+		assert.NoError(t, err)
+		assert.NoError(t, connB.agent.SetRemoteCredentials(ufrag, pwd))
+
+		gatherAndExchangeCandidates(connA.agent, connB.agent)
+
+		<-aConnected
+		<-bConnected
+
+		buf := make([]byte, 16)
+		n, err := connB.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "before", string(buf[:n]))
+
+		_, err = connA.Write([]byte("after"))
+		assert.NoError(t, err)
+		n, err = connB.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "after", string(buf[:n]))
+
+		assert.NoError(t, connA.agent.Close())
+		assert.NoError(t, connB.agent.Close())
+	})
 }
 
 func TestGetRemoteCredentials(t *testing.T) {
@@ -1475,3 +2831,877 @@ func TestGetRemoteCredentials(t *testing.T) {
 	assert.Equal(t, actualUfrag, a.remoteUfrag)
 	assert.Equal(t, actualPwd, a.remotePwd)
 }
+
+// recordingLogger keeps the messages logged at Debug level and above
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level string, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+": "+msg)
+}
+
+func (l *recordingLogger) contains(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.messages {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *recordingLogger) Trace(msg string)                          {}
+func (l *recordingLogger) Tracef(format string, args ...interface{}) {}
+func (l *recordingLogger) Debug(msg string)                          { l.record("debug", msg) }
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Info(msg string) { l.record("info", msg) }
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Warn(msg string) { l.record("warn", msg) }
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warn", fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Error(msg string) { l.record("error", msg) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", fmt.Sprintf(format, args...))
+}
+
+type recordingLoggerFactory struct {
+	logger *recordingLogger
+}
+
+func (f *recordingLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return f.logger
+}
+
+func TestLoggerFactory(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	logger := &recordingLogger{}
+	maxBindingRequests := uint16(1)
+	a, err := NewAgent(&AgentConfig{
+		LoggerFactory:      &recordingLoggerFactory{logger: logger},
+		MaxBindingRequests: &maxBindingRequests,
+	})
+	assert.NoError(t, err)
+
+	local, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.2",
+		Port:      777,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+	local.conn = &mockPacketConn{}
+
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.3",
+		Port:      888,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+
+	// A pair that never gets a response says why it failed
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.startSelector()
+		p := a.addPair(local, remote)
+		a.pingAllCandidates()
+		p.nextBindingRequest = time.Now()
+		a.pingAllCandidates()
+		assert.Equal(t, CandidatePairStateFailed, p.state)
+	}, nil))
+	assert.True(t, logger.contains("no response to 1 binding requests"))
+
+	assert.NoError(t, a.Close())
+	assert.True(t, logger.contains("info: Setting new connection state: Closed"))
+}
+
+func TestGetRemoteCandidates(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{AllowPrivateRemoteCandidates: true})
+	assert.NoError(t, err)
+
+	remoteCandidates, err := a.GetRemoteCandidates()
+	assert.NoError(t, err)
+	assert.Empty(t, remoteCandidates)
+
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.2",
+		Port:      5000,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, a.AddRemoteCandidate(remote))
+
+	// Remote candidates are added asynchronously
+	for len(remoteCandidates) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		remoteCandidates, err = a.GetRemoteCandidates()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []Candidate{remote}, remoteCandidates)
+
+	// Restarting forgets the remote candidates
+	assert.NoError(t, a.Restart("", ""))
+	remoteCandidates, err = a.GetRemoteCandidates()
+	assert.NoError(t, err)
+	assert.Empty(t, remoteCandidates)
+
+	assert.NoError(t, a.Close())
+	_, err = a.GetRemoteCandidates()
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestCandidatePriorityFunc(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	// The candidates of 100.64.0.0/10 are only used as a last resort
+	_, carrierGradeNAT, err := net.ParseCIDR("100.64.0.0/10")
+	assert.NoError(t, err)
+	a, err := NewAgent(&AgentConfig{
+		CandidatePriorityFunc: func(c Candidate) uint32 {
+			if carrierGradeNAT.Contains(net.ParseIP(c.Address())) {
+				return 100
+			}
+			return 0
+		},
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	addLocal := func(address string) Candidate {
+		c, newErr := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   address,
+			Port:      5000,
+			Component: 1,
+		})
+		assert.NoError(t, newErr)
+		assert.NoError(t, a.run(func(a *Agent) {
+			a.setLocalCandidatePriority(c)
+			a.localCandidates[c.NetworkType()] = append(a.localCandidates[c.NetworkType()], c)
+		}, nil))
+		return c
+	}
+	defaultLocal := addLocal("192.168.0.1")
+	cgnatLocal := addLocal("100.64.0.1")
+	otherCGNATLocal := addLocal("100.64.0.2")
+
+	// The default priority is kept, and the custom ones are made unique
+	assert.Equal(t, uint32(2130706431), defaultLocal.Priority())
+	assert.Equal(t, uint32(100), cgnatLocal.Priority())
+	assert.Equal(t, uint32(99), otherCGNATLocal.Priority())
+	assert.True(t, strings.Contains(cgnatLocal.Marshal(), " 100 100.64.0.1 5000 "))
+
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.2",
+		Port:      5000,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+
+	// The pairs of the carrier-grade NAT candidates are checked last
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.addRemoteCandidate(remote)
+		assert.Equal(t, 3, len(a.checklist))
+		for _, p := range a.checklist {
+			if p.local != defaultLocal {
+				assert.True(t, p.Priority() < a.findPair(defaultLocal, remote).Priority())
+			}
+		}
+		assert.True(t, a.findPair(otherCGNATLocal, remote).Priority() < a.findPair(cgnatLocal, remote).Priority())
+	}, nil))
+
+	assert.NoError(t, a.Close())
+}
+
+func TestOnCheck(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	type check struct {
+		local, remote Candidate
+		result        CheckResult
+		rtt           time.Duration
+	}
+	onCheck := func(a *Agent) chan check {
+		checks := make(chan check, checkBufferSize)
+		assert.NoError(t, a.OnCheck(func(local, remote Candidate, result CheckResult, rtt time.Duration) {
+			select {
+			case checks <- check{local, remote, result, rtt}:
+			default:
+			}
+		}))
+		return checks
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		cfg := &AgentConfig{NetworkTypes: supportedNetworkTypes, AllowPrivateRemoteCandidates: true}
+		aAgent, err := NewAgent(cfg)
+		assert.NoError(t, err)
+		bAgent, err := NewAgent(cfg)
+		assert.NoError(t, err)
+		checks := onCheck(aAgent)
+
+		aNotifier, aConnected := onConnected()
+		assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+		bNotifier, bConnected := onConnected()
+		assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+		connect(aAgent, bAgent)
+		<-aConnected
+		<-bConnected
+
+		// The selected pair was checked successfully
+		pair, err := aAgent.GetSelectedCandidatePair()
+		assert.NoError(t, err)
+		for c := range checks {
+			if c.result == CheckResultSuccess && c.local.Equal(pair.Local) && c.remote.Equal(pair.Remote) {
+				assert.True(t, c.rtt > 0)
+				break
+			}
+		}
+
+		assert.NoError(t, aAgent.Close())
+		assert.NoError(t, bAgent.Close())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		maxBindingRequests := uint16(1)
+		a, err := NewAgent(&AgentConfig{MaxBindingRequests: &maxBindingRequests})
+		assert.NoError(t, err)
+		checks := onCheck(a)
+		a.startOnConnectionStateChangeRoutine()
+
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		local.conn = &mockPacketConn{}
+
+		remote, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.3",
+			Port:      888,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, a.run(func(a *Agent) {
+			a.startSelector()
+			p := a.addPair(local, remote)
+			a.pingAllCandidates()
+			p.nextBindingRequest = time.Now()
+			a.pingAllCandidates()
+		}, nil))
+		assert.Equal(t, check{local, remote, CheckResultTimeout, 0}, <-checks)
+
+		assert.NoError(t, a.Close())
+	})
+}
+
+func TestControlledNominationOrder(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	newLocal := func(t *testing.T, address string, priority uint32) *CandidateHost {
+		c, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   address,
+			Port:      777,
+			Component: 1,
+			Priority:  priority,
+		})
+		assert.NoError(t, err)
+		c.conn = &recordingPacketConn{sent: make(chan []byte, 10)}
+		return c
+	}
+
+	// The events that decide the selected pair of the controlled agent, the
+	// checks of the network and the nominations of the remote can interleave
+	// in any order
+	const (
+		nominateLow = iota
+		nominateHigh
+		validateHigh
+	)
+	orders := [][]int{
+		{nominateLow, nominateHigh, validateHigh},
+		{nominateLow, validateHigh, nominateHigh},
+		{nominateHigh, nominateLow, validateHigh},
+		{nominateHigh, validateHigh, nominateLow},
+		{validateHigh, nominateLow, nominateHigh},
+		{validateHigh, nominateHigh, nominateLow},
+	}
+
+	for _, order := range orders {
+		a, err := NewAgent(&AgentConfig{})
+		assert.NoError(t, err)
+		a.startOnConnectionStateChangeRoutine()
+
+		assert.NoError(t, a.run(func(a *Agent) {
+			a.startSelector()
+			s := a.getControlledSelector()
+			assert.NotNil(t, s)
+
+			remoteAddr := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+			remote, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   remoteAddr.IP.String(),
+				Port:      remoteAddr.Port,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+			a.addRemoteCandidate(remote)
+
+			low, high := newLocal(t, "192.168.0.2", 100), newLocal(t, "192.168.0.3", 200)
+			lowPair, highPair := a.addPair(low, remote), a.addPair(high, remote)
+			lowPair.state = CandidatePairStateSucceeded
+
+			// The check of the high priority pair that succeeds with validateHigh
+			s.PingCandidate(high, remote)
+			check := &stun.Message{Raw: <-high.conn.(*recordingPacketConn).sent}
+			assert.NoError(t, check.Decode())
+
+			nominate := func(local Candidate) {
+				msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+					stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+					UseCandidate,
+					AttrControlling(1),
+					PriorityAttr(1),
+					stun.NewShortTermIntegrity(a.localPwd),
+					stun.Fingerprint,
+				)
+				assert.NoError(t, err)
+				s.HandleBindingRequest(msg, local, remote)
+			}
+
+			for _, event := range order {
+				switch event {
+				case nominateLow:
+					nominate(low)
+				case nominateHigh:
+					nominate(high)
+				case validateHigh:
+					msg, err := stun.Build(check, stun.BindingSuccess,
+						&stun.XORMappedAddress{IP: net.ParseIP("192.168.0.3"), Port: 777},
+						stun.NewShortTermIntegrity(a.remotePwd),
+						stun.Fingerprint,
+					)
+					assert.NoError(t, err)
+					s.HandleSuccessResponse(msg, high, remote, remoteAddr)
+				}
+			}
+
+			assert.Equal(t, highPair, a.getSelectedPair(), "order %v", order)
+			assert.True(t, lowPair.nominated)
+			assert.True(t, highPair.nominated)
+
+			// The low priority pair is still nominated, it is selected again
+			// once the high priority one is gone. Its recvLoop was never
+			// started, so there is no conn to close.
+			high.conn = nil
+			a.removeLocalCandidate(high)
+			assert.Equal(t, lowPair, a.getSelectedPair(), "order %v", order)
+		}, nil))
+
+		assert.NoError(t, a.Close())
+	}
+}
+
+func TestMaxConcurrentChecks(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	noInterval := time.Duration(0)
+	runAgentTest(t, &AgentConfig{CheckInterval: &noInterval, MaxConcurrentChecks: 2}, func(a *Agent) {
+		a.isControlling = true
+		a.startSelector()
+
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		local.conn = &mockPacketConn{}
+
+		var pairs []*candidatePair
+		for i := 0; i < 4; i++ {
+			remote, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   fmt.Sprintf("192.168.0.%d", 10+i),
+				Port:      1000,
+				Component: 1,
+				Priority:  uint32(400 - i*100),
+			})
+			assert.NoError(t, err)
+			pairs = append(pairs, a.addPair(local, remote))
+		}
+
+		states := func() (states []CandidatePairState) {
+			for _, p := range pairs {
+				states = append(states, p.state)
+			}
+			return states
+		}
+
+		// The highest priority pairs are checked first
+		a.pingAllCandidates()
+		assert.Equal(t, []CandidatePairState{
+			CandidatePairStateInProgress, CandidatePairStateInProgress, CandidatePairStateWaiting, CandidatePairStateWaiting,
+		}, states())
+		_, scheduled := a.nextRetransmission()
+		assert.True(t, scheduled)
+
+		// The next one starts once a check completes
+		pairs[1].state = CandidatePairStateSucceeded
+		a.pingAllCandidates()
+		assert.Equal(t, []CandidatePairState{
+			CandidatePairStateInProgress, CandidatePairStateSucceeded, CandidatePairStateInProgress, CandidatePairStateWaiting,
+		}, states())
+
+		pairs[0].bindingRequestCount = a.maxBindingRequests
+		pairs[0].nextBindingRequest = time.Now()
+		a.pingAllCandidates()
+		assert.Equal(t, []CandidatePairState{
+			CandidatePairStateFailed, CandidatePairStateSucceeded, CandidatePairStateInProgress, CandidatePairStateInProgress,
+		}, states())
+	})
+}
+
+func TestCancelChecks(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	newCandidate := func(t *testing.T, address string, port int) *CandidateHost {
+		c, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   address,
+			Port:      port,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		c.conn = &mockPacketConn{}
+		return c
+	}
+
+	t.Run("Regular nomination", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{}, func(a *Agent) {
+			a.isControlling = true
+			a.startSelector()
+			a.startOnConnectionStateChangeRoutine()
+
+			selectedLocal := newCandidate(t, "192.168.0.2", 777)
+			otherLocal := newCandidate(t, "192.168.0.5", 777)
+			selected := a.addPair(selectedLocal, newCandidate(t, "192.168.0.3", 1000))
+			inProgress := a.addPair(otherLocal, newCandidate(t, "192.168.0.4", 1000))
+			waiting := a.addPair(otherLocal, newCandidate(t, "192.168.0.6", 1000))
+			valid := a.addPair(otherLocal, newCandidate(t, "192.168.0.7", 1000))
+
+			inProgress.state = CandidatePairStateInProgress
+			inProgress.bindingRequestCount = 1
+			inProgress.nextBindingRequest = time.Now()
+			valid.state = CandidatePairStateSucceeded
+			selected.state = CandidatePairStateSucceeded
+			a.setSelectedPair(selected)
+
+			// The valid pairs can still be renominated
+			assert.Equal(t, CandidatePairStateSucceeded, selected.state)
+			assert.Equal(t, CandidatePairStateSucceeded, valid.state)
+			assert.Equal(t, CandidatePairStateCancelled, inProgress.state)
+			assert.Equal(t, CandidatePairStateCancelled, waiting.state)
+
+			// Neither retransmissions nor new checks are sent
+			a.nextCheck = time.Now()
+			a.pingAllCandidates()
+			assert.Equal(t, 0, len(a.pendingBindingRequests))
+
+			late := a.addPair(otherLocal, newCandidate(t, "192.168.0.8", 1000))
+			assert.Equal(t, CandidatePairStateCancelled, late.state)
+
+			// The checks start again without a selected pair
+			selectedLocal.conn = nil
+			a.removeLocalCandidate(selectedLocal)
+			assert.Equal(t, CandidatePairStateWaiting, inProgress.state)
+			assert.Equal(t, CandidatePairStateWaiting, waiting.state)
+			assert.Equal(t, CandidatePairStateWaiting, late.state)
+			assert.Equal(t, CandidatePairStateSucceeded, valid.state)
+
+			// The candidate was never started, it has no read loop to wait for
+			otherLocal.conn = nil
+		})
+	})
+
+	t.Run("Aggressive nomination", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AggressiveNomination: true}, func(a *Agent) {
+			a.isControlling = true
+			a.startSelector()
+			a.startOnConnectionStateChangeRoutine()
+
+			local := newCandidate(t, "192.168.0.2", 777)
+			remote := newCandidate(t, "192.168.0.3", 1000)
+			selected := a.addPair(local, remote)
+			waiting := a.addPair(local, newCandidate(t, "192.168.0.4", 1000))
+
+			selected.state = CandidatePairStateSucceeded
+			a.setSelectedPair(selected)
+			assert.Equal(t, CandidatePairStateWaiting, waiting.state)
+
+			// The checks stop once consent is granted on the selected pair
+			a.selector.PingCandidate(local, remote)
+			assert.Equal(t, 1, len(a.pendingBindingRequests))
+			resp, err := stun.Build(stun.NewTransactionIDSetter(a.pendingBindingRequests[0].transactionID), stun.BindingSuccess)
+			assert.NoError(t, err)
+			a.selector.HandleSuccessResponse(resp, local, remote, remote.addr())
+			assert.Equal(t, CandidatePairStateCancelled, waiting.state)
+
+			local.conn = nil
+		})
+	})
+
+	t.Run("Triggered checks", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{}, func(a *Agent) {
+			a.startSelector()
+			a.startOnConnectionStateChangeRoutine()
+
+			sent := make(chan []byte, 10)
+			local := newCandidate(t, "192.168.0.2", 777)
+			local.conn = &recordingPacketConn{sent: sent}
+			selected := a.addPair(local, newCandidate(t, "192.168.0.3", 1000))
+			remote := newCandidate(t, "192.168.0.4", 1000)
+			cancelled := a.addPair(local, remote)
+
+			selected.state = CandidatePairStateSucceeded
+			a.setSelectedPair(selected)
+			assert.Equal(t, CandidatePairStateCancelled, cancelled.state)
+
+			// The check of the remote is answered, without a check in return
+			msg, err := stun.Build(stun.BindingRequest, stun.TransactionID, stun.NewUsername(a.localUfrag+":"+a.remoteUfrag))
+			assert.NoError(t, err)
+			a.selector.HandleBindingRequest(msg, local, remote)
+			assert.Equal(t, 1, len(sent))
+			resp := &stun.Message{Raw: <-sent}
+			assert.NoError(t, resp.Decode())
+			assert.Equal(t, stun.BindingSuccess, resp.Type)
+			assert.Equal(t, 0, len(a.pendingBindingRequests))
+
+			local.conn = nil
+		})
+	})
+}
+
+func TestReceivingCandidatePair(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	logger := &recordingLogger{}
+	a, err := NewAgent(&AgentConfig{
+		LoggerFactory:            &recordingLoggerFactory{logger: logger},
+		asymmetricRoutingTimeout: 50 * time.Millisecond,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	pair, err := a.GetReceivingCandidatePair()
+	assert.NoError(t, err)
+	assert.Nil(t, pair)
+
+	local, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.0.2",
+		Port:      777,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+	local.conn = &mockPacketConn{}
+
+	newRemote := func(port int) *CandidateHost {
+		remote, remoteErr := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.3",
+			Port:      port,
+			Component: 1,
+		})
+		assert.NoError(t, remoteErr)
+		return remote
+	}
+	sending, hairpin := newRemote(888), newRemote(999)
+
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.addRemoteCandidate(sending)
+		a.addRemoteCandidate(hairpin)
+		p := a.addPair(local, sending)
+		p.state = CandidatePairStateSucceeded
+		a.setSelectedPair(p)
+		a.addPair(local, hairpin)
+	}, nil))
+
+	// The data of the remote arrives on the selected pair
+	_, _, ok := a.validateNonSTUNTraffic(local, sending.addr(), 10)
+	assert.True(t, ok)
+	pair, err = a.GetReceivingCandidatePair()
+	assert.NoError(t, err)
+	assert.Equal(t, &CandidatePair{Local: local, Remote: sending}, pair)
+
+	// It arrives on another pair, which is warned about once it lasts
+	_, _, ok = a.validateNonSTUNTraffic(local, hairpin.addr(), 10)
+	assert.True(t, ok)
+	pair, err = a.GetReceivingCandidatePair()
+	assert.NoError(t, err)
+	assert.Equal(t, &CandidatePair{Local: local, Remote: hairpin}, pair)
+
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.checkAsymmetricRouting()
+	}, nil))
+	assert.False(t, logger.contains("Asymmetric routing"))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.checkAsymmetricRouting()
+	}, nil))
+	assert.True(t, logger.contains("warn: Asymmetric routing of component 1"))
+
+	assert.NoError(t, a.Close())
+}
+
+func TestNetworkTypes(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	t.Run("Default", func(t *testing.T) {
+		a, err := NewAgent(&AgentConfig{})
+		assert.NoError(t, err)
+		assert.Equal(t, []NetworkType{NetworkTypeUDP4, NetworkTypeUDP6}, a.networkTypes)
+		assert.NoError(t, a.Close())
+	})
+
+	t.Run("Remote candidates of disabled types are ignored", func(t *testing.T) {
+		a, err := NewAgent(&AgentConfig{
+			NetworkTypes: []NetworkType{NetworkTypeUDP4},
+
+			AllowPrivateRemoteCandidates: true,
+		})
+		assert.NoError(t, err)
+
+		for _, config := range []*CandidateHostConfig{
+			{Network: udp, Address: "192.168.0.2", Port: 1000, Component: 1},
+			{Network: udp, Address: "fe80::2", Port: 1000, Component: 1},
+			{Network: tcp, Address: "192.168.0.2", Port: 1000, Component: 1, TCPType: TCPTypePassive},
+		} {
+			c, err := NewCandidateHost(config)
+			assert.NoError(t, err)
+			assert.NoError(t, a.run(func(agent *Agent) {
+				agent.addRemoteCandidate(c)
+			}, nil))
+		}
+
+		remote, err := a.GetRemoteCandidates()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(remote))
+		assert.Equal(t, NetworkTypeUDP4, remote[0].NetworkType())
+
+		assert.NoError(t, a.Close())
+	})
+}
+
+func TestAgentConfigRand(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	newAgent := func(seed int64) *Agent {
+		a, err := NewAgent(&AgentConfig{
+			Rand:             mrand.New(mrand.NewSource(seed)), // nolint:gosec
+			MulticastDNSMode: MulticastDNSModeDisabled,
+		})
+		assert.NoError(t, err)
+		return a
+	}
+	transactionID := func(a *Agent) [stun.TransactionIDSize]byte {
+		msg, err := stun.Build(stun.BindingRequest, a.transactionID())
+		assert.NoError(t, err)
+		return msg.TransactionID
+	}
+
+	// The same seed gives the same credentials, tie-breaker, transactions and
+	// consent check jitter
+	a, b, c := newAgent(1), newAgent(1), newAgent(2)
+	aUfrag, aPwd, err := a.GetLocalUserCredentials()
+	assert.NoError(t, err)
+	bUfrag, bPwd, err := b.GetLocalUserCredentials()
+	assert.NoError(t, err)
+	cUfrag, cPwd, err := c.GetLocalUserCredentials()
+	assert.NoError(t, err)
+
+	assert.Equal(t, aUfrag, bUfrag)
+	assert.Equal(t, aPwd, bPwd)
+	assert.Equal(t, a.tieBreaker, b.tieBreaker)
+	assert.Equal(t, a.mDNSName, b.mDNSName)
+	assert.Equal(t, transactionID(a), transactionID(b))
+	assert.Equal(t, a.mathRand.Uint64(), b.mathRand.Uint64())
+
+	assert.NotEqual(t, aUfrag, cUfrag)
+	assert.NotEqual(t, aPwd, cPwd)
+	assert.NotEqual(t, a.tieBreaker, c.tieBreaker)
+	assert.NotEqual(t, transactionID(a), transactionID(c))
+
+	for _, agent := range []*Agent{a, b, c} {
+		assert.NoError(t, agent.Close())
+	}
+}
+
+func TestPreferLowLatency(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	newCandidate := func(t *testing.T, address string) *CandidateHost {
+		c, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   address,
+			Port:      777,
+			Component: 1,
+			Priority:  100,
+		})
+		assert.NoError(t, err)
+		return c
+	}
+
+	for _, tc := range []struct {
+		name             string
+		preferLowLatency bool
+		expectedRemote   string
+	}{
+		{"Disabled", false, "192.168.0.3"},
+		{"Enabled", true, "192.168.0.4"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			runAgentTest(t, &AgentConfig{PreferLowLatency: tc.preferLowLatency}, func(a *Agent) {
+				local := newCandidate(t, "192.168.0.2")
+				slow := a.addPair(local, newCandidate(t, "192.168.0.3"))
+				fast := a.addPair(local, newCandidate(t, "192.168.0.4"))
+				unmeasured := a.addPair(local, newCandidate(t, "192.168.0.5"))
+				assert.Equal(t, slow.Priority(), fast.Priority())
+
+				for _, p := range []*candidatePair{slow, fast, unmeasured} {
+					p.state = CandidatePairStateSucceeded
+				}
+				slow.responseReceived(80 * time.Millisecond)
+				fast.responseReceived(20 * time.Millisecond)
+
+				assert.Equal(t, tc.expectedRemote, a.getBestValidCandidatePair(1).remote.Address())
+			})
+		})
+	}
+}
+
+// closingPacketConn is a mockPacketConn whose reads block until it is closed,
+// it fails to close with err
+type closingPacketConn struct {
+	mockPacketConn
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newClosingPacketConn(err error) *closingPacketConn {
+	return &closingPacketConn{err: err, closed: make(chan struct{})}
+}
+
+func (c *closingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	<-c.closed
+	return 0, nil, io.EOF
+}
+
+func (c *closingPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.err
+}
+
+func TestCloseJoinsErrors(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	a, err := NewAgent(&AgentConfig{})
+	assert.NoError(t, err)
+
+	errA, errB := errors.New("failed to close a"), errors.New("failed to close b")
+	var conns []*closingPacketConn
+	for i, closeErr := range []error{errA, nil, errB} {
+		c, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777 + i,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		conn := newClosingPacketConn(closeErr)
+		conns = append(conns, conn)
+		assert.NoError(t, a.run(func(agent *Agent) {
+			c.start(agent, conn, agent.startedCh)
+			agent.localCandidates[c.NetworkType()] = append(agent.localCandidates[c.NetworkType()], c)
+		}, nil))
+	}
+
+	// Every socket is closed, and both failures are returned
+	err = a.Close()
+	assert.True(t, errors.Is(err, errA), err)
+	assert.True(t, errors.Is(err, errB), err)
+	assert.False(t, errors.Is(err, ErrClosed), err)
+	assert.Contains(t, err.Error(), errA.Error())
+	assert.Contains(t, err.Error(), errB.Error())
+	for _, conn := range conns {
+		select {
+		case <-conn.closed:
+		default:
+			assert.Fail(t, "a socket was left open")
+		}
+	}
+
+	assert.NoError(t, a.Close())
+}
@@ -2,17 +2,20 @@ package ice
 
 import (
 	"net"
+	"os"
+	"syscall"
 	"time"
 )
 
 const (
 	receiveMTU             = 8192
 	defaultLocalPreference = 65535
+	tcpOtherPreference     = 8191
 
 	// ComponentRTP indicates that the candidate is used for RTP
 	ComponentRTP uint16 = 1
 	// ComponentRTCP indicates that the candidate is used for RTCP
-	ComponentRTCP
+	ComponentRTCP uint16 = 2
 )
 
 // Candidate represents an ICE candidate
@@ -20,6 +23,7 @@ type Candidate interface {
 	ID() string
 	Component() uint16
 	Address() string
+	Foundation() string
 	LastReceived() time.Time
 	LastSent() time.Time
 	NetworkType() NetworkType
@@ -27,16 +31,30 @@ type Candidate interface {
 	Priority() uint32
 	RelatedAddress() *CandidateRelatedAddress
 	String() string
+	TCPType() TCPType
 	Type() CandidateType
 
 	Equal(other Candidate) bool
 
+	// Marshal returns the candidate as the value of an SDP a=candidate attribute,
+	// without the "candidate:" prefix
+	Marshal() string
+
 	addr() *net.UDPAddr
 	agent() *Agent
 	getCloseCh() chan struct{}
 
 	close() error
+	file() (*os.File, error)
 	seen(outbound bool)
+	setDSCP(dscp int) error
+	setLastReceived(t time.Time)
+	setPriority(priority uint32)
+	syscallConn() (syscall.RawConn, error)
 	start(a *Agent, conn net.PacketConn, initializedCh <-chan struct{})
+	tryWriteTo(raw []byte, dst Candidate) (int, error)
+	waitWritable() error
 	writeTo(raw []byte, dst Candidate) (int, error)
+	writeBatch(raws [][]byte, dst Candidate, batch bool) (int, error)
+	writeToAddr(raw []byte, dst net.Addr) (int, error)
 }
@@ -1,19 +1,28 @@
 package ice
 
 import (
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pion/logging"
 	"github.com/pion/stun"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type candidateBase struct {
 	id            string
 	networkType   NetworkType
 	candidateType CandidateType
+	tcpType       TCPType
 
 	component      uint16
 	address        string
@@ -22,6 +31,15 @@ type candidateBase struct {
 
 	resolvedAddr *net.UDPAddr
 
+	// foundationOverride and priorityOverride are the values signaled for
+	// a remote candidate, they replace the computed ones when set
+	foundationOverride string
+	priorityOverride   uint32
+
+	// server is the URL of the STUN or TURN server a server reflexive or relay
+	// candidate was gathered from, it is part of the foundation
+	server string
+
 	lastSent     atomic.Value
 	lastReceived atomic.Value
 	conn         net.PacketConn
@@ -51,6 +69,11 @@ func (c *candidateBase) Type() CandidateType {
 	return c.candidateType
 }
 
+// TCPType returns the type of TCP candidate, TCPTypeUnspecified for UDP candidates
+func (c *candidateBase) TCPType() TCPType {
+	return c.tcpType
+}
+
 // NetworkType returns candidate NetworkType
 func (c *candidateBase) NetworkType() NetworkType {
 	return c.networkType
@@ -61,8 +84,44 @@ func (c *candidateBase) Component() uint16 {
 	return c.component
 }
 
+// Foundation returns the foundation of the candidate, candidates of the same
+// type, base IP, transport and STUN or TURN server share their foundation
+// https://tools.ietf.org/html/rfc8445#section-5.1.1.3
+func (c *candidateBase) Foundation() string {
+	if c.foundationOverride != "" {
+		return c.foundationOverride
+	}
+
+	// The base of server reflexive and relay candidates is their related address
+	base := c.address
+	if c.relatedAddress != nil && (c.candidateType == CandidateTypeServerReflexive || c.candidateType == CandidateTypeRelay) {
+		base = c.relatedAddress.Address
+	}
+
+	return fmt.Sprintf("%d", crc32.ChecksumIEEE([]byte(c.Type().String()+base+c.networkType.String()+c.server)))
+}
+
 // LocalPreference returns the local preference for this candidate
 func (c *candidateBase) LocalPreference() uint16 {
+	if c.NetworkType().IsReliable() {
+		// RFC 6544, section 4.2
+		//
+		// local preference = (2^13) * direction-pref + other-pref
+		//
+		// The direction-pref MUST be between 0 and 7 (both inclusive), with 7
+		// being the most preferred.  The other-pref MUST be between 0 and 8191
+		// (both inclusive), with 8191 being the most preferred.
+		return (1<<13)*c.tcpType.directionPreference() + tcpOtherPreference
+	}
+
+	// Local candidates use the preference of their IP family configured on the Agent
+	if a := c.agent(); a != nil {
+		if c.NetworkType().IsIPv6() {
+			return a.ipv6LocalPreference
+		}
+		return a.ipv4LocalPreference
+	}
+
 	return defaultLocalPreference
 }
 
@@ -93,12 +152,16 @@ func (c *candidateBase) recvLoop(initializedCh <-chan struct{}) {
 	}
 
 	log := c.agent().log
+	trace := c.agent().packetTrace
 	buffer := make([]byte, receiveMTU)
 	for {
 		n, srcAddr, err := c.conn.ReadFrom(buffer)
 		if err != nil {
 			return
 		}
+		if trace != nil {
+			trace(DirectionInbound, buffer[:n], c.conn.LocalAddr(), srcAddr)
+		}
 
 		handleInboundCandidateMsg(c, buffer[:n], srcAddr, log)
 	}
@@ -125,14 +188,16 @@ func handleInboundCandidateMsg(c Candidate, buffer []byte, srcAddr net.Addr, log
 		return
 	}
 
-	if !c.agent().validateNonSTUNTraffic(c, srcAddr) {
-		log.Warnf("Discarded message from %s, not a valid remote candidate", c.addr())
+	local, remote, ok := c.agent().validateNonSTUNTraffic(c, srcAddr, len(buffer))
+	if !ok {
+		log.Warnf("Discarded message from %s to %s, not a valid remote candidate", srcAddr, c.addr())
 		return
 	}
 
-	// NOTE This will return packetio.ErrFull if the buffer ever manages to fill up.
-	if _, err := c.agent().buffer.Write(buffer); err != nil {
-		log.Warnf("failed to write packet")
+	// NOTE This will return packetio.ErrFull when the packetBuffer is full and
+	// its BufferOverflowPolicy drops the packet, or io.ErrClosedPipe once closed.
+	if err := writeInboundPacket(c.agent().getBuffer(c.Component()), buffer, local, remote); err != nil {
+		log.Warnf("failed to write packet: %v", err)
 	}
 }
 
@@ -154,17 +219,169 @@ func (c *candidateBase) close() error {
 	return nil
 }
 
+// setDSCP marks the packets sent on the socket of the candidate with dscp
+func (c *candidateBase) setDSCP(dscp int) error {
+	if _, ok := c.conn.(syscall.Conn); !ok || c.NetworkType().IsReliable() {
+		return ErrDSCPNotSupported
+	}
+
+	// DSCP is the upper 6 bits of the TOS / Traffic Class byte
+	if c.NetworkType().IsIPv6() {
+		return ipv6.NewPacketConn(c.conn).SetTrafficClass(dscp << 2)
+	}
+	return ipv4.NewPacketConn(c.conn).SetTOS(dscp << 2)
+}
+
+// syscallConn returns the raw conn of the socket of the candidate
+func (c *candidateBase) syscallConn() (syscall.RawConn, error) {
+	conn, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrSyscallConnNotSupported
+	}
+	return conn.SyscallConn()
+}
+
+// file returns a duplicate of the UDP socket of the candidate
+func (c *candidateBase) file() (*os.File, error) {
+	if c.candidateType == CandidateTypeRelay || c.networkType.IsReliable() {
+		return nil, ErrFileNotSupported
+	}
+
+	conn, ok := c.conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, ErrFileNotSupported
+	}
+	return conn.File()
+}
+
 func (c *candidateBase) writeTo(raw []byte, dst Candidate) (int, error) {
-	n, err := c.conn.WriteTo(raw, dst.addr())
-	if err != nil {
-		return n, fmt.Errorf("failed to send packet: %v", err)
+	return c.writeToAddr(raw, c.dstAddr(dst))
+}
+
+// dstAddr returns the address the packets to dst are sent to
+func (c *candidateBase) dstAddr(dst Candidate) *net.UDPAddr {
+	addr := dst.addr()
+
+	// The zone of a remote IPv6 link-local candidate is an interface of the
+	// remote, the packet is sent on the interface of the local candidate
+	if local := c.addr(); local != nil && local.Zone != "" && addr != nil && addr.IP.IsLinkLocalUnicast() && addr.Zone != local.Zone {
+		addr = &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: local.Zone}
+	}
+	return addr
+}
+
+// writeBatch sends raws to dst and returns the number of packets sent. They are
+// sent with as few sendmmsg calls as possible when batch is set and the
+// candidate has its own UDP socket, and with a call per packet otherwise.
+func (c *candidateBase) writeBatch(raws [][]byte, dst Candidate, batch bool) (int, error) {
+	udpConn, ok := c.conn.(*net.UDPConn)
+	if !batch || !ok || c.networkConditioner() != nil {
+		for i, raw := range raws {
+			if _, err := c.writeTo(raw, dst); err != nil {
+				return i, err
+			}
+		}
+		return len(raws), nil
+	}
+
+	addr := c.dstAddr(dst)
+	msgs := make([]ipv4.Message, len(raws))
+	for i := range raws {
+		msgs[i].Buffers = [][]byte{raws[i]}
+		msgs[i].Addr = addr
+	}
+
+	// ipv4.Message and ipv6.Message are the same type
+	var pc interface {
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+	if c.NetworkType().IsIPv6() {
+		pc = ipv6.NewPacketConn(udpConn)
+	} else {
+		pc = ipv4.NewPacketConn(udpConn)
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		n, err := pc.WriteBatch(msgs[sent:], 0)
+		if err != nil {
+			return sent, fmt.Errorf("failed to send packets: %w", err)
+		}
+		if a := c.agent(); a != nil && a.packetTrace != nil {
+			for _, msg := range msgs[sent : sent+n] {
+				a.packetTrace(DirectionOutbound, msg.Buffers[0][:msg.N], c.conn.LocalAddr(), addr)
+			}
+		}
+		sent += n
 	}
 	c.seen(true)
+	return sent, nil
+}
+
+// writeToAddr sends raw to an arbitrary address, used when answering
+// traffic from a source that is not (yet) a known remote candidate
+func (c *candidateBase) writeToAddr(raw []byte, dst net.Addr) (int, error) {
+	if conditioner := c.networkConditioner(); conditioner != nil {
+		c.packetSent(raw, len(raw), dst)
+		conditioner.send(raw, func(packet []byte) {
+			_, _ = c.conn.WriteTo(packet, dst)
+		})
+		return len(raw), nil
+	}
+
+	n, err := c.conn.WriteTo(raw, dst)
+	if err != nil {
+		return n, fmt.Errorf("failed to send packet: %w", err)
+	}
+	c.packetSent(raw, n, dst)
 	return n, nil
 }
 
+// tryWriteTo sends raw to dst without blocking, ErrWouldBlock is returned if
+// the send buffer of the UDP socket of the candidate is full. The candidates
+// without a UDP socket of their own write like writeTo.
+func (c *candidateBase) tryWriteTo(raw []byte, dst Candidate) (int, error) {
+	udpConn, ok := c.conn.(*net.UDPConn)
+	if !ok || c.networkConditioner() != nil {
+		return c.writeTo(raw, dst)
+	}
+
+	addr := c.dstAddr(dst)
+	n, err := trySendTo(udpConn, raw, addr)
+	if errors.Is(err, ErrWouldBlock) {
+		return 0, err
+	} else if err != nil {
+		return n, fmt.Errorf("failed to send packet: %w", err)
+	}
+	c.packetSent(raw, n, addr)
+	return n, nil
+}
+
+// waitWritable blocks until tryWriteTo can send on the socket of the
+// candidate, or the socket is closed
+func (c *candidateBase) waitWritable() error {
+	udpConn, ok := c.conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	return waitWritable(udpConn)
+}
+
+// packetSent traces the n bytes of raw sent to dst and records the time they
+// were sent
+func (c *candidateBase) packetSent(raw []byte, n int, dst net.Addr) {
+	if a := c.agent(); a != nil && a.packetTrace != nil {
+		a.packetTrace(DirectionOutbound, raw[:n], c.conn.LocalAddr(), dst)
+	}
+	c.seen(true)
+}
+
 // Priority computes the priority for this ICE Candidate
 func (c *candidateBase) Priority() uint32 {
+	if c.priorityOverride != 0 {
+		return c.priorityOverride
+	}
+
 	// The local preference MUST be an integer from 0 (lowest preference) to
 	// 65535 (highest preference) inclusive.  When there is only a single IP
 	// address, this value SHOULD be set to 65535.  If there are multiple
@@ -176,12 +393,19 @@ func (c *candidateBase) Priority() uint32 {
 		uint32(256-c.Component())
 }
 
+// setPriority replaces the computed priority, it must be called before
+// the candidate is used by the Agent
+func (c *candidateBase) setPriority(priority uint32) {
+	c.priorityOverride = priority
+}
+
 // Equal is used to compare two candidateBases
 func (c *candidateBase) Equal(other Candidate) bool {
 	return c.NetworkType() == other.NetworkType() &&
 		c.Type() == other.Type() &&
 		c.Address() == other.Address() &&
 		c.Port() == other.Port() &&
+		c.TCPType() == other.TCPType() &&
 		c.RelatedAddress().Equal(other.RelatedAddress())
 }
 
@@ -220,9 +444,9 @@ func (c *candidateBase) setLastSent(t time.Time) {
 
 func (c *candidateBase) seen(outbound bool) {
 	if outbound {
-		c.setLastSent(time.Now())
+		c.setLastSent(clockOf(c).Now())
 	} else {
-		c.setLastReceived(time.Now())
+		c.setLastReceived(clockOf(c).Now())
 	}
 }
 
@@ -237,3 +461,144 @@ func (c *candidateBase) agent() *Agent {
 func (c *candidateBase) getCloseCh() chan struct{} {
 	return c.closeCh
 }
+
+// Marshal returns the candidate as the value of an SDP a=candidate attribute
+// https://tools.ietf.org/html/rfc5245#section-15.1
+func (c *candidateBase) Marshal() string {
+	val := fmt.Sprintf("%s %d %s %d %s %d typ %s",
+		c.Foundation(),
+		c.Component(),
+		c.NetworkType().NetworkShort(),
+		c.Priority(),
+		c.Address(),
+		c.Port(),
+		c.Type())
+
+	if r := c.RelatedAddress(); r != nil && r.Address != "" {
+		val += fmt.Sprintf(" raddr %s rport %d", r.Address, r.Port)
+	}
+
+	if c.TCPType() != TCPTypeUnspecified {
+		val += fmt.Sprintf(" tcptype %s", c.TCPType())
+	}
+
+	return val
+}
+
+// UnmarshalCandidate creates a Candidate from the value of an SDP a=candidate
+// attribute, with or without the "a=" and "candidate:" prefixes. Extension
+// attributes other than raddr, rport and tcptype are ignored.
+func UnmarshalCandidate(raw string) (Candidate, error) {
+	raw = strings.TrimPrefix(strings.TrimSpace(raw), "a=")
+	raw = strings.TrimPrefix(raw, "candidate:")
+
+	fields := strings.Fields(raw)
+	// foundation component transport priority address port "typ" type
+	if len(fields) < 8 {
+		return nil, fmt.Errorf("%w: %q", ErrCandidateTooShort, raw)
+	}
+
+	foundation := fields[0]
+
+	component, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil || component == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrParseComponent, fields[1])
+	}
+
+	network := strings.ToLower(fields[2])
+	if network != udp && network != tcp {
+		return nil, fmt.Errorf("%w: %q", ErrProtoType, fields[2])
+	}
+
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrParsePriority, fields[3])
+	}
+
+	address := fields[4]
+
+	port, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrParsePort, fields[5])
+	}
+
+	if fields[6] != "typ" {
+		return nil, fmt.Errorf("%w: expected typ, got %q", ErrUnknownCandidateType, fields[6])
+	}
+	typ := fields[7]
+
+	relAddr, relPort := "", 0
+	tcpType := TCPTypeUnspecified
+	for i := 8; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("%w: %q has no value", ErrCandidateTooShort, fields[i])
+		}
+
+		key, value := fields[i], fields[i+1]
+		switch key {
+		case "raddr":
+			relAddr = value
+		case "rport":
+			rport, parseErr := strconv.ParseUint(value, 10, 16)
+			if parseErr != nil {
+				return nil, fmt.Errorf("%w: %q", ErrParseRelatedAddr, value)
+			}
+			relPort = int(rport)
+		case "tcptype":
+			if tcpType = NewTCPType(value); tcpType == TCPTypeUnspecified {
+				return nil, fmt.Errorf("%w: %q", ErrParseTCPType, value)
+			}
+		}
+	}
+
+	switch typ {
+	case "host":
+		return NewCandidateHost(&CandidateHostConfig{
+			Network:    network,
+			Address:    address,
+			Port:       int(port),
+			Component:  uint16(component),
+			TCPType:    tcpType,
+			Foundation: foundation,
+			Priority:   uint32(priority),
+		})
+	case "srflx":
+		return NewCandidateServerReflexive(&CandidateServerReflexiveConfig{
+			Network:    network,
+			Address:    address,
+			Port:       int(port),
+			Component:  uint16(component),
+			RelAddr:    relAddr,
+			RelPort:    relPort,
+			TCPType:    tcpType,
+			Foundation: foundation,
+			Priority:   uint32(priority),
+		})
+	case "prflx":
+		return NewCandidatePeerReflexive(&CandidatePeerReflexiveConfig{
+			Network:    network,
+			Address:    address,
+			Port:       int(port),
+			Component:  uint16(component),
+			RelAddr:    relAddr,
+			RelPort:    relPort,
+			TCPType:    tcpType,
+			Foundation: foundation,
+			Priority:   uint32(priority),
+		})
+	case "relay":
+		return NewCandidateRelay(&CandidateRelayConfig{
+			Network:    network,
+			Address:    address,
+			Port:       int(port),
+			Component:  uint16(component),
+			RelAddr:    relAddr,
+			RelPort:    relPort,
+			TCPType:    tcpType,
+			Foundation: foundation,
+			Priority:   uint32(priority),
+		})
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCandidateType, typ)
+	}
+}
@@ -0,0 +1,57 @@
+package ice
+
+import "net"
+
+// rfc1918IPNets are the private IPv4 ranges of RFC 1918
+var rfc1918IPNets = []*net.IPNet{
+	{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+	{IP: net.IP{172, 16, 0, 0}, Mask: net.CIDRMask(12, 32)},
+	{IP: net.IP{192, 168, 0, 0}, Mask: net.CIDRMask(16, 32)},
+}
+
+// privateIPNets are the RFC 1918 and RFC 4193 private ranges, and the
+// shared address space of RFC 6598 used by carrier-grade NATs
+var privateIPNets = append([]*net.IPNet{
+	{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}, rfc1918IPNets...)
+
+// PublicRemoteCandidateFilter is a RemoteCandidateFilter rejecting the
+// candidates whose address is private, link-local, loopback or unspecified,
+// e.g. to keep a peer from directing the connectivity checks of a server at
+// its internal network. A filter allowing some of them can fall back to it,
+// with AllowPrivateRemoteCandidates set:
+//
+//	func(c Candidate) bool {
+//		return c.Address() == "10.1.2.3" || ice.PublicRemoteCandidateFilter(c)
+//	}
+func PublicRemoteCandidateFilter(c Candidate) bool {
+	addr := c.addr()
+	if addr == nil {
+		return false
+	}
+	return isPublicIP(addr.IP)
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	return !containsIP(privateIPNets, ip)
+}
+
+// isPrivateOrLoopbackIP returns true if ip is in the ranges of RFC 1918, or
+// a loopback address, the remote candidates Agents drop by default
+func isPrivateOrLoopbackIP(ip net.IP) bool {
+	return ip.IsLoopback() || containsIP(rfc1918IPNets, ip)
+}
+
+func containsIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
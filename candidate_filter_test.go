@@ -0,0 +1,136 @@
+// +build !js
+
+package ice
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicRemoteCandidateFilter(t *testing.T) {
+	for _, address := range []string{"10.1.2.3", "172.16.0.1", "172.31.255.255", "192.168.0.2", "100.64.0.1", "127.0.0.1", "169.254.1.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::", "::ffff:192.168.0.2"} {
+		c, err := NewCandidateHost(&CandidateHostConfig{Network: "udp", Address: address, Port: 1234, Component: 1})
+		assert.NoError(t, err)
+		assert.False(t, PublicRemoteCandidateFilter(c), address)
+	}
+
+	for _, address := range []string{"8.8.8.8", "172.32.0.1", "192.169.0.1", "100.128.0.1", "2001:4860:4860::8888"} {
+		c, err := NewCandidateHost(&CandidateHostConfig{Network: "udp", Address: address, Port: 1234, Component: 1})
+		assert.NoError(t, err)
+		assert.True(t, PublicRemoteCandidateFilter(c), address)
+	}
+}
+
+func TestRemoteCandidateFilter(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	newLocal := func(t *testing.T) (*CandidateHost, chan []byte) {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "203.0.113.1",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		sent := make(chan []byte, 10)
+		local.conn = &recordingPacketConn{sent: sent}
+		return local, sent
+	}
+
+	// The private ranges of RFC 1918 and loopback are only dropped by default,
+	// the other private ranges are left to RemoteCandidateFilter
+	dropped := []string{"10.1.2.3", "172.16.0.1", "192.168.0.3", "127.0.0.1", "::1"}
+	accepted := []string{"100.64.0.1", "fd00::1", "fe80::1", "198.51.100.1"}
+	for _, allow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("AllowPrivateRemoteCandidates=%t", allow), func(t *testing.T) {
+			runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: allow}, func(a *Agent) {
+				allowed := func(address string) bool {
+					remote, err := NewCandidateHost(&CandidateHostConfig{
+						Network:   "udp",
+						Address:   address,
+						Port:      999,
+						Component: 1,
+					})
+					assert.NoError(t, err)
+					return a.remoteCandidateAllowed(remote)
+				}
+
+				for _, address := range dropped {
+					assert.Equal(t, allow, allowed(address), address)
+				}
+				for _, address := range accepted {
+					assert.True(t, allowed(address), address)
+				}
+			})
+		})
+	}
+
+	t.Run("Remote candidates", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true, RemoteCandidateFilter: PublicRemoteCandidateFilter}, func(a *Agent) {
+			local, _ := newLocal(t)
+			a.localCandidates[local.NetworkType()] = []Candidate{local}
+
+			for _, address := range []string{"192.168.0.3", "198.51.100.1"} {
+				remote, err := NewCandidateHost(&CandidateHostConfig{
+					Network:   "udp",
+					Address:   address,
+					Port:      999,
+					Component: 1,
+				})
+				assert.NoError(t, err)
+				a.addRemoteCandidate(remote)
+			}
+
+			remotes := a.remoteCandidates[NetworkTypeUDP4]
+			assert.Equal(t, 1, len(remotes))
+			assert.Equal(t, "198.51.100.1", remotes[0].Address())
+			assert.Equal(t, 1, len(a.checklist))
+			assert.Equal(t, remotes[0], a.checklist[0].remote)
+
+			// The candidate was never started, it has no read loop to wait for
+			local.conn = nil
+		})
+	})
+
+	t.Run("Peer-reflexive candidates", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true, RemoteCandidateFilter: PublicRemoteCandidateFilter}, func(a *Agent) {
+			a.startSelector()
+			local, sent := newLocal(t)
+
+			check := func(remote net.Addr) {
+				msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+					stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+					AttrControlling(1),
+					PriorityAttr(1),
+					stun.NewShortTermIntegrity(a.localPwd),
+					stun.Fingerprint,
+				)
+				assert.NoError(t, err)
+				a.handleInbound(msg, local, remote)
+			}
+
+			check(&net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 999})
+			assert.Equal(t, 0, len(sent))
+			assert.Equal(t, 0, len(a.remoteCandidates[NetworkTypeUDP4]))
+
+			check(&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 999})
+			resp := &stun.Message{Raw: <-sent}
+			assert.NoError(t, resp.Decode())
+			assert.Equal(t, stun.BindingSuccess, resp.Type)
+			remotes := a.remoteCandidates[NetworkTypeUDP4]
+			assert.Equal(t, 1, len(remotes))
+			assert.Equal(t, CandidateTypePeerReflexive, remotes[0].Type())
+		})
+	})
+}
@@ -19,6 +19,9 @@ type CandidateHostConfig struct {
 	Address     string
 	Port        int
 	Component   uint16
+	TCPType     TCPType
+	Foundation  string
+	Priority    uint32
 }
 
 // NewCandidateHost creates a new host candidate
@@ -36,17 +39,21 @@ func NewCandidateHost(config *CandidateHostConfig) (*CandidateHost, error) {
 			candidateType: CandidateTypeHost,
 			component:     config.Component,
 			port:          config.Port,
+			tcpType:       config.TCPType,
+
+			foundationOverride: config.Foundation,
+			priorityOverride:   config.Priority,
 		},
 		network: config.Network,
 	}
 
 	if !strings.HasSuffix(config.Address, ".local") {
-		ip := net.ParseIP(config.Address)
-		if ip == nil {
-			return nil, ErrAddressParseFailed
+		ip, zone, err := parseIPZone(config.Address)
+		if err != nil {
+			return nil, err
 		}
 
-		if err := c.setIP(ip); err != nil {
+		if err := c.setIPZone(ip, zone); err != nil {
 			return nil, err
 		}
 	}
@@ -54,12 +61,18 @@ func NewCandidateHost(config *CandidateHostConfig) (*CandidateHost, error) {
 }
 
 func (c *CandidateHost) setIP(ip net.IP) error {
+	return c.setIPZone(ip, "")
+}
+
+// setIPZone sets the IP of the candidate, zone is the interface of an IPv6
+// link-local IP
+func (c *CandidateHost) setIPZone(ip net.IP, zone string) error {
 	networkType, err := determineNetworkType(c.network, ip)
 	if err != nil {
 		return err
 	}
 
 	c.candidateBase.networkType = networkType
-	c.candidateBase.resolvedAddr = &net.UDPAddr{IP: ip, Port: c.port}
+	c.candidateBase.resolvedAddr = &net.UDPAddr{IP: ip, Port: c.port, Zone: zone}
 	return nil
 }
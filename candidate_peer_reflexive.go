@@ -18,6 +18,9 @@ type CandidatePeerReflexiveConfig struct {
 	Component   uint16
 	RelAddr     string
 	RelPort     int
+	TCPType     TCPType
+	Foundation  string
+	Priority    uint32
 }
 
 // NewCandidatePeerReflexive creates a new peer reflective candidate
@@ -44,12 +47,16 @@ func NewCandidatePeerReflexive(config *CandidatePeerReflexiveConfig) (*Candidate
 			candidateType: CandidateTypePeerReflexive,
 			address:       config.Address,
 			port:          config.Port,
+			tcpType:       config.TCPType,
 			resolvedAddr:  &net.UDPAddr{IP: ip, Port: config.Port},
 			component:     config.Component,
 			relatedAddress: &CandidateRelatedAddress{
 				Address: config.RelAddr,
 				Port:    config.RelPort,
 			},
+
+			foundationOverride: config.Foundation,
+			priorityOverride:   config.Priority,
 		},
 	}, nil
 }
@@ -9,6 +9,10 @@ type CandidateRelay struct {
 	candidateBase
 
 	onClose func() error
+
+	// channels tracks the channels bound on the TURN server, it is nil for
+	// the relay candidates that were not gathered by the Agent
+	channels *turnChannelConn
 }
 
 // CandidateRelayConfig is the config required to create a new CandidateRelay
@@ -20,6 +24,9 @@ type CandidateRelayConfig struct {
 	Component   uint16
 	RelAddr     string
 	RelPort     int
+	TCPType     TCPType
+	Foundation  string
+	Priority    uint32
 	OnClose     func() error
 }
 
@@ -48,12 +55,16 @@ func NewCandidateRelay(config *CandidateRelayConfig) (*CandidateRelay, error) {
 			candidateType: CandidateTypeRelay,
 			address:       config.Address,
 			port:          config.Port,
+			tcpType:       config.TCPType,
 			resolvedAddr:  &net.UDPAddr{IP: ip, Port: config.Port},
 			component:     config.Component,
 			relatedAddress: &CandidateRelatedAddress{
 				Address: config.RelAddr,
 				Port:    config.RelPort,
 			},
+
+			foundationOverride: config.Foundation,
+			priorityOverride:   config.Priority,
 		},
 		onClose: config.OnClose,
 	}, nil
@@ -62,7 +73,7 @@ func NewCandidateRelay(config *CandidateRelayConfig) (*CandidateRelay, error) {
 func (c *CandidateRelay) close() error {
 	err := c.candidateBase.close()
 	if c.onClose != nil {
-		err = c.onClose()
+		err = joinErrors(err, c.onClose())
 		c.onClose = nil
 	}
 	return err
@@ -3,11 +3,17 @@
 package ice
 
 import (
+	"context"
+	"encoding/binary"
+	mrand "math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/transport/test"
 	"github.com/pion/turn/v2"
 	"github.com/stretchr/testify/assert"
@@ -54,6 +60,8 @@ func TestRelayOnlyConnection(t *testing.T) {
 			},
 		},
 		CandidateTypes: []CandidateType{CandidateTypeRelay},
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg)
@@ -84,3 +92,576 @@ func TestRelayOnlyConnection(t *testing.T) {
 	assert.NoError(t, bAgent.Close())
 	assert.NoError(t, server.Close())
 }
+
+// channelDataRecordingPacketConn signals every ChannelData message
+type channelDataRecordingPacketConn struct {
+	net.PacketConn
+	channelData chan struct{}
+}
+
+func (c *channelDataRecordingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	// The channel numbers are in the 0x4000 to 0x7FFF range
+	if err == nil && n >= 4 && p[0]&0xC0 == 0x40 {
+		select {
+		case c.channelData <- struct{}{}:
+		default:
+		}
+	}
+	return n, addr, err
+}
+
+func TestRelayChannelBinding(t *testing.T) {
+	// Limit runtime in case of deadlocks
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	serverPort := randomPort(t)
+	serverListener, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(serverPort))
+	assert.NoError(t, err)
+	recorder := &channelDataRecordingPacketConn{PacketConn: serverListener, channelData: make(chan struct{}, 1)}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            recorder,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	cfg := &AgentConfig{
+		NetworkTypes: supportedNetworkTypes,
+		Urls: []*URL{
+			{
+				Scheme:   SchemeTypeTURN,
+				Host:     "127.0.0.1",
+				Username: "username",
+				Password: "password",
+				Port:     serverPort,
+				Proto:    ProtoTypeUDP,
+			},
+		},
+		CandidateTypes: []CandidateType{CandidateTypeRelay},
+
+		AllowPrivateRemoteCandidates: true,
+	}
+
+	aAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+	aNotifier, aConnected := onConnected()
+	assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+
+	bAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+	bNotifier, bConnected := onConnected()
+	assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+	connect(aAgent, bAgent)
+	<-aConnected
+	<-bConnected
+
+	// The channel is bound after the first check sent to the peer
+	selectedBound := func() bool {
+		pair, err := aAgent.GetSelectedCandidatePair()
+		assert.NoError(t, err)
+		for _, stats := range aAgent.GetCandidatePairsStats() {
+			if stats.LocalCandidateID == pair.Local.ID() && stats.RemoteCandidateID == pair.Remote.ID() {
+				return stats.ChannelBound
+			}
+		}
+		return false
+	}
+	for !selectedBound() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-recorder.channelData
+
+	assert.NoError(t, aAgent.Close())
+	assert.NoError(t, bAgent.Close())
+	assert.NoError(t, server.Close())
+}
+
+// readingPacketConn is a mockPacketConn that reads the packets sent to read
+type readingPacketConn struct {
+	mockPacketConn
+	read chan []byte
+}
+
+func (r *readingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return copy(p, <-r.read), nil, nil
+}
+
+func TestTURNChannelConn(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	server := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3478}
+
+	bind := func(t *testing.T, conn *turnChannelConn, responseClass stun.MessageClass) {
+		request, err := stun.Build(stun.TransactionID, channelBindRequest, turnPeerAddress(*peer))
+		assert.NoError(t, err)
+		_, err = conn.WriteTo(request.Raw, server)
+		assert.NoError(t, err)
+
+		response, err := stun.Build(stun.NewTransactionIDSetter(request.TransactionID), stun.NewType(stun.MethodChannelBind, responseClass))
+		assert.NoError(t, err)
+		conn.PacketConn.(*readingPacketConn).read <- response.Raw
+		_, _, err = conn.ReadFrom(make([]byte, receiveMTU))
+		assert.NoError(t, err)
+	}
+
+	newConn := func() *turnChannelConn {
+		return newTURNChannelConn(&readingPacketConn{read: make(chan []byte, 1)}, logging.NewDefaultLoggerFactory().NewLogger("ice"))
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		conn := newConn()
+		assert.False(t, conn.isBound(peer))
+		bind(t, conn, stun.ClassSuccessResponse)
+		assert.True(t, conn.isBound(peer))
+		assert.False(t, conn.isBound(server))
+
+		conn.bound[peer.String()] = time.Now().Add(-turnChannelLifetime)
+		assert.False(t, conn.isBound(peer))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		conn := newConn()
+		bind(t, conn, stun.ClassSuccessResponse)
+		bind(t, conn, stun.ClassErrorResponse)
+		assert.False(t, conn.isBound(peer))
+	})
+}
+
+// turnDemuxPackets are well-formed packets of a TURN server to a client with
+// channel 0x4000 bound to peer
+func turnDemuxPackets(t *testing.T, peer *net.UDPAddr) [][]byte {
+	dataIndication, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication),
+		turnPeerAddress(*peer), stun.RawAttribute{Type: stun.AttrData, Value: []byte{1, 2, 3}})
+	assert.NoError(t, err)
+	response, err := stun.Build(stun.TransactionID, channelBindSuccess)
+	assert.NoError(t, err)
+
+	return [][]byte{
+		{0x40, 0x00, 0x00, 0x02, 1, 2, 0, 0},
+		dataIndication.Raw,
+		response.Raw,
+	}
+}
+
+func newBoundTURNChannelConn(t *testing.T, peer, server *net.UDPAddr) *turnChannelConn {
+	conn := newTURNChannelConn(&readingPacketConn{read: make(chan []byte, 16)}, logging.NewDefaultLoggerFactory().NewLogger("ice"))
+	request, err := stun.Build(stun.TransactionID, channelBindRequest, turnPeerAddress(*peer),
+		stun.RawAttribute{Type: stun.AttrChannelNumber, Value: []byte{0x40, 0x00, 0x00, 0x00}})
+	assert.NoError(t, err)
+	_, err = conn.WriteTo(request.Raw, server)
+	assert.NoError(t, err)
+	return conn
+}
+
+func TestTURNChannelConnMalformed(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	server := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3478}
+	conn := newBoundTURNChannelConn(t, peer, server)
+
+	bindingRequest, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	assert.NoError(t, err)
+	noData, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication), turnPeerAddress(*peer))
+	assert.NoError(t, err)
+	truncated := append([]byte{}, bindingRequest.Raw...)
+	binary.BigEndian.PutUint16(truncated[2:4], 8)
+
+	for _, p := range [][]byte{
+		{0x40},
+		{0xff, 0xff, 0x00, 0x00},
+		{0x40, 0x00, 0x00, 0x0a, 1, 2},
+		{0x40, 0x01, 0x00, 0x02, 1, 2},
+		bindingRequest.Raw,
+		noData.Raw,
+		truncated,
+	} {
+		assert.Error(t, conn.malformed(p), p)
+		conn.PacketConn.(*readingPacketConn).read <- p
+	}
+
+	// The malformed packets are discarded by ReadFrom
+	valid := turnDemuxPackets(t, peer)[0]
+	conn.PacketConn.(*readingPacketConn).read <- valid
+	buf := make([]byte, receiveMTU)
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, valid, buf[:n])
+}
+
+// TestTURNDemuxFuzz mutates well-formed packets, every one read from the
+// turnChannelConn must then be handled by the turn.Client without error
+func TestTURNDemuxFuzz(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	server := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3478}
+	conn := newBoundTURNChannelConn(t, peer, server)
+
+	client, err := turn.NewClient(&turn.ClientConfig{Conn: &mockPacketConn{}})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	seeds := turnDemuxPackets(t, peer)
+	for _, p := range seeds {
+		assert.NoError(t, conn.malformed(p))
+	}
+
+	r := mrand.New(mrand.NewSource(1)) // nolint:gosec
+	for i := 0; i < 100000; i++ {
+		p := append([]byte{}, seeds[r.Intn(len(seeds))]...)
+		for mutations := 1 + r.Intn(4); mutations > 0; mutations-- {
+			switch r.Intn(3) {
+			case 0:
+				if len(p) > 0 {
+					p[r.Intn(len(p))] = byte(r.Intn(256))
+				}
+			case 1:
+				p = p[:r.Intn(len(p)+1)]
+			default:
+				extra := make([]byte, r.Intn(8))
+				r.Read(extra)
+				p = append(p, extra...)
+			}
+		}
+
+		if conn.malformed(p) != nil {
+			continue
+		}
+		_, err := client.HandleInbound(p, server)
+		assert.NoError(t, err, p)
+	}
+}
+
+// recordingProxyDialer records the addresses it dialed, and dials addr instead
+type recordingProxyDialer struct {
+	addr string
+
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *recordingProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, network+" "+addr)
+	d.mu.Unlock()
+	return net.Dial(network, d.addr)
+}
+
+func TestRelayProxyDialer(t *testing.T) {
+	// Limit runtime in case of deadlocks
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	serverPort := randomPort(t)
+	serverListener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(serverPort))
+	assert.NoError(t, err)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	dialer := &recordingProxyDialer{addr: serverListener.Addr().String()}
+	cfg := &AgentConfig{
+		NetworkTypes: supportedNetworkTypes,
+		Urls: []*URL{
+			{
+				Scheme:   SchemeTypeTURN,
+				Host:     "turn.invalid",
+				Username: "username",
+				Password: "password",
+				Port:     serverPort,
+				Proto:    ProtoTypeTCP,
+			},
+		},
+		CandidateTypes: []CandidateType{CandidateTypeRelay},
+		ProxyDialer:    dialer,
+
+		AllowPrivateRemoteCandidates: true,
+	}
+
+	aAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+	aNotifier, aConnected := onConnected()
+	assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+
+	bAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+	bNotifier, bConnected := onConnected()
+	assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+	aConn, bConn := connect(aAgent, bAgent)
+	<-aConnected
+	<-bConnected
+
+	// The relay candidates carry the data between the peers
+	_, err = aConn.Write([]byte("proxied"))
+	assert.NoError(t, err)
+	buf := make([]byte, 10)
+	n, err := bConn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "proxied", string(buf[:n]))
+
+	// The host of the URL is only known to the proxy
+	dialer.mu.Lock()
+	assert.Equal(t, []string{"tcp turn.invalid:" + strconv.Itoa(serverPort), "tcp turn.invalid:" + strconv.Itoa(serverPort)}, dialer.dialed)
+	dialer.mu.Unlock()
+
+	assert.NoError(t, aAgent.Close())
+	assert.NoError(t, bAgent.Close())
+	assert.NoError(t, server.Close())
+}
+
+// refreshRecordingPacketConn signals every TURN Refresh request with a LIFETIME of 0
+type refreshRecordingPacketConn struct {
+	net.PacketConn
+	deallocated chan struct{}
+}
+
+func (c *refreshRecordingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && stun.IsMessage(p[:n]) {
+		msg := &stun.Message{Raw: append([]byte{}, p[:n]...)}
+		if msg.Decode() != nil || msg.Type != stun.NewType(stun.MethodRefresh, stun.ClassRequest) {
+			return n, addr, err
+		}
+		if lifetime, getErr := msg.Get(stun.AttrLifetime); getErr == nil && binary.BigEndian.Uint32(lifetime) == 0 {
+			select {
+			case c.deallocated <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return n, addr, err
+}
+
+func TestRelayDeallocatedOnClose(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	serverListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	recordingListener := &refreshRecordingPacketConn{PacketConn: serverListener, deallocated: make(chan struct{}, 1)}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            recordingListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes: supportedNetworkTypes,
+		Urls: []*URL{{
+			Scheme:   SchemeTypeTURN,
+			Host:     "127.0.0.1",
+			Username: "username",
+			Password: "password",
+			Port:     serverListener.LocalAddr().(*net.UDPAddr).Port,
+			Proto:    ProtoTypeUDP,
+		}},
+		CandidateTypes: []CandidateType{CandidateTypeRelay},
+	})
+	assert.NoError(t, err)
+
+	relayGathered := make(chan struct{})
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		if c != nil && c.Type() == CandidateTypeRelay {
+			close(relayGathered)
+		}
+	}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+	<-relayGathered
+
+	assert.NoError(t, a.Close())
+	<-recordingListener.deallocated
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestRelayCredentialRefresh(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	serverListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	refreshed := make(chan struct{}, 1)
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: "pion.ly",
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			if username == "refreshed" {
+				select {
+				case refreshed <- struct{}{}:
+				default:
+				}
+				return turn.GenerateAuthKey("refreshed", "pion.ly", "refreshed-password"), true
+			}
+			return turn.GenerateAuthKey("username", "pion.ly", "password"), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	url := &URL{
+		Scheme:   SchemeTypeTURN,
+		Host:     "127.0.0.1",
+		Username: "username",
+		Password: "password",
+		Port:     serverListener.LocalAddr().(*net.UDPAddr).Port,
+		Proto:    ProtoTypeUDP,
+	}
+
+	gatherRelay := func(onRefresh func(string) (string, string, error)) *Agent {
+		a, newErr := NewAgent(&AgentConfig{
+			NetworkTypes:            supportedNetworkTypes,
+			Urls:                    []*URL{url},
+			CandidateTypes:          []CandidateType{CandidateTypeRelay},
+			OnTURNCredentialRefresh: onRefresh,
+			turnRefreshInterval:     50 * time.Millisecond,
+		})
+		assert.NoError(t, newErr)
+
+		relayGathered := make(chan struct{})
+		assert.NoError(t, a.OnCandidate(func(c Candidate) {
+			if c != nil && c.Type() == CandidateTypeRelay {
+				close(relayGathered)
+			}
+		}))
+		assert.NoError(t, a.GatherCandidates(context.Background()))
+		<-relayGathered
+		return a
+	}
+
+	t.Run("Refreshed with the new credentials", func(t *testing.T) {
+		urls := make(chan string, 1)
+		a := gatherRelay(func(url string) (string, string, error) {
+			select {
+			case urls <- url:
+			default:
+			}
+			return "refreshed", "refreshed-password", nil
+		})
+
+		assert.Equal(t, url.String(), <-urls)
+		<-refreshed
+
+		// The server accepted the refresh, the candidate is kept
+		time.Sleep(100 * time.Millisecond)
+		localCandidates, err := a.GetLocalCandidates()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(localCandidates))
+
+		assert.NoError(t, a.Close())
+	})
+
+	t.Run("Dropped when the callback fails", func(t *testing.T) {
+		a := gatherRelay(func(string) (string, string, error) {
+			return "", "", ErrPasswordEmpty
+		})
+
+		for {
+			localCandidates, err := a.GetLocalCandidates()
+			assert.NoError(t, err)
+			if len(localCandidates) == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		assert.NoError(t, a.Close())
+	})
+
+	assert.NoError(t, server.Close())
+}
+
+func TestRelayPortRange(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	serverListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	portMin, portMax := uint16(51000), uint16(51010)
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes: supportedNetworkTypes,
+		Urls: []*URL{{
+			Scheme:   SchemeTypeTURN,
+			Host:     "127.0.0.1",
+			Username: "username",
+			Password: "password",
+			Port:     serverListener.LocalAddr().(*net.UDPAddr).Port,
+			Proto:    ProtoTypeUDP,
+		}},
+		CandidateTypes: []CandidateType{CandidateTypeRelay},
+		PortMin:        portMin,
+		PortMax:        portMax,
+	})
+	assert.NoError(t, err)
+
+	relays := make(chan Candidate, 1)
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		if c != nil && c.Type() == CandidateTypeRelay {
+			relays <- c
+		}
+	}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+
+	// The socket to the TURN server is bound in the port range
+	relay := <-relays
+	assert.GreaterOrEqual(t, relay.RelatedAddress().Port, int(portMin))
+	assert.LessOrEqual(t, relay.RelatedAddress().Port, int(portMax))
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, server.Close())
+}
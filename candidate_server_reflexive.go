@@ -18,6 +18,9 @@ type CandidateServerReflexiveConfig struct {
 	Component   uint16
 	RelAddr     string
 	RelPort     int
+	TCPType     TCPType
+	Foundation  string
+	Priority    uint32
 }
 
 // NewCandidateServerReflexive creates a new server reflective candidate
@@ -44,12 +47,16 @@ func NewCandidateServerReflexive(config *CandidateServerReflexiveConfig) (*Candi
 			candidateType: CandidateTypeServerReflexive,
 			address:       config.Address,
 			port:          config.Port,
+			tcpType:       config.TCPType,
 			resolvedAddr:  &net.UDPAddr{IP: ip, Port: config.Port},
 			component:     config.Component,
 			relatedAddress: &CandidateRelatedAddress{
 				Address: config.RelAddr,
 				Port:    config.RelPort,
 			},
+
+			foundationOverride: config.Foundation,
+			priorityOverride:   config.Priority,
 		},
 	}, nil
 }
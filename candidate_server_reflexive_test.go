@@ -47,6 +47,8 @@ func TestServerReflexiveOnlyConnection(t *testing.T) {
 			},
 		},
 		CandidateTypes: []CandidateType{CandidateTypeServerReflexive},
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg)
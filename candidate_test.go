@@ -1,6 +1,7 @@
 package ice
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -21,6 +22,15 @@ func TestCandidatePriority(t *testing.T) {
 			},
 			WantPriority: 2130706431,
 		},
+		{
+			Candidate: &CandidateHost{
+				candidateBase: candidateBase{
+					candidateType: CandidateTypeHost,
+					component:     ComponentRTCP,
+				},
+			},
+			WantPriority: 2130706430,
+		},
 		{
 			Candidate: &CandidatePeerReflexive{
 				candidateBase: candidateBase{
@@ -55,6 +65,44 @@ func TestCandidatePriority(t *testing.T) {
 	}
 }
 
+func TestCandidateLocalPreferencePerIPFamily(t *testing.T) {
+	ipv4Preference, ipv6Preference := uint16(100), uint16(200)
+	a, err := NewAgent(&AgentConfig{
+		IPv4LocalPreference: &ipv4Preference,
+		IPv6LocalPreference: &ipv6Preference,
+	})
+	assert.NoError(t, err)
+
+	newHost := func(networkType NetworkType) *CandidateHost {
+		return &CandidateHost{
+			candidateBase: candidateBase{
+				candidateType: CandidateTypeHost,
+				networkType:   networkType,
+				component:     ComponentRTP,
+				currAgent:     a,
+			},
+		}
+	}
+
+	ipv4, ipv6 := newHost(NetworkTypeUDP4), newHost(NetworkTypeUDP6)
+	assert.Equal(t, ipv4Preference, ipv4.LocalPreference())
+	assert.Equal(t, ipv6Preference, ipv6.LocalPreference())
+	assert.Equal(t, uint32((1<<24)*126+(1<<8)*200+255), ipv6.Priority())
+	assert.Greater(t, ipv6.Priority(), ipv4.Priority())
+
+	// TCP candidates keep the local preference of RFC 6544
+	tcp := newHost(NetworkTypeTCP6)
+	tcp.tcpType = TCPTypePassive
+	assert.Equal(t, uint16((1<<13)*4+tcpOtherPreference), tcp.LocalPreference())
+
+	// Remote candidates are not bound to the Agent
+	remote := newHost(NetworkTypeUDP4)
+	remote.currAgent = nil
+	assert.Equal(t, uint16(defaultLocalPreference), remote.LocalPreference())
+
+	assert.NoError(t, a.Close())
+}
+
 func TestCandidateLastSent(t *testing.T) {
 	candidate := candidateBase{}
 	assert.Equal(t, candidate.LastSent(), time.Time{})
@@ -70,3 +118,135 @@ func TestCandidateLastReceived(t *testing.T) {
 	candidate.setLastReceived(now)
 	assert.Equal(t, candidate.LastReceived(), now)
 }
+
+func TestCandidateFoundation(t *testing.T) {
+	host := func(address string) *CandidateHost {
+		c, err := NewCandidateHost(&CandidateHostConfig{Network: udp, Address: address, Port: 5000, Component: ComponentRTP})
+		assert.NoError(t, err)
+		return c
+	}
+	srflx := func(address, relAddr string, relPort int, server string) *CandidateServerReflexive {
+		c, err := NewCandidateServerReflexive(&CandidateServerReflexiveConfig{
+			Network:   udp,
+			Address:   address,
+			Port:      40000,
+			Component: ComponentRTP,
+			RelAddr:   relAddr,
+			RelPort:   relPort,
+		})
+		assert.NoError(t, err)
+		c.server = server
+		return c
+	}
+
+	// Stable across gathering runs
+	assert.Equal(t, host("192.168.0.1").Foundation(), host("192.168.0.1").Foundation())
+	assert.NotEqual(t, host("192.168.0.1").Foundation(), host("192.168.0.2").Foundation())
+
+	// The base and the server are hashed, not the reflexive address nor the ports
+	base := srflx("1.2.3.4", "192.168.0.1", 5000, "stun:stun.example.com:3478")
+	assert.Equal(t, base.Foundation(), srflx("1.2.3.5", "192.168.0.1", 5001, "stun:stun.example.com:3478").Foundation())
+	assert.NotEqual(t, base.Foundation(), srflx("1.2.3.4", "192.168.0.2", 5000, "stun:stun.example.com:3478").Foundation())
+	assert.NotEqual(t, base.Foundation(), srflx("1.2.3.4", "192.168.0.1", 5000, "stun:stun.example.org:3478").Foundation())
+	assert.NotEqual(t, base.Foundation(), host("192.168.0.1").Foundation())
+
+	// The foundation of a remote candidate is the signaled one
+	remote, err := UnmarshalCandidate(base.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, base.Foundation(), remote.Foundation())
+}
+
+func TestCandidateMarshal(t *testing.T) {
+	mustCandidate := func(c Candidate, err error) Candidate {
+		assert.NoError(t, err)
+		return c
+	}
+
+	for _, c := range []Candidate{
+		mustCandidate(NewCandidateHost(&CandidateHostConfig{
+			Network:   udp,
+			Address:   "192.168.0.1",
+			Port:      5000,
+			Component: ComponentRTP,
+		})),
+		mustCandidate(NewCandidateHost(&CandidateHostConfig{
+			Network:   tcp,
+			Address:   "fe80::1",
+			Port:      tcpActivePort,
+			Component: ComponentRTCP,
+			TCPType:   TCPTypeActive,
+		})),
+		mustCandidate(NewCandidateHost(&CandidateHostConfig{
+			Network:   udp,
+			Address:   "fe80::1%eth0",
+			Port:      5000,
+			Component: ComponentRTP,
+		})),
+		mustCandidate(NewCandidateServerReflexive(&CandidateServerReflexiveConfig{
+			Network:   udp,
+			Address:   "1.2.3.4",
+			Port:      40000,
+			Component: ComponentRTP,
+			RelAddr:   "192.168.0.1",
+			RelPort:   5000,
+		})),
+		mustCandidate(NewCandidatePeerReflexive(&CandidatePeerReflexiveConfig{
+			Network:   udp,
+			Address:   "1.2.3.5",
+			Port:      40001,
+			Component: ComponentRTP,
+		})),
+		mustCandidate(NewCandidateRelay(&CandidateRelayConfig{
+			Network:   udp,
+			Address:   "5.6.7.8",
+			Port:      50000,
+			Component: ComponentRTP,
+			RelAddr:   "1.2.3.4",
+			RelPort:   40000,
+		})),
+	} {
+		unmarshaled, err := UnmarshalCandidate(c.Marshal())
+		assert.NoError(t, err)
+		assert.True(t, c.Equal(unmarshaled), "%s != %s", c, unmarshaled)
+		assert.Equal(t, c.Component(), unmarshaled.Component())
+		assert.Equal(t, c.Priority(), unmarshaled.Priority())
+		assert.Equal(t, c.Foundation(), unmarshaled.Foundation())
+		assert.Equal(t, c.Marshal(), unmarshaled.Marshal())
+	}
+
+	c, err := UnmarshalCandidate("a=candidate:842163049 1 UDP 1686052607 1.2.3.4 46154 typ srflx raddr 10.0.0.1 rport 46154 generation 0")
+	assert.NoError(t, err)
+	assert.Equal(t, CandidateTypeServerReflexive, c.Type())
+	assert.Equal(t, NetworkTypeUDP4, c.NetworkType())
+	assert.Equal(t, "842163049", c.Foundation())
+	assert.Equal(t, uint32(1686052607), c.Priority())
+	assert.Equal(t, &CandidateRelatedAddress{Address: "10.0.0.1", Port: 46154}, c.RelatedAddress())
+
+	c, err = UnmarshalCandidate("candidate:1 1 tcp 1518280447 192.168.0.1 9 typ host tcptype passive")
+	assert.NoError(t, err)
+	assert.Equal(t, NetworkTypeTCP4, c.NetworkType())
+	assert.Equal(t, TCPTypePassive, c.TCPType())
+
+	for _, test := range []struct {
+		raw string
+		err error
+	}{
+		{"", ErrCandidateTooShort},
+		{"1 1 udp 2130706431 192.168.0.1 5000 typ", ErrCandidateTooShort},
+		{"1 0 udp 2130706431 192.168.0.1 5000 typ host", ErrParseComponent},
+		{"1 1 sctp 2130706431 192.168.0.1 5000 typ host", ErrProtoType},
+		{"1 1 udp -1 192.168.0.1 5000 typ host", ErrParsePriority},
+		{"1 1 udp 2130706431 192.168.0.1 70000 typ host", ErrParsePort},
+		{"1 1 udp 2130706431 192.168.0.1 5000 type host", ErrUnknownCandidateType},
+		{"1 1 udp 2130706431 192.168.0.1 5000 typ foo", ErrUnknownCandidateType},
+		{"1 1 udp 2130706431 1.2.3.4 5000 typ srflx raddr 192.168.0.1 rport x", ErrParseRelatedAddr},
+		{"1 1 udp 2130706431 1.2.3.4 5000 typ srflx raddr", ErrCandidateTooShort},
+		{"1 1 tcp 2130706431 192.168.0.1 5000 typ host tcptype foo", ErrParseTCPType},
+		{"1 1 udp 2130706431 not-an-ip 5000 typ srflx", ErrAddressParseFailed},
+		{"1 1 udp 2130706431 192.168.0.1%eth0 5000 typ host", ErrAddressParseFailed},
+		{"1 1 udp 2130706431 2001:db8::1%eth0 5000 typ host", ErrAddressParseFailed},
+	} {
+		_, err := UnmarshalCandidate(test.raw)
+		assert.True(t, errors.Is(err, test.err), "%q: %v", test.raw, err)
+	}
+}
@@ -2,10 +2,24 @@ package ice
 
 import (
 	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/stun"
 )
 
+// CandidatePair is a local and a remote candidate, used to report the
+// candidate pair the Agent selected
+type CandidatePair struct {
+	Local  Candidate
+	Remote Candidate
+}
+
+func (p *CandidatePair) String() string {
+	return fmt.Sprintf("%s <-> %s", p.Local, p.Remote)
+}
+
 func newCandidatePair(local, remote Candidate, controlling bool) *candidatePair {
 	return &candidatePair{
 		iceRoleControlling: controlling,
@@ -17,12 +31,147 @@ func newCandidatePair(local, remote Candidate, controlling bool) *candidatePair
 
 // candidatePair represents a combination of a local and remote candidate
 type candidatePair struct {
+	// Data traffic counters, these are accessed atomically since
+	// Conn writes to the pair without holding the agent lock
+	bytesSent          uint64
+	bytesReceived      uint64
+	packetsSent        uint32
+	packetsReceived    uint32
+	lastPacketSent     atomic.Value // time.Time
+	lastPacketReceived atomic.Value // time.Time
+
+	// smoothedRTT is the time.Duration of the RTT estimate, it is accessed
+	// atomically since Conn reads it without holding the agent lock
+	smoothedRTT int64
+
 	iceRoleControlling  bool
 	remote              Candidate
 	local               Candidate
 	bindingRequestCount uint16
 	state               CandidatePairState
 	nominated           bool
+
+	// nominateOnBindingSuccess is set on the controlled side when a nomination
+	// arrived before the pair was validated by our own check
+	nominateOnBindingSuccess bool
+
+	// rto is the retransmission timeout of the last binding request sent by
+	// pingAllCandidates, the next one is only sent at nextBindingRequest
+	rto                time.Duration
+	nextBindingRequest time.Time
+
+	// consentTime is the last time the remote granted consent on this pair
+	// by answering a Binding request
+	consentTime time.Time
+	// selectedTime is the last time this pair was selected
+	selectedTime time.Time
+
+	// Connectivity check counters, guarded by the agent lock
+	requestsSent         uint64
+	requestsReceived     uint64
+	responsesSent        uint64
+	responsesReceived    uint64
+	consentRequestsSent  uint64
+	firstRequestTime     time.Time
+	lastRequestTime      time.Time
+	lastResponseTime     time.Time
+	currentRoundTripTime time.Duration
+	totalRoundTripTime   time.Duration
+}
+
+// foundation is the pair foundation, the foundations of both candidates
+// https://tools.ietf.org/html/rfc8445#section-6.1.2.6
+func (p *candidatePair) foundation() string {
+	return p.local.Foundation() + ":" + p.remote.Foundation()
+}
+
+// linkLocalCompatible returns true if local and remote may form a candidate pair,
+// an IPv6 link-local candidate can only reach the link-local candidates of its link
+func linkLocalCompatible(local, remote Candidate) bool {
+	localAddr, remoteAddr := local.addr(), remote.addr()
+	if localAddr == nil || remoteAddr == nil {
+		return true
+	}
+	return isIPv6LinkLocal(localAddr.IP) == isIPv6LinkLocal(remoteAddr.IP)
+}
+
+func isIPv6LinkLocal(ip net.IP) bool {
+	return ip.To4() == nil && ip.IsLinkLocalUnicast()
+}
+
+// channelBound returns true if the local candidate is a relay candidate, and its
+// TURN server has a channel bound to the remote candidate
+func (p *candidatePair) channelBound() bool {
+	relay, ok := p.local.(*CandidateRelay)
+	if !ok || relay.channels == nil {
+		return false
+	}
+	addr := p.remote.addr()
+	return addr != nil && relay.channels.isBound(addr)
+}
+
+// turnOverhead returns the largest number of bytes the framing of the TURN
+// server adds to a packet sent on p, a ChannelData header once a channel is
+// bound, else a Send indication with the XOR-PEER-ADDRESS and DATA attributes.
+// It is 0 unless the local candidate is a relay candidate.
+// https://tools.ietf.org/html/rfc5766#section-10
+func (p *candidatePair) turnOverhead() int {
+	if p.local.Type() != CandidateTypeRelay {
+		return 0
+	}
+
+	const maxPadding = 3
+	if p.channelBound() {
+		return channelDataHeaderSize + maxPadding
+	}
+
+	addrLen := 8 // family, port and IPv4
+	if p.remote.NetworkType().IsIPv6() {
+		addrLen = 20
+	}
+	return stunHeaderSize + stunAttributeHeaderSize + addrLen + stunAttributeHeaderSize + maxPadding
+}
+
+// withRemote returns a copy of p paired with remote instead, it is used when
+// a signaled candidate supersedes the peer-reflexive one p was created with
+func (p *candidatePair) withRemote(remote Candidate) *candidatePair {
+	np := &candidatePair{
+		bytesSent:       atomic.LoadUint64(&p.bytesSent),
+		bytesReceived:   atomic.LoadUint64(&p.bytesReceived),
+		packetsSent:     atomic.LoadUint32(&p.packetsSent),
+		packetsReceived: atomic.LoadUint32(&p.packetsReceived),
+		smoothedRTT:     atomic.LoadInt64(&p.smoothedRTT),
+
+		iceRoleControlling:       p.iceRoleControlling,
+		remote:                   remote,
+		local:                    p.local,
+		bindingRequestCount:      p.bindingRequestCount,
+		state:                    p.state,
+		nominated:                p.nominated,
+		nominateOnBindingSuccess: p.nominateOnBindingSuccess,
+		rto:                      p.rto,
+		nextBindingRequest:       p.nextBindingRequest,
+		consentTime:              p.consentTime,
+		selectedTime:             p.selectedTime,
+
+		requestsSent:         p.requestsSent,
+		requestsReceived:     p.requestsReceived,
+		responsesSent:        p.responsesSent,
+		responsesReceived:    p.responsesReceived,
+		consentRequestsSent:  p.consentRequestsSent,
+		firstRequestTime:     p.firstRequestTime,
+		lastRequestTime:      p.lastRequestTime,
+		lastResponseTime:     p.lastResponseTime,
+		currentRoundTripTime: p.currentRoundTripTime,
+		totalRoundTripTime:   p.totalRoundTripTime,
+	}
+	if t := p.lastPacketSent.Load(); t != nil {
+		np.lastPacketSent.Store(t)
+	}
+	if t := p.lastPacketReceived.Load(); t != nil {
+		np.lastPacketReceived.Store(t)
+	}
+	return np
 }
 
 func (p *candidatePair) String() string {
@@ -83,12 +232,148 @@ func (p *candidatePair) Priority() uint64 {
 }
 
 func (p *candidatePair) Write(b []byte) (int, error) {
-	return p.local.writeTo(b, p.remote)
+	n, err := p.local.writeTo(b, p.remote)
+	if err == nil {
+		atomic.AddUint64(&p.bytesSent, uint64(n))
+		atomic.AddUint32(&p.packetsSent, 1)
+		p.lastPacketSent.Store(clockOf(p.local).Now())
+	}
+	return n, err
 }
 
-func (a *Agent) sendSTUN(msg *stun.Message, local, remote Candidate) {
-	_, err := local.writeTo(msg.Raw, remote)
-	if err != nil {
-		a.log.Tracef("failed to send STUN message: %s", err)
+// tryWrite sends b without blocking, see candidateBase.tryWriteTo
+func (p *candidatePair) tryWrite(b []byte) (int, error) {
+	n, err := p.local.tryWriteTo(b, p.remote)
+	if err == nil {
+		atomic.AddUint64(&p.bytesSent, uint64(n))
+		atomic.AddUint32(&p.packetsSent, 1)
+		p.lastPacketSent.Store(clockOf(p.local).Now())
 	}
+	return n, err
+}
+
+// writeBatch sends the packets of b, and returns how many were sent
+func (p *candidatePair) writeBatch(b [][]byte, batch bool) (int, error) {
+	n, err := p.local.writeBatch(b, p.remote, batch)
+	if n > 0 {
+		var bytes int
+		for _, packet := range b[:n] {
+			bytes += len(packet)
+		}
+		atomic.AddUint64(&p.bytesSent, uint64(bytes))
+		atomic.AddUint32(&p.packetsSent, uint32(n))
+		p.lastPacketSent.Store(clockOf(p.local).Now())
+	}
+	return n, err
+}
+
+// packetReceived records a data packet received on this pair
+func (p *candidatePair) packetReceived(n int) {
+	atomic.AddUint64(&p.bytesReceived, uint64(n))
+	atomic.AddUint32(&p.packetsReceived, 1)
+	p.lastPacketReceived.Store(clockOf(p.local).Now())
+}
+
+// requestSent records a Binding request sent on this pair
+// Note: the caller should hold the agent lock.
+func (p *candidatePair) requestSent(t time.Time) {
+	if p.requestsSent == 0 {
+		p.firstRequestTime = t
+	}
+	p.requestsSent++
+	p.lastRequestTime = t
+}
+
+// responseReceived records a Binding success response received on this pair,
+// rtt is the time since the matching request was sent
+// Note: the caller should hold the agent lock.
+func (p *candidatePair) responseReceived(rtt time.Duration) {
+	p.responsesReceived++
+	p.lastResponseTime = clockOf(p.local).Now()
+	p.currentRoundTripTime = rtt
+	p.totalRoundTripTime += rtt
+
+	// Smoothed like the SRTT of TCP, the first measurement is used as is
+	// https://tools.ietf.org/html/rfc6298#section-2
+	srtt := time.Duration(atomic.LoadInt64(&p.smoothedRTT))
+	if srtt == 0 {
+		srtt = rtt
+	} else {
+		srtt = (7*srtt + rtt) / 8
+	}
+	atomic.StoreInt64(&p.smoothedRTT, int64(srtt))
+}
+
+// rtt returns the smoothed RTT of the Binding requests sent on this pair, or
+// 0 if no response was received yet
+func (p *candidatePair) rtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.smoothedRTT))
+}
+
+// pacedSTUN is a STUN message delayed by MaxCheckBandwidth with RateLimitBlock
+type pacedSTUN struct {
+	due  time.Time
+	send func()
+}
+
+// paceSTUN sends msg with send once it fits in MaxCheckBandwidth. With
+// RateLimitBlock, a message over it is queued for the connectivity checks
+// routine rather than waited for, since the caller holds the agent lock.
+func (a *Agent) paceSTUN(msg *stun.Message, local Candidate, remote fmt.Stringer, send func()) {
+	switch {
+	case a.checkLimiter == nil:
+		send()
+	case a.checkBandwidthPolicy != RateLimitBlock:
+		if !a.checkLimiter.allow(len(msg.Raw)) {
+			a.log.Debugf("Not sending STUN message from %s to %s over MaxCheckBandwidth: %v", local, remote, ErrRateLimited)
+			return
+		}
+		send()
+	default:
+		// The queued messages are sent first, to keep the order
+		delay := a.checkLimiter.reserve(len(msg.Raw))
+		if delay <= 0 && len(a.pacedSTUN) == 0 {
+			send()
+			return
+		}
+		a.log.Tracef("Delaying STUN message from %s to %s by %s for MaxCheckBandwidth", local, remote, delay)
+		a.pacedSTUN = append(a.pacedSTUN, pacedSTUN{due: a.clock.Now().Add(delay), send: send})
+		if len(a.pacedSTUN) == 1 {
+			a.requestConnectivityCheck()
+		}
+	}
+}
+
+// sendPacedSTUN sends the STUN messages queued by paceSTUN that are due
+func (a *Agent) sendPacedSTUN() {
+	now := a.clock.Now()
+	sent := 0
+	for ; sent < len(a.pacedSTUN) && !a.pacedSTUN[sent].due.After(now); sent++ {
+		a.pacedSTUN[sent].send()
+	}
+	a.pacedSTUN = append(a.pacedSTUN[:0], a.pacedSTUN[sent:]...)
+}
+
+// nextPacedSTUN returns when the next STUN message queued by paceSTUN is due
+func (a *Agent) nextPacedSTUN() (time.Time, bool) {
+	if len(a.pacedSTUN) == 0 {
+		return time.Time{}, false
+	}
+	return a.pacedSTUN[0].due, true
+}
+
+func loadTime(v *atomic.Value) time.Time {
+	if t, ok := v.Load().(time.Time); ok {
+		return t
+	}
+	return time.Time{}
+}
+
+func (a *Agent) sendSTUN(msg *stun.Message, local, remote Candidate) {
+	a.paceSTUN(msg, local, remote, func() {
+		_, err := local.writeTo(msg.Raw, remote)
+		if err != nil {
+			a.log.Debugf("failed to send STUN message from %s to %s: %s", local, remote, err)
+		}
+	})
 }
@@ -6,7 +6,7 @@ type CandidatePairState int
 const (
 	// CandidatePairStateWaiting means a check has not been performed for
 	// this pair
-	CandidatePairStateWaiting = iota + 1
+	CandidatePairStateWaiting CandidatePairState = iota + 1
 
 	// CandidatePairStateInProgress means a check has been sent for this pair,
 	// but the transaction is in progress.
@@ -20,6 +20,15 @@ const (
 	// CandidatePairStateSucceeded means a check for this pair was already
 	// done and produced a successful result.
 	CandidatePairStateSucceeded
+
+	// CandidatePairStateFrozen means a check for this pair has not been
+	// performed, and it waits for the check of a pair sharing its foundation
+	CandidatePairStateFrozen
+
+	// CandidatePairStateCancelled means the checks of this pair were stopped,
+	// or never started, because another pair of its component was selected.
+	// They start again if the selected pair is removed.
+	CandidatePairStateCancelled
 )
 
 func (c CandidatePairState) String() string {
@@ -32,6 +41,10 @@ func (c CandidatePairState) String() string {
 		return "failed"
 	case CandidatePairStateSucceeded:
 		return "succeeded"
+	case CandidatePairStateFrozen:
+		return "frozen"
+	case CandidatePairStateCancelled:
+		return "cancelled"
 	}
 	return "Unknown candidate pair state"
 }
@@ -1,6 +1,9 @@
 package ice
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 var (
 	hostCandidate = &CandidateHost{
@@ -113,3 +116,53 @@ func TestCandidatePairEquality(t *testing.T) {
 		t.Fatalf("Expected %v to equal %v", pairA, pairB)
 	}
 }
+
+func TestCandidatePairRTT(t *testing.T) {
+	p := newCandidatePair(hostCandidate, srflxCandidate, true)
+	if rtt := p.rtt(); rtt != 0 {
+		t.Fatalf("Expected no RTT before any response, got %v", rtt)
+	}
+
+	p.responseReceived(80 * time.Millisecond)
+	if rtt := p.rtt(); rtt != 80*time.Millisecond {
+		t.Fatalf("Expected the first RTT to be used as is, got %v", rtt)
+	}
+
+	p.responseReceived(160 * time.Millisecond)
+	if rtt := p.rtt(); rtt != 90*time.Millisecond {
+		t.Fatalf("Expected the RTT to be smoothed to 90ms, got %v", rtt)
+	}
+}
+
+func TestCandidatePairTURNOverhead(t *testing.T) {
+	if overhead := newCandidatePair(hostCandidate, srflxCandidate, true).turnOverhead(); overhead != 0 {
+		t.Fatalf("Expected no TURN overhead on a host pair, got %d", overhead)
+	}
+
+	newRemote := func(address string) *CandidateHost {
+		remote, err := NewCandidateHost(&CandidateHostConfig{Network: udp, Address: address, Port: 5000, Component: ComponentRTP})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return remote
+	}
+	relay := &CandidateRelay{
+		candidateBase: candidateBase{candidateType: CandidateTypeRelay, component: ComponentRTP},
+		channels:      newTURNChannelConn(nil, nil),
+	}
+
+	// A Send indication until a channel is bound
+	remote := newRemote("1.2.3.4")
+	p := newCandidatePair(relay, remote, true)
+	if overhead := p.turnOverhead(); overhead != 39 {
+		t.Fatalf("Expected the overhead of a Send indication to an IPv4 peer, got %d", overhead)
+	}
+	if overhead := newCandidatePair(relay, newRemote("::1"), true).turnOverhead(); overhead != 51 {
+		t.Fatalf("Expected the overhead of a Send indication to an IPv6 peer, got %d", overhead)
+	}
+
+	relay.channels.bound[remote.addr().String()] = time.Now()
+	if overhead := p.turnOverhead(); overhead != 7 {
+		t.Fatalf("Expected the overhead of a ChannelData message, got %d", overhead)
+	}
+}
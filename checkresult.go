@@ -0,0 +1,49 @@
+package ice
+
+import "time"
+
+// CheckResult is the outcome of a connectivity check, reported to OnCheck
+type CheckResult int
+
+const (
+	// CheckResultSuccess means a success response was received
+	CheckResultSuccess CheckResult = iota + 1
+
+	// CheckResultFailure means an error response was received, e.g. a role
+	// conflict after which the pair is checked again
+	CheckResultFailure
+
+	// CheckResultTimeout means no response was received to any retransmission,
+	// the pair failed
+	CheckResultTimeout
+)
+
+func (c CheckResult) String() string {
+	switch c {
+	case CheckResultSuccess:
+		return "success"
+	case CheckResultFailure:
+		return "failure"
+	case CheckResultTimeout:
+		return "timeout"
+	}
+	return "Unknown check result"
+}
+
+// checkBufferSize is how many checks are queued for OnCheck before they are
+// dropped, so a slow handler never blocks the connectivity checks
+const checkBufferSize = 64
+
+// checkWaiter is notified of the outcome of the next check of the pair of
+// local and remote, result must be buffered
+type checkWaiter struct {
+	local, remote Candidate
+	result        chan CheckResult
+}
+
+// checkEvent is a check reported to OnCheck
+type checkEvent struct {
+	local, remote Candidate
+	result        CheckResult
+	rtt           time.Duration
+}
@@ -0,0 +1,62 @@
+package ice
+
+import (
+	"time"
+)
+
+// Clock is the time source of the Agent for its connectivity checks and their
+// retransmissions, consent freshness, keepalives, the connection state
+// timeouts and the times of the candidates and pairs. It defaults to the wall
+// clock, tests may use a Clock they advance on their own to not wait for the
+// timeouts. The sockets, gathering and TURN keep using the wall clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a time.Ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{t: time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{t: time.NewTicker(d)} }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+// clockOf returns the Clock of the Agent of c, or the wall clock if c isn't
+// started by an Agent
+func clockOf(c Candidate) Clock {
+	if a := c.agent(); a != nil && a.clock != nil {
+		return a.clock
+	}
+	return realClock{}
+}
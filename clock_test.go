@@ -0,0 +1,183 @@
+// +build !js
+
+package ice
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockClock is a Clock whose time only moves with advance
+type mockClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*mockTimer]struct{}
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Unix(0, 0), timers: map[*mockTimer]struct{}{}}
+}
+
+// mockTimer is a Timer, or the timer of a mockTicker when its period is set
+type mockTimer struct {
+	clock  *mockClock
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (c *mockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *mockClock) NewTimer(d time.Duration) Timer {
+	t := &mockTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (c *mockClock) NewTicker(d time.Duration) Ticker {
+	t := &mockTimer{clock: c, c: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+	return mockTicker{t}
+}
+
+type mockTicker struct {
+	t *mockTimer
+}
+
+func (t mockTicker) C() <-chan time.Time { return t.t.C() }
+func (t mockTicker) Stop()               { t.t.Stop() }
+
+// advance moves the time forward by d, and fires the timers that are due
+func (c *mockClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.fireLocked()
+}
+
+func (c *mockClock) fireLocked() {
+	for t := range c.timers {
+		if t.at.After(c.now) {
+			continue
+		}
+
+		// Like the timers of the time package, a tick is dropped while the
+		// previous one wasn't received
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.period == 0 {
+			delete(c.timers, t)
+			continue
+		}
+		for !t.at.After(c.now) {
+			t.at = t.at.Add(t.period)
+		}
+	}
+}
+
+func (t *mockTimer) C() <-chan time.Time { return t.c }
+
+func (t *mockTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, active := t.clock.timers[t]
+	t.at = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	t.clock.fireLocked()
+	return active
+}
+
+func TestAgentConfigClock(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	t.Run("Consent expires after exactly ConsentTimeout", func(t *testing.T) {
+		clock := newMockClock()
+		a, err := NewAgent(&AgentConfig{Clock: clock})
+		assert.NoError(t, err)
+		a.startOnConnectionStateChangeRoutine()
+
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		local.conn = &mockPacketConn{}
+		remote, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "172.17.0.3",
+			Port:      999,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, a.run(func(a *Agent) {
+			a.startSelector()
+			p := a.addPair(local, remote)
+			p.state = CandidatePairStateSucceeded
+			a.setSelectedPair(p)
+			assert.Equal(t, clock.Now(), p.consentTime)
+
+			clock.advance(defaultConsentTimeout)
+			assert.True(t, a.checkConsent())
+
+			clock.advance(time.Nanosecond)
+			assert.False(t, a.checkConsent())
+		}, nil))
+
+		<-a.done
+		assert.Equal(t, FailureReasonConsentExpired, a.FailureReason())
+		assert.NoError(t, a.Close())
+	})
+
+	t.Run("Connection times out on the Clock", func(t *testing.T) {
+		clock := newMockClock()
+		connectionTimeout := 30 * time.Second
+		a, err := NewAgent(&AgentConfig{Clock: clock, ConnectionTimeout: &connectionTimeout})
+		assert.NoError(t, err)
+		start := clock.Now()
+
+		assert.NoError(t, a.startConnectivityChecks(true, "remoteUfrag", "remotePasswordWith128Bits"))
+
+		// The checks are only waited for on the Clock
+		for timedOut := false; !timedOut; {
+			clock.advance(a.taskLoopInterval)
+			select {
+			case <-a.onConnectionTimeout:
+				timedOut = true
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+
+		elapsed := clock.Now().Sub(start)
+		assert.True(t, elapsed >= connectionTimeout, elapsed)
+		assert.True(t, elapsed <= connectionTimeout+2*a.taskLoopInterval, elapsed)
+		assert.NoError(t, a.Close())
+	})
+}
@@ -0,0 +1,58 @@
+package ice
+
+import (
+	"time"
+)
+
+// ConnStats is a snapshot of the traffic and state of a Conn, see Conn.Stats
+type ConnStats struct {
+	// ConnCounters are the bytes of Counters
+	ConnCounters
+	// PacketsSent and PacketsReceived are the packets written on and read from
+	// the Conn, counted with the bytes of ConnCounters
+	PacketsSent     uint64
+	PacketsReceived uint64
+	// PacketsDropped is PacketsDropped
+	PacketsDropped uint64
+
+	// RTT is the smoothed round-trip time of the selected pair, see RTT
+	RTT time.Duration
+	// LocalCandidateType and RemoteCandidateType are the types of the
+	// candidates of the selected pair, they are 0 while none is selected
+	LocalCandidateType  CandidateType
+	RemoteCandidateType CandidateType
+
+	ConnectionState ConnectionState
+}
+
+// Stats returns the traffic counters of the Conn with the RTT and the candidate
+// types of the selected pair and the connection state, read at once so that
+// they are consistent with each other, unlike the individual getters. Once the
+// Agent is closed only the counters are returned, with ConnectionStateClosed.
+func (c *Conn) Stats() ConnStats {
+	var stats ConnStats
+	if err := c.agent.run(func(a *Agent) {
+		stats.ConnectionState = a.connectionState
+		if p := a.getComponentSelectedPair(c.component); p != nil {
+			stats.RTT = p.rtt()
+			stats.LocalCandidateType = p.local.Type()
+			stats.RemoteCandidateType = p.remote.Type()
+		}
+		c.readStats(&stats)
+	}, nil); err != nil {
+		stats = ConnStats{ConnectionState: ConnectionStateClosed}
+		c.readStats(&stats)
+	}
+	return stats
+}
+
+// readStats reads the counters of stats
+func (c *Conn) readStats(stats *ConnStats) {
+	c.countersMu.Lock()
+	stats.ConnCounters = c.counters
+	stats.PacketsSent = c.packetsSent
+	stats.PacketsReceived = c.packetsReceived
+	c.countersMu.Unlock()
+
+	stats.PacketsDropped = c.agent.getBuffer(c.component).Dropped()
+}
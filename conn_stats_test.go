@@ -0,0 +1,60 @@
+// +build !js
+
+package ice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnStatsSnapshot(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	ca, cb := pipe(nil)
+
+	for i := 0; i < 3; i++ {
+		_, err := ca.Write(make([]byte, 10))
+		assert.NoError(t, err)
+	}
+	buf := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		_, err := cb.Read(buf)
+		assert.NoError(t, err)
+	}
+
+	stats := ca.Stats()
+	assert.Equal(t, ConnCounters{BytesSent: 30}, stats.ConnCounters)
+	assert.Equal(t, uint64(3), stats.PacketsSent)
+	assert.Equal(t, uint64(0), stats.PacketsReceived)
+	assert.Equal(t, ca.RTT(), stats.RTT)
+	assert.Equal(t, CandidateTypeHost, stats.LocalCandidateType)
+	assert.Equal(t, CandidateTypeHost, stats.RemoteCandidateType)
+	assert.Equal(t, ConnectionStateConnected, stats.ConnectionState)
+
+	stats = cb.Stats()
+	assert.Equal(t, ConnCounters{BytesReceived: 30}, stats.ConnCounters)
+	assert.Equal(t, uint64(3), stats.PacketsReceived)
+	assert.Equal(t, uint64(0), stats.PacketsDropped)
+
+	// The packet counters are reset with the bytes
+	_, err := cb.ResetCounters()
+	assert.NoError(t, err)
+	stats = cb.Stats()
+	assert.Equal(t, ConnCounters{}, stats.ConnCounters)
+	assert.Equal(t, uint64(0), stats.PacketsReceived)
+
+	assert.NoError(t, ca.Close())
+	assert.NoError(t, cb.Close())
+
+	stats = ca.Stats()
+	assert.Equal(t, ConnectionStateClosed, stats.ConnectionState)
+	assert.Equal(t, uint64(3), stats.PacketsSent)
+	assert.Equal(t, CandidateType(0), stats.LocalCandidateType)
+}
@@ -212,6 +212,8 @@ func pipeWithVNet(v *virtualNet, a0TestConfig, a1TestConfig *agentTestConfig) (*
 		NAT1To1IPs:             nat1To1IPs,
 		NAT1To1IPCandidateType: a0TestConfig.nat1To1IPCandidateType,
 		Net:                    v.net0,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg0)
@@ -235,6 +237,8 @@ func pipeWithVNet(v *virtualNet, a0TestConfig, a1TestConfig *agentTestConfig) (*
 		NAT1To1IPs:             nat1To1IPs,
 		NAT1To1IPCandidateType: a1TestConfig.nat1To1IPCandidateType,
 		Net:                    v.net1,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	bAgent, err := NewAgent(cfg1)
@@ -476,6 +480,8 @@ func TestDisconnectedToConnected(t *testing.T) {
 		DisconnectedTimeout: &disconnectTimeout,
 		KeepaliveInterval:   &keepaliveInterval,
 		taskLoopInterval:    keepaliveInterval,
+
+		AllowPrivateRemoteCandidates: true,
 	})
 	assert.NoError(t, err)
 
@@ -486,6 +492,8 @@ func TestDisconnectedToConnected(t *testing.T) {
 		DisconnectedTimeout: &disconnectTimeout,
 		KeepaliveInterval:   &keepaliveInterval,
 		taskLoopInterval:    keepaliveInterval,
+
+		AllowPrivateRemoteCandidates: true,
 	})
 	assert.NoError(t, err)
 
@@ -576,6 +584,8 @@ func TestWriteUseValidPair(t *testing.T) {
 		NetworkTypes:     supportedNetworkTypes,
 		MulticastDNSMode: MulticastDNSModeDisabled,
 		Net:              net0,
+
+		AllowPrivateRemoteCandidates: true,
 	})
 	assert.NoError(t, err)
 
@@ -583,6 +593,8 @@ func TestWriteUseValidPair(t *testing.T) {
 		NetworkTypes:     supportedNetworkTypes,
 		MulticastDNSMode: MulticastDNSModeDisabled,
 		Net:              net1,
+
+		AllowPrivateRemoteCandidates: true,
 	})
 	assert.NoError(t, err)
 
@@ -600,7 +612,7 @@ func TestWriteUseValidPair(t *testing.T) {
 	testMessage := []byte("Test Message")
 	go func() {
 		for {
-			if _, writeErr := (&Conn{agent: controllingAgent}).Write(testMessage); writeErr != nil {
+			if _, writeErr := newConn(controllingAgent, ComponentRTP).Write(testMessage); writeErr != nil {
 				return
 			}
 
@@ -609,7 +621,7 @@ func TestWriteUseValidPair(t *testing.T) {
 	}()
 
 	readBuf := make([]byte, len(testMessage))
-	_, err = (&Conn{agent: controlledAgent}).Read(readBuf)
+	_, err = newConn(controlledAgent, ComponentRTP).Read(readBuf)
 	assert.NoError(t, err)
 
 	assert.Equal(t, readBuf, testMessage)
@@ -618,3 +630,189 @@ func TestWriteUseValidPair(t *testing.T) {
 	assert.NoError(t, controllingAgent.Close())
 	assert.NoError(t, controlledAgent.Close())
 }
+
+// Assert that candidates trickled in after Dial/Accept have started
+// are paired and checked, leading to a connection
+func TestConnectivityTrickle(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "0.0.0.0/0",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	net0 := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{"192.168.0.1"},
+	})
+	assert.NoError(t, wan.AddNet(net0))
+
+	net1 := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{"192.168.0.2"},
+	})
+	assert.NoError(t, wan.AddNet(net1))
+
+	assert.NoError(t, wan.Start())
+
+	aAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:     supportedNetworkTypes,
+		MulticastDNSMode: MulticastDNSModeDisabled,
+		Net:              net0,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	bAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:     supportedNetworkTypes,
+		MulticastDNSMode: MulticastDNSModeDisabled,
+		Net:              net1,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	aUfrag, aPwd, err := aAgent.GetLocalUserCredentials()
+	assert.NoError(t, err)
+
+	bUfrag, bPwd, err := bAgent.GetLocalUserCredentials()
+	assert.NoError(t, err)
+
+	// Start connecting before any candidate has been exchanged
+	accepted := make(chan *Conn)
+	go func() {
+		conn, acceptErr := aAgent.Accept(context.TODO(), bUfrag, bPwd)
+		check(acceptErr)
+		accepted <- conn
+	}()
+
+	dialed := make(chan *Conn)
+	go func() {
+		conn, dialErr := bAgent.Dial(context.TODO(), aUfrag, aPwd)
+		check(dialErr)
+		dialed <- conn
+	}()
+
+	// Trickle every candidate to the other side as soon as it is gathered
+	aGathered, bGathered := make(chan struct{}), make(chan struct{})
+	assert.NoError(t, aAgent.OnCandidate(func(c Candidate) {
+		if c == nil {
+			close(aGathered)
+			return
+		}
+		check(bAgent.AddRemoteCandidate(copyCandidate(c)))
+	}))
+	assert.NoError(t, bAgent.OnCandidate(func(c Candidate) {
+		if c == nil {
+			close(bGathered)
+			return
+		}
+		check(aAgent.AddRemoteCandidate(copyCandidate(c)))
+	}))
+	assert.NoError(t, aAgent.GatherCandidates(context.Background()))
+	assert.NoError(t, bAgent.GatherCandidates(context.Background()))
+
+	// A nil candidate signals the end of gathering
+	<-aGathered
+	<-bGathered
+
+	aConn, bConn := <-accepted, <-dialed
+
+	assert.NoError(t, wan.Stop())
+	closePipe(t, aConn, bConn)
+}
+
+func TestRenomination(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "0.0.0.0/0",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	// The controlling agent has two host candidates to move between
+	net0 := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{"192.168.0.1", "192.168.0.3"},
+	})
+	assert.NoError(t, wan.AddNet(net0))
+
+	net1 := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{"192.168.0.2"},
+	})
+	assert.NoError(t, wan.AddNet(net1))
+
+	assert.NoError(t, wan.Start())
+
+	// Wait before nominating so that both pairs are validated
+	hostAcceptanceMinWait := 500 * time.Millisecond
+	controllingAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:          []NetworkType{NetworkTypeUDP4},
+		MulticastDNSMode:      MulticastDNSModeDisabled,
+		Net:                   net0,
+		HostAcceptanceMinWait: &hostAcceptanceMinWait,
+		EnableRenomination:    true,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	controlledAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:       []NetworkType{NetworkTypeUDP4},
+		MulticastDNSMode:   MulticastDNSModeDisabled,
+		Net:                net1,
+		EnableRenomination: true,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	controlledConn, controllingConn := connectWithVNet(controlledAgent, controllingAgent)
+
+	local, remote := controllingAgent.getSelectedPair().local, controllingAgent.getSelectedPair().remote
+	localCandidates, err := controllingAgent.GetLocalCandidates()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(localCandidates))
+	other := localCandidates[0]
+	if other.Equal(local) {
+		other = localCandidates[1]
+	}
+
+	assert.Equal(t, ErrRenominationNotControlling, controlledAgent.Renominate(remote, other))
+
+	// Both agents move to the renominated pair, and back
+	for _, renominated := range []Candidate{other, local} {
+		assert.NoError(t, controllingAgent.Renominate(renominated, remote))
+		assert.Eventually(t, func() bool {
+			return controllingAgent.getSelectedPair().local.Equal(renominated) &&
+				controlledAgent.getSelectedPair().remote.Address() == renominated.Address()
+		}, 5*time.Second, 10*time.Millisecond)
+
+		_, err = controllingConn.Write([]byte("renominated"))
+		assert.NoError(t, err)
+		buf := make([]byte, receiveMTU)
+		n, addr, readErr := controlledConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "renominated", string(buf[:n]))
+		assert.Equal(t, renominated.Address(), addr.(*net.UDPAddr).IP.String())
+	}
+
+	assert.NoError(t, wan.Stop())
+	assert.NoError(t, controllingAgent.Close())
+	assert.NoError(t, controlledAgent.Close())
+
+	a, err := NewAgent(&AgentConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, ErrRenominationDisabled, a.Renominate(local, remote))
+	assert.NoError(t, a.Close())
+}
@@ -0,0 +1,22 @@
+package ice
+
+// Direction is the direction of a packet traced by AgentConfig.PacketTrace
+type Direction int
+
+const (
+	// DirectionInbound is a packet read from the socket of a local candidate
+	DirectionInbound Direction = iota + 1
+
+	// DirectionOutbound is a packet written to the socket of a local candidate
+	DirectionOutbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	}
+	return ErrUnknownType.Error()
+}
@@ -1,6 +1,9 @@
 package ice
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 var (
 	// ErrUnknownType indicates an error with Unknown info.
@@ -32,8 +35,9 @@ var (
 	// ErrProtoType indicates an unsupported transport type was provided.
 	ErrProtoType = errors.New("invalid transport protocol type")
 
-	// ErrClosed indicates the agent is closed
-	ErrClosed = errors.New("the agent is closed")
+	// ErrClosed indicates the agent is closed, it is a net.Error that is
+	// neither a timeout nor temporary
+	ErrClosed error = &closedError{"the agent is closed"}
 
 	// ErrNoCandidatePairs indicates agent does not have a valid candidate pair
 	ErrNoCandidatePairs = errors.New("no candidate pairs available")
@@ -41,6 +45,14 @@ var (
 	// ErrCanceledByCaller indicates agent connection was canceled by the caller
 	ErrCanceledByCaller = errors.New("connecting canceled by caller")
 
+	// ErrConnectionTimeout indicates no candidate pair was selected before the
+	// ConnectionTimeout elapsed
+	ErrConnectionTimeout = errors.New("no candidate pair selected before the connection timeout")
+
+	// ErrConnectionFailed indicates the connection state is failed, the error
+	// returned carries the FailureReason
+	ErrConnectionFailed = errors.New("the connection failed")
+
 	// ErrMultipleStart indicates agent was started twice
 	ErrMultipleStart = errors.New("attempted to start agent twice")
 
@@ -102,4 +114,205 @@ var (
 
 	// ErrRunCanceled indicates a run operation was canceled by its individual done
 	ErrRunCanceled = errors.New("run was canceled by done")
+
+	// ErrTCPFramePayloadTooLarge indicates a packet can't be framed with the 16 bit length
+	// prefix used for ICE-TCP
+	ErrTCPFramePayloadTooLarge = errors.New("packet is too large to be sent over TCP")
+
+	// ErrNoTCPConnection indicates that a packet was sent over a passive TCP candidate
+	// to an address that has not connected to it
+	ErrNoTCPConnection = errors.New("no TCP connection to remote address")
+
+	// ErrConsentExpired indicates the remote stopped answering consent freshness checks
+	// on the selected candidate pair
+	ErrConsentExpired = errors.New("ICE consent expired")
+
+	// ErrInvalidInitialRTO indicates AgentConfig.InitialRTO is not positive
+	ErrInvalidInitialRTO = errors.New("initial RTO must be greater than zero")
+
+	// ErrInvalidRTOMultiplier indicates AgentConfig.RTOMultiplier would shrink the RTO
+	ErrInvalidRTOMultiplier = errors.New("RTO multiplier must be at least 1")
+
+	// ErrWriteToUnselectedRemote indicates Conn.WriteTo was called with an address that
+	// is not the remote of the selected candidate pair
+	ErrWriteToUnselectedRemote = errors.New("address is not the remote of the selected candidate pair")
+
+	// ErrCandidateTooShort indicates a candidate attribute is missing mandatory fields,
+	// or an extension attribute has no value
+	ErrCandidateTooShort = errors.New("candidate attribute is too short")
+
+	// ErrParseComponent indicates the component ID of a candidate attribute is invalid
+	ErrParseComponent = errors.New("failed to parse candidate component")
+
+	// ErrParsePriority indicates the priority of a candidate attribute is invalid
+	ErrParsePriority = errors.New("failed to parse candidate priority")
+
+	// ErrParsePort indicates the port of a candidate attribute is invalid
+	ErrParsePort = errors.New("failed to parse candidate port")
+
+	// ErrParseRelatedAddr indicates the rport of a candidate attribute is invalid
+	ErrParseRelatedAddr = errors.New("failed to parse candidate related address")
+
+	// ErrParseTCPType indicates the tcptype of a candidate attribute is invalid
+	ErrParseTCPType = errors.New("failed to parse candidate tcptype")
+
+	// ErrUnknownCandidateType indicates the type of a candidate attribute is not host, srflx, prflx or relay
+	ErrUnknownCandidateType = errors.New("unknown candidate type")
+
+	// ErrCandidatePairNotValid indicates SelectCandidatePair was called with a pair
+	// on which no connectivity check succeeded
+	ErrCandidatePairNotValid = errors.New("the candidate pair is not valid")
+
+	// ErrRenominationDisabled indicates Renominate was called without AgentConfig.EnableRenomination
+	ErrRenominationDisabled = errors.New("renomination is not enabled")
+
+	// ErrRenominationNotControlling indicates Renominate was called on an Agent that is not controlling
+	ErrRenominationNotControlling = errors.New("only the controlling agent can renominate")
+
+	// ErrInvalidDSCP indicates SetDSCP was called with a value that doesn't fit in 6 bits
+	ErrInvalidDSCP = errors.New("DSCP must be between 0 and 63")
+
+	// ErrDSCPNotSupported indicates the socket of a candidate can't mark the packets it sends
+	ErrDSCPNotSupported = errors.New("DSCP is not supported on the socket of the candidate")
+
+	// ErrSyscallConnNotSupported indicates the local candidate of the selected pair doesn't have
+	// an OS socket of its own, like TCP, relay and UDPMux candidates
+	ErrSyscallConnNotSupported = errors.New("the socket of the candidate doesn't provide a raw conn")
+
+	// ErrFileNotSupported indicates the local candidate of the selected pair doesn't have a UDP
+	// socket of its own, like TCP, relay and UDPMux candidates
+	ErrFileNotSupported = errors.New("the socket of the candidate can't be duplicated")
+
+	// ErrInvalidComponents indicates AgentConfig.Components is larger than maxComponents
+	ErrInvalidComponents = errors.New("an agent can have at most 256 components")
+
+	// ErrTURNRefreshFailed indicates the TURN server rejected the refresh of a relay
+	// candidate done with the credentials of OnTURNCredentialRefresh
+	ErrTURNRefreshFailed = errors.New("failed to refresh TURN allocation")
+
+	// ErrInvalidSoftwareName indicates AgentConfig.SoftwareName has 128 characters or more
+	ErrInvalidSoftwareName = errors.New("the software name must be fewer than 128 characters")
+
+	// ErrInvalidMaxPacketSize indicates AgentConfig.MaxPacketSize is negative or larger than receiveMTU
+	ErrInvalidMaxPacketSize = errors.New("the max packet size must be between 0 and 8192 bytes")
+
+	// ErrPacketTooLarge indicates a packet written to a Conn is larger than its MTU
+	ErrPacketTooLarge = errors.New("the packet is larger than the MTU of the Conn")
+
+	// ErrAgentNotStarted indicates a method requiring connectivity checks was
+	// called before Dial or Accept
+	ErrAgentNotStarted = errors.New("the agent was not started by Dial or Accept")
+
+	// ErrListenerConfig indicates Listen was called without a UDPMux or a Credentials lookup
+	ErrListenerConfig = errors.New("a listener requires a UDPMux and a Credentials lookup")
+
+	// ErrRelayPrewarmAfterGathering indicates PrewarmRelay was called once gathering started
+	ErrRelayPrewarmAfterGathering = errors.New("relay candidates can only be prewarmed before gathering")
+
+	// ErrListenerClosed indicates the listener is closed, it is a net.Error
+	// that is neither a timeout nor temporary
+	ErrListenerClosed error = &closedError{"the listener is closed"}
+
+	// ErrTooManyRedirects indicates a STUN or TURN server redirected gathering
+	// to an ALTERNATE-SERVER more than once
+	ErrTooManyRedirects = errors.New("too many ALTERNATE-SERVER redirects")
+
+	// ErrWouldBlock indicates TryWrite didn't send the packet because the send
+	// buffer of the socket is full
+	ErrWouldBlock = errors.New("the packet can't be sent without blocking")
+
+	// ErrRemoteCredentialsConflict indicates StartConnectivityChecks was called
+	// again with other remote credentials than the current ones
+	ErrRemoteCredentialsConflict = errors.New("the remote credentials differ from the ones the checks were started with")
+
+	// ErrRelayOnlyCandidateTypes indicates RelayOnly is set with CandidateTypes
+	// other than CandidateTypeRelay
+	ErrRelayOnlyCandidateTypes = errors.New("relay only agents can only gather relay candidates")
+
+	// ErrRelayGatheringFailed indicates RelayOnly is set and gathering completed
+	// without a relay candidate
+	ErrRelayGatheringFailed = errors.New("no relay candidate was gathered by a relay only agent")
+
+	// ErrNoSTUNServer indicates DetectNATType is called without a STUN server
+	// in AgentConfig.Urls
+	ErrNoSTUNServer = errors.New("no STUN server to detect the NAT type with")
+
+	// ErrRateLimited indicates a packet was dropped because it exceeds the
+	// bandwidth set with Conn.SetMaxBandwidth
+	ErrRateLimited = errors.New("the packet exceeds the maximum bandwidth")
+
+	// ErrNATDetectionUnsupported indicates the STUN server doesn't support the
+	// NAT behavior discovery of RFC 5780
+	ErrNATDetectionUnsupported = errors.New("the STUN server doesn't support NAT behavior discovery")
 )
+
+// joinedError is the errors of several steps that failed together, e.g. of
+// the teardown of an Agent
+type joinedError struct {
+	errs []error
+}
+
+// joinErrors returns an error wrapping errs, the ones that are nil are
+// discarded. It returns nil if they all are, and the error itself if only one
+// is not.
+func joinErrors(errs ...error) error {
+	var nonNil []error
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	default:
+		return &joinedError{errs: nonNil}
+	}
+}
+
+// Error returns the messages of the errors, one per line
+func (e *joinedError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is returns true if one of the errors is target, for errors.Is
+func (e *joinedError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target, for errors.As
+func (e *joinedError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the errors
+func (e *joinedError) Unwrap() []error {
+	return e.errs
+}
+
+// closedError is the error of an operation on something that is closed, like
+// the net.ErrClosed of Go 1.16
+type closedError struct {
+	msg string
+}
+
+func (e *closedError) Error() string   { return e.msg }
+func (e *closedError) Timeout() bool   { return false }
+func (e *closedError) Temporary() bool { return false }
@@ -1,8 +1,10 @@
 package ice
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"reflect"
 	"sync"
@@ -11,10 +13,7 @@ import (
 	"github.com/pion/dtls/v2"
 	"github.com/pion/logging"
 	"github.com/pion/turn/v2"
-)
-
-const (
-	stunGatherTimeout = time.Second * 5
+	"golang.org/x/net/proxy"
 )
 
 type closeable interface {
@@ -53,8 +52,15 @@ func (f *fakePacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return f.nextConn.Write(p)
 }
 
-// GatherCandidates initiates the trickle based gathering process.
-func (a *Agent) GatherCandidates() error {
+// GatherCandidates initiates the trickle based gathering process, candidates are
+// delivered to the OnCandidate handler as they are gathered. Cancelling ctx, or
+// reaching its deadline, aborts the STUN and TURN transactions still in flight and
+// completes gathering with the candidates gathered so far.
+func (a *Agent) GatherCandidates(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	gatherErrChan := make(chan error, 1)
 
 	runErr := a.run(func(agent *Agent) {
@@ -66,7 +72,7 @@ func (a *Agent) GatherCandidates() error {
 			return
 		}
 
-		a.gatherCandidates()
+		a.gatheringDone = a.gatherCandidates(ctx)
 		gatherErrChan <- nil
 	}, nil)
 	if runErr != nil {
@@ -75,13 +81,118 @@ func (a *Agent) GatherCandidates() error {
 	return <-gatherErrChan
 }
 
-func (a *Agent) gatherCandidates() <-chan struct{} {
-	gatherStateUpdated := make(chan bool)
+// GetGatheringState returns the current gathering state of the Agent
+func (a *Agent) GetGatheringState() (GatheringState, error) {
+	res := make(chan GatheringState, 1)
+	if err := a.run(func(agent *Agent) {
+		res <- agent.gatheringState
+	}, nil); err != nil {
+		return GatheringState(Unknown), err
+	}
 
-	a.chanCandidate = make(chan Candidate, 1)
-	var closeChanCandidateOnce sync.Once
+	return <-res, nil
+}
+
+// OnGatheringStateChange sets a handler that is fired when the gathering state changes.
+// GatheringStateComplete is only fired once every candidate type has been gathered or has failed.
+func (a *Agent) OnGatheringStateChange(f func(GatheringState)) error {
+	a.onGatheringStateChangeHdlr.Store(f)
+	return nil
+}
+
+func (a *Agent) onGatheringStateChange(s GatheringState) {
+	if hdlr, ok := a.onGatheringStateChangeHdlr.Load().(func(GatheringState)); ok {
+		hdlr(s)
+	}
+}
+
+// GatheringErrors returns the last error of each candidate type that failed to
+// be gathered, e.g. a STUN timeout for CandidateTypeServerReflexive, or the
+// 401 response of a TURN server for CandidateTypeRelay. These failures are
+// not fatal, the Agent connects with the candidates that were gathered. A
+// type is missing when it was gathered without error. The errors are cleared
+// when gathering starts again after a Restart.
+func (a *Agent) GatheringErrors() (map[CandidateType]error, error) {
+	res := make(chan map[CandidateType]error, 1)
+	if err := a.run(func(agent *Agent) {
+		errs := make(map[CandidateType]error, len(agent.gatheringErrors))
+		for t, err := range agent.gatheringErrors {
+			errs[t] = err
+		}
+		res <- errs
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	return <-res, nil
+}
+
+// DuplicateCandidates returns how many gathered local candidates were
+// discarded as duplicates since the Agent was created, they are not paired. A
+// candidate is a duplicate of one gathered before it with the same type,
+// transport, address, port and base, e.g. the srflx candidates two STUN
+// servers returned the same reflexive address for. An IP of several
+// interfaces, like an address a VPN mirrors, is gathered once per component
+// and counts as one duplicate for the others.
+func (a *Agent) DuplicateCandidates() (uint64, error) {
+	res := make(chan uint64, 1)
+	if err := a.run(func(agent *Agent) {
+		res <- agent.duplicateCandidates
+	}, nil); err != nil {
+		return 0, err
+	}
+
+	return <-res, nil
+}
+
+// duplicateGathered counts a candidate that wasn't gathered because it is a
+// duplicate
+func (a *Agent) duplicateGathered() {
+	if err := a.run(func(agent *Agent) {
+		agent.duplicateCandidates++
+	}, nil); err != nil {
+		a.log.Warnf("Failed to count duplicate candidate: %v", err)
+	}
+}
+
+// gatheringFailed records err as the last gathering error of t
+func (a *Agent) gatheringFailed(t CandidateType, err error) {
+	if runErr := a.run(func(agent *Agent) {
+		agent.gatheringErrors[t] = err
+	}, nil); runErr != nil {
+		a.log.Warnf("Failed to record gathering error %v: %v", err, runErr)
+	}
+}
+
+// onCancel calls f if ctx is done before stop is called, this aborts blocking
+// gathering steps so that gathering doesn't wait for them to time out.
+// stop returns whether f was called.
+func onCancel(ctx context.Context, f func()) (stop func() bool) {
+	stopCh := make(chan struct{})
+	aborted := make(chan bool, 1)
 	go func() {
-		for c := range a.chanCandidate {
+		select {
+		case <-ctx.Done():
+			f()
+			aborted <- true
+		case <-stopCh:
+			aborted <- false
+		}
+	}()
+
+	return func() bool {
+		close(stopCh)
+		return <-aborted
+	}
+}
+
+// startCandidateRoutine creates chanCandidate, and delivers the candidates
+// sent on it to the OnCandidate handler. The nil candidate signaling the end
+// of gathering is delivered once it is closed.
+func (a *Agent) startCandidateRoutine() {
+	a.chanCandidate = make(chan Candidate, 1)
+	go func(chanCandidate <-chan Candidate) {
+		for c := range chanCandidate {
 			if onCandidateHdlr, ok := a.onCandidateHdlr.Load().(func(Candidate)); ok {
 				onCandidateHdlr(c)
 			}
@@ -89,7 +200,19 @@ func (a *Agent) gatherCandidates() <-chan struct{} {
 		if onCandidateHdlr, ok := a.onCandidateHdlr.Load().(func(Candidate)); ok {
 			onCandidateHdlr(nil)
 		}
-	}()
+	}(a.chanCandidate)
+}
+
+// gatherCandidates gathers until every gatherer is done, ctx is cancelled or the Agent is closed
+func (a *Agent) gatherCandidates(ctx context.Context) <-chan struct{} {
+	gatherStateUpdated := make(chan bool)
+
+	a.startCandidateRoutine()
+	var closeChanCandidateOnce sync.Once
+
+	// A lite remote is publicly reachable, relaying to it is only needed to
+	// hide the local IPs
+	gatherRelay := !a.remoteLite || a.relayOnly
 
 	done := make(chan struct{})
 
@@ -101,28 +224,52 @@ func (a *Agent) gatherCandidates() <-chan struct{} {
 			close(done)
 		}()
 
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-a.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
 		if err := a.run(func(agent *Agent) {
 			a.gatheringState = GatheringStateGathering
+			a.gatheringErrors = map[CandidateType]error{}
 			close(gatherStateUpdated)
 		}, nil); err != nil {
 			a.log.Warnf("failed to set gatheringState to GatheringStateGathering for gatherCandidates: %v", err)
 			return
 		}
 		<-gatherStateUpdated
+		a.onGatheringStateChange(GatheringStateGathering)
 
 		var wg sync.WaitGroup
-		for _, t := range a.candidateTypes {
-			switch t {
-			case CandidateTypeHost:
-				a.gatherCandidatesLocal(a.networkTypes)
-			case CandidateTypeServerReflexive:
-				a.gatherCandidatesSrflx(a.urls, a.networkTypes, &wg)
-				if a.extIPMapper != nil && a.extIPMapper.candidateType == CandidateTypeServerReflexive {
-					a.gatherCandidatesSrflxMapped(a.networkTypes, &wg)
-				}
-			case CandidateTypeRelay:
-				if err := a.gatherCandidatesRelay(a.urls, &wg); err != nil {
-					a.log.Errorf("Failed to gather relay candidates: %v\n", err)
+		for component := uint16(1); component <= a.components; component++ {
+			for _, t := range a.candidateTypes {
+				switch t {
+				case CandidateTypeHost:
+					a.gatherCandidatesLocal(a.networkTypes, component)
+					if a.udpMux != nil && component == ComponentRTP {
+						a.gatherCandidatesLocalUDPMux(a.networkTypes)
+					}
+					if component == ComponentRTP {
+						a.gatherCandidatesLocalUDPConns(a.networkTypes)
+					}
+				case CandidateTypeServerReflexive:
+					a.gatherCandidatesSrflx(ctx, a.urls, a.networkTypes, component, &wg)
+					if a.extIPMapper != nil && a.extIPMapper.candidateType == CandidateTypeServerReflexive {
+						a.gatherCandidatesSrflxMapped(a.networkTypes, component, &wg)
+					}
+				case CandidateTypeRelay:
+					if !gatherRelay {
+						continue
+					}
+					if err := a.gatherCandidatesRelay(ctx, a.urls, component, &wg); err != nil {
+						a.log.Errorf("Failed to gather relay candidates: %v\n", err)
+						a.gatheringFailed(CandidateTypeRelay, err)
+					}
 				}
 			}
 		}
@@ -133,23 +280,58 @@ func (a *Agent) gatherCandidates() <-chan struct{} {
 				close(agent.chanCandidate)
 			})
 			a.gatheringState = GatheringStateComplete
+
+			// Falling back to the direct candidates would expose the local IPs
+			if a.relayGatheringFailed() {
+				a.log.Warnf("no relay candidate gathered, failing the relay only agent")
+				a.fail(FailureReasonGatheringFailed)
+				a.onConnectionTimeoutOnce.Do(func() { close(a.onConnectionTimeout) })
+			}
 		}, nil); err != nil {
 			a.log.Warnf("Failed to stop OnCandidate handler routine and update gatheringState: %v\n", err)
 			return
 		}
+		a.onGatheringStateChange(GatheringStateComplete)
 	}()
 
 	return done
 }
 
-func (a *Agent) gatherCandidatesLocal(networkTypes []NetworkType) {
-	localIPs, err := localInterfaces(a.net, a.interfaceFilter, networkTypes)
+func (a *Agent) gatherCandidatesLocal(networkTypes []NetworkType, component uint16) {
+	localAddrs, err := localAddrs(a.net, a.gatheredInterfaceFilter(), a.ipFilter, networkTypes)
 	if err != nil {
 		a.log.Warnf("failed to iterate local interfaces, host candidates will not be gathered %s", err)
+		a.gatheringFailed(CandidateTypeHost, fmt.Errorf("failed to iterate local interfaces: %w", err))
 		return
 	}
 
-	for _, ip := range localIPs {
+	a.gatherCandidatesLocalAddrs(localAddrs, networkTypes, component)
+}
+
+// gatherCandidatesLocalAddrs gathers the host candidates of component on localAddrs
+func (a *Agent) gatherCandidatesLocalAddrs(localAddrs []net.IPAddr, networkTypes []NetworkType, component uint16) {
+	if err := a.run(func(agent *Agent) {
+		if agent.hostLocalAddrs == nil {
+			agent.hostLocalAddrs = map[string]net.IPAddr{}
+		}
+		for _, localAddr := range localAddrs {
+			agent.hostLocalAddrs[localAddr.String()] = localAddr
+		}
+	}, nil); err != nil {
+		return
+	}
+
+	// An IP can be of several interfaces, its candidates are gathered on the first one
+	gathered := map[string]bool{}
+	for _, localAddr := range localAddrs {
+		ip, zone := localAddr.IP, localAddr.Zone
+		if gathered[localAddr.String()] {
+			a.log.Debugf("skipping %s, its host candidates are already gathered", localAddr.String())
+			a.duplicateGathered()
+			continue
+		}
+		gathered[localAddr.String()] = true
+
 		mappedIP := ip
 		if a.mDNSMode != MulticastDNSModeQueryAndGather && a.extIPMapper != nil && a.extIPMapper.candidateType == CandidateTypeHost {
 			if _mappedIP, err := a.extIPMapper.findExternalIP(ip.String()); err == nil {
@@ -162,48 +344,346 @@ func (a *Agent) gatherCandidatesLocal(networkTypes []NetworkType) {
 		address := mappedIP.String()
 		if a.mDNSMode == MulticastDNSModeQueryAndGather {
 			address = a.mDNSName
+		} else if mappedIP.Equal(ip) {
+			address = joinIPZone(ip, zone)
 		}
 
-		for _, network := range supportedNetworks {
-			conn, err := listenUDPInPortRange(a.net, a.log, int(a.portmax), int(a.portmin), network, &net.UDPAddr{IP: ip, Port: 0})
-			if err != nil {
-				a.log.Warnf("could not listen %s %s\n", network, ip)
-				continue
-			}
-
-			port := conn.LocalAddr().(*net.UDPAddr).Port
-			hostConfig := CandidateHostConfig{
-				Network:   network,
-				Address:   address,
-				Port:      port,
-				Component: ComponentRTP,
+		for _, network := range a.hostNetworks(localAddr, networkTypes, component) {
+			var conns []hostConn
+			switch network {
+			case tcp:
+				conns = a.listenHostTCP(ip)
+			case udp:
+				conn, err := listenUDPInPortRange(a.net, a.log, int(a.portmax), int(a.portmin), network, &net.UDPAddr{IP: ip, Port: 0, Zone: zone})
+				if err != nil {
+					a.log.Warnf("could not listen %s %s: %v\n", network, joinIPZone(ip, zone), err)
+					a.gatheringFailed(CandidateTypeHost, fmt.Errorf("failed to listen %s %s: %w", network, joinIPZone(ip, zone), err))
+					continue
+				}
+				a.setSocketBuffers(conn)
+				conns = append(conns, hostConn{conn: conn, port: conn.LocalAddr().(*net.UDPAddr).Port})
 			}
 
-			c, err := NewCandidateHost(&hostConfig)
-			if err != nil {
-				closeConnAndLog(conn, a.log, fmt.Sprintf("Failed to create host candidate: %s %s %d: %v\n", network, mappedIP, port, err))
-				continue
-			}
+			for _, hc := range conns {
+				hostConfig := CandidateHostConfig{
+					Network:   network,
+					Address:   address,
+					Port:      hc.port,
+					Component: component,
+					TCPType:   hc.tcpType,
+				}
 
-			if a.mDNSMode == MulticastDNSModeQueryAndGather {
-				if err = c.setIP(ip); err != nil {
-					closeConnAndLog(conn, a.log, fmt.Sprintf("Failed to create host candidate: %s %s %d: %v\n", network, mappedIP, port, err))
+				c, err := NewCandidateHost(&hostConfig)
+				if err != nil {
+					closeConnAndLog(hc.conn, a.log, fmt.Sprintf("Failed to create host candidate: %s %s %d: %v\n", network, mappedIP, hc.port, err))
 					continue
 				}
-			}
 
-			if err := a.addCandidate(c, conn); err != nil {
-				if closeErr := c.close(); closeErr != nil {
-					a.log.Warnf("Failed to close candidate: %v", closeErr)
+				if a.mDNSMode == MulticastDNSModeQueryAndGather {
+					if err = c.setIPZone(ip, zone); err != nil {
+						closeConnAndLog(hc.conn, a.log, fmt.Sprintf("Failed to create host candidate: %s %s %d: %v\n", network, mappedIP, hc.port, err))
+						continue
+					}
+				}
+
+				if err := a.addCandidate(c, hc.conn); err != nil {
+					if closeErr := c.close(); closeErr != nil {
+						a.log.Warnf("Failed to close candidate: %v", closeErr)
+					}
+					a.log.Warnf("Failed to append to localCandidates and run onCandidateHdlr: %v\n", err)
 				}
-				a.log.Warnf("Failed to append to localCandidates and run onCandidateHdlr: %v\n", err)
 			}
 		}
 	}
 }
 
-func (a *Agent) gatherCandidatesSrflxMapped(networkTypes []NetworkType, wg *sync.WaitGroup) {
+// hostCandidateIP returns the IP and the address of the host candidate of a
+// socket bound to udpAddr. When udpAddr is unspecified the first matching
+// local interface IP is used. ok is false if no candidate must be gathered.
+func (a *Agent) hostCandidateIP(udpAddr *net.UDPAddr, networkTypes []NetworkType) (ip net.IP, address string, ok bool) {
+	ip = udpAddr.IP
+	if ip == nil || ip.IsUnspecified() {
+		localIPs, err := localInterfaces(a.net, a.gatheredInterfaceFilter(), a.ipFilter, networkTypes)
+		if err != nil {
+			a.log.Warnf("failed to iterate local interfaces, host candidates will not be gathered %s", err)
+			return nil, "", false
+		}
+
+		ip = nil
+		for _, localIP := range localIPs {
+			// An unspecified IPv4 address only accepts IPv4 traffic
+			if udpAddr.IP.To4() == nil || localIP.To4() != nil {
+				ip = localIP
+				break
+			}
+		}
+		if ip == nil {
+			a.log.Warnf("no local interface IP for address %s", udpAddr)
+			return nil, "", false
+		}
+	} else if a.ipFilter != nil && !a.ipFilter(ip) {
+		return nil, "", false
+	}
+
+	if networkType, err := determineNetworkType(udp, ip); err != nil || !containsNetworkType(networkType, networkTypes) {
+		return nil, "", false
+	}
+
+	return ip, a.hostCandidateAddress(ip), true
+}
+
+// hostCandidateAddress returns the address of the host candidate of ip, its
+// mDNS name or its 1:1 NAT mapping if enabled
+func (a *Agent) hostCandidateAddress(ip net.IP) string {
+	address := ip.String()
+	if a.mDNSMode == MulticastDNSModeQueryAndGather {
+		address = a.mDNSName
+	} else if a.extIPMapper != nil && a.extIPMapper.candidateType == CandidateTypeHost {
+		if mappedIP, err := a.extIPMapper.findExternalIP(ip.String()); err == nil {
+			address = mappedIP.String()
+		} else {
+			a.log.Warnf("1:1 NAT mapping is enabled but no external IP is found for %s\n", ip.String())
+		}
+	}
+	return address
+}
+
+// hostNetworks returns the networks gatherCandidatesLocalAddrs gathers the
+// host candidates of component on for localAddr
+func (a *Agent) hostNetworks(localAddr net.IPAddr, networkTypes []NetworkType, component uint16) []string {
+	var networks []string
+	for _, network := range supportedNetworks {
+		if networkType, err := determineNetworkType(network, localAddr.IP); err != nil || !containsNetworkType(networkType, networkTypes) {
+			continue
+		}
+
+		switch network {
+		case tcp:
+			if localAddr.Zone != "" {
+				continue // ICE-TCP is not gathered on link-local IPs
+			}
+		case udp:
+			if a.udpMux != nil && component == ComponentRTP {
+				continue // gathered by gatherCandidatesLocalUDPMux
+			}
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// gatherCandidatesLocalUDPMux gathers the single host UDP candidate on the address of a.udpMux
+func (a *Agent) gatherCandidatesLocalUDPMux(networkTypes []NetworkType) {
+	udpAddr, ok := a.udpMux.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		a.log.Warnf("UDPMux address %s is not a UDP address, no host candidate gathered on it", a.udpMux.LocalAddr())
+		return
+	}
+
+	ip, address, ok := a.hostCandidateIP(udpAddr, networkTypes)
+	if !ok {
+		return
+	}
+
+	conn, err := a.udpMux.GetConn(a.localUfrag)
+	if err != nil {
+		a.log.Warnf("could not get UDPMux conn for %s: %v", a.localUfrag, err)
+		return
+	}
+
+	a.addHostUDPCandidate(conn, ip, address, udpAddr.Port)
+}
+
+// gatherCandidatesLocalUDPConns gathers a host UDP candidate for every
+// socket of AgentConfig.UDPConns
+func (a *Agent) gatherCandidatesLocalUDPConns(networkTypes []NetworkType) {
+	for _, udpConn := range a.udpConns {
+		udpAddr, ok := udpConn.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		if (udpAddr.IP == nil || udpAddr.IP.IsUnspecified()) && a.gatherCandidatesLocalPktInfo(udpConn, udpAddr, networkTypes) {
+			continue
+		}
+
+		ip, address, ok := a.hostCandidateIP(udpAddr, networkTypes)
+		if !ok {
+			continue
+		}
+
+		var conn net.PacketConn = udpConn
+		if !a.closeUDPConns {
+			conn = &borrowedUDPConn{UDPConn: udpConn}
+		}
+		a.addHostUDPCandidate(conn, ip, address, udpAddr.Port)
+	}
+}
+
+// gatherCandidatesLocalPktInfo gathers a host UDP candidate for every local
+// interface IP on udpConn, a socket bound to an unspecified address. The
+// candidates tell their packets apart with IP_PKTINFO, it returns false if
+// the platform doesn't support it. With mDNS, the candidates would all have
+// the same address, so a single one is gathered as without IP_PKTINFO.
+func (a *Agent) gatherCandidatesLocalPktInfo(udpConn *net.UDPConn, udpAddr *net.UDPAddr, networkTypes []NetworkType) bool {
+	if a.mDNSMode == MulticastDNSModeQueryAndGather {
+		return false
+	}
+
+	localIPs, err := localInterfaces(a.net, a.gatheredInterfaceFilter(), a.ipFilter, networkTypes)
+	if err != nil {
+		return false
+	}
+	var ips []net.IP
+	for _, ip := range localIPs {
+		// An unspecified IPv4 address only accepts IPv4 traffic
+		if udpAddr.IP.To4() != nil && ip.To4() == nil {
+			continue
+		}
+		if networkType, err := determineNetworkType(udp, ip); err == nil && containsNetworkType(networkType, networkTypes) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return false
+	}
+
+	pc, err := newPktInfoPacketConn(udpConn)
+	if err != nil {
+		a.log.Debugf("IP_PKTINFO is not supported on %s, gathering a single host candidate: %v", udpAddr, err)
+		return false
+	}
+
+	mux := newPktInfoMux(udpConn, pc, !a.closeUDPConns, a.log)
+	conns := make([]*pktInfoConn, len(ips))
+	for i, ip := range ips {
+		conns[i] = mux.conn(ip)
+	}
+	for i, ip := range ips {
+		a.addHostUDPCandidate(conns[i], ip, a.hostCandidateAddress(ip), udpAddr.Port)
+	}
+	return true
+}
+
+// addHostUDPCandidate adds the ComponentRTP host candidate of conn, a socket
+// shared or owned by the application
+func (a *Agent) addHostUDPCandidate(conn net.PacketConn, ip net.IP, address string, port int) {
+	c, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   udp,
+		Address:   address,
+		Port:      port,
+		Component: ComponentRTP,
+	})
+	if err != nil {
+		closeConnAndLog(conn, a.log, fmt.Sprintf("Failed to create host candidate: %s %s %d: %v\n", udp, address, port, err))
+		return
+	}
+
+	if a.mDNSMode == MulticastDNSModeQueryAndGather {
+		if err = c.setIP(ip); err != nil {
+			closeConnAndLog(conn, a.log, fmt.Sprintf("Failed to create host candidate: %s %s %d: %v\n", udp, address, port, err))
+			return
+		}
+	}
+
+	if err := a.addCandidate(c, conn); err != nil {
+		if closeErr := c.close(); closeErr != nil {
+			a.log.Warnf("Failed to close candidate: %v", closeErr)
+		}
+		a.log.Warnf("Failed to append to localCandidates and run onCandidateHdlr: %v\n", err)
+	}
+}
+
+// borrowedUDPConn is a socket of AgentConfig.UDPConns that stays open when
+// its candidate is closed, closing it only unblocks the read of the candidate
+type borrowedUDPConn struct {
+	*net.UDPConn
+
+	mu      sync.Mutex
+	reading bool
+	closed  bool
+}
+
+func (c *borrowedUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, nil, io.ErrClosedPipe
+	}
+	c.reading = true
+	c.mu.Unlock()
+
+	n, addr, err := c.UDPConn.ReadFrom(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reading = false
+	if c.closed {
+		// Clear the deadline set by Close, the socket is handed back as it was
+		if deadlineErr := c.UDPConn.SetReadDeadline(time.Time{}); deadlineErr != nil {
+			return 0, nil, deadlineErr
+		}
+		return 0, nil, io.ErrClosedPipe
+	}
+	return n, addr, err
+}
+
+func (c *borrowedUDPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.reading {
+		return c.UDPConn.SetReadDeadline(time.Now())
+	}
+	return nil
+}
+
+// hostConn is a conn a host candidate is gathered for
+type hostConn struct {
+	conn    net.PacketConn
+	port    int
+	tcpType TCPType
+}
+
+// listenHostTCP creates a passive TCP candidate conn listening on ip, and an
+// active one that dials from ip. Simultaneous-open candidates are not gathered.
+// https://tools.ietf.org/html/rfc6544#section-5.1
+func (a *Agent) listenHostTCP(ip net.IP) []hostConn {
+	if a.net.IsVirtual() {
+		a.log.Warn("TCP candidates are only supported on the OS network")
+		return nil
+	}
+
+	listener, err := listenTCPInPortRange(a.log, int(a.portmax), int(a.portmin), tcp, &net.TCPAddr{IP: ip, Port: 0})
+	if err != nil {
+		a.log.Warnf("could not listen %s %s: %v\n", tcp, ip, err)
+		return nil
+	}
+
+	return []hostConn{
+		{
+			conn:    newPassiveTCPPacketConn(listener, a.log),
+			port:    listener.Addr().(*net.TCPAddr).Port,
+			tcpType: TCPTypePassive,
+		},
+		{
+			conn:    newActiveTCPPacketConn(ip, a.log),
+			port:    tcpActivePort,
+			tcpType: TCPTypeActive,
+		},
+	}
+}
+
+func (a *Agent) gatherCandidatesSrflxMapped(networkTypes []NetworkType, component uint16, wg *sync.WaitGroup) {
 	for _, networkType := range networkTypes {
+		if networkType.IsReliable() {
+			continue
+		}
+
 		network := networkType.String()
 		wg.Add(1)
 		go func() {
@@ -213,6 +693,7 @@ func (a *Agent) gatherCandidatesSrflxMapped(networkTypes []NetworkType, wg *sync
 				a.log.Warnf("Failed to listen %s: %v\n", network, err)
 				return
 			}
+			a.setSocketBuffers(conn)
 
 			laddr := conn.LocalAddr().(*net.UDPAddr)
 			mappedIP, err := a.extIPMapper.findExternalIP(laddr.IP.String())
@@ -225,7 +706,7 @@ func (a *Agent) gatherCandidatesSrflxMapped(networkTypes []NetworkType, wg *sync
 				Network:   network,
 				Address:   mappedIP.String(),
 				Port:      laddr.Port,
-				Component: ComponentRTP,
+				Component: component,
 				RelAddr:   laddr.IP.String(),
 				RelPort:   laddr.Port,
 			}
@@ -249,8 +730,18 @@ func (a *Agent) gatherCandidatesSrflxMapped(networkTypes []NetworkType, wg *sync
 	}
 }
 
-func (a *Agent) gatherCandidatesSrflx(urls []*URL, networkTypes []NetworkType, wg *sync.WaitGroup) {
+func (a *Agent) gatherCandidatesSrflx(ctx context.Context, urls []*URL, networkTypes []NetworkType, component uint16, wg *sync.WaitGroup) {
 	for _, networkType := range networkTypes {
+		if networkType.IsReliable() {
+			continue
+		}
+
+		// Servers listed more than once, and servers returning a reflexive
+		// address that was already gathered, don't produce another candidate
+		var mu sync.Mutex
+		queried := map[string]bool{}
+		mapped := map[string]bool{}
+
 		for i := range urls {
 			wg.Add(1)
 			go func(url URL, network string) {
@@ -259,30 +750,61 @@ func (a *Agent) gatherCandidatesSrflx(urls []*URL, networkTypes []NetworkType, w
 				serverAddr, err := a.net.ResolveUDPAddr(network, hostPort)
 				if err != nil {
 					a.log.Warnf("failed to resolve stun host: %s: %v", hostPort, err)
+					a.gatheringFailed(CandidateTypeServerReflexive, fmt.Errorf("failed to resolve %s: %w", url.String(), err))
+					return
+				}
+
+				mu.Lock()
+				duplicate := queried[serverAddr.String()]
+				queried[serverAddr.String()] = true
+				mu.Unlock()
+				if duplicate {
+					a.log.Debugf("skipping %s %s, %s is already queried", network, url, serverAddr)
 					return
 				}
 
 				conn, err := listenUDPInPortRange(a.net, a.log, int(a.portmax), int(a.portmin), network, &net.UDPAddr{IP: nil, Port: 0})
 				if err != nil {
 					closeConnAndLog(conn, a.log, fmt.Sprintf("Failed to listen for %s: %v\n", serverAddr.String(), err))
+					a.gatheringFailed(CandidateTypeServerReflexive, fmt.Errorf("failed to listen for %s: %w", url.String(), err))
 					return
 				}
+				a.setSocketBuffers(conn)
 
-				xoraddr, err := getXORMappedAddr(conn, serverAddr, stunGatherTimeout)
-				if err != nil {
+				stop := onCancel(ctx, func() {
+					_ = conn.Close()
+				})
+				xoraddr, err := getXORMappedAddr(conn, serverAddr, a.stunGatherTimeout, a.softwareName)
+				if aborted := stop(); aborted {
+					return
+				} else if err != nil {
 					closeConnAndLog(conn, a.log, fmt.Sprintf("could not get server reflexive address %s %s: %v\n", network, url, err))
+					a.gatheringFailed(CandidateTypeServerReflexive, fmt.Errorf("failed to query %s: %w", url.String(), err))
 					return
 				}
 
 				ip := xoraddr.IP
 				port := xoraddr.Port
 
+				mu.Lock()
+				duplicate = mapped[xoraddr.String()]
+				mapped[xoraddr.String()] = true
+				mu.Unlock()
+				if duplicate {
+					a.log.Debugf("skipping %s %s, it returned the already gathered reflexive address %s", network, url, xoraddr)
+					a.duplicateGathered()
+					if closeErr := conn.Close(); closeErr != nil {
+						a.log.Warnf("Failed to close conn: %v", closeErr)
+					}
+					return
+				}
+
 				laddr := conn.LocalAddr().(*net.UDPAddr)
 				srflxConfig := CandidateServerReflexiveConfig{
 					Network:   network,
 					Address:   ip.String(),
 					Port:      port,
-					Component: ComponentRTP,
+					Component: component,
 					RelAddr:   laddr.IP.String(),
 					RelPort:   laddr.Port,
 				}
@@ -291,6 +813,7 @@ func (a *Agent) gatherCandidatesSrflx(urls []*URL, networkTypes []NetworkType, w
 					closeConnAndLog(conn, a.log, fmt.Sprintf("Failed to create server reflexive candidate: %s %s %d: %v\n", network, ip, port, err))
 					return
 				}
+				c.server = url.String()
 
 				if err := a.addCandidate(c, conn); err != nil {
 					if closeErr := c.close(); closeErr != nil {
@@ -303,8 +826,7 @@ func (a *Agent) gatherCandidatesSrflx(urls []*URL, networkTypes []NetworkType, w
 	}
 }
 
-func (a *Agent) gatherCandidatesRelay(urls []*URL, wg *sync.WaitGroup) error {
-	network := NetworkTypeUDP4.String() // TODO IPv6
+func (a *Agent) gatherCandidatesRelay(ctx context.Context, urls []*URL, component uint16, wg *sync.WaitGroup) error {
 	for i := range urls {
 		switch {
 		case urls[i].Scheme != SchemeTypeTURN && urls[i].Scheme != SchemeTypeTURNS:
@@ -318,131 +840,344 @@ func (a *Agent) gatherCandidatesRelay(urls []*URL, wg *sync.WaitGroup) error {
 		wg.Add(1)
 		go func(url URL) {
 			defer wg.Done()
-			TURNServerAddr := fmt.Sprintf("%s:%d", url.Host, url.Port)
-			var (
-				locConn net.PacketConn
-				err     error
-				RelAddr string
-				RelPort int
-			)
-
-			switch {
-			case url.Proto == ProtoTypeUDP && url.Scheme == SchemeTypeTURN:
-				if locConn, err = a.net.ListenPacket(network, "0.0.0.0:0"); err != nil {
-					a.log.Warnf("Failed to listen %s: %v\n", network, err)
-					return
-				}
 
-				RelAddr = locConn.LocalAddr().(*net.UDPAddr).IP.String()
-				RelPort = locConn.LocalAddr().(*net.UDPAddr).Port
-			case url.Proto == ProtoTypeTCP && url.Scheme == SchemeTypeTURN:
-				tcpAddr, connectErr := net.ResolveTCPAddr(NetworkTypeTCP4.String(), TURNServerAddr)
-				if connectErr != nil {
-					a.log.Warnf("Failed to resolve TCP Addr %s: %v\n", TURNServerAddr, connectErr)
-					return
+			// An allocation made by PrewarmRelay is used if it is still alive
+			alloc := a.takePrewarmedRelay(url)
+			if alloc != nil {
+				if err := a.refreshPrewarmedRelay(alloc, url); err != nil {
+					a.log.Warnf("Failed to refresh prewarmed allocation on %s, allocating again: %v", url.String(), err)
+					if closeErr := alloc.close(); closeErr != nil {
+						a.log.Warnf("Failed to close prewarmed allocation: %v", closeErr)
+					}
+					alloc = nil
 				}
-
-				conn, connectErr := net.DialTCP(NetworkTypeTCP4.String(), nil, tcpAddr)
-				if connectErr != nil {
-					a.log.Warnf("Failed to Dial TCP Addr %s: %v\n", TURNServerAddr, connectErr)
+			}
+			if alloc == nil {
+				var err error
+				if alloc, err = a.allocateRelay(ctx, url); err != nil {
+					if ctx.Err() == nil {
+						a.log.Warnf("Failed to allocate on %s: %v\n", url.String(), err)
+						a.gatheringFailed(CandidateTypeRelay, fmt.Errorf("failed to allocate on %s: %w", url.String(), err))
+					}
 					return
 				}
+			}
 
-				RelAddr = conn.LocalAddr().(*net.TCPAddr).IP.String()
-				RelPort = conn.LocalAddr().(*net.TCPAddr).Port
-				locConn = turn.NewSTUNConn(conn)
-			case url.Proto == ProtoTypeUDP && url.Scheme == SchemeTypeTURNS:
-				udpAddr, connectErr := net.ResolveUDPAddr(network, TURNServerAddr)
-				if connectErr != nil {
-					a.log.Warnf("Failed to resolve UDP Addr %s: %v\n", TURNServerAddr, connectErr)
-					return
-				}
+			a.addRelayCandidate(alloc, url, component)
+		}(*urls[i])
+	}
 
-				conn, connectErr := dtls.Dial(network, udpAddr, &dtls.Config{
-					InsecureSkipVerify: a.insecureSkipVerify, //nolint:gosec
-				})
-				if connectErr != nil {
-					a.log.Warnf("Failed to Dial DTLS Addr %s: %v\n", TURNServerAddr, connectErr)
-					return
-				}
+	return nil
+}
 
-				RelAddr = conn.LocalAddr().(*net.UDPAddr).IP.String()
-				RelPort = conn.LocalAddr().(*net.UDPAddr).Port
-				locConn = &fakePacketConn{conn}
-			case url.Proto == ProtoTypeTCP && url.Scheme == SchemeTypeTURNS:
-				conn, connectErr := tls.Dial(NetworkTypeTCP4.String(), TURNServerAddr, &tls.Config{
-					InsecureSkipVerify: a.insecureSkipVerify, //nolint:gosec
-				})
-				if connectErr != nil {
-					a.log.Warnf("Failed to Dial TLS Addr %s: %v\n", TURNServerAddr, connectErr)
-					return
-				}
-				RelAddr = conn.LocalAddr().(*net.TCPAddr).IP.String()
-				RelPort = conn.LocalAddr().(*net.TCPAddr).Port
-				locConn = turn.NewSTUNConn(conn)
-			default:
-				a.log.Warnf("Unable to handle URL in gatherCandidatesRelay %v\n", url)
-				return
-			}
+// dialTURN opens the TCP connection to a TURN server, through the ProxyDialer
+// when it is set
+func (a *Agent) dialTURN(ctx context.Context, dialer *net.Dialer, addr string) (net.Conn, error) {
+	switch d := a.proxyDialer.(type) {
+	case nil:
+		return dialer.DialContext(ctx, NetworkTypeTCP4.String(), addr)
+	case proxy.ContextDialer:
+		return d.DialContext(ctx, tcp, addr)
+	default:
+		return d.Dial(tcp, addr)
+	}
+}
 
-			client, err := turn.NewClient(&turn.ClientConfig{
-				TURNServerAddr: TURNServerAddr,
-				Conn:           locConn,
-				Username:       url.Username,
-				Password:       url.Password,
-				LoggerFactory:  a.loggerFactory,
-				Net:            a.net,
-			})
-			if err != nil {
-				closeConnAndLog(locConn, a.log, fmt.Sprintf("Failed to build new turn.Client %s %s\n", TURNServerAddr, err))
-				return
-			}
+// tcpAddrParts returns the IP and port of the local address of a connection to
+// a TURN server, the ones of a proxied connection may not be known
+func tcpAddrParts(addr net.Addr) (string, int) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String(), tcpAddr.Port
+	}
+	return net.IPv4zero.String(), 0
+}
 
-			if err = client.Listen(); err != nil {
-				client.Close()
-				closeConnAndLog(locConn, a.log, fmt.Sprintf("Failed to listen on turn.Client %s %s\n", TURNServerAddr, err))
-				return
-			}
+// relayAllocation is a TURN allocation, with the client and the socket it was made with
+type relayAllocation struct {
+	client    *turn.Client
+	locConn   net.PacketConn
+	channels  *turnChannelConn
+	relayConn net.PacketConn
+	relAddr   string
+	relPort   int
+}
 
-			relayConn, err := client.Allocate()
-			if err != nil {
-				client.Close()
-				closeConnAndLog(locConn, a.log, fmt.Sprintf("Failed to allocate on turn.Client %s %s\n", TURNServerAddr, err))
-				return
-			}
+// close releases the allocation and closes the socket to the TURN server
+func (r *relayAllocation) close() error {
+	err := r.relayConn.Close()
+	r.client.Close()
+	return joinErrors(err, r.locConn.Close())
+}
 
-			raddr := relayConn.LocalAddr().(*net.UDPAddr)
-			relayConfig := CandidateRelayConfig{
-				Network:   network,
-				Component: ComponentRTP,
-				Address:   raddr.IP.String(),
-				Port:      raddr.Port,
-				RelAddr:   RelAddr,
-				RelPort:   RelPort,
-				OnClose: func() error {
-					client.Close()
-					return locConn.Close()
-				},
+// allocateRelay connects to the TURN server of url and allocates a relayed
+// address on it, ctx aborts connecting and allocating. An Allocate redirected
+// to an ALTERNATE-SERVER is retried there with the same credentials, the
+// certificate of a TLS or DTLS alternate is verified against the host of url.
+func (a *Agent) allocateRelay(ctx context.Context, url URL) (*relayAllocation, error) {
+	serverName := url.Host
+	for redirects := 0; ; redirects++ {
+		alloc, alternate, err := a.allocateRelayOn(ctx, url, serverName)
+		if alternate == nil {
+			return alloc, err
+		} else if redirects == maxAlternateServerRedirects {
+			return nil, fmt.Errorf("%w: %s redirected to %s", ErrTooManyRedirects, url.String(), alternate)
+		}
+
+		a.log.Infof("%s redirected the allocation to %s", url.String(), alternate)
+		url.Host, url.Port = alternate.IP.String(), alternate.Port
+	}
+}
+
+// allocateRelayOn allocates a relayed address on the TURN server of url. It
+// returns the ALTERNATE-SERVER if the server redirected the Allocate.
+func (a *Agent) allocateRelayOn(ctx context.Context, url URL, serverName string) (*relayAllocation, *net.UDPAddr, error) {
+	network := NetworkTypeUDP4.String() // TODO IPv6
+	TURNServerAddr := fmt.Sprintf("%s:%d", url.Host, url.Port)
+	var (
+		locConn net.PacketConn
+		err     error
+		RelAddr string
+		RelPort int
+	)
+
+	dialer := &net.Dialer{}
+
+	switch {
+	case url.Proto == ProtoTypeUDP && url.Scheme == SchemeTypeTURN:
+		if locConn, err = listenUDPInPortRange(a.net, a.log, int(a.portmax), int(a.portmin), network, &net.UDPAddr{IP: nil, Port: 0}); err != nil {
+			return nil, nil, fmt.Errorf("failed to listen %s: %w", network, err)
+		}
+		a.setSocketBuffers(locConn)
+
+		RelAddr = locConn.LocalAddr().(*net.UDPAddr).IP.String()
+		RelPort = locConn.LocalAddr().(*net.UDPAddr).Port
+	case url.Proto == ProtoTypeTCP && url.Scheme == SchemeTypeTURN:
+		dialAddr := TURNServerAddr
+		if a.proxyDialer == nil {
+			tcpAddr, connectErr := net.ResolveTCPAddr(NetworkTypeTCP4.String(), TURNServerAddr)
+			if connectErr != nil {
+				return nil, nil, fmt.Errorf("failed to resolve TCP Addr %s: %w", TURNServerAddr, connectErr)
 			}
-			candidate, err := NewCandidateRelay(&relayConfig)
-			if err != nil {
-				if relayConErr := relayConn.Close(); relayConErr != nil {
-					a.log.Warnf("Failed to close relay %v", relayConErr)
-				}
+			dialAddr = tcpAddr.String()
+		}
 
-				client.Close()
-				closeConnAndLog(locConn, a.log, fmt.Sprintf("Failed to create relay candidate: %s %s: %v\n", network, raddr.String(), err))
-				return
+		conn, connectErr := a.dialTURN(ctx, dialer, dialAddr)
+		if connectErr != nil {
+			return nil, nil, fmt.Errorf("failed to Dial TCP Addr %s: %w", TURNServerAddr, connectErr)
+		}
+		a.setSocketBuffers(conn)
+
+		RelAddr, RelPort = tcpAddrParts(conn.LocalAddr())
+		locConn = turn.NewSTUNConn(conn)
+	case url.Proto == ProtoTypeUDP && url.Scheme == SchemeTypeTURNS:
+		udpAddr, connectErr := net.ResolveUDPAddr(network, TURNServerAddr)
+		if connectErr != nil {
+			return nil, nil, fmt.Errorf("failed to resolve UDP Addr %s: %w", TURNServerAddr, connectErr)
+		}
+
+		conn, connectErr := dtls.DialWithContext(ctx, network, udpAddr, a.turnDTLSConfig(serverName))
+		if connectErr != nil {
+			return nil, nil, fmt.Errorf("failed to Dial DTLS Addr %s: %w", TURNServerAddr, connectErr)
+		}
+
+		RelAddr = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		RelPort = conn.LocalAddr().(*net.UDPAddr).Port
+		locConn = &fakePacketConn{conn}
+	case url.Proto == ProtoTypeTCP && url.Scheme == SchemeTypeTURNS:
+		tcpConn, connectErr := a.dialTURN(ctx, dialer, TURNServerAddr)
+		if connectErr != nil {
+			return nil, nil, fmt.Errorf("failed to Dial TLS Addr %s: %w", TURNServerAddr, connectErr)
+		}
+		a.setSocketBuffers(tcpConn)
+
+		conn := tls.Client(tcpConn, a.turnTLSConfig(serverName))
+		stopHandshake := onCancel(ctx, func() {
+			_ = tcpConn.Close()
+		})
+		connectErr = conn.Handshake()
+		if aborted := stopHandshake(); connectErr != nil || aborted {
+			_ = tcpConn.Close()
+			if connectErr == nil {
+				connectErr = ctx.Err()
 			}
+			return nil, nil, fmt.Errorf("failed to Dial TLS Addr %s: %w", TURNServerAddr, connectErr)
+		}
+		RelAddr, RelPort = tcpAddrParts(conn.LocalAddr())
+		locConn = turn.NewSTUNConn(conn)
+	default:
+		return nil, nil, fmt.Errorf("unable to handle URL %s", url.String())
+	}
+	if ctx.Err() != nil {
+		_ = locConn.Close()
+		return nil, nil, ctx.Err()
+	}
+	channels := newTURNChannelConn(locConn, a.log)
+	locConn = channels
 
-			if err := a.addCandidate(candidate, relayConn); err != nil {
-				if closeErr := candidate.close(); closeErr != nil {
-					a.log.Warnf("Failed to close candidate: %v", closeErr)
-				}
-				a.log.Warnf("Failed to append to localCandidates and run onCandidateHdlr: %v\n", err)
+	// The turn.Client resolves the address of the server, which may only be
+	// known to the proxy. It is ignored when writing to a TCP connection.
+	clientServerAddr := TURNServerAddr
+	if a.proxyDialer != nil && url.Proto == ProtoTypeTCP {
+		clientServerAddr = fmt.Sprintf("%s:%d", net.IPv4zero, url.Port)
+	}
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: clientServerAddr,
+		Conn:           locConn,
+		Username:       url.Username,
+		Password:       url.Password,
+		Software:       string(a.softwareName),
+		LoggerFactory:  a.loggerFactory,
+		Net:            vnetOrNil(a.net),
+	})
+	if err != nil {
+		_ = locConn.Close()
+		return nil, nil, fmt.Errorf("failed to build new turn.Client %s: %w", TURNServerAddr, err)
+	}
+
+	if err = client.Listen(); err != nil {
+		client.Close()
+		_ = locConn.Close()
+		return nil, nil, fmt.Errorf("failed to listen on turn.Client %s: %w", TURNServerAddr, err)
+	}
+
+	stopAllocate := onCancel(ctx, client.Close)
+	relayConn, err := client.Allocate()
+	if aborted := stopAllocate(); aborted {
+		if err == nil {
+			// Release the allocation the server granted before the cancellation
+			_ = relayConn.Close()
+		}
+		client.Close()
+		_ = locConn.Close()
+		return nil, nil, ctx.Err()
+	} else if err != nil {
+		client.Close()
+		_ = locConn.Close()
+		if alternate, ok := channels.alternateServer(); ok {
+			return nil, alternate, err
+		}
+		return nil, nil, fmt.Errorf("failed to allocate on turn.Client %s: %w", TURNServerAddr, err)
+	}
+
+	return &relayAllocation{
+		client:    client,
+		locConn:   locConn,
+		channels:  channels,
+		relayConn: relayConn,
+		relAddr:   RelAddr,
+		relPort:   RelPort,
+	}, nil, nil
+}
+
+// addRelayCandidate adds the relay candidate of alloc, which it then owns
+func (a *Agent) addRelayCandidate(alloc *relayAllocation, url URL, component uint16) {
+	network := NetworkTypeUDP4.String() // TODO IPv6
+
+	// With time-limited credentials, the refresher keeps the allocation
+	// alive once the ones it was created with expired
+	var refresher *turnRefresher
+	if a.onTURNCredentialRefresh != nil {
+		refresher = newTURNRefresher(a, alloc.client, url)
+	}
+
+	raddr := alloc.relayConn.LocalAddr().(*net.UDPAddr)
+	relayConfig := CandidateRelayConfig{
+		Network:   network,
+		Component: component,
+		Address:   raddr.IP.String(),
+		Port:      raddr.Port,
+		RelAddr:   alloc.relAddr,
+		RelPort:   alloc.relPort,
+		OnClose: func() error {
+			if refresher != nil {
+				refresher.stop()
 			}
-		}(*urls[i])
+			alloc.client.Close()
+			return alloc.locConn.Close()
+		},
+	}
+	if a.relayOnly {
+		// The related address is the local IP of the socket to the server
+		relayConfig.RelAddr, relayConfig.RelPort = net.IPv4zero.String(), 0
+	}
+	candidate, err := NewCandidateRelay(&relayConfig)
+	if err != nil {
+		if relayConErr := alloc.close(); relayConErr != nil {
+			a.log.Warnf("Failed to close relay %v", relayConErr)
+		}
+		a.log.Warnf("Failed to create relay candidate: %s %s: %v\n", network, raddr.String(), err)
+		return
 	}
 
-	return nil
+	// The TURN client creates a permission and binds a channel for each peer
+	// on the first write, so every connectivity check on a relay pair installs one
+	candidate.channels = alloc.channels
+	candidate.server = url.String()
+	if refresher != nil {
+		refresher.start(candidate)
+	}
+	if err := a.addCandidate(candidate, alloc.relayConn); err != nil {
+		// The candidate was never started so it doesn't own relayConn yet,
+		// close it here to stop the allocation refresh timers
+		if relayConErr := alloc.relayConn.Close(); relayConErr != nil {
+			a.log.Warnf("Failed to close relay %v", relayConErr)
+		}
+		if closeErr := candidate.close(); closeErr != nil {
+			a.log.Warnf("Failed to close candidate: %v", closeErr)
+		}
+		a.log.Warnf("Failed to append to localCandidates and run onCandidateHdlr: %v\n", err)
+	}
+}
+
+// turnTLSConfig returns the configuration of a TLS connection to the TURN server host
+func (a *Agent) turnTLSConfig(host string) *tls.Config {
+	config := &tls.Config{}
+	if a.tlsConfig != nil {
+		config = a.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if a.insecureSkipVerify {
+		config.InsecureSkipVerify = true //nolint:gosec
+	}
+	return config
+}
+
+// turnDTLSConfig returns the configuration of a DTLS connection to the TURN server host
+func (a *Agent) turnDTLSConfig(host string) *dtls.Config {
+	tlsConfig := a.turnTLSConfig(host)
+	return &dtls.Config{
+		Certificates:       tlsConfig.Certificates,
+		RootCAs:            tlsConfig.RootCAs,
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify, //nolint:gosec
+	}
+}
+
+// socketBufferSetter is implemented by the UDP and TCP sockets of the net package
+type socketBufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketBuffers applies ReceiveBufferSize and SendBufferSize to conn,
+// conns that are not OS sockets, e.g. of a vnet.Net, are left as is
+func (a *Agent) setSocketBuffers(conn interface{}) {
+	s, ok := conn.(socketBufferSetter)
+	if !ok {
+		return
+	}
+
+	if a.receiveBufferSize > 0 {
+		if err := s.SetReadBuffer(a.receiveBufferSize); err != nil {
+			a.log.Warnf("Failed to set the receive buffer size to %d: %v", a.receiveBufferSize, err)
+		}
+	}
+	if a.sendBufferSize > 0 {
+		if err := s.SetWriteBuffer(a.sendBufferSize); err != nil {
+			a.log.Warnf("Failed to set the send buffer size to %d: %v", a.sendBufferSize, err)
+		}
+	}
 }
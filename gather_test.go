@@ -5,16 +5,21 @@ package ice
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net"
 	"reflect"
 	"sort"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/pion/dtls/v2"
 	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"github.com/pion/stun"
 	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
 	"github.com/pion/turn/v2"
 	"github.com/stretchr/testify/assert"
 )
@@ -23,7 +28,7 @@ func TestListenUDP(t *testing.T) {
 	a, err := NewAgent(&AgentConfig{})
 	assert.NoError(t, err)
 
-	localIPs, err := localInterfaces(a.net, a.interfaceFilter, []NetworkType{NetworkTypeUDP4})
+	localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
 	assert.NotEqual(t, len(localIPs), 0, "localInterfaces found no interfaces, unable to test")
 	assert.NoError(t, err)
 
@@ -73,7 +78,8 @@ func TestListenUDP(t *testing.T) {
 		t.Fatalf("listenUDP with port restriction [%d, %d], got:%v, want:%v", portMin, portMax, result, portRange)
 	}
 	_, err = listenUDPInPortRange(a.net, a.log, portMax, portMin, udp, &net.UDPAddr{IP: ip, Port: 0})
-	assert.Equal(t, err, ErrPort, "listenUDP with port restriction [%d, %d], did not return ErrPort", portMin, portMax)
+	assert.True(t, errors.Is(err, ErrPort), "listenUDP with port restriction [%d, %d], did not return ErrPort", portMin, portMax)
+	assert.EqualError(t, err, "invalid port: no port available between 5100 and 5109")
 
 	assert.NoError(t, a.Close())
 }
@@ -129,7 +135,7 @@ func TestSTUNConcurrency(t *testing.T) {
 			candidateGatheredFunc()
 		}
 	}))
-	assert.NoError(t, a.GatherCandidates())
+	assert.NoError(t, a.GatherCandidates(context.Background()))
 
 	<-candidateGathered.Done()
 
@@ -204,7 +210,7 @@ func TestTURNConcurrency(t *testing.T) {
 				candidateGatheredFunc()
 			}
 		}))
-		assert.NoError(t, a.GatherCandidates())
+		assert.NoError(t, a.GatherCandidates(context.Background()))
 
 		<-candidateGathered.Done()
 
@@ -255,6 +261,79 @@ func TestTURNConcurrency(t *testing.T) {
 	})
 }
 
+// Assert that the TLS connection to a turns: server uses AgentConfig.TLSConfig
+func TestTURNTLSConfig(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	certificate, err := selfsign.GenerateSelfSignedWithDNS("turn.pion.ly", "turn.pion.ly")
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.NoError(t, err)
+
+	serverListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	})
+	assert.NoError(t, err)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	gatherRelay := func(tlsConfig *tls.Config) []Candidate {
+		a, newErr := NewAgent(&AgentConfig{
+			CandidateTypes: []CandidateType{CandidateTypeRelay},
+			NetworkTypes:   supportedNetworkTypes,
+			Urls: []*URL{{
+				Scheme:   SchemeTypeTURNS,
+				Host:     "127.0.0.1",
+				Username: "username",
+				Password: "password",
+				Proto:    ProtoTypeTCP,
+				Port:     serverListener.Addr().(*net.TCPAddr).Port,
+			}},
+			TLSConfig: tlsConfig,
+		})
+		assert.NoError(t, newErr)
+
+		gatheringDone := make(chan struct{})
+		assert.NoError(t, a.OnCandidate(func(c Candidate) {
+			if c == nil {
+				close(gatheringDone)
+			}
+		}))
+		assert.NoError(t, a.GatherCandidates(context.Background()))
+		<-gatheringDone
+
+		candidates, newErr := a.GetLocalCandidates()
+		assert.NoError(t, newErr)
+		assert.NoError(t, a.Close())
+		return candidates
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	// The certificate is verified against RootCAs and ServerName
+	assert.Equal(t, 1, len(gatherRelay(&tls.Config{RootCAs: roots, ServerName: "turn.pion.ly"})))
+
+	// Without ServerName, the host of the URL doesn't match the certificate
+	assert.Equal(t, 0, len(gatherRelay(&tls.Config{RootCAs: roots})))
+
+	assert.NoError(t, server.Close())
+}
+
 // Assert that STUN and TURN gathering are done concurrently
 func TestSTUNTURNConcurrency(t *testing.T) {
 	report := test.CheckRoutines(t)
@@ -311,7 +390,7 @@ func TestSTUNTURNConcurrency(t *testing.T) {
 				candidateGatheredFunc()
 			}
 		}))
-		assert.NoError(t, a.GatherCandidates())
+		assert.NoError(t, a.GatherCandidates(context.Background()))
 
 		<-candidateGathered.Done()
 
@@ -322,6 +401,121 @@ func TestSTUNTURNConcurrency(t *testing.T) {
 	assert.NoError(t, server.Close())
 }
 
+// Assert that every STUN server is queried, duplicates are skipped and
+// unreachable servers only delay gathering by STUNGatherTimeout
+func TestSTUNMultipleServers(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	urls := []*URL{{Scheme: SchemeTypeSTUN, Host: "127.0.0.1", Port: randomPort(t)}}
+	servers := []*turn.Server{}
+	for i := 0; i < 2; i++ {
+		serverListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := turn.NewServer(turn.ServerConfig{
+			PacketConnConfigs: []turn.PacketConnConfig{{
+				PacketConn:            serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			}},
+		})
+		assert.NoError(t, err)
+		servers = append(servers, server)
+
+		url := &URL{Scheme: SchemeTypeSTUN, Host: "127.0.0.1", Port: serverListener.LocalAddr().(*net.UDPAddr).Port}
+		urls = append(urls, url, url)
+	}
+
+	stunGatherTimeout := 500 * time.Millisecond
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:      []NetworkType{NetworkTypeUDP4},
+		Urls:              urls,
+		CandidateTypes:    []CandidateType{CandidateTypeServerReflexive},
+		STUNGatherTimeout: &stunGatherTimeout,
+	})
+	assert.NoError(t, err)
+
+	var candidates []Candidate
+	gathered := make(chan struct{})
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		if c == nil {
+			close(gathered)
+			return
+		}
+		candidates = append(candidates, c)
+	}))
+
+	start := time.Now()
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+	<-gathered
+	assert.Less(t, int64(time.Since(start)), int64(3*time.Second))
+
+	// One candidate per reachable server, each with its own reflexive address
+	assert.Equal(t, 2, len(candidates))
+	if len(candidates) == 2 {
+		assert.Equal(t, CandidateTypeServerReflexive, candidates[0].Type())
+		assert.NotEqual(t, candidates[0].Port(), candidates[1].Port())
+	}
+
+	assert.NoError(t, a.Close())
+	for _, server := range servers {
+		assert.NoError(t, server.Close())
+	}
+}
+
+// Assert that cancelling the context of GatherCandidates aborts STUN and TURN transactions
+func TestGatherCandidatesContext(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	// Nothing answers on this socket, both transactions block until cancelled
+	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := blackhole.LocalAddr().(*net.UDPAddr).Port
+
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:   []NetworkType{NetworkTypeUDP4},
+		CandidateTypes: []CandidateType{CandidateTypeServerReflexive, CandidateTypeRelay},
+		Urls: []*URL{
+			{Scheme: SchemeTypeSTUN, Host: "127.0.0.1", Port: port},
+			{Scheme: SchemeTypeTURN, Proto: ProtoTypeUDP, Host: "127.0.0.1", Port: port, Username: "username", Password: "password"},
+		},
+	})
+	assert.NoError(t, err)
+
+	gathered := make(chan struct{})
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		if c == nil {
+			close(gathered)
+		}
+	}))
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, a.GatherCandidates(cancelled))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.NoError(t, a.GatherCandidates(ctx))
+	<-gathered
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+
+	state, err := a.GetGatheringState()
+	assert.NoError(t, err)
+	assert.Equal(t, GatheringStateComplete, state)
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, blackhole.Close())
+}
+
 // Assert that srflx candidates can be gathered from TURN servers
 //
 // When TURN servers are utilized, both types of candidates
@@ -374,7 +568,7 @@ func TestTURNSrflx(t *testing.T) {
 		}
 	}))
 
-	assert.NoError(t, a.GatherCandidates())
+	assert.NoError(t, a.GatherCandidates(context.Background()))
 
 	<-candidateGathered.Done()
 
@@ -382,6 +576,47 @@ func TestTURNSrflx(t *testing.T) {
 	assert.NoError(t, server.Close())
 }
 
+func TestGatheringStateChange(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:   supportedNetworkTypes,
+		CandidateTypes: []CandidateType{CandidateTypeHost},
+	})
+	assert.NoError(t, err)
+
+	state, err := a.GetGatheringState()
+	assert.NoError(t, err)
+	assert.Equal(t, GatheringStateNew, state)
+
+	states := make(chan GatheringState, 3)
+	assert.NoError(t, a.OnGatheringStateChange(func(s GatheringState) {
+		states <- s
+	}))
+	assert.NoError(t, a.OnCandidate(func(Candidate) {}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+
+	assert.Equal(t, GatheringStateGathering, <-states)
+	assert.Equal(t, GatheringStateComplete, <-states)
+
+	state, err = a.GetGatheringState()
+	assert.NoError(t, err)
+	assert.Equal(t, GatheringStateComplete, state)
+
+	// Restarting returns gathering back to new
+	assert.NoError(t, a.Restart("", ""))
+	assert.Equal(t, GatheringStateNew, <-states)
+
+	assert.NoError(t, a.Close())
+
+	_, err = a.GetGatheringState()
+	assert.Equal(t, ErrClosed, err)
+}
+
 func TestCloseConnLog(t *testing.T) {
 	a, err := NewAgent(&AgentConfig{})
 	assert.NoError(t, err)
@@ -393,3 +628,683 @@ func TestCloseConnLog(t *testing.T) {
 
 	assert.NoError(t, a.Close())
 }
+
+// bufferRecordingNet is the OS network, recording the buffer sizes set on its sockets
+type bufferRecordingNet struct {
+	Net
+
+	mu                    sync.Mutex
+	readSizes, writeSizes []int
+}
+
+func (n *bufferRecordingNet) ListenUDP(network string, locAddr *net.UDPAddr) (vnet.UDPPacketConn, error) {
+	conn, err := n.Net.ListenUDP(network, locAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferRecordingConn{UDPPacketConn: conn, net: n}, nil
+}
+
+type bufferRecordingConn struct {
+	vnet.UDPPacketConn
+	net *bufferRecordingNet
+}
+
+func (c *bufferRecordingConn) SetReadBuffer(bytes int) error {
+	c.net.mu.Lock()
+	c.net.readSizes = append(c.net.readSizes, bytes)
+	c.net.mu.Unlock()
+	return c.UDPPacketConn.(*net.UDPConn).SetReadBuffer(bytes)
+}
+
+func (c *bufferRecordingConn) SetWriteBuffer(bytes int) error {
+	c.net.mu.Lock()
+	c.net.writeSizes = append(c.net.writeSizes, bytes)
+	c.net.mu.Unlock()
+	return c.UDPPacketConn.(*net.UDPConn).SetWriteBuffer(bytes)
+}
+
+func TestSocketBufferSizes(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	localIPs, err := localInterfaces(vnet.NewNet(nil), nil, nil, []NetworkType{NetworkTypeUDP4})
+	assert.NoError(t, err)
+	if len(localIPs) == 0 {
+		t.Skip("no non-loopback IPv4 interface to gather host candidates on")
+	}
+
+	n := &bufferRecordingNet{Net: vnet.NewNet(nil)}
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:      []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:    []CandidateType{CandidateTypeHost},
+		Net:               n,
+		ReceiveBufferSize: 1 << 20,
+		SendBufferSize:    1 << 19,
+	})
+	assert.NoError(t, err)
+
+	gatherDone := make(chan struct{})
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		if c == nil {
+			close(gatherDone)
+		}
+	}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+	<-gatherDone
+
+	localCandidates, err := a.GetLocalCandidates()
+	assert.NoError(t, err)
+
+	// Every socket got both sizes
+	n.mu.Lock()
+	assert.Equal(t, len(localCandidates), len(n.readSizes))
+	for _, size := range n.readSizes {
+		assert.Equal(t, 1<<20, size)
+	}
+	assert.Equal(t, len(localCandidates), len(n.writeSizes))
+	for _, size := range n.writeSizes {
+		assert.Equal(t, 1<<19, size)
+	}
+	n.mu.Unlock()
+
+	assert.NoError(t, a.Close())
+}
+
+func TestGatherUDPConns(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		return conn
+	}
+
+	newAgent := func(conn *net.UDPConn, closeConn bool) (*Agent, func(ConnectionState), chan struct{}) {
+		a, err := NewAgent(&AgentConfig{
+			NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+			CandidateTypes:   []CandidateType{CandidateTypeHost},
+			MulticastDNSMode: MulticastDNSModeDisabled,
+			// Only the sockets of the application are gathered
+			InterfaceFilter: func(string) bool { return false },
+			UDPConns:        []*net.UDPConn{conn},
+			CloseUDPConns:   closeConn,
+
+			AllowPrivateRemoteCandidates: true,
+		})
+		assert.NoError(t, err)
+		notifier, connected := onConnected()
+		return a, notifier, connected
+	}
+
+	t.Run("Borrowed", func(t *testing.T) {
+		aSocket, bSocket := listen(), listen()
+		aAgent, aNotifier, aConnected := newAgent(aSocket, false)
+		assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+		bAgent, bNotifier, bConnected := newAgent(bSocket, false)
+		assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+		aConn, bConn := connect(aAgent, bAgent)
+		<-aConnected
+		<-bConnected
+
+		pair, err := aAgent.GetSelectedCandidatePair()
+		assert.NoError(t, err)
+		assert.Equal(t, aSocket.LocalAddr().(*net.UDPAddr).Port, pair.Local.Port())
+		assert.Equal(t, bSocket.LocalAddr().(*net.UDPAddr).Port, pair.Remote.Port())
+
+		_, err = aConn.Write([]byte("hello"))
+		assert.NoError(t, err)
+		buf := make([]byte, receiveMTU)
+		n, err := bConn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+
+		assert.NoError(t, aAgent.Close())
+		assert.NoError(t, bAgent.Close())
+
+		// The sockets are handed back open, without a read deadline
+		_, err = aSocket.WriteTo([]byte("still open"), bSocket.LocalAddr())
+		assert.NoError(t, err)
+		n, _, err = bSocket.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "still open", string(buf[:n]))
+
+		assert.NoError(t, aSocket.Close())
+		assert.NoError(t, bSocket.Close())
+	})
+
+	t.Run("Owned", func(t *testing.T) {
+		socket := listen()
+		a, _, _ := newAgent(socket, true)
+
+		gathered := make(chan struct{})
+		assert.NoError(t, a.OnCandidate(func(c Candidate) {
+			if c == nil {
+				close(gathered)
+			}
+		}))
+		assert.NoError(t, a.GatherCandidates(context.Background()))
+		<-gathered
+
+		candidates, err := a.GetLocalCandidates()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(candidates))
+		assert.Equal(t, "127.0.0.1", candidates[0].Address())
+		assert.Equal(t, socket.LocalAddr().(*net.UDPAddr).Port, candidates[0].Port())
+
+		// The socket is closed with the Agent
+		assert.NoError(t, a.Close())
+		_, err = socket.WriteTo([]byte("closed"), socket.LocalAddr())
+		assert.Error(t, err)
+	})
+}
+
+func TestPrewarmRelay(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	serverPort := randomPort(t)
+	serverListener, err := net.ListenPacket("udp4", "127.0.0.1:"+strconv.Itoa(serverPort))
+	assert.NoError(t, err)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	newAgent := func(t *testing.T, port int) *Agent {
+		a, err := NewAgent(&AgentConfig{
+			NetworkTypes:   supportedNetworkTypes,
+			CandidateTypes: []CandidateType{CandidateTypeRelay},
+			Urls: []*URL{{
+				Scheme:   SchemeTypeTURN,
+				Proto:    ProtoTypeUDP,
+				Host:     "127.0.0.1",
+				Port:     port,
+				Username: "username",
+				Password: "password",
+			}},
+		})
+		assert.NoError(t, err)
+		return a
+	}
+
+	t.Run("Gathered", func(t *testing.T) {
+		a := newAgent(t, serverPort)
+		assert.NoError(t, a.PrewarmRelay(context.Background()))
+
+		var prewarmed []net.Addr
+		assert.NoError(t, a.run(func(agent *Agent) {
+			for _, list := range agent.prewarmedRelays {
+				for _, alloc := range list {
+					prewarmed = append(prewarmed, alloc.relayConn.LocalAddr())
+				}
+			}
+		}, nil))
+		assert.Equal(t, 1, len(prewarmed))
+
+		relay := make(chan Candidate, 1)
+		assert.NoError(t, a.OnCandidate(func(c Candidate) {
+			if c != nil {
+				relay <- c
+			}
+		}))
+		assert.NoError(t, a.GatherCandidates(context.Background()))
+
+		// The prewarmed allocation is gathered instead of a new one
+		c := <-relay
+		assert.Equal(t, CandidateTypeRelay, c.Type())
+		assert.Equal(t, prewarmed[0].String(), net.JoinHostPort(c.Address(), strconv.Itoa(c.Port())))
+		assert.Equal(t, ErrRelayPrewarmAfterGathering, a.PrewarmRelay(context.Background()))
+
+		assert.NoError(t, a.Close())
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		a := newAgent(t, randomPort(t))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Error(t, a.PrewarmRelay(ctx))
+		assert.NoError(t, a.run(func(agent *Agent) {
+			assert.Equal(t, 0, len(agent.prewarmedRelays))
+		}, nil))
+
+		assert.NoError(t, a.Close())
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		a := newAgent(t, serverPort)
+		assert.NoError(t, a.PrewarmRelay(context.Background()))
+
+		// The allocations that are never gathered are released by Close
+		assert.NoError(t, a.Close())
+	})
+
+	assert.NoError(t, server.Close())
+}
+
+func TestGatheringErrors(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	serverPort := randomPort(t)
+	serverListener, err := net.ListenPacket("udp4", "127.0.0.1:"+strconv.Itoa(serverPort))
+	assert.NoError(t, err)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	gatheringErrors := func(t *testing.T, config *AgentConfig) map[CandidateType]error {
+		a, err := NewAgent(config)
+		assert.NoError(t, err)
+
+		complete := make(chan struct{})
+		assert.NoError(t, a.OnGatheringStateChange(func(s GatheringState) {
+			if s == GatheringStateComplete {
+				close(complete)
+			}
+		}))
+		assert.NoError(t, a.OnCandidate(func(Candidate) {}))
+		assert.NoError(t, a.GatherCandidates(context.Background()))
+		<-complete
+
+		errs, err := a.GatheringErrors()
+		assert.NoError(t, err)
+		assert.NoError(t, a.Close())
+		return errs
+	}
+
+	t.Run("Failures", func(t *testing.T) {
+		stunTimeout := 100 * time.Millisecond
+		errs := gatheringErrors(t, &AgentConfig{
+			NetworkTypes:      []NetworkType{NetworkTypeUDP4},
+			CandidateTypes:    []CandidateType{CandidateTypeHost, CandidateTypeServerReflexive, CandidateTypeRelay},
+			STUNGatherTimeout: &stunTimeout,
+			Urls: []*URL{
+				{
+					Scheme: SchemeTypeSTUN,
+					Proto:  ProtoTypeUDP,
+					Host:   "127.0.0.1",
+					Port:   randomPort(t),
+				},
+				{
+					Scheme:   SchemeTypeTURN,
+					Proto:    ProtoTypeUDP,
+					Host:     "127.0.0.1",
+					Port:     serverPort,
+					Username: "username",
+					Password: "wrong",
+				},
+			},
+		})
+
+		assert.Equal(t, 2, len(errs))
+		assert.Error(t, errs[CandidateTypeServerReflexive])
+		assert.Contains(t, errs[CandidateTypeRelay].Error(), "Allocate error response")
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		errs := gatheringErrors(t, &AgentConfig{
+			NetworkTypes:   []NetworkType{NetworkTypeUDP4},
+			CandidateTypes: []CandidateType{CandidateTypeHost},
+		})
+		assert.Equal(t, 0, len(errs))
+	})
+
+	assert.NoError(t, server.Close())
+}
+
+// redirectSTUN answers the requests received on conn with a 300 (Try
+// Alternate) to alternate until conn is closed
+func redirectSTUN(conn net.PacketConn, alternate *net.UDPAddr) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, receiveMTU)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if req.Decode() != nil {
+				continue
+			}
+			resp, err := stun.Build(
+				stun.NewTransactionIDSetter(req.TransactionID),
+				stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+				stun.CodeTryAlternate,
+				&stun.AlternateServer{IP: alternate.IP, Port: alternate.Port},
+				stun.Fingerprint,
+			)
+			if err == nil {
+				_, _ = conn.WriteTo(resp.Raw, addr)
+			}
+		}
+	}()
+	return done
+}
+
+func TestGatherAlternateServer(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	serverListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	// redirector starts a server redirecting to the address alternate returns
+	redirector := func(t *testing.T, alternate func(self *net.UDPAddr) *net.UDPAddr) (int, func()) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		self := conn.LocalAddr().(*net.UDPAddr)
+		done := redirectSTUN(conn, alternate(self))
+		return self.Port, func() {
+			assert.NoError(t, conn.Close())
+			<-done
+		}
+	}
+
+	gather := func(t *testing.T, port int, candidateTypes ...CandidateType) ([]Candidate, map[CandidateType]error) {
+		stunTimeout := 100 * time.Millisecond
+		a, err := NewAgent(&AgentConfig{
+			NetworkTypes:      []NetworkType{NetworkTypeUDP4},
+			CandidateTypes:    candidateTypes,
+			STUNGatherTimeout: &stunTimeout,
+			Urls: []*URL{
+				{
+					Scheme: SchemeTypeSTUN,
+					Proto:  ProtoTypeUDP,
+					Host:   "127.0.0.1",
+					Port:   port,
+				},
+				{
+					Scheme:   SchemeTypeTURN,
+					Proto:    ProtoTypeUDP,
+					Host:     "127.0.0.1",
+					Port:     port,
+					Username: "username",
+					Password: "password",
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		var candidates []Candidate
+		complete := make(chan struct{})
+		assert.NoError(t, a.OnCandidate(func(c Candidate) {
+			if c == nil {
+				close(complete)
+				return
+			}
+			candidates = append(candidates, c)
+		}))
+		assert.NoError(t, a.GatherCandidates(context.Background()))
+		<-complete
+
+		errs, err := a.GatheringErrors()
+		assert.NoError(t, err)
+		assert.NoError(t, a.Close())
+		return candidates, errs
+	}
+
+	t.Run("Redirect", func(t *testing.T) {
+		port, stop := redirector(t, func(*net.UDPAddr) *net.UDPAddr {
+			return serverListener.LocalAddr().(*net.UDPAddr)
+		})
+		defer stop()
+
+		candidates, errs := gather(t, port, CandidateTypeServerReflexive, CandidateTypeRelay)
+		assert.Equal(t, 0, len(errs))
+
+		types := map[CandidateType]bool{}
+		for _, c := range candidates {
+			types[c.Type()] = true
+		}
+		assert.True(t, types[CandidateTypeServerReflexive])
+		assert.True(t, types[CandidateTypeRelay])
+	})
+
+	t.Run("Loop", func(t *testing.T) {
+		port, stop := redirector(t, func(self *net.UDPAddr) *net.UDPAddr {
+			return self
+		})
+		defer stop()
+
+		_, errs := gather(t, port, CandidateTypeServerReflexive, CandidateTypeRelay)
+		assert.True(t, errors.Is(errs[CandidateTypeServerReflexive], ErrTooManyRedirects))
+		assert.True(t, errors.Is(errs[CandidateTypeRelay], ErrTooManyRedirects))
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		port, stop := redirector(t, func(*net.UDPAddr) *net.UDPAddr {
+			return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: randomPort(t)}
+		})
+		defer stop()
+
+		// Only the gathering of the redirected server fails
+		candidates, errs := gather(t, port, CandidateTypeHost, CandidateTypeServerReflexive)
+		assert.Equal(t, 1, len(errs))
+		assert.Error(t, errs[CandidateTypeServerReflexive])
+		assert.NotEqual(t, 0, len(candidates))
+		for _, c := range candidates {
+			assert.Equal(t, CandidateTypeHost, c.Type())
+		}
+	})
+
+	assert.NoError(t, server.Close())
+}
+
+func TestDuplicateCandidates(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	// The IP is of two interfaces, like an address a VPN mirrors
+	ip := net.IPv4(10, 0, 0, 2)
+	n := &changingNet{hub: newMemoryHub(), ips: []net.IP{ip, ip}}
+
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:   []CandidateType{CandidateTypeHost},
+		MulticastDNSMode: MulticastDNSModeDisabled,
+		Net:              n,
+	})
+	assert.NoError(t, err)
+
+	candidates := make(chan Candidate, 10)
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		candidates <- c
+	}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+
+	c := <-candidates
+	assert.Equal(t, ip.String(), c.Address())
+	assert.Nil(t, <-candidates)
+
+	duplicates, err := a.DuplicateCandidates()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), duplicates)
+
+	// A candidate equal to one gathered before is closed, and not added
+	duplicate, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   c.Address(),
+		Port:      c.Port(),
+		Component: c.Component(),
+	})
+	assert.NoError(t, err)
+	conn, err := n.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	assert.NoError(t, err)
+	assert.NoError(t, a.addCandidate(duplicate, conn))
+
+	local, err := a.GetLocalCandidates()
+	assert.NoError(t, err)
+	assert.Equal(t, []Candidate{c}, local)
+	duplicates, err = a.DuplicateCandidates()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), duplicates)
+
+	assert.NoError(t, a.Close())
+}
+
+func TestRelayOnly(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	_, err := NewAgent(&AgentConfig{RelayOnly: true, CandidateTypes: []CandidateType{CandidateTypeHost, CandidateTypeRelay}})
+	assert.Equal(t, ErrRelayOnlyCandidateTypes, err)
+
+	serverListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: optimisticAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            serverListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	newAgent := func(t *testing.T, password string) *Agent {
+		a, agentErr := NewAgent(&AgentConfig{
+			NetworkTypes: []NetworkType{NetworkTypeUDP4},
+			RelayOnly:    true,
+			Urls: []*URL{
+				{
+					Scheme: SchemeTypeSTUN,
+					Proto:  ProtoTypeUDP,
+					Host:   "127.0.0.1",
+					Port:   serverListener.LocalAddr().(*net.UDPAddr).Port,
+				},
+				{
+					Scheme:   SchemeTypeTURN,
+					Proto:    ProtoTypeUDP,
+					Host:     "127.0.0.1",
+					Port:     serverListener.LocalAddr().(*net.UDPAddr).Port,
+					Username: "username",
+					Password: password,
+				},
+			},
+		})
+		assert.NoError(t, agentErr)
+		return a
+	}
+
+	gather := func(t *testing.T, a *Agent) []Candidate {
+		var candidates []Candidate
+		complete := make(chan struct{})
+		assert.NoError(t, a.OnCandidate(func(c Candidate) {
+			if c == nil {
+				close(complete)
+				return
+			}
+			candidates = append(candidates, c)
+		}))
+		assert.NoError(t, a.GatherCandidates(context.Background()))
+		<-complete
+		return candidates
+	}
+
+	t.Run("Relay candidates", func(t *testing.T) {
+		a := newAgent(t, "password")
+		candidates := gather(t, a)
+
+		assert.Equal(t, 1, len(candidates))
+		for _, c := range candidates {
+			assert.Equal(t, CandidateTypeRelay, c.Type())
+			assert.Equal(t, &CandidateRelatedAddress{Address: "0.0.0.0", Port: 0}, c.RelatedAddress())
+		}
+		assert.NoError(t, a.Close())
+	})
+
+	t.Run("Fails while connecting", func(t *testing.T) {
+		a := newAgent(t, "wrong")
+
+		accepted := make(chan error)
+		go func() {
+			_, acceptErr := a.Accept(context.Background(), "remoteUfrag", "remotePasswordWith128Bits")
+			accepted <- acceptErr
+		}()
+		assert.Eventually(t, func() bool {
+			state := make(chan ConnectionState, 1)
+			assert.NoError(t, a.run(func(agent *Agent) {
+				state <- agent.connectionState
+			}, nil))
+			return <-state == ConnectionStateChecking
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, 0, len(gather(t, a)))
+		assert.Equal(t, ErrRelayGatheringFailed, <-accepted)
+		assert.Equal(t, FailureReasonGatheringFailed, a.FailureReason())
+		assert.NoError(t, a.Close())
+	})
+
+	t.Run("Fails before connecting", func(t *testing.T) {
+		a := newAgent(t, "wrong")
+		assert.Equal(t, 0, len(gather(t, a)))
+
+		_, err := a.Dial(context.Background(), "remoteUfrag", "remotePasswordWith128Bits")
+		assert.Equal(t, ErrRelayGatheringFailed, err)
+		assert.NoError(t, a.Close())
+	})
+
+	assert.NoError(t, server.Close())
+}
@@ -3,6 +3,7 @@
 package ice
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
@@ -26,7 +27,7 @@ func TestVNetGather(t *testing.T) {
 		})
 		assert.NoError(t, err)
 
-		localIPs, err := localInterfaces(a.net, a.interfaceFilter, []NetworkType{NetworkTypeUDP4})
+		localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
 		if len(localIPs) > 0 {
 			t.Fatal("should return no local IP")
 		} else if err != nil {
@@ -66,7 +67,7 @@ func TestVNetGather(t *testing.T) {
 		})
 		assert.NoError(t, err)
 
-		localIPs, err := localInterfaces(a.net, a.interfaceFilter, []NetworkType{NetworkTypeUDP4})
+		localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
 		if len(localIPs) == 0 {
 			t.Fatal("should have one local IP")
 		} else if err != nil {
@@ -109,7 +110,7 @@ func TestVNetGather(t *testing.T) {
 			t.Fatalf("Failed to create agent: %s", err)
 		}
 
-		localIPs, err := localInterfaces(a.net, a.interfaceFilter, []NetworkType{NetworkTypeUDP4})
+		localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
 		if len(localIPs) == 0 {
 			t.Fatal("localInterfaces found no interfaces, unable to test")
 		} else if err != nil {
@@ -215,7 +216,7 @@ func TestVNetGatherWithNAT1To1(t *testing.T) {
 		})
 		assert.NoError(t, err, "should succeed")
 
-		err = a.GatherCandidates()
+		err = a.GatherCandidates(context.Background())
 		assert.NoError(t, err, "should succeed")
 
 		log.Debug("wait for gathering is done...")
@@ -315,7 +316,7 @@ func TestVNetGatherWithNAT1To1(t *testing.T) {
 		})
 		assert.NoError(t, err, "should succeed")
 
-		err = a.GatherCandidates()
+		err = a.GatherCandidates(context.Background())
 		assert.NoError(t, err, "should succeed")
 
 		log.Debug("wait for gathering is done...")
@@ -382,7 +383,7 @@ func TestVNetGatherWithInterfaceFilter(t *testing.T) {
 		})
 		assert.NoError(t, err)
 
-		localIPs, err := localInterfaces(a.net, a.interfaceFilter, []NetworkType{NetworkTypeUDP4})
+		localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
 		if err != nil {
 			t.Fatal(err)
 		} else if len(localIPs) != 0 {
@@ -402,7 +403,7 @@ func TestVNetGatherWithInterfaceFilter(t *testing.T) {
 		})
 		assert.NoError(t, err)
 
-		localIPs, err := localInterfaces(a.net, a.interfaceFilter, []NetworkType{NetworkTypeUDP4})
+		localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
 		if err != nil {
 			t.Fatal(err)
 		} else if len(localIPs) == 0 {
@@ -412,3 +413,61 @@ func TestVNetGatherWithInterfaceFilter(t *testing.T) {
 		assert.NoError(t, a.Close())
 	})
 }
+
+func TestVNetGatherWithIPFilter(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	r, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "1.2.3.0/24",
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a router: %s", err)
+	}
+
+	nw := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{"1.2.3.4", "1.2.3.5"},
+	})
+	if nw == nil {
+		t.Fatalf("Failed to create a Net: %s", err)
+	}
+
+	if err = r.AddNet(nw); err != nil {
+		t.Fatalf("Failed to add a Net to the router: %s", err)
+	}
+
+	a, err := NewAgent(&AgentConfig{
+		Net:          nw,
+		NetworkTypes: []NetworkType{NetworkTypeUDP4},
+		IPFilter: func(ip net.IP) bool {
+			return !ip.Equal(net.IPv4(1, 2, 3, 4))
+		},
+	})
+	assert.NoError(t, err)
+
+	localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(localIPs))
+	assert.Equal(t, "1.2.3.5", localIPs[0].String())
+
+	// No host candidate is gathered on a filtered IP
+	gathered := make(chan struct{})
+	var candidates []Candidate
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		if c == nil {
+			close(gathered)
+			return
+		}
+		candidates = append(candidates, c)
+	}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+	<-gathered
+
+	assert.NotEqual(t, 0, len(candidates))
+	for _, c := range candidates {
+		assert.Equal(t, "1.2.3.5", c.Address())
+	}
+	assert.NoError(t, a.Close())
+}
@@ -12,4 +12,5 @@ require (
 	github.com/pion/turn/v2 v2.0.3
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/net v0.0.0-20200602114024-627f9648deb9
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
 )
@@ -0,0 +1,63 @@
+package ice
+
+import (
+	"time"
+)
+
+// pendingSwitch is a pair better than the selected pair of its component, that
+// has been better since the time it was first compared to it
+type pendingSwitch struct {
+	pair  *candidatePair
+	since time.Time
+}
+
+// dwelled returns true if p, which is better than the selected pair of its
+// component, may replace it. Without NominationHysteresis it may at once, else
+// once it has been better for NominationHysteresis. The pairs it has to wait
+// for are switched to by switchDwelledPairs.
+// Note: the caller should hold the agent lock.
+func (a *Agent) dwelled(p *candidatePair) bool {
+	component := p.local.Component()
+	selectedPair := a.getComponentSelectedPair(component)
+	if a.nominationHysteresis <= 0 || selectedPair == nil || selectedPair.state != CandidatePairStateSucceeded {
+		return true
+	}
+
+	pending, ok := a.pendingSwitches[component]
+	if !ok || pending.pair != p {
+		a.log.Debugf("Not switching to %s before it has been better than %s for %s", p, selectedPair, a.nominationHysteresis)
+		a.pendingSwitches[component] = pendingSwitch{pair: p, since: a.clock.Now()}
+		return false
+	}
+	return a.clock.Now().Sub(pending.since) >= a.nominationHysteresis
+}
+
+// switchDwelledPairs selects the pairs that have been better than the selected
+// ones for NominationHysteresis, and forgets the ones that no longer are
+// Note: the caller should hold the agent lock.
+func (a *Agent) switchDwelledPairs() {
+	for component, pending := range a.pendingSwitches {
+		selectedPair := a.getComponentSelectedPair(component)
+		if selectedPair == nil || pending.pair.state != CandidatePairStateSucceeded || !a.isBetterPair(pending.pair, selectedPair) {
+			delete(a.pendingSwitches, component)
+			continue
+		}
+
+		if a.clock.Now().Sub(pending.since) >= a.nominationHysteresis {
+			a.log.Debugf("Switching to %s, it has been better than %s for %s", pending.pair, selectedPair, a.nominationHysteresis)
+			a.setSelectedPair(pending.pair)
+		}
+	}
+}
+
+// nextPendingSwitch returns when the next pending switch has dwelled
+// Note: the caller should hold the agent lock.
+func (a *Agent) nextPendingSwitch() (time.Time, bool) {
+	var next time.Time
+	for _, pending := range a.pendingSwitches {
+		if at := pending.since.Add(a.nominationHysteresis); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
@@ -0,0 +1,117 @@
+// +build !js
+
+package ice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNominationHysteresis(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	hysteresis := 100 * time.Millisecond
+	newCandidate := func(t *testing.T, address string, priority uint32) *CandidateHost {
+		c, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   address,
+			Port:      777,
+			Component: 1,
+			Priority:  priority,
+		})
+		assert.NoError(t, err)
+		return c
+	}
+
+	for _, tc := range []struct {
+		name         string
+		highFails    bool
+		expectSwitch bool
+	}{
+		{"Switch once the better pair dwelled", false, true},
+		{"No switch once the better pair failed", true, false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAgent(&AgentConfig{NominationHysteresis: hysteresis})
+			assert.NoError(t, err)
+			a.startOnConnectionStateChangeRoutine()
+
+			var lowPair, highPair *candidatePair
+			assert.NoError(t, a.run(func(a *Agent) {
+				a.startSelector()
+				s := a.getControlledSelector()
+				assert.NotNil(t, s)
+
+				remote := newCandidate(t, "172.17.0.3", 100)
+				lowPair = a.addPair(newCandidate(t, "192.168.0.2", 100), remote)
+				highPair = a.addPair(newCandidate(t, "192.168.0.3", 200), remote)
+				lowPair.state = CandidatePairStateSucceeded
+				highPair.state = CandidatePairStateSucceeded
+
+				s.nominate(lowPair)
+				assert.Equal(t, lowPair, a.getSelectedPair())
+
+				// The better pair waits for the hysteresis
+				s.nominate(highPair)
+				assert.Equal(t, lowPair, a.getSelectedPair())
+				a.switchDwelledPairs()
+				assert.Equal(t, lowPair, a.getSelectedPair())
+				_, pending := a.nextPendingSwitch()
+				assert.True(t, pending)
+
+				if tc.highFails {
+					highPair.state = CandidatePairStateFailed
+				}
+			}, nil))
+
+			time.Sleep(hysteresis)
+			assert.NoError(t, a.run(func(a *Agent) {
+				a.switchDwelledPairs()
+				if tc.expectSwitch {
+					assert.Equal(t, highPair, a.getSelectedPair())
+				} else {
+					assert.Equal(t, lowPair, a.getSelectedPair())
+				}
+				_, pending := a.nextPendingSwitch()
+				assert.False(t, pending)
+			}, nil))
+
+			assert.NoError(t, a.Close())
+		})
+	}
+
+	t.Run("Failed selected pair is replaced at once", func(t *testing.T) {
+		a, err := NewAgent(&AgentConfig{NominationHysteresis: time.Hour})
+		assert.NoError(t, err)
+		a.startOnConnectionStateChangeRoutine()
+
+		assert.NoError(t, a.run(func(a *Agent) {
+			a.startSelector()
+			s := a.getControlledSelector()
+
+			remote := newCandidate(t, "172.17.0.3", 100)
+			highPair := a.addPair(newCandidate(t, "192.168.0.3", 200), remote)
+			lowPair := a.addPair(newCandidate(t, "192.168.0.2", 100), remote)
+			highPair.state = CandidatePairStateSucceeded
+			lowPair.state = CandidatePairStateSucceeded
+
+			s.nominate(highPair)
+			lowPair.nominated = true
+			assert.Equal(t, highPair, a.getSelectedPair())
+
+			assert.True(t, a.failPair(highPair))
+			a.reselectPair(1)
+			assert.Equal(t, lowPair, a.getSelectedPair())
+		}, nil))
+
+		assert.NoError(t, a.Close())
+	})
+}
@@ -6,7 +6,7 @@ type ConnectionState int
 // List of supported States
 const (
 	// ConnectionStateNew ICE agent is gathering addresses
-	ConnectionStateNew = iota + 1
+	ConnectionStateNew ConnectionState = iota + 1
 
 	// ConnectionStateChecking ICE agent has been given local and remote candidates, and is attempting to find a match
 	ConnectionStateChecking
@@ -48,6 +48,43 @@ func (c ConnectionState) String() string {
 	}
 }
 
+// FailureReason tells why the connection state of an Agent became failed
+type FailureReason int
+
+const (
+	// FailureReasonGatheringFailed means no local candidate was gathered
+	// before the connection timeout
+	FailureReasonGatheringFailed FailureReason = iota + 1
+
+	// FailureReasonNoValidPairs means no connectivity check succeeded before
+	// the connection timeout, e.g. because of a firewall
+	FailureReasonNoValidPairs
+
+	// FailureReasonConsentExpired means the remote stopped answering the
+	// consent freshness checks of the selected pair
+	FailureReasonConsentExpired
+
+	// FailureReasonTimeout means nothing was received on the selected pair for
+	// DisconnectedTimeout and FailedTimeout, or that no valid pair could be
+	// nominated before the connection timeout
+	FailureReasonTimeout
+)
+
+func (r FailureReason) String() string {
+	switch r {
+	case FailureReasonGatheringFailed:
+		return "GatheringFailed"
+	case FailureReasonNoValidPairs:
+		return "NoValidPairs"
+	case FailureReasonConsentExpired:
+		return "ConsentExpired"
+	case FailureReasonTimeout:
+		return "Timeout"
+	default:
+		return "Invalid"
+	}
+}
+
 // GatheringState describes the state of the candidate gathering process
 type GatheringState int
 
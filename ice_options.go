@@ -0,0 +1,61 @@
+package ice
+
+import (
+	"strings"
+)
+
+// The ice-options the Agent acts upon
+// https://tools.ietf.org/html/rfc8839#section-5.6
+const (
+	iceOptionTrickle = "trickle"
+	iceOptionICE2    = "ice2"
+)
+
+// SetRemoteICEOptions sets the ice-options the remote advertised in its offer
+// or answer, e.g. []string{"trickle", "ice2"} for "a=ice-options:trickle ice2".
+// A remote that doesn't advertise "trickle" sends every candidate with its
+// offer or answer, so its remote candidates are done like after
+// RemoteCandidatesDone and the connection fails as soon as every pair failed.
+// The options apply until they are set again, including across a Restart.
+func (a *Agent) SetRemoteICEOptions(options []string) error {
+	return a.run(func(agent *Agent) {
+		agent.remoteICEOptions = map[string]bool{}
+		for _, option := range options {
+			agent.remoteICEOptions[strings.TrimSpace(option)] = true
+		}
+		agent.requestConnectivityCheck()
+	}, nil)
+}
+
+// RemoteSupportsTrickle returns true if the remote advertised the "trickle"
+// ice-option, it is false until SetRemoteICEOptions is called
+// https://tools.ietf.org/html/rfc8840
+func (a *Agent) RemoteSupportsTrickle() bool {
+	return a.remoteSupports(iceOptionTrickle)
+}
+
+// RemoteSupportsICE2 returns true if the remote advertised the "ice2"
+// ice-option, which tells it implements RFC 8445 rather than RFC 5245. It is
+// false until SetRemoteICEOptions is called.
+// https://tools.ietf.org/html/rfc8445#section-10
+func (a *Agent) RemoteSupportsICE2() bool {
+	return a.remoteSupports(iceOptionICE2)
+}
+
+// remoteSupports returns true if the remote advertised option, and false once
+// the Agent is closed
+func (a *Agent) remoteSupports(option string) bool {
+	supported := make(chan bool, 1)
+	if err := a.run(func(agent *Agent) {
+		supported <- agent.remoteICEOptions[option]
+	}, nil); err != nil {
+		return false
+	}
+	return <-supported
+}
+
+// remoteCandidatesComplete returns true once no more remote candidates are
+// expected, after RemoteCandidatesDone or from a remote that doesn't trickle
+func (a *Agent) remoteCandidatesComplete() bool {
+	return a.remoteCandidatesDone || (a.remoteICEOptions != nil && !a.remoteICEOptions[iceOptionTrickle])
+}
@@ -0,0 +1,92 @@
+// +build !js
+
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteICEOptions(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	oneHour := time.Hour
+	maxBindingRequests := uint16(1)
+	checkInterval := 10 * time.Millisecond
+	a, err := NewAgent(&AgentConfig{
+		ConnectionTimeout:  &oneHour,
+		MaxBindingRequests: &maxBindingRequests,
+		InitialRTO:         &checkInterval,
+		CheckInterval:      &checkInterval,
+	})
+	assert.NoError(t, err)
+
+	failed := make(chan FailureReason, 1)
+	assert.NoError(t, a.OnFailed(func(reason FailureReason) {
+		failed <- reason
+	}))
+
+	assert.False(t, a.RemoteSupportsTrickle())
+	assert.False(t, a.RemoteSupportsICE2())
+	assert.NoError(t, a.SetRemoteICEOptions([]string{"trickle", "ice2"}))
+	assert.True(t, a.RemoteSupportsTrickle())
+	assert.True(t, a.RemoteSupportsICE2())
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	local, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "127.0.0.1",
+		Port:      conn.LocalAddr().(*net.UDPAddr).Port,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+	// Nothing answers on the discard port
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "127.0.0.1",
+		Port:      9,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+
+	var p *candidatePair
+	assert.NoError(t, a.run(func(agent *Agent) {
+		agent.gatheringState = GatheringStateComplete
+		local.start(agent, conn, agent.startedCh)
+		agent.localCandidates[local.NetworkType()] = []Candidate{local}
+		p = agent.addPair(local, remote)
+	}, nil))
+	assert.NoError(t, a.startConnectivityChecks(true, "remoteUfrag", "remotePasswordWith128Bits"))
+
+	// A trickling remote may still send candidates once the only pair failed
+	assert.Eventually(t, func() bool {
+		state := CandidatePairStateWaiting
+		assert.NoError(t, a.run(func(agent *Agent) {
+			state = p.state
+		}, nil))
+		return state == CandidatePairStateFailed
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, a.run(func(agent *Agent) {
+		assert.Equal(t, ConnectionStateChecking, agent.connectionState)
+	}, nil))
+
+	// A remote that doesn't trickle sent all its candidates already
+	assert.NoError(t, a.SetRemoteICEOptions([]string{"ice2"}))
+	assert.False(t, a.RemoteSupportsTrickle())
+	assert.Equal(t, FailureReasonNoValidPairs, <-failed)
+	<-a.onConnectionTimeout
+
+	assert.NoError(t, a.Close())
+	assert.Equal(t, ErrClosed, a.SetRemoteICEOptions(nil))
+	assert.False(t, a.RemoteSupportsICE2())
+}
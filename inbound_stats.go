@@ -0,0 +1,73 @@
+package ice
+
+import (
+	"sync"
+	"time"
+)
+
+// inboundStats are the arrival statistics of the data packets of a component
+type inboundStats struct {
+	mu      sync.Mutex
+	packets uint64
+	// lastArrival and lastInterval are the arrival time of the last packet,
+	// and how long after the one before it it arrived
+	lastArrival  time.Time
+	lastInterval time.Duration
+	// jitter is the smoothed variation of the inter-arrival intervals
+	jitter float64
+}
+
+// packetArrived records a data packet received from the network at t. The
+// jitter is estimated like the interarrival jitter of RFC 3550, with the
+// variation of consecutive inter-arrival intervals in place of the transit
+// times, which need the RTP timestamps.
+// https://tools.ietf.org/html/rfc3550#section-6.4.1
+func (s *inboundStats) packetArrived(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.packets++
+	if !s.lastArrival.IsZero() {
+		interval := t.Sub(s.lastArrival)
+		if s.packets > 2 {
+			d := interval - s.lastInterval
+			if d < 0 {
+				d = -d
+			}
+			s.jitter += (float64(d) - s.jitter) / 16
+		}
+		s.lastInterval = interval
+	}
+	s.lastArrival = t
+}
+
+func (s *inboundStats) packetCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.packets
+}
+
+func (s *inboundStats) jitterEstimate() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Duration(s.jitter)
+}
+
+// InboundPacketCount returns the number of data packets received from the
+// network for the component of the Conn, on any candidate pair. It counts
+// the packets dropped by the BufferOverflowPolicy before they were read.
+func (c *Conn) InboundPacketCount() uint64 {
+	return c.agent.inboundStats[c.component-1].packetCount()
+}
+
+// InboundJitter estimates the jitter of the data received for the component
+// of the Conn from the variation of the intervals between the packet
+// arrivals, smoothed like the RTP interarrival jitter. It is a cheap quality
+// signal for the media sent at a steady rate, the bursts of other traffic
+// raise it. Packet loss is not estimated: it requires the sequence numbers of
+// a higher layer, like RTP.
+func (c *Conn) InboundJitter() time.Duration {
+	return c.agent.inboundStats[c.component-1].jitterEstimate()
+}
@@ -0,0 +1,118 @@
+package ice
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultInterfacePriorityTimeout is how long the checks of an
+// InterfacePriority tier are waited for before the next tier is gathered
+const defaultInterfacePriorityTimeout = 2 * time.Second
+
+// interfaceTier returns the tier of the interface name in priority, the
+// interfaces it doesn't list are of the last tier, len(priority)
+func interfaceTier(priority []string, name string) int {
+	for i, n := range priority {
+		if n == name {
+			return i
+		}
+	}
+	return len(priority)
+}
+
+// gatheredInterfaceFilter returns the InterfaceFilter of the interfaces host
+// candidates are gathered on, the ones accepted by AgentConfig.InterfaceFilter
+// up to the current InterfacePriority tier
+func (a *Agent) gatheredInterfaceFilter() func(string) bool {
+	if len(a.interfacePriority) == 0 {
+		return a.interfaceFilter
+	}
+
+	tier := int(atomic.LoadInt32(&a.interfaceTier))
+	return func(name string) bool {
+		if a.interfaceFilter != nil && !a.interfaceFilter(name) {
+			return false
+		}
+		return interfaceTier(a.interfacePriority, name) <= tier
+	}
+}
+
+// interfaceTierPending returns true while the Agent is checking the candidates
+// of an InterfacePriority tier that isn't the last one, and no pair succeeded
+// Note: the caller should hold the agent lock.
+func (a *Agent) interfaceTierPending() bool {
+	if len(a.interfacePriority) == 0 || int(atomic.LoadInt32(&a.interfaceTier)) >= len(a.interfacePriority) {
+		return false
+	}
+	if a.connectionState != ConnectionStateChecking || a.gatheringState != GatheringStateComplete {
+		return false
+	}
+	for _, p := range a.checklist {
+		if p.state == CandidatePairStateSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+// checkInterfaceTier gathers the host candidates of the next InterfacePriority
+// tier once the checks of the current one ran for InterfacePriorityTimeout
+// without any pair succeeding
+// Note: the caller should hold the agent lock.
+func (a *Agent) checkInterfaceTier() {
+	if !a.interfaceTierPending() {
+		return
+	}
+
+	if a.interfaceTierSince.IsZero() {
+		a.interfaceTierSince = a.clock.Now()
+		return
+	}
+	if a.clock.Now().Sub(a.interfaceTierSince) < a.interfacePriorityTimeout {
+		return
+	}
+
+	tier := atomic.AddInt32(&a.interfaceTier, 1)
+	a.interfaceTierSince = a.clock.Now()
+	a.log.Infof("No candidate pair succeeded after %s, gathering the host candidates of interface tier %d", a.interfacePriorityTimeout, tier)
+	go a.gatherInterfaceTier(int(tier))
+}
+
+// nextInterfaceTier returns when checkInterfaceTier gathers the next tier
+// Note: the caller should hold the agent lock.
+func (a *Agent) nextInterfaceTier() (time.Time, bool) {
+	if !a.interfaceTierPending() || a.interfaceTierSince.IsZero() {
+		return time.Time{}, false
+	}
+	return a.interfaceTierSince.Add(a.interfacePriorityTimeout), true
+}
+
+// gatherInterfaceTier gathers the host candidates of the interfaces of tier.
+// When it has none, the next tier is gathered at once.
+func (a *Agent) gatherInterfaceTier(tier int) {
+	addrs, err := localAddrs(a.net, func(name string) bool {
+		if a.interfaceFilter != nil && !a.interfaceFilter(name) {
+			return false
+		}
+		return interfaceTier(a.interfacePriority, name) == tier
+	}, a.ipFilter, a.networkTypes)
+	if err != nil {
+		a.log.Warnf("Failed to iterate local interfaces, host candidates of interface tier %d will not be gathered: %v", tier, err)
+		return
+	}
+
+	if len(addrs) == 0 {
+		a.log.Debugf("No local IP on interface tier %d, skipping it", tier)
+		if err := a.run(func(agent *Agent) {
+			if int(atomic.LoadInt32(&agent.interfaceTier)) == tier {
+				agent.interfaceTierSince = agent.clock.Now().Add(-agent.interfacePriorityTimeout)
+				agent.requestConnectivityCheck()
+			}
+		}, nil); err != nil {
+			a.log.Warnf("Failed to skip interface tier %d: %v", tier, err)
+		}
+		return
+	}
+
+	a.regatherHostCandidates(addrs)
+}
@@ -0,0 +1,149 @@
+// +build !js
+
+package ice
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// tieredNet is a memory network with a Wi-Fi and a cellular interface, only
+// the sockets of the cellular one reach the peer
+type tieredNet struct {
+	wifi, cellular       net.IP
+	wifiHub, cellularHub *memoryHub
+}
+
+func (n *tieredNet) Interfaces() ([]*vnet.Interface, error) {
+	wifi := vnet.NewInterface(net.Interface{Index: 1, MTU: 1500, Name: "wlan0", Flags: net.FlagUp})
+	wifi.AddAddr(&net.IPNet{IP: n.wifi, Mask: net.CIDRMask(24, 32)})
+	cellular := vnet.NewInterface(net.Interface{Index: 2, MTU: 1500, Name: "rmnet0", Flags: net.FlagUp})
+	cellular.AddAddr(&net.IPNet{IP: n.cellular, Mask: net.CIDRMask(24, 32)})
+	return []*vnet.Interface{cellular, wifi}, nil
+}
+
+func (n *tieredNet) ListenUDP(network string, locAddr *net.UDPAddr) (vnet.UDPPacketConn, error) {
+	hub := n.cellularHub
+	if locAddr.IP.Equal(n.wifi) {
+		hub = n.wifiHub
+	}
+	return (&memoryNet{hub: hub, ip: locAddr.IP}).ListenUDP(network, locAddr)
+}
+
+func (n *tieredNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return n.ListenUDP(network, &net.UDPAddr{IP: n.cellular})
+}
+
+func (n *tieredNet) ResolveUDPAddr(network, address string) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr(network, address)
+}
+
+func (n *tieredNet) IsVirtual() bool {
+	return true
+}
+
+func TestInterfaceTier(t *testing.T) {
+	priority := []string{"wlan0", "eth0"}
+	assert.Equal(t, 0, interfaceTier(priority, "wlan0"))
+	assert.Equal(t, 1, interfaceTier(priority, "eth0"))
+	assert.Equal(t, 2, interfaceTier(priority, "rmnet0"))
+	assert.Equal(t, 0, interfaceTier(nil, "rmnet0"))
+}
+
+func TestInterfacePriority(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	wifi, cellular := net.IPv4(192, 168, 1, 2), net.IPv4(10, 0, 0, 2)
+	cellularHub := newMemoryHub()
+	timeout := 200 * time.Millisecond
+
+	aAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:             []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:           []CandidateType{CandidateTypeHost},
+		MulticastDNSMode:         MulticastDNSModeDisabled,
+		Net:                      &tieredNet{wifi: wifi, cellular: cellular, wifiHub: newMemoryHub(), cellularHub: cellularHub},
+		InterfacePriority:        []string{"wlan0"},
+		InterfacePriorityTimeout: &timeout,
+		taskLoopInterval:         50 * time.Millisecond,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+	bAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:   []CandidateType{CandidateTypeHost},
+		MulticastDNSMode: MulticastDNSModeDisabled,
+		Net:              &memoryNet{hub: cellularHub, ip: net.IPv4(10, 0, 0, 3)},
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	// The candidates of a are trickled to b
+	aCandidates := make(chan Candidate, 10)
+	assert.NoError(t, aAgent.OnCandidate(func(c Candidate) {
+		if c != nil {
+			assert.NoError(t, bAgent.AddRemoteCandidate(copyCandidate(c)))
+		}
+		aCandidates <- c
+	}))
+	bGathered := make(chan struct{})
+	assert.NoError(t, bAgent.OnCandidate(func(c Candidate) {
+		if c == nil {
+			close(bGathered)
+		}
+	}))
+	assert.NoError(t, aAgent.GatherCandidates(context.Background()))
+	assert.NoError(t, bAgent.GatherCandidates(context.Background()))
+
+	// Only the Wi-Fi candidate is gathered first
+	c := <-aCandidates
+	assert.Equal(t, wifi.String(), c.Address())
+	assert.Nil(t, <-aCandidates)
+
+	<-bGathered
+	bCandidates, err := bAgent.GetLocalCandidates()
+	assert.NoError(t, err)
+	for _, c := range bCandidates {
+		assert.NoError(t, aAgent.AddRemoteCandidate(copyCandidate(c)))
+	}
+
+	bUfrag, bPwd, err := bAgent.GetLocalUserCredentials()
+	assert.NoError(t, err)
+	aUfrag, aPwd, err := aAgent.GetLocalUserCredentials()
+	assert.NoError(t, err)
+
+	start := time.Now()
+	accepted := make(chan *Conn)
+	go func() {
+		aConn, acceptErr := aAgent.Accept(context.Background(), bUfrag, bPwd)
+		assert.NoError(t, acceptErr)
+		accepted <- aConn
+	}()
+	bConn, err := bAgent.Dial(context.Background(), aUfrag, aPwd)
+	assert.NoError(t, err)
+	aConn := <-accepted
+
+	// The cellular candidate is gathered once the Wi-Fi one didn't connect
+	c = <-aCandidates
+	assert.Equal(t, cellular.String(), c.Address())
+	assert.Nil(t, <-aCandidates)
+	assert.True(t, time.Since(start) >= timeout)
+
+	pair, err := aAgent.GetSelectedCandidatePair()
+	assert.NoError(t, err)
+	assert.Equal(t, cellular.String(), pair.Local.Address())
+
+	assert.NoError(t, aConn.Close())
+	assert.NoError(t, bConn.Close())
+}
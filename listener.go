@@ -0,0 +1,193 @@
+package ice
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+)
+
+// ListenerConfig is the configuration of a Listener
+type ListenerConfig struct {
+	// UDPMux is the socket the peers connect to. It can be shared with other
+	// Agents as long as their local ufrags are distinct, but with a single Listener.
+	UDPMux *UDPMuxDefault
+
+	// Credentials looks up the passwords of a peer that was given localUfrag
+	// and that sent remoteUfrag, both exchanged by signaling. ok is false for
+	// unknown peers. The lookup is done once per peer, for the first Binding
+	// request it sent, which must be authenticated with localPwd.
+	Credentials func(localUfrag, remoteUfrag string) (localPwd, remotePwd string, ok bool)
+
+	// AgentConfig is the configuration of the Agents created for the peers,
+	// its UDPMux and local credentials are replaced by the ones of the peer
+	AgentConfig *AgentConfig
+}
+
+// Listener accepts ICE peers on a UDPMux, like a net.Listener accepts
+// connections. A controlled Agent is created for every authenticated peer,
+// and its Conn is returned by Accept once connected. The peer must send its
+// connectivity checks to the address of the UDPMux.
+type Listener struct {
+	config ListenerConfig
+	log    logging.LeveledLogger
+
+	mu sync.Mutex
+	// pending is keyed by the local ufrag of the peers being connected
+	pending map[string]bool
+
+	conns chan *Conn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Listen creates a Listener accepting the peers that connect to config.UDPMux
+func Listen(config ListenerConfig) (*Listener, error) {
+	if config.UDPMux == nil || config.Credentials == nil {
+		return nil, ErrListenerConfig
+	}
+
+	loggerFactory := logging.LoggerFactory(logging.NewDefaultLoggerFactory())
+	if config.AgentConfig != nil && config.AgentConfig.LoggerFactory != nil {
+		loggerFactory = config.AgentConfig.LoggerFactory
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		config:  config,
+		log:     loggerFactory.NewLogger("ice"),
+		pending: map[string]bool{},
+		conns:   make(chan *Conn),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	config.UDPMux.setOnUnknownUfrag(l.handleBindingRequest)
+
+	return l, nil
+}
+
+// Accept blocks until a peer is connected, and returns the Conn of its Agent.
+// The Conn is owned by the caller, closing the Listener doesn't close it.
+func (l *Listener) Accept() (*Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops accepting peers and closes the Agents still connecting, the
+// UDPMux and the accepted Conns stay open
+func (l *Listener) Close() error {
+	l.config.UDPMux.setOnUnknownUfrag(nil)
+
+	l.mu.Lock()
+	l.cancel()
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return nil
+}
+
+// Addr returns the address of the UDPMux
+func (l *Listener) Addr() net.Addr {
+	return l.config.UDPMux.LocalAddr()
+}
+
+// handleBindingRequest is called by the UDPMux, it starts connecting a peer
+// unless it is already being connected
+func (l *Listener) handleBindingRequest(localUfrag string, msg *stun.Message, addr net.Addr) {
+	var username stun.Username
+	if err := username.GetFrom(msg); err != nil {
+		return
+	}
+	parts := strings.SplitN(string(username), ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ctx.Err() != nil || l.pending[localUfrag] {
+		return
+	}
+	l.pending[localUfrag] = true
+
+	l.wg.Add(1)
+	go l.accept(localUfrag, parts[1], msg, addr)
+}
+
+// accept connects the Agent of a peer, and hands its Conn to Accept
+func (l *Listener) accept(localUfrag, remoteUfrag string, msg *stun.Message, addr net.Addr) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.pending, localUfrag)
+		l.mu.Unlock()
+	}()
+
+	localPwd, remotePwd, ok := l.config.Credentials(localUfrag, remoteUfrag)
+	if !ok {
+		l.log.Debugf("Ignoring Binding request from %s, no credentials for %s:%s", addr, localUfrag, remoteUfrag)
+		return
+	}
+	if err := assertInboundMessageIntegrity(msg, []byte(localPwd)); err != nil {
+		l.log.Warnf("Ignoring Binding request from %s for %s: %v", addr, localUfrag, err)
+		return
+	}
+
+	conn, err := l.connect(localUfrag, localPwd, remoteUfrag, remotePwd)
+	if err != nil {
+		l.log.Warnf("Failed to accept peer %s from %s: %v", localUfrag, addr, err)
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		if err := conn.Close(); err != nil {
+			l.log.Warnf("Failed to close Agent of %s: %v", localUfrag, err)
+		}
+	}
+}
+
+func (l *Listener) connect(localUfrag, localPwd, remoteUfrag, remotePwd string) (*Conn, error) {
+	config := AgentConfig{}
+	if l.config.AgentConfig != nil {
+		config = *l.config.AgentConfig
+	}
+	config.UDPMux = l.config.UDPMux
+	config.LocalUfrag = localUfrag
+	config.LocalPwd = localPwd
+
+	a, err := NewAgent(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The conn of the Agent is registered on the UDPMux when gathering, the
+	// retransmissions of the Binding request are then forwarded to it
+	if err = a.OnCandidate(func(Candidate) {}); err == nil {
+		err = a.GatherCandidates(l.ctx)
+	}
+
+	var conn *Conn
+	if err == nil {
+		conn, err = a.Accept(l.ctx, remoteUfrag, remotePwd)
+	}
+	if err != nil {
+		if closeErr := a.Close(); closeErr != nil {
+			l.log.Warnf("Failed to close Agent of %s: %v", localUfrag, closeErr)
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,125 @@
+// +build !js
+
+package ice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListener(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	localIPs, err := localInterfaces(vnet.NewNet(nil), nil, nil, []NetworkType{NetworkTypeUDP4})
+	assert.NoError(t, err)
+	if len(localIPs) == 0 {
+		t.Skip("no non-loopback IPv4 interface to gather host candidates on")
+	}
+
+	_, err = Listen(ListenerConfig{})
+	assert.Equal(t, ErrListenerConfig, err)
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	assert.NoError(t, err)
+	mux := NewUDPMuxDefault(UDPMuxParams{UDPConn: udpConn})
+	muxPort := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	cfg := &AgentConfig{
+		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:   []CandidateType{CandidateTypeHost},
+		MulticastDNSMode: MulticastDNSModeDisabled,
+
+		AllowPrivateRemoteCandidates: true,
+	}
+
+	// The credentials the server gave to the client, and looked up by the
+	// Listener. Only the first client is known.
+	const serverPwd = "serverPasswordOfClient"
+	clientCredentials := make(chan [2]string, 2)
+	listener, err := Listen(ListenerConfig{
+		UDPMux:      mux,
+		AgentConfig: cfg,
+		Credentials: func(localUfrag, remoteUfrag string) (string, string, bool) {
+			if localUfrag != "serverUfrag" {
+				return "", "", false
+			}
+			creds := <-clientCredentials
+			assert.Equal(t, creds[0], remoteUfrag)
+			return serverPwd, creds[1], true
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, mux.LocalAddr(), listener.Addr())
+
+	dial := func(serverUfrag string, timeout time.Duration) (*Agent, chan error) {
+		client, newErr := NewAgent(cfg)
+		assert.NoError(t, newErr)
+
+		ufrag, pwd, credErr := client.GetLocalUserCredentials()
+		assert.NoError(t, credErr)
+		clientCredentials <- [2]string{ufrag, pwd}
+
+		serverCandidate, candErr := NewCandidateHost(&CandidateHostConfig{
+			Network:   udp,
+			Address:   localIPs[0].String(),
+			Port:      muxPort,
+			Component: ComponentRTP,
+		})
+		assert.NoError(t, candErr)
+		assert.NoError(t, client.AddRemoteCandidate(serverCandidate))
+		assert.NoError(t, client.OnCandidate(func(Candidate) {}))
+		assert.NoError(t, client.GatherCandidates(context.Background()))
+
+		dialed := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			conn, dialErr := client.Dial(ctx, serverUfrag, serverPwd)
+			if dialErr == nil {
+				_, dialErr = conn.Write([]byte("hello"))
+			}
+			dialed <- dialErr
+		}()
+		return client, dialed
+	}
+
+	client, dialed := dial("serverUfrag", 10*time.Second)
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, <-dialed)
+
+	buf := make([]byte, receiveMTU)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	// A peer without credentials is never accepted
+	unknown, dialed := dial("unknownUfrag", time.Second)
+	assert.Equal(t, ErrCanceledByCaller, <-dialed)
+
+	assert.NoError(t, listener.Close())
+	_, err = listener.Accept()
+	assert.True(t, errors.Is(err, ErrListenerClosed))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && !netErr.Temporary(), err)
+
+	// The accepted Conn outlives the Listener
+	assert.NoError(t, conn.agent.ok())
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, client.Close())
+	assert.NoError(t, unknown.Close())
+	assert.NoError(t, mux.Close())
+}
@@ -1,7 +1,9 @@
 package ice
 
 import (
+	"io"
 	"net"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/logging"
@@ -9,6 +11,9 @@ import (
 	"golang.org/x/net/ipv4"
 )
 
+// multicastDNSQueryTimeout is how long we try to resolve a remote mDNS candidate
+const multicastDNSQueryTimeout = 10 * time.Second
+
 // MulticastDNSMode represents the different Multicast modes ICE can run in
 type MulticastDNSMode byte
 
@@ -24,11 +29,16 @@ const (
 	MulticastDNSModeQueryAndGather
 )
 
-func generateMulticastDNSName() (string, error) {
+func generateMulticastDNSName(r io.Reader) (string, error) {
 	// https://tools.ietf.org/id/draft-ietf-rtcweb-mdns-ice-candidates-02.html#gathering
 	// The unique name MUST consist of a version 4 UUID as defined in [RFC4122], followed by “.local”.
-	u, err := uuid.NewRandom()
-	return u.String() + ".local", err
+	var u uuid.UUID
+	if _, err := io.ReadFull(r, u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // Version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // Variant 10
+	return u.String() + ".local", nil
 }
 
 func createMulticastDNS(mDNSMode MulticastDNSMode, mDNSName string, log logging.LeveledLogger) (*mdns.Conn, MulticastDNSMode, error) {
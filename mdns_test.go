@@ -4,6 +4,7 @@ package ice
 
 import (
 	"context"
+	crand "crypto/rand"
 	"regexp"
 	"testing"
 	"time"
@@ -24,6 +25,8 @@ func TestMulticastDNSOnlyConnection(t *testing.T) {
 		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
 		CandidateTypes:   []CandidateType{CandidateTypeHost},
 		MulticastDNSMode: MulticastDNSModeQueryAndGather,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg)
@@ -66,6 +69,8 @@ func TestMulticastDNSMixedConnection(t *testing.T) {
 		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
 		CandidateTypes:   []CandidateType{CandidateTypeHost},
 		MulticastDNSMode: MulticastDNSModeQueryAndGather,
+
+		AllowPrivateRemoteCandidates: true,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -80,6 +85,8 @@ func TestMulticastDNSMixedConnection(t *testing.T) {
 		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
 		CandidateTypes:   []CandidateType{CandidateTypeHost},
 		MulticastDNSMode: MulticastDNSModeQueryOnly,
+
+		AllowPrivateRemoteCandidates: true,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -128,13 +135,13 @@ func TestMulticastDNSStaticHostName(t *testing.T) {
 		}
 	}))
 
-	assert.NoError(t, agent.GatherCandidates())
+	assert.NoError(t, agent.GatherCandidates(context.Background()))
 	<-correctHostName.Done()
 	assert.NoError(t, agent.Close())
 }
 
 func TestGenerateMulticastDNSName(t *testing.T) {
-	name, err := generateMulticastDNSName()
+	name, err := generateMulticastDNSName(crand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,3 +153,49 @@ func TestGenerateMulticastDNSName(t *testing.T) {
 		t.Fatalf("mDNS name must be UUID v4 + \".local\" suffix, got %s", name)
 	}
 }
+
+func TestMulticastDNSUnresolvableCandidate(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	cfg := &AgentConfig{
+		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:   []CandidateType{CandidateTypeHost},
+		MulticastDNSMode: MulticastDNSModeQueryOnly,
+
+		AllowPrivateRemoteCandidates: true,
+	}
+
+	aAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+
+	aNotifier, aConnected := onConnected()
+	assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+
+	bAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+
+	bNotifier, bConnected := onConnected()
+	assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+	// Nobody answers for this name, only the candidate must be dropped
+	unresolvable, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   udp,
+		Address:   "00000000-0000-4000-8000-000000000000.local",
+		Port:      9,
+		Component: ComponentRTP,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, aAgent.AddRemoteCandidate(unresolvable))
+
+	connect(aAgent, bAgent)
+	<-aConnected
+	<-bConnected
+
+	// Closing the Agent stops the pending query
+	assert.NoError(t, aAgent.Close())
+	assert.NoError(t, bAgent.Close())
+}
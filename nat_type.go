@@ -0,0 +1,344 @@
+package ice
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// natProbeAttempts is how many times a NAT behavior discovery request is
+	// sent before concluding no response gets through
+	natProbeAttempts = 3
+
+	// attrResponseOrigin is not known by pion/stun
+	// https://tools.ietf.org/html/rfc5780#section-7.3
+	attrResponseOrigin stun.AttrType = 0x802B
+)
+
+// NATBehavior is the mapping or the filtering behavior of a NAT
+// https://tools.ietf.org/html/rfc4787#section-4.1
+type NATBehavior int
+
+const (
+	// NATBehaviorEndpointIndependent means the NAT maps the packets to every
+	// remote on the same address, or lets in the packets of every remote
+	NATBehaviorEndpointIndependent NATBehavior = iota + 1
+
+	// NATBehaviorAddressDependent means the mapping or filtering depends on
+	// the IP of the remote
+	NATBehaviorAddressDependent
+
+	// NATBehaviorAddressAndPortDependent means the mapping or filtering
+	// depends on the IP and the port of the remote
+	NATBehaviorAddressAndPortDependent
+)
+
+func (b NATBehavior) String() string {
+	switch b {
+	case NATBehaviorEndpointIndependent:
+		return "endpoint-independent"
+	case NATBehaviorAddressDependent:
+		return "address-dependent"
+	case NATBehaviorAddressAndPortDependent:
+		return "address-and-port-dependent"
+	}
+	return ErrUnknownType.Error()
+}
+
+// NATType is the behavior of the NAT between the Agent and a STUN server, as
+// detected by DetectNATType. Direct connectivity through a NAT with an
+// address-and-port-dependent mapping usually needs a relay.
+type NATType struct {
+	// Mapped is false when the local address is not translated, the mapping
+	// behavior is then endpoint independent
+	Mapped bool
+
+	MappingBehavior   NATBehavior
+	FilteringBehavior NATBehavior
+}
+
+// changeRequest is the CHANGE-REQUEST attribute, asking the server to answer
+// from its other IP and/or port
+// https://tools.ietf.org/html/rfc5780#section-7.2
+type changeRequest struct {
+	ip, port bool
+}
+
+// AddTo adds CHANGE-REQUEST to m
+func (c changeRequest) AddTo(m *stun.Message) error {
+	var flags uint32
+	if c.ip {
+		flags |= 0x4
+	}
+	if c.port {
+		flags |= 0x2
+	}
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, flags)
+	m.Add(stun.AttrChangeRequest, v)
+	return nil
+}
+
+// DetectNATType discovers the mapping and filtering behavior of the NAT in
+// front of the Agent, with the NAT behavior discovery of RFC 5780 against the
+// first STUN server of AgentConfig.Urls. It is a diagnostic separate from
+// gathering, run over IPv4 UDP on a socket of its own. The server must return
+// OTHER-ADDRESS and honor CHANGE-REQUEST, ErrNATDetectionUnsupported is
+// returned otherwise.
+// https://tools.ietf.org/html/rfc5780#section-4.3
+func (a *Agent) DetectNATType(ctx context.Context) (NATType, error) {
+	if err := a.ok(); err != nil {
+		return NATType{}, err
+	}
+
+	var url *URL
+	for _, u := range a.urls {
+		if u.Scheme == SchemeTypeSTUN {
+			url = u
+			break
+		}
+	}
+	if url == nil {
+		return NATType{}, ErrNoSTUNServer
+	}
+
+	hostPort := fmt.Sprintf("%s:%d", url.Host, url.Port)
+	serverAddr, err := a.net.ResolveUDPAddr(udp+"4", hostPort)
+	if err != nil {
+		return NATType{}, fmt.Errorf("failed to resolve %s: %w", url, err)
+	}
+
+	// The filtering is tested on a socket of its own, the mapping tests open
+	// the NAT to the other IP and port of the server
+	var conns [2]net.PacketConn
+	for i := range conns {
+		conn, listenErr := listenUDPInPortRange(a.net, a.log, int(a.portmax), int(a.portmin), udp+"4", &net.UDPAddr{IP: nil, Port: 0})
+		if listenErr != nil {
+			return NATType{}, fmt.Errorf("failed to listen for %s: %w", url, listenErr)
+		}
+		defer func() {
+			if closeErr := conn.Close(); closeErr != nil {
+				a.log.Warnf("Failed to close the NAT detection socket: %v", closeErr)
+			}
+		}()
+		conns[i] = conn
+	}
+
+	stop := onCancel(ctx, func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+	natType, err := a.detectNATType(conns[0], conns[1], serverAddr)
+	if aborted := stop(); aborted {
+		return NATType{}, ctx.Err()
+	} else if err != nil {
+		return NATType{}, fmt.Errorf("failed to detect the NAT type with %s: %w", url, err)
+	}
+	return natType, nil
+}
+
+// detectNATType runs the mapping behavior tests on conn, and the filtering
+// behavior tests on filteringConn
+func (a *Agent) detectNATType(conn, filteringConn net.PacketConn, serverAddr *net.UDPAddr) (NATType, error) {
+	// Test I, the mapped address and the other address of the server
+	resp, _, err := a.natProbe(conn, serverAddr)
+	if err != nil {
+		return NATType{}, err
+	}
+	var mapped stun.XORMappedAddress
+	if err = mapped.GetFrom(resp); err != nil {
+		return NATType{}, fmt.Errorf("failed to get XOR-MAPPED-ADDRESS response: %w", err)
+	}
+	otherAddr, err := getAddrAs(resp, stun.AttrOtherAddress)
+	if err != nil {
+		return NATType{}, fmt.Errorf("%w: no OTHER-ADDRESS", ErrNATDetectionUnsupported)
+	}
+	if otherAddr.IP.Equal(serverAddr.IP) || otherAddr.Port == serverAddr.Port {
+		return NATType{}, fmt.Errorf("%w: OTHER-ADDRESS %s doesn't differ by IP and port", ErrNATDetectionUnsupported, otherAddr)
+	}
+
+	natType := NATType{Mapped: !a.isLocalAddr(conn, mapped), MappingBehavior: NATBehaviorEndpointIndependent}
+	if natType.Mapped {
+		natType.MappingBehavior, err = a.detectMappingBehavior(conn, serverAddr, otherAddr, mapped)
+		if err != nil {
+			return NATType{}, err
+		}
+	}
+
+	natType.FilteringBehavior, err = a.detectFilteringBehavior(filteringConn, serverAddr)
+	if err != nil {
+		return NATType{}, err
+	}
+
+	a.log.Infof("Detected NAT with %s mapping and %s filtering", natType.MappingBehavior, natType.FilteringBehavior)
+	return natType, nil
+}
+
+// isLocalAddr returns true if mapped is the address of conn on an interface
+func (a *Agent) isLocalAddr(conn net.PacketConn, mapped stun.XORMappedAddress) bool {
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || laddr.Port != mapped.Port {
+		return false
+	}
+
+	localIPs, err := localInterfaces(a.net, a.interfaceFilter, a.ipFilter, []NetworkType{NetworkTypeUDP4})
+	if err != nil {
+		a.log.Warnf("Failed to iterate local interfaces: %v", err)
+		return false
+	}
+	for _, ip := range localIPs {
+		if ip.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectMappingBehavior compares the addresses mapped for the other IP of the
+// server, and for its other IP and port, with the one mapped for the server
+// https://tools.ietf.org/html/rfc5780#section-4.3
+func (a *Agent) detectMappingBehavior(conn net.PacketConn, serverAddr, otherAddr *net.UDPAddr, mapped stun.XORMappedAddress) (NATBehavior, error) {
+	// Test II, the other IP and the primary port
+	resp, _, err := a.natProbe(conn, &net.UDPAddr{IP: otherAddr.IP, Port: serverAddr.Port})
+	if err != nil {
+		return 0, err
+	}
+	var mappedII stun.XORMappedAddress
+	if err = mappedII.GetFrom(resp); err != nil {
+		return 0, fmt.Errorf("failed to get XOR-MAPPED-ADDRESS response: %w", err)
+	}
+	if mappedII.IP.Equal(mapped.IP) && mappedII.Port == mapped.Port {
+		return NATBehaviorEndpointIndependent, nil
+	}
+
+	// Test III, the other IP and the other port
+	resp, _, err = a.natProbe(conn, otherAddr)
+	if err != nil {
+		return 0, err
+	}
+	var mappedIII stun.XORMappedAddress
+	if err = mappedIII.GetFrom(resp); err != nil {
+		return 0, fmt.Errorf("failed to get XOR-MAPPED-ADDRESS response: %w", err)
+	}
+	if mappedIII.IP.Equal(mappedII.IP) && mappedIII.Port == mappedII.Port {
+		return NATBehaviorAddressDependent, nil
+	}
+	return NATBehaviorAddressAndPortDependent, nil
+}
+
+// detectFilteringBehavior asks the server to answer from its other IP and
+// port, then from its other port only, and checks which answers get through.
+// Test I maps conn to the primary address of the server only.
+// https://tools.ietf.org/html/rfc5780#section-4.4
+func (a *Agent) detectFilteringBehavior(conn net.PacketConn, serverAddr *net.UDPAddr) (NATBehavior, error) {
+	if _, _, err := a.natProbe(conn, serverAddr); err != nil {
+		return 0, err
+	}
+
+	// Test II, from the other IP and port
+	resp, origin, err := a.natProbe(conn, serverAddr, changeRequest{ip: true, port: true})
+	if err != nil && !isTimeout(err) {
+		return 0, err
+	} else if resp != nil {
+		if origin.IP.Equal(serverAddr.IP) || origin.Port == serverAddr.Port {
+			return 0, fmt.Errorf("%w: CHANGE-REQUEST ignored, the response came from %s", ErrNATDetectionUnsupported, origin)
+		}
+		return NATBehaviorEndpointIndependent, nil
+	}
+
+	// Test III, from the other port
+	resp, origin, err = a.natProbe(conn, serverAddr, changeRequest{port: true})
+	if err != nil && !isTimeout(err) {
+		return 0, err
+	} else if resp != nil {
+		if origin.Port == serverAddr.Port {
+			return 0, fmt.Errorf("%w: CHANGE-REQUEST ignored, the response came from %s", ErrNATDetectionUnsupported, origin)
+		}
+		return NATBehaviorAddressDependent, nil
+	}
+	return NATBehaviorAddressAndPortDependent, nil
+}
+
+// natProbe sends a Binding request to dst, retransmitted up to
+// natProbeAttempts times within the STUN gather timeout, and returns the
+// response with the address it came from, its RESPONSE-ORIGIN when it has one.
+// The error is a timeout when no response came back.
+func (a *Agent) natProbe(conn net.PacketConn, dst *net.UDPAddr, setters ...stun.Setter) (*stun.Message, *net.UDPAddr, error) {
+	req, err := stun.Build(append([]stun.Setter{stun.BindingRequest, a.transactionID(), a.softwareName}, setters...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	buf := make([]byte, receiveMTU)
+	timeout := a.stunGatherTimeout / natProbeAttempts
+	for attempt := 0; attempt < natProbeAttempts; attempt++ {
+		if _, err = conn.WriteTo(req.Raw, dst); err != nil {
+			return nil, nil, err
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, nil, err
+		}
+
+		for {
+			n, src, readErr := conn.ReadFrom(buf)
+			if isTimeout(readErr) {
+				err = readErr
+				break
+			} else if readErr != nil {
+				return nil, nil, readErr
+			}
+
+			resp := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if resp.Decode() != nil || resp.TransactionID != req.TransactionID {
+				continue
+			}
+
+			origin, _ := src.(*net.UDPAddr)
+			if responseOrigin, originErr := getAddrAs(resp, attrResponseOrigin); originErr == nil {
+				origin = responseOrigin
+			}
+			if origin == nil {
+				return nil, nil, fmt.Errorf("%w: %s", ErrAddressParseFailed, src)
+			}
+			return resp, origin, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// getAddrAs returns the address of the attribute t of m, which has the format
+// of MAPPED-ADDRESS like OTHER-ADDRESS and RESPONSE-ORIGIN
+// https://tools.ietf.org/html/rfc5389#section-15.1
+func getAddrAs(m *stun.Message, t stun.AttrType) (*net.UDPAddr, error) {
+	v, err := m.Get(t)
+	if err != nil {
+		return nil, err
+	}
+
+	const (
+		familyIPv4 = 0x01
+		familyIPv6 = 0x02
+	)
+	if len(v) == 4+net.IPv4len && v[1] == familyIPv4 || len(v) == 4+net.IPv6len && v[1] == familyIPv6 {
+		return &net.UDPAddr{
+			IP:   append(net.IP{}, v[4:]...),
+			Port: int(binary.BigEndian.Uint16(v[2:4])),
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: malformed %s", ErrAddressParseFailed, t)
+}
+
+// isTimeout returns true if err is the timeout of a read deadline
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,240 @@
+// +build !js
+
+package ice
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// addrAttr adds addr as the attribute t, in the format of MAPPED-ADDRESS
+type addrAttr struct {
+	t    stun.AttrType
+	addr *net.UDPAddr
+}
+
+func (a addrAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, 4+net.IPv4len)
+	v[1] = 0x01
+	binary.BigEndian.PutUint16(v[2:4], uint16(a.addr.Port))
+	copy(v[4:], a.addr.IP.To4())
+	m.Add(a.t, v)
+	return nil
+}
+
+// natBehaviorServer is a STUN server supporting the NAT behavior discovery of
+// RFC 5780 on 2 IPs and 2 ports, or only answering on its primary address
+type natBehaviorServer struct {
+	// conns is indexed by the other IP, then the other port
+	conns [2][2]net.PacketConn
+	wg    sync.WaitGroup
+}
+
+func newNATBehaviorServer(t *testing.T, n *vnet.Net, rfc5780 bool) *natBehaviorServer {
+	s := &natBehaviorServer{}
+	for i, ip := range []string{"1.2.3.4", "1.2.3.5"} {
+		for j, port := range []string{"3478", "3479"} {
+			conn, err := n.ListenPacket(udp, ip+":"+port)
+			assert.NoError(t, err)
+			s.conns[i][j] = conn
+		}
+	}
+
+	serve := s.conns[:1]
+	if rfc5780 {
+		serve = s.conns[:]
+	}
+	for _, conns := range serve {
+		for _, conn := range conns {
+			s.wg.Add(1)
+			go s.serve(conn, rfc5780)
+		}
+	}
+	return s
+}
+
+func (s *natBehaviorServer) serve(conn net.PacketConn, rfc5780 bool) {
+	defer s.wg.Done()
+
+	buf := make([]byte, receiveMTU)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if req.Decode() != nil || req.Type != stun.BindingRequest {
+			continue
+		}
+
+		srcAddr := src.(*net.UDPAddr)
+		setters := []stun.Setter{req, stun.BindingSuccess, &stun.XORMappedAddress{IP: srcAddr.IP, Port: srcAddr.Port}}
+		from := conn
+		if rfc5780 {
+			local := conn.LocalAddr().(*net.UDPAddr)
+			i, j := 0, 0
+			if local.IP.Equal(net.IPv4(1, 2, 3, 5)) {
+				i = 1
+			}
+			if local.Port == 3479 {
+				j = 1
+			}
+			if v, getErr := req.Get(stun.AttrChangeRequest); getErr == nil && len(v) == 4 {
+				flags := binary.BigEndian.Uint32(v)
+				if flags&0x4 != 0 {
+					i = 1 - i
+				}
+				if flags&0x2 != 0 {
+					j = 1 - j
+				}
+			}
+			from = s.conns[i][j]
+			setters = append(setters,
+				addrAttr{stun.AttrOtherAddress, s.conns[1][1].LocalAddr().(*net.UDPAddr)},
+				addrAttr{attrResponseOrigin, from.LocalAddr().(*net.UDPAddr)},
+			)
+		}
+
+		resp, err := stun.Build(append(setters, stun.Fingerprint)...)
+		if err != nil {
+			continue
+		}
+		_, _ = from.WriteTo(resp.Raw, src)
+	}
+}
+
+func (s *natBehaviorServer) close() {
+	for _, conns := range s.conns {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	s.wg.Wait()
+}
+
+func TestDetectNATType(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	stunGatherTimeout := 300 * time.Millisecond
+
+	// detect runs DetectNATType behind natType, or on the WAN when it is nil
+	detect := func(t *testing.T, natType *vnet.NATType, rfc5780 bool) (NATType, error) {
+		wan, err := vnet.NewRouter(&vnet.RouterConfig{
+			CIDR:          "1.2.3.0/24",
+			LoggerFactory: loggerFactory,
+		})
+		assert.NoError(t, err)
+
+		serverNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"1.2.3.4", "1.2.3.5"}})
+		assert.NoError(t, wan.AddNet(serverNet))
+
+		agentNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"192.168.0.2"}})
+		if natType == nil {
+			agentNet = vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"1.2.3.10"}})
+			assert.NoError(t, wan.AddNet(agentNet))
+		} else {
+			lan, lanErr := vnet.NewRouter(&vnet.RouterConfig{
+				StaticIPs:     []string{"1.2.3.100"},
+				CIDR:          "192.168.0.0/24",
+				NATType:       natType,
+				LoggerFactory: loggerFactory,
+			})
+			assert.NoError(t, lanErr)
+			assert.NoError(t, lan.AddNet(agentNet))
+			assert.NoError(t, wan.AddRouter(lan))
+		}
+		assert.NoError(t, wan.Start())
+		defer func() {
+			assert.NoError(t, wan.Stop())
+		}()
+
+		server := newNATBehaviorServer(t, serverNet, rfc5780)
+		defer server.close()
+
+		a, err := NewAgent(&AgentConfig{
+			Urls:              []*URL{{Scheme: SchemeTypeSTUN, Host: "1.2.3.4", Port: 3478, Proto: ProtoTypeUDP}},
+			NetworkTypes:      []NetworkType{NetworkTypeUDP4},
+			Net:               agentNet,
+			STUNGatherTimeout: &stunGatherTimeout,
+		})
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, a.Close())
+		}()
+
+		return a.DetectNATType(context.Background())
+	}
+
+	for _, tc := range []struct {
+		name     string
+		natType  *vnet.NATType
+		expected NATType
+	}{
+		{
+			name:     "No NAT",
+			expected: NATType{MappingBehavior: NATBehaviorEndpointIndependent, FilteringBehavior: NATBehaviorEndpointIndependent},
+		},
+		{
+			name:     "Full cone",
+			natType:  &vnet.NATType{MappingBehavior: vnet.EndpointIndependent, FilteringBehavior: vnet.EndpointIndependent},
+			expected: NATType{Mapped: true, MappingBehavior: NATBehaviorEndpointIndependent, FilteringBehavior: NATBehaviorEndpointIndependent},
+		},
+		{
+			name:     "Restricted cone",
+			natType:  &vnet.NATType{MappingBehavior: vnet.EndpointIndependent, FilteringBehavior: vnet.EndpointAddrDependent},
+			expected: NATType{Mapped: true, MappingBehavior: NATBehaviorEndpointIndependent, FilteringBehavior: NATBehaviorAddressDependent},
+		},
+		{
+			name:     "Port restricted cone",
+			natType:  &vnet.NATType{MappingBehavior: vnet.EndpointIndependent, FilteringBehavior: vnet.EndpointAddrPortDependent},
+			expected: NATType{Mapped: true, MappingBehavior: NATBehaviorEndpointIndependent, FilteringBehavior: NATBehaviorAddressAndPortDependent},
+		},
+		{
+			name:     "Address dependent mapping",
+			natType:  &vnet.NATType{MappingBehavior: vnet.EndpointAddrDependent, FilteringBehavior: vnet.EndpointAddrDependent},
+			expected: NATType{Mapped: true, MappingBehavior: NATBehaviorAddressDependent, FilteringBehavior: NATBehaviorAddressDependent},
+		},
+		{
+			name:     "Symmetric",
+			natType:  &vnet.NATType{MappingBehavior: vnet.EndpointAddrPortDependent, FilteringBehavior: vnet.EndpointAddrPortDependent},
+			expected: NATType{Mapped: true, MappingBehavior: NATBehaviorAddressAndPortDependent, FilteringBehavior: NATBehaviorAddressAndPortDependent},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			natType, err := detect(t, tc.natType, true)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, natType)
+		})
+	}
+
+	t.Run("Unsupported server", func(t *testing.T) {
+		natType := &vnet.NATType{MappingBehavior: vnet.EndpointIndependent, FilteringBehavior: vnet.EndpointIndependent}
+		_, err := detect(t, natType, false)
+		assert.True(t, errors.Is(err, ErrNATDetectionUnsupported), err)
+	})
+
+	t.Run("No STUN server", func(t *testing.T) {
+		a, err := NewAgent(&AgentConfig{})
+		assert.NoError(t, err)
+		_, err = a.DetectNATType(context.Background())
+		assert.Equal(t, ErrNoSTUNServer, err)
+		assert.NoError(t, a.Close())
+	})
+}
@@ -0,0 +1,40 @@
+package ice
+
+import (
+	"net"
+
+	"github.com/pion/transport/vnet"
+)
+
+// Net is the network stack the Agent uses to enumerate local interfaces,
+// create the sockets of its candidates and resolve STUN servers. Providing
+// one in AgentConfig allows running ICE over a userspace network stack (e.g
+// gVisor netstack or a WireGuard tun) or an in-memory network in tests.
+//
+// *vnet.Net implements Net, vnet.NewNet(nil) is the OS network and is used
+// when AgentConfig.Net is nil.
+type Net interface {
+	// Interfaces returns the interfaces host candidates are gathered on
+	Interfaces() ([]*vnet.Interface, error)
+
+	// ListenUDP creates the socket of a host or server reflexive candidate
+	ListenUDP(network string, locAddr *net.UDPAddr) (vnet.UDPPacketConn, error)
+
+	// ListenPacket creates the socket used to reach a TURN server over UDP
+	ListenPacket(network string, address string) (net.PacketConn, error)
+
+	// ResolveUDPAddr resolves the address of STUN servers
+	ResolveUDPAddr(network, address string) (*net.UDPAddr, error)
+
+	// IsVirtual returns false only for the OS network. ICE-TCP candidates are
+	// listened on with the OS network, so they are not gathered on a virtual one.
+	IsVirtual() bool
+}
+
+// vnetOrNil returns n when it is a *vnet.Net, for APIs that only accept one
+func vnetOrNil(n Net) *vnet.Net {
+	if v, ok := n.(*vnet.Net); ok {
+		return v
+	}
+	return nil
+}
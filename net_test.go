@@ -0,0 +1,205 @@
+// +build !js
+
+package ice
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/deadline"
+	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryHub delivers packets between the memoryPacketConns of every memoryNet using it
+type memoryHub struct {
+	mu       sync.Mutex
+	conns    map[string]*memoryPacketConn
+	nextPort int
+}
+
+func newMemoryHub() *memoryHub {
+	return &memoryHub{conns: map[string]*memoryPacketConn{}, nextPort: 5000}
+}
+
+// memoryNet is a Net without any OS socket, with a single interface owning ip
+type memoryNet struct {
+	hub *memoryHub
+	ip  net.IP
+
+	mu        sync.Mutex
+	listening int
+}
+
+func (n *memoryNet) Interfaces() ([]*vnet.Interface, error) {
+	iface := vnet.NewInterface(net.Interface{Index: 1, MTU: 1500, Name: "mem0", Flags: net.FlagUp})
+	iface.AddAddr(&net.IPNet{IP: n.ip, Mask: net.CIDRMask(24, 32)})
+	return []*vnet.Interface{iface}, nil
+}
+
+func (n *memoryNet) ListenUDP(network string, locAddr *net.UDPAddr) (vnet.UDPPacketConn, error) {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+
+	addr := &net.UDPAddr{IP: n.ip, Port: locAddr.Port}
+	if addr.Port == 0 {
+		addr.Port = n.hub.nextPort
+		n.hub.nextPort++
+	}
+
+	c := &memoryPacketConn{
+		hub:          n.hub,
+		addr:         addr,
+		recvCh:       make(chan addrPacket, 64),
+		readDeadline: deadline.New(),
+		closed:       make(chan struct{}),
+	}
+	n.hub.conns[addr.String()] = c
+
+	n.mu.Lock()
+	n.listening++
+	n.mu.Unlock()
+
+	return c, nil
+}
+
+func (n *memoryNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return n.ListenUDP(network, &net.UDPAddr{})
+}
+
+func (n *memoryNet) ResolveUDPAddr(network, address string) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr(network, address)
+}
+
+func (n *memoryNet) IsVirtual() bool {
+	return true
+}
+
+type memoryPacketConn struct {
+	hub  *memoryHub
+	addr *net.UDPAddr
+
+	recvCh       chan addrPacket
+	readDeadline *deadline.Deadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *memoryPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.recvCh:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.readDeadline.Done():
+		return 0, nil, &timeoutError{}
+	case <-c.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *memoryPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.hub.mu.Lock()
+	dst, ok := c.hub.conns[addr.String()]
+	c.hub.mu.Unlock()
+	if !ok {
+		return len(p), nil
+	}
+
+	select {
+	case dst.recvCh <- addrPacket{data: append([]byte{}, p...), addr: c.addr}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (c *memoryPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.hub.mu.Lock()
+		delete(c.hub.conns, c.addr.String())
+		c.hub.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *memoryPacketConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memoryPacketConn) RemoteAddr() net.Addr               { return nil }
+func (c *memoryPacketConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c *memoryPacketConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *memoryPacketConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *memoryPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *memoryPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func TestCustomNet(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	hub := newMemoryHub()
+	aNet := &memoryNet{hub: hub, ip: net.IPv4(10, 0, 0, 1)}
+	bNet := &memoryNet{hub: hub, ip: net.IPv4(10, 0, 0, 2)}
+
+	aNotifier, aConnected := onConnected()
+	bNotifier, bConnected := onConnected()
+
+	aAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:     supportedNetworkTypes,
+		MulticastDNSMode: MulticastDNSModeDisabled,
+		Net:              aNet,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+
+	bAgent, err := NewAgent(&AgentConfig{
+		NetworkTypes:     supportedNetworkTypes,
+		MulticastDNSMode: MulticastDNSModeDisabled,
+		Net:              bNet,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+	aConn, bConn := connect(aAgent, bAgent)
+	<-aConnected
+	<-bConnected
+
+	// Every candidate was gathered on the memory network
+	for _, n := range []*memoryNet{aNet, bNet} {
+		n.mu.Lock()
+		assert.Equal(t, 1, n.listening)
+		n.mu.Unlock()
+	}
+	assert.Equal(t, aNet.ip.String(), aConn.LocalAddr().(*net.UDPAddr).IP.String())
+	assert.Equal(t, bNet.ip.String(), aConn.RemoteAddr().(*net.UDPAddr).IP.String())
+
+	_, err = aConn.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, err := bConn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	assert.NoError(t, aConn.Close())
+	assert.NoError(t, bConn.Close())
+}
+
+func TestNilVNet(t *testing.T) {
+	var n *vnet.Net
+	a, err := NewAgent(&AgentConfig{Net: n})
+	assert.NoError(t, err)
+	assert.False(t, a.net.IsVirtual())
+	assert.NoError(t, a.Close())
+}
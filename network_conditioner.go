@@ -0,0 +1,56 @@
+package ice
+
+import (
+	"time"
+)
+
+// networkConditioner simulates a lossy and slow network on the packets an
+// Agent sends, for the tests of retransmissions and timeouts
+type networkConditioner struct {
+	loss  float64
+	delay time.Duration
+	rand  *mathRandomGenerator
+}
+
+// send drops packet with the probability of the loss, and otherwise hands a
+// copy of it to write once the delay elapsed
+func (n *networkConditioner) send(packet []byte, write func([]byte)) {
+	if n.rand.Float64() < n.loss {
+		return
+	}
+	if n.delay <= 0 {
+		write(packet)
+		return
+	}
+
+	delayed := append([]byte{}, packet...)
+	time.AfterFunc(n.delay, func() {
+		write(delayed)
+	})
+}
+
+// setNetworkConditioner drops the packets the Agent sends with the probability
+// loss, between 0 and 1, and delays the other ones by delay. The packets are
+// reported as sent, the Agent handles them like the network lost or delayed
+// them. Only the packets sent are conditioned, both Agents of a test have to
+// be for the losses and delays to apply both ways. A loss and delay of 0
+// remove the conditioner. The losses are drawn from a generator seeded from
+// AgentConfig.Rand, so a seeded Agent loses the same packets on every run.
+func (a *Agent) setNetworkConditioner(loss float64, delay time.Duration) {
+	var conditioner *networkConditioner
+	if loss > 0 || delay > 0 {
+		conditioner = &networkConditioner{loss: loss, delay: delay, rand: newMathRandomGeneratorSeed(int64(a.mathRand.Uint64()))}
+	}
+	a.networkConditioner.Store(conditioner)
+}
+
+// networkConditioner returns the conditioner of the packets sent by the Agent
+// of the candidate, if any
+func (c *candidateBase) networkConditioner() *networkConditioner {
+	a := c.agent()
+	if a == nil {
+		return nil
+	}
+	conditioner, _ := a.networkConditioner.Load().(*networkConditioner)
+	return conditioner
+}
@@ -0,0 +1,111 @@
+// +build !js
+
+package ice
+
+import (
+	mrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkConditioner(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	t.Run("Loss and delay", func(t *testing.T) {
+		lossy := &networkConditioner{loss: 1, rand: newMathRandomGenerator()}
+		lossy.send([]byte{1}, func([]byte) {
+			assert.Fail(t, "the packet should be dropped")
+		})
+
+		written := make(chan []byte, 1)
+		slow := &networkConditioner{delay: 50 * time.Millisecond, rand: newMathRandomGenerator()}
+		packet := []byte{1}
+		start := time.Now()
+		slow.send(packet, func(p []byte) {
+			written <- p
+		})
+		packet[0] = 2
+
+		assert.Equal(t, []byte{1}, <-written)
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	})
+
+	t.Run("Checks retransmit under loss", func(t *testing.T) {
+		// The seeds make the conditioners lose the same packets on every run
+		newAgent := func(seed int64) *Agent {
+			agent, err := NewAgent(&AgentConfig{
+				NetworkTypes: supportedNetworkTypes,
+				Rand:         mrand.New(mrand.NewSource(seed)), // nolint:gosec
+
+				AllowPrivateRemoteCandidates: true,
+			})
+			assert.NoError(t, err)
+			agent.setNetworkConditioner(0.2, 10*time.Millisecond)
+			return agent
+		}
+		aAgent, bAgent := newAgent(1), newAgent(2)
+
+		aConn, bConn := connect(aAgent, bAgent)
+
+		pair, err := aAgent.GetSelectedCandidatePair()
+		assert.NoError(t, err)
+		assert.NotNil(t, pair)
+
+		// A pair succeeded although some of its requests or their responses
+		// were lost, the requests were retransmitted
+		var retransmitted bool
+		for _, agent := range []*Agent{aAgent, bAgent} {
+			for _, stats := range agent.GetCandidatePairsStats() {
+				if stats.ResponsesReceived > 0 && stats.RequestsSent > stats.ResponsesReceived {
+					retransmitted = true
+				}
+			}
+		}
+		assert.True(t, retransmitted)
+
+		assert.NoError(t, aConn.Close())
+		assert.NoError(t, bConn.Close())
+		// Let the delayed packets be written
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	t.Run("Consent expires once the remote is unreachable", func(t *testing.T) {
+		consentCheckInterval := 100 * time.Millisecond
+		consentTimeout := time.Second
+		keepaliveInterval := time.Duration(0)
+
+		aConn, bConn := pipe(&AgentConfig{
+			ConsentCheckInterval: &consentCheckInterval,
+			ConsentTimeout:       &consentTimeout,
+			KeepaliveInterval:    &keepaliveInterval,
+			taskLoopInterval:     100 * time.Millisecond,
+		})
+
+		isFailed := make(chan struct{})
+		assert.NoError(t, aConn.agent.OnConnectionStateChange(func(c ConnectionState) {
+			if c == ConnectionStateFailed {
+				close(isFailed)
+			}
+		}))
+
+		// Every response of b is lost
+		start := time.Now()
+		bConn.agent.setNetworkConditioner(1, 0)
+		<-isFailed
+
+		elapsed := time.Since(start)
+		assert.True(t, elapsed >= consentTimeout-consentCheckInterval, elapsed)
+		assert.True(t, elapsed < consentTimeout+5*consentCheckInterval, elapsed)
+		assert.Equal(t, FailureReasonConsentExpired, aConn.agent.FailureReason())
+
+		assert.NoError(t, aConn.Close())
+		_ = bConn.Close()
+	})
+}
@@ -0,0 +1,185 @@
+package ice
+
+import (
+	"net"
+	"time"
+)
+
+// defaultNetworkChangeInterval is how often the local interfaces are polled
+// when NetworkChangeDetection is enabled
+const defaultNetworkChangeInterval = 2 * time.Second
+
+// watchNetworkChanges polls the local interfaces until the Agent is closed.
+// Once gathering is complete the host candidates follow the local IPs, they
+// are gathered on the IPs that appear and removed from the ones that go away.
+func (a *Agent) watchNetworkChanges() {
+	ticker := time.NewTicker(a.networkChangeInterval)
+	defer ticker.Stop()
+
+	// known are the local IPs enumerated to gather the host candidates on, it
+	// is nil until gathering is complete
+	var known map[string]net.IPAddr
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		gathered := make(chan map[string]net.IPAddr, 1)
+		if err := a.run(func(agent *Agent) {
+			if agent.gatheringState != GatheringStateComplete {
+				gathered <- nil
+				return
+			}
+			ips := make(map[string]net.IPAddr, len(agent.hostLocalAddrs))
+			for key, addr := range agent.hostLocalAddrs {
+				ips[key] = addr
+			}
+			gathered <- ips
+		}, nil); err != nil {
+			return
+		}
+		if ips := <-gathered; ips == nil {
+			known = nil
+			continue
+		} else if known == nil {
+			known = ips
+		}
+
+		localAddrs, err := localAddrs(a.net, a.gatheredInterfaceFilter(), a.ipFilter, a.networkTypes)
+		if err != nil {
+			a.log.Warnf("Failed to iterate local interfaces, network changes are not detected: %v", err)
+			continue
+		}
+
+		current := make(map[string]net.IPAddr, len(localAddrs))
+		var added []net.IPAddr
+		for _, addr := range localAddrs {
+			current[addr.String()] = addr
+			if _, ok := known[addr.String()]; !ok {
+				added = append(added, addr)
+			}
+		}
+
+		var removed []net.IPAddr
+		for key, addr := range known {
+			if _, ok := current[key]; !ok {
+				removed = append(removed, addr)
+			}
+		}
+		known = current
+
+		if len(removed) > 0 {
+			a.removeHostCandidates(removed)
+		}
+		if len(added) > 0 {
+			a.regatherHostCandidates(added)
+		}
+	}
+}
+
+// hostCandidateLocalAddr returns the local IP the socket of a host candidate
+// is bound to, it differs from the address of the candidate when it is an
+// mDNS name or a 1:1 NAT mapping
+func hostCandidateLocalAddr(c Candidate) (net.IPAddr, bool) {
+	host, ok := c.(*CandidateHost)
+	if !ok || host.conn == nil {
+		return net.IPAddr{}, false
+	}
+
+	var addr net.IPAddr
+	switch local := host.conn.LocalAddr().(type) {
+	case *net.UDPAddr:
+		addr = net.IPAddr{IP: local.IP, Zone: local.Zone}
+	case *net.TCPAddr:
+		addr = net.IPAddr{IP: local.IP, Zone: local.Zone}
+	default:
+		return net.IPAddr{}, false
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return net.IPAddr{}, false
+	}
+	return addr, true
+}
+
+// removeHostCandidates removes the host candidates of the local IPs that went
+// away, their pairs are failed
+func (a *Agent) removeHostCandidates(removed []net.IPAddr) {
+	if err := a.run(func(agent *Agent) {
+		var candidates []Candidate
+		for _, set := range agent.localCandidates {
+			for _, c := range set {
+				addr, ok := hostCandidateLocalAddr(c)
+				if !ok {
+					continue
+				}
+				for _, r := range removed {
+					if addr.IP.Equal(r.IP) && addr.Zone == r.Zone {
+						candidates = append(candidates, c)
+						break
+					}
+				}
+			}
+		}
+
+		for _, c := range candidates {
+			agent.log.Infof("Local IP of host candidate %s went away, removing it", c)
+			agent.removeLocalCandidate(c)
+		}
+	}, nil); err != nil {
+		a.log.Warnf("Failed to remove host candidates: %v", err)
+	}
+}
+
+// regatherHostCandidates gathers the host candidates of the local IPs that
+// appeared. Gathering goes through GatheringStateGathering again, the new
+// candidates are delivered to the OnCandidate handler followed by nil. Nothing
+// is done when no host candidate would be gathered on them, e.g. for the UDP
+// candidates of a UDPMux.
+func (a *Agent) regatherHostCandidates(added []net.IPAddr) {
+	if !containsCandidateType(CandidateTypeHost, a.candidateTypes) || !a.gathersHostCandidates(added) {
+		return
+	}
+
+	started := make(chan bool, 1)
+	if err := a.run(func(agent *Agent) {
+		if agent.gatheringState != GatheringStateComplete {
+			started <- false
+			return
+		}
+		agent.gatheringState = GatheringStateGathering
+		agent.startCandidateRoutine()
+		started <- true
+	}, nil); err != nil || !<-started {
+		return
+	}
+	a.onGatheringStateChange(GatheringStateGathering)
+
+	for component := uint16(1); component <= a.components; component++ {
+		a.gatherCandidatesLocalAddrs(added, a.networkTypes, component)
+	}
+
+	if err := a.run(func(agent *Agent) {
+		close(agent.chanCandidate)
+		agent.gatheringState = GatheringStateComplete
+	}, nil); err != nil {
+		// The Agent is closed, nothing else sends on chanCandidate
+		close(a.chanCandidate)
+		return
+	}
+	a.onGatheringStateChange(GatheringStateComplete)
+}
+
+// gathersHostCandidates returns true if gatherCandidatesLocalAddrs gathers a
+// host candidate of any component on addrs
+func (a *Agent) gathersHostCandidates(addrs []net.IPAddr) bool {
+	for _, addr := range addrs {
+		for component := uint16(1); component <= a.components; component++ {
+			if len(a.hostNetworks(addr, a.networkTypes, component)) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+// +build !js
+
+package ice
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// changingNet is a memory network whose interface IPs can change
+type changingNet struct {
+	hub *memoryHub
+
+	mu  sync.Mutex
+	ips []net.IP
+}
+
+func (n *changingNet) setIPs(ips ...net.IP) {
+	n.mu.Lock()
+	n.ips = ips
+	n.mu.Unlock()
+}
+
+func (n *changingNet) Interfaces() ([]*vnet.Interface, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	iface := vnet.NewInterface(net.Interface{Index: 1, MTU: 1500, Name: "mem0", Flags: net.FlagUp})
+	for _, ip := range n.ips {
+		iface.AddAddr(&net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)})
+	}
+	return []*vnet.Interface{iface}, nil
+}
+
+func (n *changingNet) ListenUDP(network string, locAddr *net.UDPAddr) (vnet.UDPPacketConn, error) {
+	return (&memoryNet{hub: n.hub, ip: locAddr.IP}).ListenUDP(network, locAddr)
+}
+
+func (n *changingNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return n.ListenUDP(network, &net.UDPAddr{})
+}
+
+func (n *changingNet) ResolveUDPAddr(network, address string) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr(network, address)
+}
+
+func (n *changingNet) IsVirtual() bool {
+	return true
+}
+
+func TestNetworkChangeDetection(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	wifi, ethernet := net.IPv4(192, 168, 1, 2), net.IPv4(10, 0, 0, 2)
+	n := &changingNet{hub: newMemoryHub(), ips: []net.IP{wifi}}
+
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:           []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:         []CandidateType{CandidateTypeHost},
+		MulticastDNSMode:       MulticastDNSModeDisabled,
+		Net:                    n,
+		NetworkChangeDetection: true,
+		networkChangeInterval:  10 * time.Millisecond,
+
+		AllowPrivateRemoteCandidates: true,
+	})
+	assert.NoError(t, err)
+
+	candidates := make(chan Candidate, 10)
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		candidates <- c
+	}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+
+	c := <-candidates
+	assert.Equal(t, wifi.String(), c.Address())
+	assert.Nil(t, <-candidates)
+
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "172.17.0.3",
+		Port:      999,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, a.AddRemoteCandidate(remote))
+
+	var wifiPair *candidatePair
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, a.run(func(agent *Agent) {
+			if len(agent.checklist) == 1 {
+				wifiPair = agent.checklist[0]
+			}
+		}, nil))
+		return wifiPair != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// The host candidate of the new IP is trickled, the one of the IP that
+	// went away is removed and its pair failed
+	n.setIPs(ethernet)
+
+	c = <-candidates
+	assert.Equal(t, ethernet.String(), c.Address())
+	assert.Nil(t, <-candidates)
+
+	state, err := a.GetGatheringState()
+	assert.NoError(t, err)
+	assert.Equal(t, GatheringStateComplete, state)
+
+	local, err := a.GetLocalCandidates()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(local))
+	assert.Equal(t, ethernet.String(), local[0].Address())
+
+	assert.NoError(t, a.run(func(agent *Agent) {
+		assert.Equal(t, CandidatePairStateFailed, wifiPair.state)
+		assert.Equal(t, 1, len(agent.checklist))
+		assert.Equal(t, local[0], agent.checklist[0].local)
+	}, nil))
+
+	assert.NoError(t, a.Close())
+}
+
+func TestNetworkChangeDetectionUDPMux(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	wifi, ethernet := net.IPv4(192, 168, 1, 2), net.IPv4(10, 0, 0, 2)
+	n := &changingNet{hub: newMemoryHub(), ips: []net.IP{wifi}}
+
+	conn, err := n.ListenUDP("udp4", &net.UDPAddr{IP: wifi, Port: 5000})
+	assert.NoError(t, err)
+	udpMux := NewUDPMuxDefault(UDPMuxParams{UDPConn: conn})
+
+	a, err := NewAgent(&AgentConfig{
+		NetworkTypes:           []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:         []CandidateType{CandidateTypeHost},
+		MulticastDNSMode:       MulticastDNSModeDisabled,
+		Net:                    n,
+		UDPMux:                 udpMux,
+		NetworkChangeDetection: true,
+		networkChangeInterval:  10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	candidates := make(chan Candidate, 10)
+	assert.NoError(t, a.OnCandidate(func(c Candidate) {
+		candidates <- c
+	}))
+	assert.NoError(t, a.GatherCandidates(context.Background()))
+
+	c := <-candidates
+	assert.Equal(t, wifi.String(), c.Address())
+	assert.Nil(t, <-candidates)
+
+	// Nothing is gathered on a new IP when the UDPMux gathers the UDP
+	// candidates, gathering isn't completed again
+	n.setIPs(wifi, ethernet)
+	select {
+	case c := <-candidates:
+		t.Fatalf("unexpected candidate %v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, udpMux.Close())
+}
@@ -0,0 +1,39 @@
+package ice
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isNetworkUnavailable returns true if err is the error of a write on a socket
+// whose local address or route went away, e.g. when its interface went down
+func isNetworkUnavailable(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EADDRNOTAVAIL, syscall.ENETDOWN, syscall.ENETUNREACH, syscall.EHOSTUNREACH} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// failover fails pair when err shows that its network is unavailable, and
+// returns true if the write may be retried on another pair. The selected pair
+// is replaced like when its local candidate is removed, the
+// OnSelectedCandidatePairChange handler is fired once another one is selected.
+func (c *Conn) failover(pair *candidatePair, err error) bool {
+	if !isNetworkUnavailable(err) {
+		return false
+	}
+
+	return c.agent.run(func(a *Agent) {
+		if pair.state == CandidatePairStateFailed {
+			return
+		}
+		a.log.Warnf("Failing %s, its network is unavailable: %v", pair, err)
+		if a.failPair(pair) {
+			a.reselectPair(pair.local.Component())
+		} else {
+			a.requestConnectivityCheck()
+		}
+	}, nil) == nil
+}
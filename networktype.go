@@ -13,14 +13,14 @@ const (
 
 var supportedNetworks = []string{
 	udp,
-	// tcp, // Not supported yet
+	tcp,
 }
 
 var supportedNetworkTypes = []NetworkType{
 	NetworkTypeUDP4,
 	NetworkTypeUDP6,
-	// NetworkTypeTCP4, // Not supported yet
-	// NetworkTypeTCP6, // Not supported yet
+	NetworkTypeTCP4,
+	NetworkTypeTCP6,
 }
 
 // NetworkType represents the type of network
@@ -121,3 +121,12 @@ func determineNetworkType(network string, ip net.IP) (NetworkType, error) {
 
 	return NetworkType(0), fmt.Errorf("unable to determine networkType from %s %s", network, ip)
 }
+
+func containsNetworkType(networkType NetworkType, networkTypeList []NetworkType) bool {
+	for _, nt := range networkTypeList {
+		if nt == networkType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package ice
+
+import "github.com/pion/stun"
+
+// NominationAttr represents the NOMINATION attribute of ICE renomination, the
+// controlled agent selects the pair nominated with the highest value.
+// https://tools.ietf.org/html/draft-thatcher-ice-renomination-01#section-4
+type NominationAttr uint32
+
+const (
+	attrNomination stun.AttrType = 0xC001
+
+	nominationSize = 4 // 32 bit
+)
+
+// AddTo adds NOMINATION attribute to message.
+func (n NominationAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, nominationSize)
+	bin.PutUint32(v, uint32(n))
+	m.Add(attrNomination, v)
+	return nil
+}
+
+// GetFrom decodes NOMINATION attribute from message.
+func (n *NominationAttr) GetFrom(m *stun.Message) error {
+	v, err := m.Get(attrNomination)
+	if err != nil {
+		return err
+	}
+	if err = stun.CheckSize(attrNomination, len(v), nominationSize); err != nil {
+		return err
+	}
+	*n = NominationAttr(bin.Uint32(v))
+	return nil
+}
@@ -0,0 +1,223 @@
+package ice
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/transport/deadline"
+	"github.com/pion/transport/packetio"
+)
+
+// BufferOverflowPolicy is what the Agent does with a packet received while
+// the buffer of its component is full, because the Conn is not read fast enough
+type BufferOverflowPolicy byte
+
+// BufferOverflowPolicy enum
+const (
+	// BufferOverflowDropNewest drops the packet that doesn't fit in the buffer
+	BufferOverflowDropNewest BufferOverflowPolicy = iota + 1
+
+	// BufferOverflowDropOldest drops the oldest buffered packets until the
+	// packet fits in the buffer
+	BufferOverflowDropOldest
+
+	// BufferOverflowBlock blocks the goroutine reading the socket of the
+	// candidate until the packet fits in the buffer. Connectivity checks
+	// received on the candidate are not handled while it is blocked.
+	BufferOverflowBlock
+)
+
+func (p BufferOverflowPolicy) String() string {
+	switch p {
+	case BufferOverflowDropNewest:
+		return "drop-newest"
+	case BufferOverflowDropOldest:
+		return "drop-oldest"
+	case BufferOverflowBlock:
+		return "block"
+	default:
+		return ErrUnknownType.Error()
+	}
+}
+
+// packetBuffer is a packetio.Buffer with a BufferOverflowPolicy, it holds the
+// packets received on a component until they are read from its Conn
+type packetBuffer struct {
+	// dropped is accessed atomically so it can be read without the lock
+	dropped uint64
+
+	mu        sync.Mutex
+	packets   []bufferedPacket
+	size      int
+	limitSize int
+	policy    BufferOverflowPolicy
+	closed    bool
+
+	// notify is closed when a packet is written or read while waiting is set,
+	// waking up the blocked readers and writers
+	notify  chan struct{}
+	waiting bool
+
+	readDeadline *deadline.Deadline
+}
+
+func newPacketBuffer(limitSize int, policy BufferOverflowPolicy) *packetBuffer {
+	return &packetBuffer{
+		limitSize:    limitSize,
+		policy:       policy,
+		notify:       make(chan struct{}),
+		readDeadline: deadline.New(),
+	}
+}
+
+// wakeLocked wakes up the blocked readers and writers, the lock must be held
+func (b *packetBuffer) wakeLocked() {
+	if b.waiting {
+		close(b.notify)
+		b.notify = make(chan struct{})
+		b.waiting = false
+	}
+}
+
+// bufferedPacket is a packet of a packetBuffer, with the local and the remote
+// candidate of the pair it was received on
+type bufferedPacket struct {
+	data          []byte
+	local, remote Candidate
+}
+
+// Write queues packet, the buffer takes ownership of it. packetio.ErrFull is
+// returned when the packet is dropped.
+func (b *packetBuffer) Write(packet []byte) (int, error) {
+	return b.writeFrom(packet, nil, nil)
+}
+
+// writeFrom queues packet like Write, received on the pair of local and remote
+func (b *packetBuffer) writeFrom(packet []byte, local, remote Candidate) (int, error) {
+	b.mu.Lock()
+	for {
+		if b.closed {
+			b.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+
+		if b.limitSize == 0 || b.size+len(packet) <= b.limitSize {
+			break
+		}
+
+		switch {
+		case len(packet) > b.limitSize:
+			// It would never fit, whatever the policy
+		case b.policy == BufferOverflowDropOldest:
+			b.size -= len(b.packets[0].data)
+			b.packets[0] = bufferedPacket{}
+			b.packets = b.packets[1:]
+			atomic.AddUint64(&b.dropped, 1)
+			continue
+		case b.policy == BufferOverflowBlock:
+			notify := b.notify
+			b.waiting = true
+			b.mu.Unlock()
+			<-notify
+			b.mu.Lock()
+			continue
+		}
+
+		atomic.AddUint64(&b.dropped, 1)
+		b.mu.Unlock()
+		return 0, packetio.ErrFull
+	}
+
+	b.packets = append(b.packets, bufferedPacket{data: packet, local: local, remote: remote})
+	b.size += len(packet)
+	b.wakeLocked()
+	b.mu.Unlock()
+
+	return len(packet), nil
+}
+
+// Read reads the oldest packet into p, it blocks until a packet is written,
+// the buffer is closed or the read deadline is exceeded. Like packetio.Buffer,
+// io.ErrShortBuffer is returned and the packet stays buffered if it doesn't fit.
+func (b *packetBuffer) Read(p []byte) (int, error) {
+	n, _, _, err := b.readFrom(p)
+	return n, err
+}
+
+// readFrom reads a packet like Read, and returns the local and the remote
+// candidate it was written with
+func (b *packetBuffer) readFrom(p []byte) (int, Candidate, Candidate, error) {
+	for {
+		select {
+		case <-b.readDeadline.Done():
+			return 0, nil, nil, &timeoutError{}
+		default:
+		}
+
+		b.mu.Lock()
+		if len(b.packets) > 0 {
+			packet := b.packets[0]
+			if len(packet.data) > len(p) {
+				b.mu.Unlock()
+				return 0, nil, nil, io.ErrShortBuffer
+			}
+
+			b.packets[0] = bufferedPacket{}
+			b.packets = b.packets[1:]
+			b.size -= len(packet.data)
+			b.wakeLocked()
+			b.mu.Unlock()
+
+			return copy(p, packet.data), packet.local, packet.remote, nil
+		}
+
+		// The buffered packets can still be read once closed
+		if b.closed {
+			b.mu.Unlock()
+			return 0, nil, nil, io.EOF
+		}
+
+		notify := b.notify
+		b.waiting = true
+		b.mu.Unlock()
+
+		select {
+		case <-b.readDeadline.Done():
+			return 0, nil, nil, &timeoutError{}
+		case <-notify:
+		}
+	}
+}
+
+// Close unblocks the readers and writers, and makes any later Write fail
+func (b *packetBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		b.waiting = true
+		b.wakeLocked()
+	}
+	return nil
+}
+
+// SetReadDeadline sets the deadline of the current and future Read calls
+func (b *packetBuffer) SetReadDeadline(t time.Time) error {
+	b.readDeadline.Set(t)
+	return nil
+}
+
+// Count returns the number of buffered packets
+func (b *packetBuffer) Count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.packets)
+}
+
+// Dropped returns the number of packets dropped because the buffer was full
+func (b *packetBuffer) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
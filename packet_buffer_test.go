@@ -0,0 +1,136 @@
+package ice
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/packetio"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketBuffer(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	read := func(b *packetBuffer) byte {
+		p := make([]byte, 10)
+		n, err := b.Read(p)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		return p[0]
+	}
+
+	t.Run("DropNewest", func(t *testing.T) {
+		b := newPacketBuffer(2, BufferOverflowDropNewest)
+		for i := byte(1); i <= 3; i++ {
+			_, err := b.Write([]byte{i})
+			if i == 3 {
+				assert.Equal(t, packetio.ErrFull, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		}
+		assert.Equal(t, uint64(1), b.Dropped())
+		assert.Equal(t, byte(1), read(b))
+		assert.Equal(t, byte(2), read(b))
+
+		// A packet larger than the buffer is never queued
+		_, err := b.Write([]byte{1, 2, 3})
+		assert.Equal(t, packetio.ErrFull, err)
+		assert.Equal(t, uint64(2), b.Dropped())
+		assert.NoError(t, b.Close())
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		b := newPacketBuffer(2, BufferOverflowDropOldest)
+		for i := byte(1); i <= 3; i++ {
+			_, err := b.Write([]byte{i})
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, uint64(1), b.Dropped())
+		assert.Equal(t, 2, b.Count())
+		assert.Equal(t, byte(2), read(b))
+		assert.Equal(t, byte(3), read(b))
+		assert.NoError(t, b.Close())
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		b := newPacketBuffer(1, BufferOverflowBlock)
+		_, err := b.Write([]byte{1})
+		assert.NoError(t, err)
+
+		written := make(chan error)
+		go func() {
+			_, writeErr := b.Write([]byte{2})
+			written <- writeErr
+		}()
+
+		select {
+		case <-written:
+			t.Fatal("Write must block while the buffer is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// Reading makes room for the blocked packet
+		assert.Equal(t, byte(1), read(b))
+		assert.NoError(t, <-written)
+		assert.Equal(t, byte(2), read(b))
+		assert.Equal(t, uint64(0), b.Dropped())
+
+		// Closing unblocks the writers
+		_, err = b.Write([]byte{3})
+		assert.NoError(t, err)
+		go func() {
+			_, writeErr := b.Write([]byte{4})
+			written <- writeErr
+		}()
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, b.Close())
+		assert.Equal(t, io.ErrClosedPipe, <-written)
+
+		// Buffered packets can still be read once closed
+		assert.Equal(t, byte(3), read(b))
+		_, err = b.Read(make([]byte, 10))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("ReadDeadline and short buffer", func(t *testing.T) {
+		b := newPacketBuffer(0, BufferOverflowDropNewest)
+		assert.NoError(t, b.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		_, err := b.Read(make([]byte, 10))
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok)
+		assert.True(t, netErr.Timeout())
+		assert.NoError(t, b.SetReadDeadline(time.Time{}))
+
+		_, err = b.Write([]byte{1, 2})
+		assert.NoError(t, err)
+		_, err = b.Read(make([]byte, 1))
+		assert.Equal(t, io.ErrShortBuffer, err)
+		assert.Equal(t, 1, b.Count())
+		assert.NoError(t, b.Close())
+	})
+}
+
+func TestConnPacketsDropped(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	a, err := NewAgent(&AgentConfig{MaxBufferSize: 2})
+	assert.NoError(t, err)
+	c := newConn(a, ComponentRTP)
+
+	for i := byte(1); i <= 3; i++ {
+		err = writeInboundPacket(a.getBuffer(ComponentRTP), []byte{i}, nil, nil)
+	}
+	assert.Equal(t, packetio.ErrFull, err)
+	assert.Equal(t, uint64(1), c.PacketsDropped())
+
+	assert.NoError(t, a.Close())
+}
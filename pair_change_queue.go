@@ -0,0 +1,67 @@
+package ice
+
+import (
+	"sync"
+)
+
+// pairChangeQueue holds the selected pair changes until the routine of the
+// OnSelectedCandidatePairChange handler delivers them. It is unbounded so that
+// the Agent queues a change without blocking while it holds its lock, however
+// many pairs it selects before the handler runs.
+type pairChangeQueue struct {
+	mu     sync.Mutex
+	pairs  []*candidatePair
+	closed bool
+	notify chan struct{}
+}
+
+func newPairChangeQueue() *pairChangeQueue {
+	return &pairChangeQueue{notify: make(chan struct{}, 1)}
+}
+
+// push queues p, it is dropped once the queue is closed
+func (q *pairChangeQueue) push(p *candidatePair) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.pairs = append(q.pairs, p)
+	q.mu.Unlock()
+
+	q.wake()
+}
+
+// close makes pop return false once the queued changes are delivered
+func (q *pairChangeQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.wake()
+}
+
+func (q *pairChangeQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the queued changes and returns them in order, it returns false
+// once the queue is closed and empty
+func (q *pairChangeQueue) pop() ([]*candidatePair, bool) {
+	for {
+		q.mu.Lock()
+		pairs, closed := q.pairs, q.closed
+		q.pairs = nil
+		q.mu.Unlock()
+
+		if len(pairs) > 0 {
+			return pairs, true
+		} else if closed {
+			return nil, false
+		}
+		<-q.notify
+	}
+}
@@ -0,0 +1,266 @@
+package ice
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/deadline"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pktInfoPacketConn reads and writes on a UDP socket bound to an unspecified
+// address with IP_PKTINFO / IPV6_PKTINFO, so the local IP that received a
+// packet is known, and the packets sent to the sender leave from that same IP
+type pktInfoPacketConn struct {
+	v4 *ipv4.PacketConn
+	v6 *ipv6.PacketConn
+}
+
+// newPktInfoPacketConn enables the control messages on conn, it fails on the
+// platforms that don't support them
+func newPktInfoPacketConn(conn *net.UDPConn) (*pktInfoPacketConn, error) {
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && udpAddr.IP.To4() != nil {
+		v4 := ipv4.NewPacketConn(conn)
+		if err := v4.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+			return nil, err
+		}
+		return &pktInfoPacketConn{v4: v4}, nil
+	}
+
+	v6 := ipv6.NewPacketConn(conn)
+	if err := v6.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
+		return nil, err
+	}
+	return &pktInfoPacketConn{v6: v6}, nil
+}
+
+// readFrom returns the local IP the packet was sent to as dst, it is nil if
+// the control message is missing
+func (c *pktInfoPacketConn) readFrom(p []byte) (n int, dst net.IP, src net.Addr, err error) {
+	if c.v4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = c.v4.ReadFrom(p)
+		if cm != nil {
+			dst = cm.Dst
+		}
+		return n, dst, src, err
+	}
+
+	var cm *ipv6.ControlMessage
+	n, cm, src, err = c.v6.ReadFrom(p)
+	if cm != nil {
+		dst = cm.Dst
+	}
+	return n, dst, src, err
+}
+
+// writeTo sends p to dst from the local IP src, the OS picks one if src is nil
+func (c *pktInfoPacketConn) writeTo(p []byte, src net.IP, dst net.Addr) (int, error) {
+	if c.v4 != nil {
+		var cm *ipv4.ControlMessage
+		if src != nil {
+			cm = &ipv4.ControlMessage{Src: src}
+		}
+		return c.v4.WriteTo(p, cm, dst)
+	}
+
+	var cm *ipv6.ControlMessage
+	if src != nil {
+		cm = &ipv6.ControlMessage{Src: src}
+	}
+	return c.v6.WriteTo(p, cm, dst)
+}
+
+// pktInfoMux shares a socket of AgentConfig.UDPConns bound to an unspecified
+// address between the host candidates of the local IPs. Every candidate reads
+// the packets sent to its IP, and sends from it.
+type pktInfoMux struct {
+	udpConn *net.UDPConn
+	pc      *pktInfoPacketConn
+	log     logging.LeveledLogger
+
+	// borrowed sockets are handed back open once every candidate is closed
+	borrowed bool
+
+	mu sync.Mutex
+	// conns is keyed by local IP
+	conns map[string]*pktInfoConn
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPktInfoMux(udpConn *net.UDPConn, pc *pktInfoPacketConn, borrowed bool, log logging.LeveledLogger) *pktInfoMux {
+	m := &pktInfoMux{
+		udpConn:  udpConn,
+		pc:       pc,
+		log:      log,
+		borrowed: borrowed,
+		conns:    map[string]*pktInfoConn{},
+		closed:   make(chan struct{}),
+	}
+
+	m.wg.Add(1)
+	go m.readLoop()
+
+	return m
+}
+
+// conn returns the conn of the host candidate of ip, it must be called before
+// the candidates are started
+func (m *pktInfoMux) conn(ip net.IP) *pktInfoConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := &pktInfoConn{
+		mux:          m,
+		ip:           ip,
+		recvCh:       make(chan addrPacket, udpMuxConnBufferSize),
+		readDeadline: deadline.New(),
+		closed:       make(chan struct{}),
+	}
+	m.conns[ip.String()] = c
+	return c
+}
+
+func (m *pktInfoMux) readLoop() {
+	defer m.wg.Done()
+	defer close(m.closed)
+
+	buf := make([]byte, receiveMTU)
+	for {
+		n, dst, src, err := m.pc.readFrom(buf)
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		var c *pktInfoConn
+		if dst != nil {
+			c = m.conns[dst.String()]
+			if c == nil && dst.To4() != nil {
+				// IPv4 packets received on an IPv6 socket have a mapped address
+				c = m.conns[dst.To4().String()]
+			}
+		}
+		m.mu.Unlock()
+
+		if c == nil {
+			m.log.Tracef("dropping packet from %s to %s, no host candidate on that IP", src, dst)
+			continue
+		}
+		c.push(addrPacket{data: append([]byte{}, buf[:n]...), addr: src})
+	}
+}
+
+// removeConn hands the socket back, or closes it, once the last conn is closed
+func (m *pktInfoMux) removeConn(c *pktInfoConn) error {
+	m.mu.Lock()
+	if m.conns[c.ip.String()] == c {
+		delete(m.conns, c.ip.String())
+	}
+	last := len(m.conns) == 0
+	m.mu.Unlock()
+
+	if !last {
+		return nil
+	}
+
+	if !m.borrowed {
+		err := m.udpConn.Close()
+		m.wg.Wait()
+		return err
+	}
+
+	// Unblock the read loop, and clear the deadline once it returned
+	if err := m.udpConn.SetReadDeadline(time.Now()); err != nil {
+		return err
+	}
+	m.wg.Wait()
+	return m.udpConn.SetReadDeadline(time.Time{})
+}
+
+// pktInfoConn is the net.PacketConn of the host candidate of a single local
+// IP on a pktInfoMux
+type pktInfoConn struct {
+	mux *pktInfoMux
+	ip  net.IP
+
+	recvCh       chan addrPacket
+	readDeadline *deadline.Deadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *pktInfoConn) push(pkt addrPacket) {
+	select {
+	case c.recvCh <- pkt:
+	case <-c.closed:
+	default:
+		c.mux.log.Warnf("dropping packet from %s, the host candidate of %s is not reading fast enough", pkt.addr, c.ip)
+	}
+}
+
+// ReadFrom reads a packet sent to the IP of c
+func (c *pktInfoConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.recvCh:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.readDeadline.Done():
+		return 0, nil, &timeoutError{}
+	case <-c.closed:
+		return 0, nil, io.ErrClosedPipe
+	case <-c.mux.closed:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+// WriteTo sends p from the IP of c
+func (c *pktInfoConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return c.mux.pc.writeTo(p, c.ip, addr)
+}
+
+// Close unregisters c, the socket is released with the last conn
+func (c *pktInfoConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.mux.removeConn(c)
+	})
+	return err
+}
+
+// LocalAddr returns the IP of c, with the port of the socket
+func (c *pktInfoConn) LocalAddr() net.Addr {
+	port := 0
+	if udpAddr, ok := c.mux.udpConn.LocalAddr().(*net.UDPAddr); ok {
+		port = udpAddr.Port
+	}
+	return &net.UDPAddr{IP: c.ip, Port: port}
+}
+
+// SetDeadline sets the read deadline, write deadlines are not supported
+func (c *pktInfoConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future ReadFrom calls
+func (c *pktInfoConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, it exists to implement net.PacketConn
+func (c *pktInfoConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,112 @@
+// +build !js
+
+package ice
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPktInfo(t *testing.T) {
+	// The whole 127.0.0.0/8 block is only routed to the loopback on Linux
+	if runtime.GOOS != "linux" {
+		t.Skip("a second loopback IP is required")
+	}
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	ip1, ip2 := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+
+	listen := func(t *testing.T) (*net.UDPConn, *net.UDPConn, int) {
+		socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+		assert.NoError(t, err)
+		client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip1})
+		assert.NoError(t, err)
+		return socket, client, socket.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	read := func(t *testing.T, conn net.PacketConn) (string, net.Addr) {
+		buf := make([]byte, receiveMTU)
+		n, addr, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		return string(buf[:n]), addr
+	}
+
+	t.Run("Host candidates", func(t *testing.T) {
+		socket, client, port := listen(t)
+		pc, err := newPktInfoPacketConn(socket)
+		if err != nil {
+			t.Skipf("IP_PKTINFO is not supported: %v", err)
+		}
+
+		mux := newPktInfoMux(socket, pc, true, logging.NewDefaultLoggerFactory().NewLogger("ice"))
+		conn1, conn2 := mux.conn(ip1), mux.conn(ip2)
+		assert.Equal(t, &net.UDPAddr{IP: ip2, Port: port}, conn2.LocalAddr())
+
+		// Every conn reads the packets sent to its IP
+		_, err = client.WriteTo([]byte("to 2"), &net.UDPAddr{IP: ip2, Port: port})
+		assert.NoError(t, err)
+		_, err = client.WriteTo([]byte("to 1"), &net.UDPAddr{IP: ip1, Port: port})
+		assert.NoError(t, err)
+		data, addr := read(t, conn1)
+		assert.Equal(t, "to 1", data)
+		assert.Equal(t, client.LocalAddr().String(), addr.String())
+		data, _ = read(t, conn2)
+		assert.Equal(t, "to 2", data)
+
+		// And sends from it
+		_, err = conn2.WriteTo([]byte("from 2"), client.LocalAddr())
+		assert.NoError(t, err)
+		data, addr = read(t, client)
+		assert.Equal(t, "from 2", data)
+		assert.True(t, addr.(*net.UDPAddr).IP.Equal(ip2))
+
+		// The borrowed socket is handed back with the last conn
+		assert.NoError(t, conn1.Close())
+		assert.NoError(t, conn2.Close())
+		_, err = socket.WriteTo([]byte("still open"), client.LocalAddr())
+		assert.NoError(t, err)
+		data, _ = read(t, client)
+		assert.Equal(t, "still open", data)
+
+		assert.NoError(t, socket.Close())
+		assert.NoError(t, client.Close())
+	})
+
+	t.Run("UDPMux", func(t *testing.T) {
+		socket, client, port := listen(t)
+		mux := NewUDPMuxDefault(UDPMuxParams{UDPConn: socket})
+		if mux.pktInfo == nil {
+			t.Skip("IP_PKTINFO is not supported")
+		}
+		conn, err := mux.GetConn("ufrag")
+		assert.NoError(t, err)
+
+		msg, err := stun.Build(stun.BindingRequest, stun.TransactionID, stun.NewUsername("ufrag:remote"))
+		assert.NoError(t, err)
+		_, err = client.WriteTo(msg.Raw, &net.UDPAddr{IP: ip2, Port: port})
+		assert.NoError(t, err)
+		_, addr := read(t, conn)
+
+		// The reply leaves from the IP the request was sent to
+		_, err = conn.WriteTo([]byte("reply"), addr)
+		assert.NoError(t, err)
+		data, from := read(t, client)
+		assert.Equal(t, "reply", data)
+		assert.True(t, from.(*net.UDPAddr).IP.Equal(ip2))
+
+		assert.NoError(t, mux.Close())
+		assert.NoError(t, client.Close())
+	})
+}
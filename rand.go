@@ -3,6 +3,7 @@ package ice
 import (
 	crand "crypto/rand"
 	"encoding/binary"
+	"io"
 	"math/big"
 	mrand "math/rand" // used for non-crypto unique ID and random port selection
 	"sync"
@@ -16,6 +17,13 @@ const (
 
 	lenUFrag = 16
 	lenPwd   = 32
+
+	// minLenUFrag and minLenPwd are the shortest credentials allowed by the
+	// ice-ufrag and ice-pwd attributes, an ice-char carries 6 bits so they
+	// hold at least 24 and 128 bits
+	// https://tools.ietf.org/html/rfc8839#section-5.4
+	minLenUFrag = 4
+	minLenPwd   = 22
 )
 
 // Seeding random generator each time limits number of generated sequence to 31-bits,
@@ -40,6 +48,21 @@ func newMathRandomGenerator() *mathRandomGenerator {
 	return &mathRandomGenerator{r: mrand.New(mrand.NewSource(seed))}
 }
 
+// newMathRandomGeneratorSeed returns a mathRandomGenerator of seed
+func newMathRandomGeneratorSeed(seed int64) *mathRandomGenerator {
+	return &mathRandomGenerator{r: mrand.New(mrand.NewSource(seed))}
+}
+
+// newMathRandomGeneratorFrom returns a mathRandomGenerator seeded from r, e.g.
+// AgentConfig.Rand to make the non-crypto randomness of an Agent reproducible
+func newMathRandomGeneratorFrom(r io.Reader) (*mathRandomGenerator, error) {
+	var seed int64
+	if err := binary.Read(r, binary.LittleEndian, &seed); err != nil {
+		return nil, err
+	}
+	return newMathRandomGeneratorSeed(seed), nil
+}
+
 func (g *mathRandomGenerator) Intn(n int) int {
 	g.mu.Lock()
 	v := g.r.Intn(n)
@@ -54,6 +77,13 @@ func (g *mathRandomGenerator) Uint64() uint64 {
 	return v
 }
 
+func (g *mathRandomGenerator) Float64() float64 {
+	g.mu.Lock()
+	v := g.r.Float64()
+	g.mu.Unlock()
+	return v
+}
+
 func (g *mathRandomGenerator) GenerateString(n int, runes string) string {
 	letters := []rune(runes)
 	b := make([]rune, n)
@@ -84,12 +114,33 @@ func (g *candidateIDGenerator) Generate() string {
 	return "candidate:" + g.mathRandomGenerator.GenerateString(32, runesCandidateIDFoundation)
 }
 
-// generateCryptoRandomString generates a random string for crypto usage.
-func generateCryptoRandomString(n int, runes string) (string, error) {
+// lockedReader serializes the reads of AgentConfig.Rand, which may not be safe
+// for concurrent use like a math/rand source
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
+
+// generateTieBreaker generates the tie-breaker of the ICE role attributes.
+func generateTieBreaker(r io.Reader) (uint64, error) {
+	var tieBreaker uint64
+	err := binary.Read(r, binary.BigEndian, &tieBreaker)
+	return tieBreaker, err
+}
+
+// generateCryptoRandomString generates a random string for crypto usage, r is
+// crypto/rand unless AgentConfig.Rand is set.
+func generateCryptoRandomString(r io.Reader, n int, runes string) (string, error) {
 	letters := []rune(runes)
 	b := make([]rune, n)
 	for i := range b {
-		v, err := crand.Int(crand.Reader, big.NewInt(int64(len(letters))))
+		v, err := crand.Int(r, big.NewInt(int64(len(letters))))
 		if err != nil {
 			return "", err
 		}
@@ -100,12 +151,12 @@ func generateCryptoRandomString(n int, runes string) (string, error) {
 
 // generatePwd generates ICE pwd.
 // This internally uses generateCryptoRandomString.
-func generatePwd() (string, error) {
-	return generateCryptoRandomString(lenPwd, runesAlpha)
+func generatePwd(r io.Reader) (string, error) {
+	return generateCryptoRandomString(r, lenPwd, runesAlpha)
 }
 
 // generateUFrag generates ICE user fragment.
 // This internally uses generateCryptoRandomString.
-func generateUFrag() (string, error) {
-	return generateCryptoRandomString(lenUFrag, runesAlpha)
+func generateUFrag(r io.Reader) (string, error) {
+	return generateCryptoRandomString(r, lenUFrag, runesAlpha)
 }
@@ -1,6 +1,7 @@
 package ice
 
 import (
+	crand "crypto/rand"
 	"regexp"
 	"sync"
 	"testing"
@@ -25,7 +26,7 @@ func TestCryptoRandomGenerator(t *testing.T) {
 	isLetter := regexp.MustCompile(`^[a-zA-Z]+$`).MatchString
 
 	for i := 0; i < 10000; i++ {
-		s, err := generateCryptoRandomString(10, runesAlpha)
+		s, err := generateCryptoRandomString(crand.Reader, 10, runesAlpha)
 		if err != nil {
 			t.Error(err)
 		}
@@ -51,7 +52,7 @@ func TestRandomGeneratorCollision(t *testing.T) {
 		},
 		"PWD": {
 			gen: func(t *testing.T) string {
-				s, err := generatePwd()
+				s, err := generatePwd(crand.Reader)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -60,7 +61,7 @@ func TestRandomGeneratorCollision(t *testing.T) {
 		},
 		"Ufrag": {
 			gen: func(t *testing.T) string {
-				s, err := generateUFrag()
+				s, err := generateUFrag(crand.Reader)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -0,0 +1,170 @@
+package ice
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy is what is done with a packet sent over the bandwidth of
+// AgentConfig.MaxCheckBandwidth or Conn.SetMaxBandwidth
+type RateLimitPolicy byte
+
+// RateLimitPolicy enum
+const (
+	// RateLimitDrop drops the packet. A dropped connectivity check is
+	// retransmitted like a lost one, a dropped Write returns ErrRateLimited.
+	RateLimitDrop RateLimitPolicy = iota + 1
+
+	// RateLimitBlock delays the packet until it fits in the bandwidth. A
+	// delayed STUN message is sent by the connectivity checks routine, the
+	// Agent keeps handling the other ones in the meantime.
+	RateLimitBlock
+)
+
+func (p RateLimitPolicy) String() string {
+	switch p {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitBlock:
+		return "block"
+	default:
+		return ErrUnknownType.Error()
+	}
+}
+
+// tokenBucket paces the bytes sent to a bandwidth, with bursts of up to one
+// second of it. A packet larger than the burst is sent once the bucket is
+// full, the next ones wait for the bucket to refill.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full tokenBucket of bytesPerSecond
+func newTokenBucket(bytesPerSecond int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// refillLocked adds the tokens earned since the last call
+func (b *tokenBucket) refillLocked(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// needed returns the tokens n bytes wait for
+func (b *tokenBucket) needed(n int) float64 {
+	if float64(n) > b.rate {
+		return b.rate
+	}
+	return float64(n)
+}
+
+// allow takes the tokens of n bytes, and returns false without taking any if
+// they aren't available yet
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked(time.Now())
+	if b.tokens < b.needed(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// reserve takes the tokens of n bytes, and returns how long to wait until they
+// are available. Reserving in advance keeps the order of concurrent writes.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked(time.Now())
+	var delay time.Duration
+	if missing := b.needed(n) - b.tokens; missing > 0 {
+		delay = time.Duration(missing / b.rate * float64(time.Second))
+	}
+	b.tokens -= float64(n)
+	return delay
+}
+
+// cancel returns the tokens of n bytes that were reserved but not sent
+func (b *tokenBucket) cancel(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += float64(n)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// wait paces n bytes with policy, and returns an error if they must not be
+// sent: ErrRateLimited when they are dropped, ErrClosed when done is closed, or
+// a timeout error when deadline is closed while they are blocked.
+func (b *tokenBucket) wait(n int, policy RateLimitPolicy, done, deadline <-chan struct{}) error {
+	if policy != RateLimitBlock {
+		if !b.allow(n) {
+			return ErrRateLimited
+		}
+		return nil
+	}
+
+	delay := b.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		b.cancel(n)
+		return ErrClosed
+	case <-deadline:
+		b.cancel(n)
+		return &timeoutError{}
+	}
+}
+
+// SetMaxBandwidth paces the data written on the Conn to bytesPerSecond, in
+// bursts of up to one second of it, the packets over it are dropped or delayed
+// according to policy. A blocked Write waits for the write deadline. If
+// bytesPerSecond is 0, the data is not paced.
+func (c *Conn) SetMaxBandwidth(bytesPerSecond int, policy RateLimitPolicy) {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+
+	c.limiter = nil
+	if bytesPerSecond > 0 {
+		c.limiter = newTokenBucket(bytesPerSecond)
+	}
+	c.limitPolicy = policy
+}
+
+// limit paces n bytes written on the Conn, the ones over its bandwidth are
+// dropped when canBlock is false
+func (c *Conn) limit(n int, canBlock bool) error {
+	c.limiterMu.Lock()
+	limiter, policy := c.limiter, c.limitPolicy
+	c.limiterMu.Unlock()
+
+	if limiter == nil {
+		return nil
+	}
+	if !canBlock {
+		policy = RateLimitDrop
+	}
+	return limiter.wait(n, policy, c.agent.done, c.writeDeadline.Done())
+}
@@ -0,0 +1,147 @@
+// +build !js
+
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Run("Drop", func(t *testing.T) {
+		b := newTokenBucket(1000)
+		assert.NoError(t, b.wait(600, RateLimitDrop, nil, nil))
+		assert.Equal(t, ErrRateLimited, b.wait(600, RateLimitDrop, nil, nil))
+		assert.NoError(t, b.wait(300, RateLimitDrop, nil, nil))
+	})
+
+	t.Run("Larger than the burst", func(t *testing.T) {
+		b := newTokenBucket(1000)
+		assert.True(t, b.allow(1500))
+		assert.False(t, b.allow(1))
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		b := newTokenBucket(1000)
+		assert.Equal(t, time.Duration(0), b.reserve(1000))
+		delay := b.reserve(100)
+		assert.True(t, delay > 50*time.Millisecond && delay <= 100*time.Millisecond, delay)
+
+		start := time.Now()
+		assert.NoError(t, b.wait(10, RateLimitBlock, nil, nil))
+		assert.True(t, time.Since(start) >= delay)
+	})
+
+	t.Run("Blocked wait is aborted", func(t *testing.T) {
+		b := newTokenBucket(10)
+		assert.True(t, b.allow(10))
+
+		done := make(chan struct{})
+		close(done)
+		assert.Equal(t, ErrClosed, b.wait(10, RateLimitBlock, done, nil))
+
+		deadline := make(chan struct{})
+		close(deadline)
+		err := b.wait(10, RateLimitBlock, nil, deadline)
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), err)
+	})
+}
+
+func TestMaxCheckBandwidth(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "172.17.0.3",
+		Port:      999,
+		Component: 1,
+	})
+	assert.NoError(t, err)
+
+	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID, stun.NewSoftware("0123456789012345678901234567890123456789"), stun.Fingerprint)
+	assert.NoError(t, err)
+	assert.True(t, len(msg.Raw) > 50 && len(msg.Raw) <= 100, len(msg.Raw))
+
+	newLocal := func() (*CandidateHost, chan []byte) {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		sent := make(chan []byte, 10)
+		local.conn = &recordingPacketConn{sent: sent}
+		return local, sent
+	}
+
+	runAgentTest(t, &AgentConfig{MaxCheckBandwidth: 100}, func(a *Agent) {
+		local, sent := newLocal()
+		a.sendSTUN(msg, local, remote)
+		a.sendSTUN(msg, local, remote)
+		assert.Equal(t, 1, len(sent))
+	})
+
+	// The message over the bandwidth is queued rather than waited for under
+	// the agent lock, and sent by the connectivity checks once it fits
+	a, err := NewAgent(&AgentConfig{MaxCheckBandwidth: 100, CheckBandwidthPolicy: RateLimitBlock})
+	assert.NoError(t, err)
+	assert.NoError(t, a.startConnectivityChecks(true, "remoteUfrag", "remotePasswordWith128Bits"))
+
+	local, sent := newLocal()
+	assert.NoError(t, a.run(func(a *Agent) {
+		a.sendSTUN(msg, local, remote)
+		a.sendSTUN(msg, local, remote)
+		assert.Equal(t, 1, len(sent))
+		assert.Equal(t, 1, len(a.pacedSTUN))
+	}, nil))
+	<-sent
+	<-sent
+	assert.NoError(t, a.Close())
+}
+
+func TestConnSetMaxBandwidth(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	ca, cb := pipe(nil)
+
+	packet := make([]byte, 600)
+	ca.SetMaxBandwidth(1000, RateLimitDrop)
+	_, err := ca.Write(packet)
+	assert.NoError(t, err)
+	_, err = ca.Write(packet)
+	assert.Equal(t, ErrRateLimited, err)
+	_, err = ca.TryWrite(packet)
+	assert.Equal(t, ErrRateLimited, err)
+
+	ca.SetMaxBandwidth(1000, RateLimitBlock)
+	_, err = ca.Write(packet)
+	assert.NoError(t, err)
+	assert.NoError(t, ca.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = ca.Write(packet)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), err)
+	assert.NoError(t, ca.SetWriteDeadline(time.Time{}))
+
+	ca.SetMaxBandwidth(0, RateLimitBlock)
+	_, err = ca.Write(packet)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3*len(packet)), ca.BytesSent())
+
+	assert.NoError(t, ca.Close())
+	assert.NoError(t, cb.Close())
+}
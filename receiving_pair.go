@@ -0,0 +1,74 @@
+package ice
+
+import (
+	"time"
+)
+
+// defaultAsymmetricRoutingTimeout is how long the data of a component has to
+// be received on another pair than the selected one before a warning is logged
+const defaultAsymmetricRoutingTimeout = 10 * time.Second
+
+// receivingPair is the pair the last data packet of a component was received on
+type receivingPair struct {
+	pair *candidatePair
+	// asymmetricSince is when the data was first received on a pair other
+	// than the selected one, it is zero while the routing is symmetric
+	asymmetricSince time.Time
+	warned          bool
+}
+
+// GetReceivingCandidatePair returns the candidate pair the last data packet
+// of ComponentRTP was received on, or nil if none was received yet. It is the
+// selected pair unless the remote sends on another pair than the one it
+// receives on, like when a NAT hairpins. A warning is logged when it differs
+// from the selected pair for more than 10 seconds.
+func (a *Agent) GetReceivingCandidatePair() (*CandidatePair, error) {
+	res := make(chan *CandidatePair, 1)
+	if err := a.run(func(agent *Agent) {
+		var pair *CandidatePair
+		if p := agent.receivingPairs[ComponentRTP-1].pair; p != nil {
+			pair = &CandidatePair{Local: p.local, Remote: p.remote}
+		}
+		res <- pair
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	return <-res, nil
+}
+
+// dataReceived records a data packet received on p, which becomes the
+// receiving pair of its component. It must be called with the lock held.
+func (a *Agent) dataReceived(p *candidatePair) {
+	component := p.local.Component()
+	if !a.hasComponent(component) {
+		return
+	}
+	a.inboundStats[component-1].packetArrived(a.clock.Now())
+
+	r := &a.receivingPairs[component-1]
+	if selected := a.getComponentSelectedPair(component); selected == nil || selected == p {
+		*r = receivingPair{pair: p}
+	} else if r.pair != p || r.asymmetricSince.IsZero() {
+		*r = receivingPair{pair: p, asymmetricSince: a.clock.Now()}
+	}
+}
+
+// checkAsymmetricRouting logs a warning once the data of a component has been
+// received on another pair than the selected one for asymmetricRoutingTimeout,
+// it must be called with the lock held
+func (a *Agent) checkAsymmetricRouting() {
+	for i := range a.receivingPairs {
+		r := &a.receivingPairs[i]
+		if r.warned || r.asymmetricSince.IsZero() || a.clock.Now().Sub(r.asymmetricSince) < a.asymmetricRoutingTimeout {
+			continue
+		}
+
+		selected := a.getComponentSelectedPair(uint16(i + 1))
+		if selected == nil || selected == r.pair {
+			continue
+		}
+		a.log.Warnf("Asymmetric routing of component %d for %s: sending on %s, receiving on %s", i+1, a.clock.Now().Sub(r.asymmetricSince).Round(time.Second), selected, r.pair)
+		r.warned = true
+	}
+}
@@ -17,27 +17,46 @@ type pairCandidateSelector interface {
 }
 
 type controllingSelector struct {
-	startTime     time.Time
-	agent         *Agent
-	nominatedPair *candidatePair
-	log           logging.LeveledLogger
+	startTime time.Time
+	agent     *Agent
+	// nominatedPairs is keyed by component
+	nominatedPairs map[uint16]*candidatePair
+	log            logging.LeveledLogger
+
+	// nomination is the last NOMINATION value used when renomination is
+	// enabled, nominations has the value of nominatedPairs by component
+	nomination  uint32
+	nominations map[uint16]uint32
 }
 
 func (s *controllingSelector) Start() {
-	s.startTime = time.Now()
-	s.nominatedPair = nil
+	s.startTime = s.agent.clock.Now()
+	s.nominatedPairs = map[uint16]*candidatePair{}
+	s.nominations = map[uint16]uint32{}
+}
+
+// startNomination makes p the nominated pair of its component, with the next
+// NOMINATION value when renomination is enabled
+func (s *controllingSelector) startNomination(p *candidatePair) {
+	component := p.local.Component()
+	s.nominatedPairs[component] = p
+	if s.agent.enableRenomination {
+		s.nomination++
+		s.nominations[component] = s.nomination
+	}
+	s.nominatePair(p)
 }
 
 func (s *controllingSelector) isNominatable(c Candidate) bool {
 	switch {
 	case c.Type() == CandidateTypeHost:
-		return time.Since(s.startTime).Nanoseconds() > s.agent.hostAcceptanceMinWait.Nanoseconds()
+		return s.agent.clock.Now().Sub(s.startTime).Nanoseconds() > s.agent.hostAcceptanceMinWait.Nanoseconds()
 	case c.Type() == CandidateTypeServerReflexive:
-		return time.Since(s.startTime).Nanoseconds() > s.agent.srflxAcceptanceMinWait.Nanoseconds()
+		return s.agent.clock.Now().Sub(s.startTime).Nanoseconds() > s.agent.srflxAcceptanceMinWait.Nanoseconds()
 	case c.Type() == CandidateTypePeerReflexive:
-		return time.Since(s.startTime).Nanoseconds() > s.agent.prflxAcceptanceMinWait.Nanoseconds()
+		return s.agent.clock.Now().Sub(s.startTime).Nanoseconds() > s.agent.prflxAcceptanceMinWait.Nanoseconds()
 	case c.Type() == CandidateTypeRelay:
-		return time.Since(s.startTime).Nanoseconds() > s.agent.relayAcceptanceMinWait.Nanoseconds()
+		return s.agent.clock.Now().Sub(s.startTime).Nanoseconds() > s.agent.relayAcceptanceMinWait.Nanoseconds()
 	}
 
 	s.log.Errorf("isNominatable invalid candidate type %s", c.Type().String())
@@ -46,23 +65,51 @@ func (s *controllingSelector) isNominatable(c Candidate) bool {
 
 func (s *controllingSelector) ContactCandidates() {
 	switch {
-	case s.agent.getSelectedPair() != nil:
-		if s.agent.validateSelectedPair() {
+	case s.agent.getSelectedPairs() != nil:
+		if s.agent.validateSelectedPair() && s.agent.checkConsent() {
 			s.log.Trace("checking keepalive")
 			s.agent.checkKeepalive()
 		}
-	case s.nominatedPair != nil:
-		s.nominatePair(s.nominatedPair)
-	default:
-		p := s.agent.getBestValidCandidatePair()
-		if p != nil && s.isNominatable(p.local) && s.isNominatable(p.remote) {
-			s.log.Tracef("Nominatable pair found, nominating (%s, %s)", p.local.String(), p.remote.String())
-			p.nominated = true
-			s.nominatedPair = p
-			s.nominatePair(p)
-			return
+		if s.agent.aggressiveNomination {
+			// Keep checking, a higher priority pair may still be nominated
+			s.agent.pingAllCandidates()
 		}
+		if s.agent.enableRenomination {
+			// Retransmit the renominations that did not succeed yet
+			for component, p := range s.nominatedPairs {
+				if p != s.agent.getComponentSelectedPair(component) {
+					s.nominatePair(p)
+				}
+			}
+		}
+	case s.agent.aggressiveNomination:
+		// Every check carries USE-CANDIDATE, no separate nomination round-trip
 		s.agent.pingAllCandidates()
+	default:
+		// Nomination completes independently for every component, checks
+		// continue until each of them has a pair to nominate
+		checking := false
+		for component := uint16(1); component <= s.agent.components; component++ {
+			if s.agent.getComponentSelectedPair(component) != nil {
+				continue
+			} else if nominatedPair := s.nominatedPairs[component]; nominatedPair != nil {
+				s.nominatePair(nominatedPair)
+				continue
+			}
+
+			p := s.agent.getBestValidCandidatePair(component)
+			if p != nil && s.isNominatable(p.local) && s.isNominatable(p.remote) {
+				s.log.Tracef("Nominatable pair found, nominating (%s, %s)", p.local.String(), p.remote.String())
+				p.nominated = true
+				s.startNomination(p)
+				continue
+			}
+			checking = true
+		}
+
+		if checking {
+			s.agent.pingAllCandidates()
+		}
 	}
 }
 
@@ -71,15 +118,25 @@ func (s *controllingSelector) nominatePair(pair *candidatePair) {
 	// order to nominate a candidate pair (Section 8.1.1).  The controlled
 	// agent MUST NOT include the USE-CANDIDATE attribute in a Binding
 	// request.
-	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
-		stun.NewUsername(s.agent.remoteUfrag+":"+s.agent.localUfrag),
+	setters := []stun.Setter{
+		stun.BindingRequest, s.agent.transactionID(),
+		stun.NewUsername(s.agent.remoteUfrag + ":" + s.agent.localUfrag),
 		UseCandidate,
+	}
+	if s.agent.enableRenomination {
+		setters = append(setters, NominationAttr(s.nominations[pair.local.Component()]))
+	}
+	setters = append(setters,
 		AttrControlling(s.agent.tieBreaker),
 		PriorityAttr(pair.local.Priority()),
-		stun.NewShortTermIntegrity(s.agent.remotePwd),
+		s.agent.softwareName,
+		s.agent.onBuildRequest,
+		s.agent.requestIntegrity(),
 		stun.Fingerprint,
 	)
 
+	msg, err := stun.Build(setters...)
+
 	if err != nil {
 		s.log.Error(err.Error())
 		return
@@ -99,15 +156,15 @@ func (s *controllingSelector) HandleBindingRequest(m *stun.Message, local, remot
 		return
 	}
 
-	if p.state == CandidatePairStateSucceeded && s.nominatedPair == nil && s.agent.getSelectedPair() == nil {
-		bestPair := s.agent.getBestAvailableCandidatePair()
+	component := p.local.Component()
+	if p.state == CandidatePairStateSucceeded && s.nominatedPairs[component] == nil && s.agent.getComponentSelectedPair(component) == nil {
+		bestPair := s.agent.getBestAvailableCandidatePair(component)
 		if bestPair == nil {
 			s.log.Tracef("No best pair available\n")
 		} else if bestPair.Equal(p) && s.isNominatable(p.local) && s.isNominatable(p.remote) {
 			s.log.Tracef("The candidate (%s, %s) is the best candidate available, marking it as nominated\n",
 				p.local.String(), p.remote.String())
-			s.nominatedPair = p
-			s.nominatePair(p)
+			s.startNomination(p)
 		}
 	}
 }
@@ -138,21 +195,52 @@ func (s *controllingSelector) HandleSuccessResponse(m *stun.Message, local, remo
 	}
 
 	p.state = CandidatePairStateSucceeded
+	p.consentTime = s.agent.clock.Now()
+	s.agent.unfreezePairs(p)
+	s.agent.checkCompleted()
+	rtt := s.agent.clock.Now().Sub(pendingRequest.timestamp)
+	p.responseReceived(rtt)
+	s.agent.checkDone(local, remote, CheckResultSuccess, rtt)
 	s.log.Tracef("Found valid candidate pair: %s", p)
-	if pendingRequest.isUseCandidate && s.agent.getSelectedPair() == nil {
+	if !pendingRequest.isUseCandidate {
+		return
+	}
+
+	component := p.local.Component()
+	selectedPair := s.agent.getComponentSelectedPair(component)
+	switch {
+	case selectedPair == nil,
+		s.agent.aggressiveNomination && p.Priority() > selectedPair.Priority() && s.agent.dwelled(p),
+		s.agent.enableRenomination && s.nominatedPairs[component] == p:
 		s.agent.setSelectedPair(p)
 	}
+
+	// With aggressive nomination the checks stop once the remote answered a
+	// check sent on the selected pair after selecting it
+	if s.agent.aggressiveNomination && p == s.agent.getComponentSelectedPair(component) && pendingRequest.timestamp.After(p.selectedTime) {
+		s.agent.cancelChecks(component)
+	}
 }
 
 func (s *controllingSelector) PingCandidate(local, remote Candidate) {
-	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
-		stun.NewUsername(s.agent.remoteUfrag+":"+s.agent.localUfrag),
+	setters := []stun.Setter{
+		stun.BindingRequest, s.agent.transactionID(),
+		stun.NewUsername(s.agent.remoteUfrag + ":" + s.agent.localUfrag),
+	}
+	if s.agent.aggressiveNomination {
+		setters = append(setters, UseCandidate)
+	}
+	setters = append(setters,
 		AttrControlling(s.agent.tieBreaker),
 		PriorityAttr(local.Priority()),
-		stun.NewShortTermIntegrity(s.agent.remotePwd),
+		s.agent.softwareName,
+		s.agent.onBuildRequest,
+		s.agent.requestIntegrity(),
 		stun.Fingerprint,
 	)
 
+	msg, err := stun.Build(setters...)
+
 	if err != nil {
 		s.log.Error(err.Error())
 		return
@@ -164,14 +252,19 @@ func (s *controllingSelector) PingCandidate(local, remote Candidate) {
 type controlledSelector struct {
 	agent *Agent
 	log   logging.LeveledLogger
+
+	// renominatedPairs is the pair nominated with the highest NOMINATION
+	// value by component, nominations has the value
+	renominatedPairs map[uint16]*candidatePair
+	nominations      map[uint16]uint32
 }
 
 func (s *controlledSelector) Start() {
 }
 
 func (s *controlledSelector) ContactCandidates() {
-	if s.agent.getSelectedPair() != nil {
-		if s.agent.validateSelectedPair() {
+	if s.agent.getSelectedPairs() != nil {
+		if s.agent.validateSelectedPair() && s.agent.checkConsent() {
 			s.log.Trace("checking keepalive")
 			s.agent.checkKeepalive()
 		}
@@ -181,11 +274,13 @@ func (s *controlledSelector) ContactCandidates() {
 }
 
 func (s *controlledSelector) PingCandidate(local, remote Candidate) {
-	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+	msg, err := stun.Build(stun.BindingRequest, s.agent.transactionID(),
 		stun.NewUsername(s.agent.remoteUfrag+":"+s.agent.localUfrag),
 		AttrControlled(s.agent.tieBreaker),
 		PriorityAttr(local.Priority()),
-		stun.NewShortTermIntegrity(s.agent.remotePwd),
+		s.agent.softwareName,
+		s.agent.onBuildRequest,
+		s.agent.requestIntegrity(),
 		stun.Fingerprint,
 	)
 
@@ -230,7 +325,74 @@ func (s *controlledSelector) HandleSuccessResponse(m *stun.Message, local, remot
 	}
 
 	p.state = CandidatePairStateSucceeded
+	p.consentTime = s.agent.clock.Now()
+	s.agent.unfreezePairs(p)
+	s.agent.checkCompleted()
+	rtt := s.agent.clock.Now().Sub(pendingRequest.timestamp)
+	p.responseReceived(rtt)
+	s.agent.checkDone(local, remote, CheckResultSuccess, rtt)
 	s.log.Tracef("Found valid candidate pair: %s", p)
+	if p.nominateOnBindingSuccess {
+		s.nominate(p)
+	}
+}
+
+// nominate sets the nominated flag of the valid pair p, and selects the highest
+// priority nominated pair of its component, or the renominated one. A controlling
+// agent using aggressive nomination nominates every pair it checks, in an order
+// that depends on the network, so p may not be the one selected.
+// https://tools.ietf.org/html/rfc8445#section-8.1.1
+func (s *controlledSelector) nominate(p *candidatePair) {
+	p.nominated = true
+	p.nominateOnBindingSuccess = false
+	s.selectNominatedPair(p.local.Component())
+}
+
+// selectNominatedPair selects the pair renominated last for component, or else
+// the highest priority pair that is both valid and nominated. The selected pair
+// is kept when none is.
+func (s *controlledSelector) selectNominatedPair(component uint16) {
+	if p := s.renominatedPairs[component]; p != nil {
+		if p.nominated && p.state == CandidatePairStateSucceeded {
+			s.agent.setSelectedPair(p)
+		}
+		return
+	}
+
+	var best *candidatePair
+	for _, p := range s.agent.checklist {
+		if p.local.Component() != component || !p.nominated || p.state != CandidatePairStateSucceeded {
+			continue
+		}
+		if s.agent.isBetterPair(p, best) {
+			best = p
+		}
+	}
+	if best != nil && (best == s.agent.getComponentSelectedPair(component) || s.agent.dwelled(best)) {
+		s.agent.setSelectedPair(best)
+	}
+}
+
+// acceptNomination returns false if m renominates p with a lower NOMINATION
+// value than the one of the pair renominated last for the component of p
+func (s *controlledSelector) acceptNomination(m *stun.Message, p *candidatePair) bool {
+	var nomination NominationAttr
+	if err := nomination.GetFrom(m); err != nil {
+		return true
+	}
+
+	component := p.local.Component()
+	if s.renominatedPairs == nil {
+		s.renominatedPairs = map[uint16]*candidatePair{}
+		s.nominations = map[uint16]uint32{}
+	} else if s.renominatedPairs[component] != nil && uint32(nomination) < s.nominations[component] {
+		s.log.Debugf("Ignoring nomination %d of %s, %s was nominated with %d", nomination, p, s.renominatedPairs[component], s.nominations[component])
+		return false
+	}
+
+	s.renominatedPairs[component] = p
+	s.nominations[component] = uint32(nomination)
+	return true
 }
 
 func (s *controlledSelector) HandleBindingRequest(m *stun.Message, local, remote Candidate) {
@@ -242,7 +404,9 @@ func (s *controlledSelector) HandleBindingRequest(m *stun.Message, local, remote
 		p = s.agent.addPair(local, remote)
 	}
 
-	if useCandidate {
+	if useCandidate && s.agent.enableRenomination && !s.acceptNomination(m, p) {
+		s.agent.sendBindingSuccess(m, local, remote)
+	} else if useCandidate {
 		// https://tools.ietf.org/html/rfc8445#section-7.3.1.5
 
 		if p.state == CandidatePairStateSucceeded {
@@ -250,9 +414,7 @@ func (s *controlledSelector) HandleBindingRequest(m *stun.Message, local, remote
 			// previously sent by this pair produced a successful response and
 			// generated a valid pair (Section 7.2.5.3.2).  The agent sets the
 			// nominated flag value of the valid pair to true.
-			if selectedPair := s.agent.getSelectedPair(); selectedPair == nil {
-				s.agent.setSelectedPair(p)
-			}
+			s.nominate(p)
 			s.agent.sendBindingSuccess(m, local, remote)
 		} else {
 			// If the received Binding request triggered a new check to be
@@ -263,11 +425,15 @@ func (s *controlledSelector) HandleBindingRequest(m *stun.Message, local, remote
 			// MUST remove the candidate pair from the valid list, set the
 			// candidate pair state to Failed, and set the checklist state to
 			// Failed.
+			p.nominateOnBindingSuccess = true
 			s.PingCandidate(local, remote)
 		}
 	} else {
 		s.agent.sendBindingSuccess(m, local, remote)
-		s.PingCandidate(local, remote)
+		// No triggered check once another pair was selected
+		if p.state != CandidatePairStateCancelled {
+			s.PingCandidate(local, remote)
+		}
 	}
 }
 
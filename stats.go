@@ -123,6 +123,12 @@ type CandidatePairStats struct {
 	// ConsentExpiredTimestamp represents the timestamp at which the latest valid
 	// STUN binding response expired.
 	ConsentExpiredTimestamp time.Time
+
+	// ChannelBound is true when the local candidate is a relay candidate and
+	// its TURN server has a channel bound to the remote candidate. The packets
+	// are then relayed as ChannelData, with a 4 byte header instead of the
+	// 36 bytes of Send and Data indications.
+	ChannelBound bool
 }
 
 // CandidateStats contains ICE candidate statistics related to the ICETransport objects.
@@ -1,8 +1,11 @@
 package ice
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io"
 
 	"github.com/pion/stun"
 )
@@ -22,7 +25,160 @@ func assertInboundUsername(m *stun.Message, expectedUsername string) error {
 	return nil
 }
 
+// assertInboundMessageIntegrity checks MESSAGE-INTEGRITY-SHA256 when m has
+// it, and MESSAGE-INTEGRITY otherwise
 func assertInboundMessageIntegrity(m *stun.Message, key []byte) error {
+	if m.Contains(attrMessageIntegritySHA256) {
+		return messageIntegritySHA256(key).Check(m)
+	}
 	messageIntegrityAttr := stun.MessageIntegrity(key)
 	return messageIntegrityAttr.Check(m)
 }
+
+// maxSoftwareNameLength is the length in characters the SOFTWARE attribute
+// must be shorter than
+const maxSoftwareNameLength = 128
+
+// softwareAttr is the SOFTWARE attribute, it is omitted when empty
+type softwareAttr string
+
+func (s softwareAttr) AddTo(m *stun.Message) error {
+	if s == "" {
+		return nil
+	}
+	return stun.NewSoftware(string(s)).AddTo(m)
+}
+
+// attrMessageIntegritySHA256 is not known by pion/stun
+// https://tools.ietf.org/html/rfc8489#section-14.6
+const attrMessageIntegritySHA256 stun.AttrType = 0x001C
+
+const (
+	stunHeaderSize          = 20
+	stunAttributeHeaderSize = 4
+
+	// messageIntegritySHA256MinSize is the shortest truncated HMAC accepted
+	messageIntegritySHA256MinSize = 16
+)
+
+// messageIntegritySHA256 is the MESSAGE-INTEGRITY-SHA256 attribute keyed with
+// a password, the HMAC-SHA256 of the message up to the attribute. Like
+// MESSAGE-INTEGRITY, the length in the header covers the attribute when the
+// HMAC is computed.
+type messageIntegritySHA256 []byte
+
+// AddTo adds the untruncated attribute to m
+func (i messageIntegritySHA256) AddTo(m *stun.Message) error {
+	for _, a := range m.Attributes {
+		if a.Type == stun.AttrFingerprint {
+			return stun.ErrFingerprintBeforeIntegrity
+		}
+	}
+
+	m.Add(attrMessageIntegritySHA256, i.hmac(m.Raw, sha256.Size))
+	return nil
+}
+
+// Check checks the attribute of m, which may be truncated to 16 bytes
+func (i messageIntegritySHA256) Check(m *stun.Message) error {
+	offset := stunHeaderSize
+	for _, a := range m.Attributes {
+		if a.Type != attrMessageIntegritySHA256 {
+			offset += stunAttributeHeaderSize + stunPaddedLength(int(a.Length))
+			continue
+		}
+
+		if len(a.Value) < messageIntegritySHA256MinSize || len(a.Value) > sha256.Size || len(a.Value)%4 != 0 {
+			return stun.ErrAttributeSizeInvalid
+		}
+		if !hmac.Equal(i.hmac(m.Raw[:offset], len(a.Value)), a.Value) {
+			return stun.ErrIntegrityMismatch
+		}
+		return nil
+	}
+
+	return stun.ErrAttributeNotFound
+}
+
+// hmac returns the HMAC of msg followed by an attribute of size bytes
+func (i messageIntegritySHA256) hmac(msg []byte, size int) []byte {
+	header := append([]byte{}, msg[:stunHeaderSize]...)
+	bin.PutUint16(header[2:4], uint16(len(msg)-stunHeaderSize+stunAttributeHeaderSize+size))
+
+	mac := hmac.New(sha256.New, i)
+	mac.Write(header)               //nolint:errcheck
+	mac.Write(msg[stunHeaderSize:]) //nolint:errcheck
+	return mac.Sum(nil)[:size]
+}
+
+func stunPaddedLength(l int) int {
+	return (l + 3) &^ 3
+}
+
+// shortTermIntegrity signs a message with MESSAGE-INTEGRITY, MESSAGE-INTEGRITY-SHA256
+// or both, in this order
+type shortTermIntegrity struct {
+	key          []byte
+	sha1, sha256 bool
+}
+
+func (i shortTermIntegrity) AddTo(m *stun.Message) error {
+	if i.sha1 {
+		if err := stun.MessageIntegrity(i.key).AddTo(m); err != nil {
+			return err
+		}
+	}
+	if i.sha256 {
+		return messageIntegritySHA256(i.key).AddTo(m)
+	}
+	return nil
+}
+
+// randomTransactionID is a stun.Setter like stun.TransactionID, reading the
+// transaction ID from r
+type randomTransactionID struct {
+	r io.Reader
+}
+
+// AddTo sets a random transaction ID on m
+func (t randomTransactionID) AddTo(m *stun.Message) error {
+	if _, err := io.ReadFull(t.r, m.TransactionID[:]); err != nil {
+		return err
+	}
+	m.WriteTransactionID()
+	return nil
+}
+
+// transactionID returns the setter of the transaction IDs of the requests of
+// the Agent, they are read from AgentConfig.Rand
+func (a *Agent) transactionID() stun.Setter {
+	return randomTransactionID{r: a.rand}
+}
+
+// requestHook is the AgentConfig.OnBuildRequest setter of the Binding requests
+type requestHook func(*stun.Message)
+
+// AddTo calls the hook with m, if any
+func (h requestHook) AddTo(m *stun.Message) error {
+	if h != nil {
+		h(m)
+	}
+	return nil
+}
+
+// requestIntegrity signs a connectivity check with the remote password, see
+// AgentConfig.MessageIntegritySHA256
+func (a *Agent) requestIntegrity() stun.Setter {
+	return shortTermIntegrity{key: []byte(a.remotePwd), sha1: true, sha256: a.messageIntegritySHA256}
+}
+
+// responseIntegrity signs the response to request with the integrity
+// attributes of the request, MESSAGE-INTEGRITY when it has none
+func responseIntegrity(request *stun.Message, pwd string) stun.Setter {
+	hasSHA256 := request.Contains(attrMessageIntegritySHA256)
+	return shortTermIntegrity{
+		key:    []byte(pwd),
+		sha1:   !hasSHA256 || request.Contains(stun.AttrMessageIntegrity),
+		sha256: hasSHA256,
+	}
+}
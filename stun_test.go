@@ -0,0 +1,431 @@
+//go:build !js
+// +build !js
+
+package ice
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageIntegritySHA256(t *testing.T) {
+	key := []byte("password")
+
+	build := func(t *testing.T, setters ...stun.Setter) *stun.Message {
+		m, err := stun.Build(append([]stun.Setter{stun.BindingRequest, stun.TransactionID, stun.NewUsername("a:b")}, setters...)...)
+		assert.NoError(t, err)
+
+		// Decode as a received message
+		decoded := &stun.Message{Raw: m.Raw}
+		assert.NoError(t, decoded.Decode())
+		return decoded
+	}
+
+	t.Run("SHA256 only", func(t *testing.T) {
+		m := build(t, messageIntegritySHA256(key), stun.Fingerprint)
+		assert.False(t, m.Contains(stun.AttrMessageIntegrity))
+		assert.NoError(t, messageIntegritySHA256(key).Check(m))
+		assert.NoError(t, assertInboundMessageIntegrity(m, key))
+		assert.Equal(t, stun.ErrIntegrityMismatch, assertInboundMessageIntegrity(m, []byte("wrong")))
+	})
+
+	t.Run("Both", func(t *testing.T) {
+		m := build(t, shortTermIntegrity{key: key, sha1: true, sha256: true}, stun.Fingerprint)
+		assert.NoError(t, stun.MessageIntegrity(key).Check(m))
+		assert.NoError(t, messageIntegritySHA256(key).Check(m))
+	})
+
+	t.Run("SHA1 only", func(t *testing.T) {
+		m := build(t, stun.NewShortTermIntegrity(string(key)), stun.Fingerprint)
+		assert.Equal(t, stun.ErrAttributeNotFound, messageIntegritySHA256(key).Check(m))
+		assert.NoError(t, assertInboundMessageIntegrity(m, key))
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		m := build(t)
+		m.Add(attrMessageIntegritySHA256, messageIntegritySHA256(key).hmac(m.Raw, messageIntegritySHA256MinSize))
+		m.WriteLength()
+		assert.NoError(t, messageIntegritySHA256(key).Check(m))
+
+		short := build(t)
+		short.Add(attrMessageIntegritySHA256, messageIntegritySHA256(key).hmac(short.Raw, 12))
+		assert.Equal(t, stun.ErrAttributeSizeInvalid, messageIntegritySHA256(key).Check(short))
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		m := build(t, messageIntegritySHA256(key))
+		m.Raw[stunHeaderSize+stunAttributeHeaderSize] ^= 1
+		assert.NoError(t, m.Decode())
+		assert.Equal(t, stun.ErrIntegrityMismatch, messageIntegritySHA256(key).Check(m))
+	})
+
+	t.Run("After FINGERPRINT", func(t *testing.T) {
+		_, err := stun.Build(stun.BindingRequest, stun.TransactionID, stun.Fingerprint, messageIntegritySHA256(key))
+		assert.Equal(t, stun.ErrFingerprintBeforeIntegrity, err)
+	})
+}
+
+func TestMessageIntegritySHA256Negotiation(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	remote := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+	newLocal := func(t *testing.T) (*CandidateHost, chan []byte) {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		sent := make(chan []byte, 10)
+		local.conn = &recordingPacketConn{sent: sent}
+		return local, sent
+	}
+
+	handleRequest := func(t *testing.T, a *Agent, integrity stun.Setter) *stun.Message {
+		local, sent := newLocal(t)
+		msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+			stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+			AttrControlling(1),
+			PriorityAttr(1),
+			integrity,
+			stun.Fingerprint,
+		)
+		assert.NoError(t, err)
+		a.handleInbound(msg, local, remote)
+
+		resp := &stun.Message{Raw: <-sent}
+		assert.NoError(t, resp.Decode())
+		return resp
+	}
+
+	t.Run("Responses mirror the request", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			a.startSelector()
+
+			resp := handleRequest(t, a, shortTermIntegrity{key: []byte(a.localPwd), sha1: true})
+			assert.Equal(t, stun.BindingSuccess, resp.Type)
+			assert.True(t, resp.Contains(stun.AttrMessageIntegrity))
+			assert.False(t, resp.Contains(attrMessageIntegritySHA256))
+			assert.False(t, a.messageIntegritySHA256)
+
+			resp = handleRequest(t, a, shortTermIntegrity{key: []byte(a.localPwd), sha256: true})
+			assert.Equal(t, stun.BindingSuccess, resp.Type)
+			assert.False(t, resp.Contains(stun.AttrMessageIntegrity))
+			assert.NoError(t, messageIntegritySHA256(a.localPwd).Check(resp))
+			assert.NoError(t, stun.Fingerprint.Check(resp))
+
+			// The remote supports SHA256, the checks now carry it
+			assert.True(t, a.messageIntegritySHA256)
+		})
+	})
+
+	t.Run("Wrong SHA256 integrity", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			a.startSelector()
+
+			resp := handleRequest(t, a, shortTermIntegrity{key: []byte("wrong"), sha256: true})
+			assert.Equal(t, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), resp.Type)
+			assert.False(t, a.messageIntegritySHA256)
+		})
+	})
+
+	t.Run("Wrong FINGERPRINT", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			a.startSelector()
+			local, sent := newLocal(t)
+
+			msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+				stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+				stun.NewShortTermIntegrity(a.localPwd),
+				stun.Fingerprint,
+			)
+			assert.NoError(t, err)
+			msg.Raw[len(msg.Raw)-1] ^= 1
+			assert.NoError(t, msg.Decode())
+
+			a.handleInbound(msg, local, remote)
+			assert.Equal(t, 0, len(sent))
+			assert.Equal(t, 0, len(a.remoteCandidates))
+		})
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		aConn, bConn := pipe(&AgentConfig{MessageIntegritySHA256: true})
+		assert.NoError(t, aConn.Close())
+		assert.NoError(t, bConn.Close())
+	})
+}
+
+func TestSoftwareName(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	_, err := NewAgent(&AgentConfig{SoftwareName: strings.Repeat("é", maxSoftwareNameLength)})
+	assert.Equal(t, ErrInvalidSoftwareName, err)
+
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+	software := func(t *testing.T, config *AgentConfig) (request, response stun.Attributes) {
+		runAgentTest(t, config, func(a *Agent) {
+			a.startSelector()
+			local, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   "192.168.0.2",
+				Port:      777,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+			sent := make(chan []byte, 10)
+			local.conn = &recordingPacketConn{sent: sent}
+
+			remote, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   remoteAddr.IP.String(),
+				Port:      remoteAddr.Port,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+			a.addRemoteCandidate(remote)
+
+			// A check sent by the Agent
+			a.remoteUfrag, a.remotePwd = "remoteUfrag", "remotePasswordWith128Bits"
+			a.selector.PingCandidate(local, remote)
+			msg := &stun.Message{Raw: <-sent}
+			assert.NoError(t, msg.Decode())
+			request = msg.Attributes
+
+			// The response to a check of the remote
+			in, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+				stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+				AttrControlling(1),
+				PriorityAttr(1),
+				stun.NewShortTermIntegrity(a.localPwd),
+				stun.Fingerprint,
+			)
+			assert.NoError(t, err)
+			a.handleInbound(in, local, remoteAddr)
+			msg = &stun.Message{Raw: <-sent}
+			assert.NoError(t, msg.Decode())
+			assert.Equal(t, stun.BindingSuccess, msg.Type)
+			assert.NoError(t, assertInboundMessageIntegrity(msg, []byte(a.localPwd)))
+			response = msg.Attributes
+		})
+		return request, response
+	}
+
+	request, response := software(t, &AgentConfig{SoftwareName: "client/1.0", AllowPrivateRemoteCandidates: true})
+	for _, attrs := range []stun.Attributes{request, response} {
+		attr, ok := attrs.Get(stun.AttrSoftware)
+		assert.True(t, ok)
+		assert.Equal(t, "client/1.0", string(attr.Value))
+	}
+
+	request, response = software(t, &AgentConfig{AllowPrivateRemoteCandidates: true})
+	for _, attrs := range []stun.Attributes{request, response} {
+		_, ok := attrs.Get(stun.AttrSoftware)
+		assert.False(t, ok)
+	}
+}
+
+func TestStrictICE(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	remote := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+	handleRequest := func(t *testing.T, a *Agent, setters ...stun.Setter) *stun.Message {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+		sent := make(chan []byte, 10)
+		local.conn = &recordingPacketConn{sent: sent}
+
+		setters = append([]stun.Setter{stun.BindingRequest, stun.TransactionID, stun.NewUsername(a.localUfrag + ":" + a.remoteUfrag)}, setters...)
+		msg, err := stun.Build(append(setters, stun.NewShortTermIntegrity(a.localPwd), stun.Fingerprint)...)
+		assert.NoError(t, err)
+		a.handleInbound(msg, local, remote)
+
+		resp := &stun.Message{Raw: <-sent}
+		assert.NoError(t, resp.Decode())
+		return resp
+	}
+	errorCode := func(t *testing.T, resp *stun.Message) stun.ErrorCode {
+		var code stun.ErrorCodeAttribute
+		assert.NoError(t, code.GetFrom(resp))
+		return code.Code
+	}
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{StrictICE: true, AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			a.startSelector()
+
+			for name, setters := range map[string][]stun.Setter{
+				"No PRIORITY":              {AttrControlling(1)},
+				"No role":                  {PriorityAttr(1)},
+				"Both roles":               {AttrControlling(1), AttrControlled(2), PriorityAttr(1)},
+				"Controlled USE-CANDIDATE": {AttrControlled(1), UseCandidate, PriorityAttr(1)},
+			} {
+				resp := handleRequest(t, a, setters...)
+				assert.Equal(t, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), resp.Type, name)
+				assert.Equal(t, stun.CodeBadRequest, errorCode(t, resp), name)
+
+				var control AttrControl
+				assert.NoError(t, control.GetFrom(resp), name)
+				assert.Equal(t, AttrControl{Role: Controlled, Tiebreaker: a.tieBreaker}, control, name)
+			}
+			assert.Equal(t, 0, len(a.remoteCandidates))
+
+			resp := handleRequest(t, a, AttrControlling(1), PriorityAttr(1))
+			assert.Equal(t, stun.BindingSuccess, resp.Type)
+			var control AttrControl
+			assert.NoError(t, control.GetFrom(resp))
+			assert.Equal(t, AttrControl{Role: Controlled, Tiebreaker: a.tieBreaker}, control)
+		})
+	})
+
+	t.Run("Lenient", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{AllowPrivateRemoteCandidates: true}, func(a *Agent) {
+			a.startSelector()
+
+			resp := handleRequest(t, a, AttrControlling(1))
+			assert.Equal(t, stun.BindingSuccess, resp.Type)
+			assert.False(t, resp.Contains(stun.AttrICEControlling))
+			assert.False(t, resp.Contains(stun.AttrICEControlled))
+		})
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		aConn, bConn := pipe(&AgentConfig{StrictICE: true})
+		assert.NoError(t, aConn.Close())
+		assert.NoError(t, bConn.Close())
+	})
+}
+
+func TestRequestHooks(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	// An application specific attribute signing the transaction with a key
+	// shared out of band
+	const attrAppHMAC stun.AttrType = 0xC0DE
+	key := []byte("shared key")
+	sign := func(m *stun.Message) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(m.TransactionID[:]) // nolint:errcheck
+		return mac.Sum(nil)
+	}
+	errUnsigned := errors.New("no valid application signature")
+	onBuildRequest := func(m *stun.Message) {
+		m.Add(attrAppHMAC, sign(m))
+	}
+	var validated int32
+	onValidateRequest := func(m *stun.Message) error {
+		v, err := m.Get(attrAppHMAC)
+		if err != nil || !bytes.Equal(v, sign(m)) {
+			return errUnsigned
+		}
+		atomic.AddInt32(&validated, 1)
+		return nil
+	}
+
+	remote := &net.UDPAddr{IP: net.ParseIP("172.17.0.3"), Port: 999}
+	newLocal := func(t *testing.T) (*CandidateHost, chan []byte) {
+		local, err := NewCandidateHost(&CandidateHostConfig{
+			Network:   "udp",
+			Address:   "192.168.0.2",
+			Port:      777,
+			Component: 1,
+		})
+		assert.NoError(t, err)
+
+		sent := make(chan []byte, 10)
+		local.conn = &recordingPacketConn{sent: sent}
+		return local, sent
+	}
+
+	t.Run("Signed checks", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{OnBuildRequest: onBuildRequest}, func(a *Agent) {
+			a.startSelector()
+			local, sent := newLocal(t)
+			remoteCandidate, err := NewCandidateHost(&CandidateHostConfig{
+				Network:   "udp",
+				Address:   remote.IP.String(),
+				Port:      remote.Port,
+				Component: 1,
+			})
+			assert.NoError(t, err)
+
+			a.selector.PingCandidate(local, remoteCandidate)
+			msg := &stun.Message{Raw: <-sent}
+			assert.NoError(t, msg.Decode())
+
+			v, err := msg.Get(attrAppHMAC)
+			assert.NoError(t, err)
+			assert.Equal(t, sign(msg), v)
+			assert.NoError(t, stun.NewShortTermIntegrity(a.remotePwd).Check(msg))
+		})
+	})
+
+	t.Run("Unsigned requests are rejected", func(t *testing.T) {
+		runAgentTest(t, &AgentConfig{OnValidateRequest: onValidateRequest}, func(a *Agent) {
+			a.startSelector()
+			local, sent := newLocal(t)
+
+			msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+				stun.NewUsername(a.localUfrag+":"+a.remoteUfrag),
+				AttrControlling(1),
+				PriorityAttr(1),
+				stun.NewShortTermIntegrity(a.localPwd),
+				stun.Fingerprint,
+			)
+			assert.NoError(t, err)
+			a.handleInbound(msg, local, remote)
+
+			resp := &stun.Message{Raw: <-sent}
+			assert.NoError(t, resp.Decode())
+			assert.Equal(t, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), resp.Type)
+			var code stun.ErrorCodeAttribute
+			assert.NoError(t, code.GetFrom(resp))
+			assert.Equal(t, stun.CodeForbidden, code.Code)
+			assert.Equal(t, 0, len(a.remoteCandidates))
+		})
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		aConn, bConn := pipe(&AgentConfig{
+			OnBuildRequest:    onBuildRequest,
+			OnValidateRequest: onValidateRequest,
+		})
+		assert.NotZero(t, atomic.LoadInt32(&validated))
+		assert.NoError(t, aConn.Close())
+		assert.NoError(t, bConn.Close())
+	})
+}
@@ -0,0 +1,298 @@
+package ice
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/deadline"
+)
+
+const (
+	// tcpFrameHeaderSize is the size of the length prefix of every packet sent over TCP
+	// https://tools.ietf.org/html/rfc4571#section-2
+	tcpFrameHeaderSize = 2
+
+	tcpMaxFramePayloadSize = 0xFFFF
+
+	// tcpActivePort is the port used to signal active TCP candidates
+	// https://tools.ietf.org/html/rfc6544#section-4.5
+	tcpActivePort = 9
+
+	tcpDialTimeout = 5 * time.Second
+)
+
+// addrPacket is a received packet and the address it was received from
+type addrPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// tcpPacketConn emulates a net.PacketConn on top of TCP connections so that
+// ICE-TCP candidates can share the datagram code paths of UDP candidates.
+//
+// Every packet is framed with a 2 byte length prefix as described in RFC 4571.
+// A passive conn accepts connections on its listener, an active conn dials
+// the first time a packet is sent to an address it has no connection to.
+// The packet that triggered the dial is dropped, which is fine since STUN
+// retransmits the connectivity check.
+type tcpPacketConn struct {
+	listener net.Listener
+	localIP  net.IP
+
+	log logging.LeveledLogger
+
+	mu      sync.Mutex
+	conns   map[string]net.Conn
+	dialing map[string]bool
+
+	recvCh       chan addrPacket
+	readDeadline *deadline.Deadline
+
+	dialCtx    context.Context
+	dialCancel context.CancelFunc
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// newPassiveTCPPacketConn creates a tcpPacketConn accepting connections on listener
+func newPassiveTCPPacketConn(listener net.Listener, log logging.LeveledLogger) *tcpPacketConn {
+	c := newTCPPacketConn(log)
+	c.listener = listener
+
+	c.wg.Add(1)
+	go c.acceptLoop()
+
+	return c
+}
+
+// newActiveTCPPacketConn creates a tcpPacketConn dialing from localIP
+func newActiveTCPPacketConn(localIP net.IP, log logging.LeveledLogger) *tcpPacketConn {
+	c := newTCPPacketConn(log)
+	c.localIP = localIP
+	return c
+}
+
+func newTCPPacketConn(log logging.LeveledLogger) *tcpPacketConn {
+	dialCtx, dialCancel := context.WithCancel(context.Background())
+	return &tcpPacketConn{
+		dialCtx:      dialCtx,
+		dialCancel:   dialCancel,
+		log:          log,
+		conns:        map[string]net.Conn{},
+		dialing:      map[string]bool{},
+		recvCh:       make(chan addrPacket),
+		readDeadline: deadline.New(),
+		closed:       make(chan struct{}),
+	}
+}
+
+func (c *tcpPacketConn) acceptLoop() {
+	defer c.wg.Done()
+
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c.addConn(conn)
+	}
+}
+
+func (c *tcpPacketConn) addConn(conn net.Conn) {
+	key := tcpAddrKey(conn.RemoteAddr())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		if err := conn.Close(); err != nil {
+			c.log.Warnf("Failed to close TCP conn: %v", err)
+		}
+		return
+	default:
+	}
+
+	if old, ok := c.conns[key]; ok {
+		if err := old.Close(); err != nil {
+			c.log.Warnf("Failed to close TCP conn: %v", err)
+		}
+	}
+	c.conns[key] = conn
+
+	c.wg.Add(1)
+	go c.readLoop(key, conn)
+}
+
+func (c *tcpPacketConn) removeConn(key string, conn net.Conn) {
+	c.mu.Lock()
+	if c.conns[key] == conn {
+		delete(c.conns, key)
+	}
+	c.mu.Unlock()
+
+	if err := conn.Close(); err != nil {
+		c.log.Tracef("Failed to close TCP conn: %v", err)
+	}
+}
+
+// readLoop deframes packets from conn until it is closed
+func (c *tcpPacketConn) readLoop(key string, conn net.Conn) {
+	defer c.wg.Done()
+	defer c.removeConn(key, conn)
+
+	header := make([]byte, tcpFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		select {
+		case c.recvCh <- addrPacket{data: data, addr: conn.RemoteAddr()}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *tcpPacketConn) dial(key string, raddr net.Addr) {
+	defer c.wg.Done()
+	defer func() {
+		c.mu.Lock()
+		delete(c.dialing, key)
+		c.mu.Unlock()
+	}()
+
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: c.localIP},
+		Timeout:   tcpDialTimeout,
+	}
+	conn, err := dialer.DialContext(c.dialCtx, tcp, key)
+	if err != nil {
+		c.log.Debugf("Failed to dial %s over TCP: %v", raddr, err)
+		return
+	}
+
+	c.addConn(conn)
+}
+
+// ReadFrom reads a single deframed packet
+func (c *tcpPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.recvCh:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.readDeadline.Done():
+		return 0, nil, &timeoutError{}
+	case <-c.closed:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+// WriteTo frames p and sends it over the TCP connection to addr
+func (c *tcpPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > tcpMaxFramePayloadSize {
+		return 0, ErrTCPFramePayloadTooLarge
+	}
+
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	key := tcpAddrKey(addr)
+
+	c.mu.Lock()
+	conn, ok := c.conns[key]
+	if !ok {
+		defer c.mu.Unlock()
+
+		if c.listener != nil {
+			return 0, ErrNoTCPConnection
+		}
+		if !c.dialing[key] {
+			c.dialing[key] = true
+			c.wg.Add(1)
+			go c.dial(key, addr)
+		}
+		return len(p), nil
+	}
+	c.mu.Unlock()
+
+	frame := make([]byte, tcpFrameHeaderSize+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[tcpFrameHeaderSize:], p)
+
+	if _, err := conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the listener and every TCP connection
+func (c *tcpPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		c.dialCancel()
+		if c.listener != nil {
+			err = c.listener.Close()
+		}
+		for _, conn := range c.conns {
+			if closeErr := conn.Close(); closeErr != nil {
+				c.log.Tracef("Failed to close TCP conn: %v", closeErr)
+			}
+		}
+		c.mu.Unlock()
+
+		c.wg.Wait()
+	})
+	return err
+}
+
+// LocalAddr returns the address of the listener, or the local IP of an active conn
+func (c *tcpPacketConn) LocalAddr() net.Addr {
+	if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return &net.TCPAddr{IP: c.localIP, Port: tcpActivePort}
+}
+
+// SetDeadline sets the read deadline, write deadlines are not supported
+func (c *tcpPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future ReadFrom calls
+func (c *tcpPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, it exists to implement net.PacketConn
+func (c *tcpPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func tcpAddrKey(addr net.Addr) string {
+	ip, port, err := addrIPAndPort(addr)
+	if err != nil {
+		return addr.String()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
@@ -0,0 +1,148 @@
+// +build !js
+
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPPacketConn(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	log := logging.NewDefaultLoggerFactory().NewLogger("ice")
+
+	listener, err := net.ListenTCP(tcp, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+
+	passive := newPassiveTCPPacketConn(listener, log)
+	active := newActiveTCPPacketConn(net.IPv4(127, 0, 0, 1), log)
+
+	// A passive conn can't reach addresses that never connected to it
+	_, err = passive.WriteTo([]byte("ping"), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: tcpActivePort})
+	assert.Equal(t, ErrNoTCPConnection, err)
+
+	_, err = active.WriteTo(make([]byte, tcpMaxFramePayloadSize+1), listener.Addr())
+	assert.Equal(t, ErrTCPFramePayloadTooLarge, err)
+
+	// The active conn dials on first write, keep writing until a packet arrives
+	received := make(chan net.Addr)
+	go func() {
+		buf := make([]byte, receiveMTU)
+		n, addr, readErr := passive.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "ping", string(buf[:n]))
+		received <- addr
+	}()
+
+	var activeAddr net.Addr
+	for activeAddr == nil {
+		_, err = active.WriteTo([]byte("ping"), listener.Addr())
+		assert.NoError(t, err)
+
+		select {
+		case activeAddr = <-received:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Packets boundaries are preserved in both directions
+	_, err = passive.WriteTo([]byte("pong"), activeAddr)
+	assert.NoError(t, err)
+	_, err = passive.WriteTo([]byte("pong2"), activeAddr)
+	assert.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, addr, err := active.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", string(buf[:n]))
+	assert.Equal(t, listener.Addr().String(), addr.String())
+
+	n, _, err = active.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong2", string(buf[:n]))
+
+	assert.NoError(t, active.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, _, err = active.ReadFrom(buf)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	assert.NoError(t, active.Close())
+	assert.NoError(t, passive.Close())
+
+	_, _, err = passive.ReadFrom(buf)
+	assert.Error(t, err)
+}
+
+func TestConnectivityTCP(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	localIPs, err := localInterfaces(vnet.NewNet(nil), nil, nil, []NetworkType{NetworkTypeTCP4})
+	assert.NoError(t, err)
+	if len(localIPs) == 0 {
+		t.Skip("no non-loopback IPv4 interface to gather TCP candidates on")
+	}
+
+	aNotifier, aConnected := onConnected()
+	bNotifier, bConnected := onConnected()
+
+	cfg := &AgentConfig{
+		NetworkTypes:     []NetworkType{NetworkTypeTCP4},
+		CandidateTypes:   []CandidateType{CandidateTypeHost},
+		MulticastDNSMode: MulticastDNSModeDisabled,
+
+		AllowPrivateRemoteCandidates: true,
+	}
+
+	aAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, aAgent.OnConnectionStateChange(aNotifier))
+
+	bAgent, err := NewAgent(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, bAgent.OnConnectionStateChange(bNotifier))
+
+	aConn, bConn := connect(aAgent, bAgent)
+	<-aConnected
+	<-bConnected
+
+	for _, conn := range []*Conn{aConn, bConn} {
+		pair := conn.agent.getSelectedPair()
+		assert.NotNil(t, pair)
+		assert.Equal(t, NetworkTypeTCP4, pair.local.NetworkType())
+		assert.True(t, tcpTypesCompatible(pair.local, pair.remote))
+		assert.Equal(t, tcp, conn.RemoteAddr().Network())
+	}
+
+	// Packet boundaries survive the TCP framing
+	_, err = aConn.Write([]byte("first"))
+	assert.NoError(t, err)
+	_, err = aConn.Write([]byte("second"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, err := bConn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(buf[:n]))
+	n, err = bConn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(buf[:n]))
+
+	assert.NoError(t, aConn.Close())
+	assert.NoError(t, bConn.Close())
+}
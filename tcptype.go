@@ -0,0 +1,89 @@
+package ice
+
+import "strings"
+
+// TCPType is the type of ICE TCP candidate as described in
+// https://tools.ietf.org/html/rfc6544#section-4.5
+type TCPType int
+
+const (
+	// TCPTypeUnspecified is the default value. For example UDP candidates do not
+	// need this field.
+	TCPTypeUnspecified TCPType = iota
+	// TCPTypeActive is active TCP candidate, which initiates TCP connections.
+	TCPTypeActive
+	// TCPTypePassive is passive TCP candidate, only accepts TCP connections.
+	TCPTypePassive
+	// TCPTypeSimultaneousOpen is like active and passive at the same time.
+	TCPTypeSimultaneousOpen
+)
+
+// NewTCPType creates a new TCPType from string.
+func NewTCPType(value string) TCPType {
+	switch strings.ToLower(value) {
+	case "active":
+		return TCPTypeActive
+	case "passive":
+		return TCPTypePassive
+	case "so":
+		return TCPTypeSimultaneousOpen
+	default:
+		return TCPTypeUnspecified
+	}
+}
+
+func (t TCPType) String() string {
+	switch t {
+	case TCPTypeUnspecified:
+		return ""
+	case TCPTypeActive:
+		return "active"
+	case TCPTypePassive:
+		return "passive"
+	case TCPTypeSimultaneousOpen:
+		return "so"
+	default:
+		return ErrUnknownType.Error()
+	}
+}
+
+// directionPreference is used when computing the local preference of TCP
+// candidates, active candidates are preferred as they work through NATs.
+// https://tools.ietf.org/html/rfc6544#section-4.2
+func (t TCPType) directionPreference() uint16 {
+	switch t {
+	case TCPTypeActive:
+		return 6
+	case TCPTypePassive:
+		return 4
+	case TCPTypeSimultaneousOpen:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// peerTCPType returns the TCPType a remote candidate must have to be paired with t,
+// this is also the type of a peer reflexive candidate learned on a t candidate.
+// https://tools.ietf.org/html/rfc6544#section-6.2
+func (t TCPType) peerTCPType() TCPType {
+	switch t {
+	case TCPTypeActive:
+		return TCPTypePassive
+	case TCPTypePassive:
+		return TCPTypeActive
+	default:
+		return t
+	}
+}
+
+// tcpTypesCompatible returns true if local and remote may form a candidate pair.
+// An active candidate is only paired with a passive one and vice versa, Simultaneous
+// open candidates are only paired with each other. Candidates without a TCPType
+// (e.g UDP or signaled without the tcptype attribute) are always paired.
+func tcpTypesCompatible(local, remote Candidate) bool {
+	if local.TCPType() == TCPTypeUnspecified || remote.TCPType() == TCPTypeUnspecified {
+		return true
+	}
+	return local.TCPType().peerTCPType() == remote.TCPType()
+}
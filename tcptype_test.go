@@ -0,0 +1,62 @@
+package ice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPType(t *testing.T) {
+	var tcpType TCPType
+
+	assert.Equal(t, TCPTypeUnspecified, tcpType)
+	assert.Equal(t, TCPTypeActive, NewTCPType("active"))
+	assert.Equal(t, TCPTypePassive, NewTCPType("passive"))
+	assert.Equal(t, TCPTypeSimultaneousOpen, NewTCPType("so"))
+	assert.Equal(t, TCPTypeUnspecified, NewTCPType("something else"))
+
+	assert.Equal(t, "", TCPTypeUnspecified.String())
+	assert.Equal(t, "active", TCPTypeActive.String())
+	assert.Equal(t, "passive", TCPTypePassive.String())
+	assert.Equal(t, "so", TCPTypeSimultaneousOpen.String())
+	assert.Equal(t, "Unknown", TCPType(-1).String())
+}
+
+func TestTCPTypesCompatible(t *testing.T) {
+	newHost := func(tcpType TCPType) Candidate {
+		c, err := NewCandidateHost(&CandidateHostConfig{
+			Network: tcp,
+			Address: "192.168.0.2",
+			Port:    9,
+			TCPType: tcpType,
+		})
+		assert.NoError(t, err)
+		return c
+	}
+
+	active := newHost(TCPTypeActive)
+	passive := newHost(TCPTypePassive)
+	so := newHost(TCPTypeSimultaneousOpen)
+	unspecified := newHost(TCPTypeUnspecified)
+
+	assert.True(t, tcpTypesCompatible(active, passive))
+	assert.True(t, tcpTypesCompatible(passive, active))
+	assert.True(t, tcpTypesCompatible(so, so))
+	assert.True(t, tcpTypesCompatible(unspecified, active))
+
+	assert.False(t, tcpTypesCompatible(active, active))
+	assert.False(t, tcpTypesCompatible(passive, passive))
+	assert.False(t, tcpTypesCompatible(active, so))
+
+	// Active candidates are preferred, and every TCP candidate is less preferred than UDP
+	assert.Greater(t, active.Priority(), passive.Priority())
+	assert.Greater(t, passive.Priority(), so.Priority())
+
+	udpHost, err := NewCandidateHost(&CandidateHostConfig{
+		Network: udp,
+		Address: "192.168.0.2",
+		Port:    9,
+	})
+	assert.NoError(t, err)
+	assert.Greater(t, udpHost.Priority(), active.Priority())
+}
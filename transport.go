@@ -3,44 +3,405 @@ package ice
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
-	"sync/atomic"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pion/stun"
+	"github.com/pion/transport/deadline"
 )
 
+// writeInboundPacket buffers data for Conn.ReadFrom and Conn.ReadFromPair, it
+// was received on the pair of local and remote
+func writeInboundPacket(buffer *packetBuffer, data []byte, local, remote Candidate) error {
+	_, err := buffer.writeFrom(append([]byte{}, data...), local, remote)
+	return err
+}
+
+// readInboundPacket reads a packet buffered by writeInboundPacket into p, with
+// its pair and the address of the remote candidate it came from. Like
+// packetBuffer.Read, the packet stays buffered if it doesn't fit in p.
+func readInboundPacket(buffer *packetBuffer, p []byte) (int, net.Addr, Candidate, Candidate, error) {
+	n, local, remote, err := buffer.readFrom(p)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+
+	var addr net.Addr
+	if remote != nil {
+		if remoteAddr := remote.addr(); remoteAddr != nil {
+			addr = createAddr(remote.NetworkType(), remoteAddr.IP, remoteAddr.Port)
+		}
+	}
+
+	return n, addr, local, remote, nil
+}
+
 // Dial connects to the remote agent, acting as the controlling ice agent.
-// Dial blocks until at least one ice candidate pair has successfully connected.
+// Dial blocks until at least one ice candidate pair has successfully connected
+// for every component, and returns the Conn of ComponentRTP.
 func (a *Agent) Dial(ctx context.Context, remoteUfrag, remotePwd string) (*Conn, error) {
-	return a.connect(ctx, true, remoteUfrag, remotePwd)
+	conns, err := a.connect(ctx, true, remoteUfrag, remotePwd)
+	if err != nil {
+		return nil, err
+	}
+	return conns[0], nil
 }
 
 // Accept connects to the remote agent, acting as the controlled ice agent.
-// Accept blocks until at least one ice candidate pair has successfully connected.
+// Accept blocks until at least one ice candidate pair has successfully connected
+// for every component, and returns the Conn of ComponentRTP.
 func (a *Agent) Accept(ctx context.Context, remoteUfrag, remotePwd string) (*Conn, error) {
+	conns, err := a.connect(ctx, false, remoteUfrag, remotePwd)
+	if err != nil {
+		return nil, err
+	}
+	return conns[0], nil
+}
+
+// DialComponents is Dial for an Agent with multiple components, it returns
+// a Conn for every component indexed by component ID - 1.
+func (a *Agent) DialComponents(ctx context.Context, remoteUfrag, remotePwd string) ([]*Conn, error) {
+	return a.connect(ctx, true, remoteUfrag, remotePwd)
+}
+
+// AcceptComponents is Accept for an Agent with multiple components, it returns
+// a Conn for every component indexed by component ID - 1.
+func (a *Agent) AcceptComponents(ctx context.Context, remoteUfrag, remotePwd string) ([]*Conn, error) {
 	return a.connect(ctx, false, remoteUfrag, remotePwd)
 }
 
-// Conn represents the ICE connection.
+// TryExistingPair checks the pair of local and remote once, and selects it
+// as soon as the check succeeds, e.g. to resume on the pair used before a
+// network blip or an ICE restart without waiting for the other checks. The
+// controlling Agent nominates the pair with the check. The Agent must have
+// been started by Dial or Accept.
+//
+// After Restart, local and remote may be the candidates of the pair selected
+// before: remote is added again, and the pair is adopted by the candidate
+// gathered again at the address of local. It is checked with the current
+// credentials, so the remote credentials must be set again first.
+//
+// If local was not gathered again, or no success response is received within
+// a second, TryExistingPair keeps connecting like Dial or Accept, and returns
+// once the other connectivity checks selected a pair for every component.
+func (a *Agent) TryExistingPair(ctx context.Context, local, remote Candidate) (*Conn, error) {
+	select {
+	case <-a.startedCh:
+	default:
+		return nil, ErrAgentNotStarted
+	}
+
+	waiter := checkWaiter{local: local, remote: remote, result: make(chan CheckResult, 1)}
+	var checking bool
+	if err := a.run(func(agent *Agent) {
+		p := agent.findPair(local, remote)
+		if p == nil && agent.findLocalCandidate(local) != nil {
+			// Restart cleared the checklist, pair the remote candidate again
+			agent.addRemoteCandidate(remote)
+			p = agent.findPair(local, remote)
+		}
+		if p == nil {
+			return
+		}
+		checking = true
+		agent.checkWaiters = append(agent.checkWaiters, waiter)
+
+		if s := agent.getControllingSelector(); s != nil {
+			s.startNomination(p)
+		} else {
+			agent.selector.PingCandidate(p.local, p.remote)
+		}
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	if checking {
+		selected, err := a.awaitExistingPair(ctx, waiter)
+		if err != nil {
+			return nil, err
+		} else if selected {
+			return newConn(a, local.Component()), nil
+		}
+	} else {
+		a.log.Debugf("No pair of %s and %s to check, waiting for the connectivity checks", local, remote)
+	}
+
+	if err := a.WaitUntilConnected(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrCanceledByCaller
+		}
+		return nil, err
+	}
+	return newConn(a, local.Component()), nil
+}
+
+// awaitExistingPair waits for the check of TryExistingPair, and selects its
+// pair once it succeeded. It returns false when the check failed or timed out.
+func (a *Agent) awaitExistingPair(ctx context.Context, waiter checkWaiter) (bool, error) {
+	timer := a.clock.NewTimer(existingPairCheckTimeout)
+	defer timer.Stop()
+
+	var result CheckResult
+	select {
+	case <-a.done:
+		return false, a.getErr()
+	case <-ctx.Done():
+		a.removeCheckWaiter(waiter)
+		return false, ErrCanceledByCaller
+	case <-timer.C():
+		a.removeCheckWaiter(waiter)
+		result = CheckResultTimeout
+	case result = <-waiter.result:
+	}
+	if result != CheckResultSuccess {
+		a.log.Debugf("Check of the existing pair %s <-> %s failed: %s", waiter.local, waiter.remote, result)
+		return false, nil
+	}
+
+	var selected bool
+	if err := a.run(func(agent *Agent) {
+		if p := agent.findPair(waiter.local, waiter.remote); p != nil && p.state == CandidatePairStateSucceeded {
+			agent.setSelectedPair(p)
+			selected = true
+		}
+	}, nil); err != nil {
+		return false, err
+	}
+	return selected, nil
+}
+
+// removeCheckWaiter stops notifying w, once its caller stopped waiting
+func (a *Agent) removeCheckWaiter(w checkWaiter) {
+	if err := a.run(func(agent *Agent) {
+		for i := range agent.checkWaiters {
+			if agent.checkWaiters[i].result == w.result {
+				agent.checkWaiters = append(agent.checkWaiters[:i], agent.checkWaiters[i+1:]...)
+				return
+			}
+		}
+	}, nil); err != nil {
+		a.log.Warnf("Failed to remove check waiter: %v", err)
+	}
+}
+
+// Conn represents the ICE connection of a single component.
 // At the moment the lifetime of the Conn is equal to the Agent.
+//
+// A Conn has datagram semantics like a net.UDPConn, e.g. for DTLS: every
+// Read returns a single received packet, and every Write is sent as a single
+// packet. Packets are never coalesced or split.
 type Conn struct {
-	bytesReceived uint64
-	bytesSent     uint64
-	agent         *Agent
+	agent     *Agent
+	component uint16
+
+	countersMu sync.Mutex
+	counters   ConnCounters
+	// packetsSent and packetsReceived are counted with counters for Stats
+	packetsSent     uint64
+	packetsReceived uint64
+	// pairBaselines are the counters of every pair when ResetCounters was last called
+	pairBaselines map[*candidatePair]ConnCounters
+
+	// deadlineMu serializes the deadline setters, so that SetDeadline sets
+	// both deadlines at once
+	deadlineMu    sync.Mutex
+	writeDeadline *deadline.Deadline
+
+	writableMu sync.Mutex
+	onWritable func()
+	// waitingWritable is set while a goroutine waits for the socket TryWrite
+	// returned ErrWouldBlock for to drain
+	waitingWritable bool
+
+	limiterMu   sync.Mutex
+	limiter     *tokenBucket
+	limitPolicy RateLimitPolicy
+}
+
+// ConnCounters is a snapshot of the data traffic counters of a Conn
+type ConnCounters struct {
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// CandidatePairCounters are the data bytes that flowed over a candidate pair
+type CandidatePairCounters struct {
+	CandidatePair
+	ConnCounters
+}
+
+func newConn(a *Agent, component uint16) *Conn {
+	return &Conn{
+		agent:         a,
+		component:     component,
+		writeDeadline: deadline.New(),
+	}
+}
+
+// Component returns the ID of the component the Conn sends and receives on
+func (c *Conn) Component() uint16 {
+	return c.component
+}
+
+// timeoutError is returned by Conn operations that exceed their deadline.
+// It implements net.Error so callers can check Timeout().
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// GetSelectedCandidatePair returns the selected candidate pair of the component
+// of the Conn, or nil if no pair has been selected yet
+func (c *Conn) GetSelectedCandidatePair() (*CandidatePair, error) {
+	return c.agent.getSelectedCandidatePair(c.component)
+}
+
+// RTT returns the smoothed round-trip time of the selected candidate pair, which
+// is updated by every response to the connectivity and consent checks sent on it.
+// It is 0 until a pair is selected and a response was received on it.
+func (c *Conn) RTT() time.Duration {
+	p := c.agent.getComponentSelectedPair(c.component)
+	if p == nil {
+		return 0
+	}
+	return p.rtt()
+}
+
+// SyscallConn returns the raw conn of the socket of the local candidate of the
+// selected candidate pair, to set socket options the Agent doesn't expose.
+// ErrNoCandidatePairs is returned until a pair is selected. The socket changes
+// when another pair is selected, like after a renomination or an ICE restart,
+// so the options set on it don't apply to the pairs selected later.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	p := c.agent.getComponentSelectedPair(c.component)
+	if p == nil {
+		return nil, ErrNoCandidatePairs
+	}
+	return p.local.syscallConn()
+}
+
+// MTU returns the largest packet Write sends on the selected candidate pair,
+// AgentConfig.MaxPacketSize less the overhead of the TURN framing on relay
+// pairs, which is lower once a channel is bound. It is MaxPacketSize while no
+// pair is selected.
+func (c *Conn) MTU() int {
+	p := c.agent.getComponentSelectedPair(c.component)
+	if p == nil {
+		return c.agent.maxPacketSize
+	}
+	return c.agent.maxPacketSize - p.turnOverhead()
+}
+
+// File returns a duplicate of the UDP socket of the local candidate of the
+// selected candidate pair, e.g. to hand the flow to another process. The caller
+// owns the file and must close it, the Agent keeps using its own descriptor.
+// Both share the socket, a packet read through the file isn't read by the
+// Agent. ErrFileNotSupported is returned for the candidates that don't have a
+// UDP socket of their own, like relay, TCP and UDPMux candidates.
+func (c *Conn) File() (*os.File, error) {
+	p := c.agent.getComponentSelectedPair(c.component)
+	if p == nil {
+		return nil, ErrNoCandidatePairs
+	}
+	return p.local.file()
 }
 
 // BytesSent returns the number of bytes sent
 func (c *Conn) BytesSent() uint64 {
-	return atomic.LoadUint64(&c.bytesSent)
+	return c.Counters().BytesSent
 }
 
 // BytesReceived returns the number of bytes received
 func (c *Conn) BytesReceived() uint64 {
-	return atomic.LoadUint64(&c.bytesReceived)
+	return c.Counters().BytesReceived
+}
+
+// PacketsDropped returns the number of packets received on the component of
+// the Conn that were dropped, because the Conn was not read fast enough to keep
+// AgentConfig.MaxBufferSize bytes or less buffered
+func (c *Conn) PacketsDropped() uint64 {
+	return c.agent.getBuffer(c.component).Dropped()
+}
+
+// Counters returns the bytes sent and received since the Conn was created, or
+// since the last ResetCounters. Both are read at once so their ratio is consistent.
+func (c *Conn) Counters() ConnCounters {
+	c.countersMu.Lock()
+	defer c.countersMu.Unlock()
+
+	return c.counters
 }
 
-func (a *Agent) connect(ctx context.Context, isControlling bool, remoteUfrag, remotePwd string) (*Conn, error) {
+// ResetCounters resets the counters of Counters, PairCounters and Stats to 0, and returns
+// the Counters it reset so that no traffic is lost between reading and resetting.
+func (c *Conn) ResetCounters() (ConnCounters, error) {
+	pairs, err := c.agent.getPairCounters(c.component)
+	if err != nil {
+		return ConnCounters{}, err
+	}
+
+	c.countersMu.Lock()
+	defer c.countersMu.Unlock()
+
+	counters := c.counters
+	c.counters = ConnCounters{}
+	c.packetsSent, c.packetsReceived = 0, 0
+	c.pairBaselines = make(map[*candidatePair]ConnCounters, len(pairs))
+	for _, p := range pairs {
+		c.pairBaselines[p.pair] = p.ConnCounters
+	}
+	return counters, nil
+}
+
+// PairCounters breaks the traffic of the Conn down by the candidate pairs it flowed
+// over since the last ResetCounters, e.g. to tell relayed from direct traffic.
+// Bytes are counted on a pair when they are sent, or received from the network.
+func (c *Conn) PairCounters() ([]CandidatePairCounters, error) {
+	pairs, err := c.agent.getPairCounters(c.component)
+	if err != nil {
+		return nil, err
+	}
+
+	c.countersMu.Lock()
+	defer c.countersMu.Unlock()
+
+	result := make([]CandidatePairCounters, 0, len(pairs))
+	for _, p := range pairs {
+		baseline := c.pairBaselines[p.pair]
+		result = append(result, CandidatePairCounters{
+			CandidatePair: CandidatePair{Local: p.pair.local, Remote: p.pair.remote},
+			ConnCounters: ConnCounters{
+				BytesSent:     p.BytesSent - baseline.BytesSent,
+				BytesReceived: p.BytesReceived - baseline.BytesReceived,
+			},
+		})
+	}
+	return result, nil
+}
+
+// addPacketReceived counts a packet of n bytes read from the Conn
+func (c *Conn) addPacketReceived(n int) {
+	c.countersMu.Lock()
+	c.counters.BytesReceived += uint64(n)
+	c.packetsReceived++
+	c.countersMu.Unlock()
+}
+
+// addPacketSent counts a packet of n bytes written on the Conn
+func (c *Conn) addPacketSent(n int) {
+	c.countersMu.Lock()
+	c.counters.BytesSent += uint64(n)
+	c.packetsSent++
+	c.countersMu.Unlock()
+}
+
+func (a *Agent) connect(ctx context.Context, isControlling bool, remoteUfrag, remotePwd string) ([]*Conn, error) {
 	err := a.ok()
 	if err != nil {
 		return nil, err
@@ -57,54 +418,203 @@ func (a *Agent) connect(ctx context.Context, isControlling bool, remoteUfrag, re
 	case <-ctx.Done():
 		// TODO: Stop connectivity checks?
 		return nil, ErrCanceledByCaller
+	case <-a.onConnectionTimeout:
+		if a.relayOnly && a.FailureReason() == FailureReasonGatheringFailed {
+			return nil, ErrRelayGatheringFailed
+		}
+		return nil, ErrConnectionTimeout
 	case <-a.onConnected:
 	}
 
-	return &Conn{
-		agent: a,
-	}, nil
+	conns := make([]*Conn, 0, a.components)
+	for component := uint16(1); component <= a.components; component++ {
+		conns = append(conns, newConn(a, component))
+	}
+	return conns, nil
 }
 
-// Read implements the Conn Read method.
+// Read implements the Conn Read method. It reads the payload of a single
+// received packet into p, or returns io.ErrShortBuffer without discarding
+// the packet if p is too small for it. Packets are at most 8192 bytes long.
 func (c *Conn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+// ReadFrom reads a packet like Read, and returns the address of the remote
+// candidate it was received from.
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, _, _, err := c.read(p)
+	return n, addr, err
+}
+
+// ReadFromPair reads a packet like Read, and returns the local and the remote
+// candidate of the pair it was received on. It may differ from the selected
+// pair, e.g. when the routing is asymmetric, see GetReceivingCandidatePair.
+func (c *Conn) ReadFromPair(p []byte) (n int, local, remote Candidate, err error) {
+	n, _, local, remote, err = c.read(p)
+	return n, local, remote, err
+}
+
+// read reads a packet for Read, ReadFrom and ReadFromPair
+func (c *Conn) read(p []byte) (int, net.Addr, Candidate, Candidate, error) {
 	err := c.agent.ok()
 	if err != nil {
-		return 0, err
+		return 0, nil, nil, nil, err
 	}
 
-	n, err := c.agent.buffer.Read(p)
-	atomic.AddUint64(&c.bytesReceived, uint64(n))
-	return n, err
+	n, addr, local, remote, err := readInboundPacket(c.agent.getBuffer(c.component), p)
+	if err == io.EOF {
+		// The buffer is closed with the Agent
+		if closeErr := c.agent.ok(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		c.addPacketReceived(n)
+	}
+	return n, addr, local, remote, err
 }
 
 // Write implements the Conn Write method.
 func (c *Conn) Write(p []byte) (int, error) {
+	return c.write(p, nil)
+}
+
+// WriteTo writes a packet like Write, addr must be the remote address of the
+// selected candidate pair, or of a valid pair while none is selected (e.g.
+// during an ICE restart). Any other address returns ErrWriteToUnselectedRemote.
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr == nil {
+		return 0, ErrWriteToUnselectedRemote
+	}
+	return c.write(p, addr)
+}
+
+// WriteBatch writes the packets of ps like as many calls to Write, and returns
+// the number of packets written. With AgentConfig.BatchWrites set, the packets
+// sent from a host UDP candidate take a single sendmmsg system call on Linux,
+// e.g. 1 instead of 64 sendto calls for a burst of 64 RTP packets.
+func (c *Conn) WriteBatch(ps [][]byte) (int, error) {
+	pair, err := c.writePair(ps, nil)
+	if pair == nil {
+		return 0, err
+	}
+
+	size := 0
+	for _, p := range ps {
+		size += len(p)
+	}
+	if err = c.limit(size, true); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for {
+		n, err := pair.writeBatch(ps[written:], c.agent.batchWrites)
+		for _, p := range ps[written : written+n] {
+			c.addPacketSent(len(p))
+		}
+		written += n
+		if err == nil || !c.failover(pair, err) {
+			return written, err
+		}
+
+		// The remaining packets are sent on another pair, if any is valid
+		if next, _ := c.writePair(ps[written:], nil); next != nil {
+			pair = next
+		} else {
+			return written, err
+		}
+	}
+}
+
+// write sends p over the selected pair, or the best valid pair when none is
+// selected. If addr is set the pair must have it as remote address. When the
+// network of the pair is unavailable, e.g. its interface went down, the pair
+// fails and p is sent on another valid pair; the error is only returned when
+// none is left.
+func (c *Conn) write(p []byte, addr net.Addr) (int, error) {
+	pair, err := c.writePair([][]byte{p}, addr)
+	if pair == nil {
+		return 0, err
+	}
+	if err = c.limit(len(p), true); err != nil {
+		return 0, err
+	}
+
+	c.addPacketSent(len(p))
+	for {
+		n, err := pair.Write(p)
+		if err == nil || !c.failover(pair, err) {
+			return n, err
+		}
+
+		if next, _ := c.writePair([][]byte{p}, addr); next != nil {
+			pair = next
+		} else {
+			return n, err
+		}
+	}
+}
+
+// writePair returns the pair that ps are sent on, see write. It returns a nil
+// pair and error when no pair is valid yet.
+func (c *Conn) writePair(ps [][]byte, addr net.Addr) (*candidatePair, error) {
 	err := c.agent.ok()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	if stun.IsMessage(p) {
-		return 0, errors.New("the ICE conn can't write STUN messages")
+	for _, p := range ps {
+		if stun.IsMessage(p) {
+			return nil, errors.New("the ICE conn can't write STUN messages")
+		}
+	}
+
+	select {
+	case <-c.writeDeadline.Done():
+		return nil, &timeoutError{}
+	default:
 	}
 
-	pair := c.agent.getSelectedPair()
+	pair := c.agent.getComponentSelectedPair(c.component)
 	if pair == nil {
 		bestValidPair := make(chan *candidatePair, 1)
 		if err = c.agent.run(func(a *Agent) {
-			bestValidPair <- a.getBestValidCandidatePair()
-		}, nil); err != nil {
-			return 0, err
+			if addr == nil {
+				bestValidPair <- a.getBestValidCandidatePair(c.component)
+			} else {
+				bestValidPair <- a.getValidCandidatePairTo(c.component, addr)
+			}
+		}, c.writeDeadline.Done()); err != nil {
+			if err == ErrRunCanceled {
+				return nil, &timeoutError{}
+			}
+			return nil, err
 		}
 
 		pair = <-bestValidPair
 		if pair == nil {
-			return 0, err
+			if addr != nil {
+				return nil, ErrWriteToUnselectedRemote
+			}
+			return nil, err
 		}
 	}
 
-	atomic.AddUint64(&c.bytesSent, uint64(len(p)))
-	return pair.Write(p)
+	if addr != nil && !addrEqual(addr, createAddr(pair.remote.NetworkType(), pair.remote.addr().IP, pair.remote.Port())) {
+		return nil, ErrWriteToUnselectedRemote
+	}
+
+	mtu := c.agent.maxPacketSize - pair.turnOverhead()
+	for _, p := range ps {
+		if len(p) > mtu {
+			return nil, fmt.Errorf("%w: %d bytes, the MTU is %d", ErrPacketTooLarge, len(p), mtu)
+		}
+	}
+
+	return pair, nil
 }
 
 // Close implements the Conn Close method. It is used to close
@@ -115,27 +625,58 @@ func (c *Conn) Close() error {
 
 // TODO: Maybe just switch to using io.ReadWriteCloser?
 
-// LocalAddr is a stub
+// LocalAddr returns the local address of the selected candidate pair.
+// If no pair has been selected yet an unspecified address is returned.
 func (c *Conn) LocalAddr() net.Addr {
-	return nil
+	pair := c.agent.getComponentSelectedPair(c.component)
+	if pair == nil {
+		return &net.UDPAddr{IP: net.IPv4zero}
+	}
+
+	return createAddr(pair.local.NetworkType(), pair.local.addr().IP, pair.local.Port())
 }
 
-// RemoteAddr is a stub
+// RemoteAddr returns the remote address of the selected candidate pair.
+// If no pair has been selected yet an unspecified address is returned.
 func (c *Conn) RemoteAddr() net.Addr {
-	return nil
+	pair := c.agent.getComponentSelectedPair(c.component)
+	if pair == nil {
+		return &net.UDPAddr{IP: net.IPv4zero}
+	}
+
+	return createAddr(pair.remote.NetworkType(), pair.remote.addr().IP, pair.remote.Port())
 }
 
-// SetDeadline is a stub
+// SetDeadline sets both the read and write deadlines associated with the Conn.
+// Both are set at once, a concurrent SetReadDeadline or SetWriteDeadline is
+// applied either before or after them.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	if err := c.agent.getBuffer(c.component).SetReadDeadline(t); err != nil {
+		return err
+	}
+	c.writeDeadline.Set(t)
 	return nil
 }
 
-// SetReadDeadline is a stub
+// SetReadDeadline sets the deadline for future Read and ReadFrom calls and any
+// currently-blocked Read call. A zero value for t means Read will not time out.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return nil
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	return c.agent.getBuffer(c.component).SetReadDeadline(t)
 }
 
-// SetWriteDeadline is a stub
+// SetWriteDeadline sets the deadline for future Write calls and any
+// Write call currently waiting on the Agent. A zero value for t means
+// Write will not time out.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.writeDeadline.Set(t)
 	return nil
 }
@@ -3,14 +3,25 @@
 package ice
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pion/stun"
 	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func TestStressDuplex(t *testing.T) {
@@ -104,6 +115,43 @@ func TestTimeout(t *testing.T) {
 	})
 }
 
+func TestConnectionTimeout(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	connectionTimeout := 500 * time.Millisecond
+	a, err := NewAgent(&AgentConfig{ConnectionTimeout: &connectionTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := make(chan struct{})
+	if err = a.OnConnectionStateChange(func(c ConnectionState) {
+		if c == ConnectionStateFailed {
+			close(failed)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote never answers, Dial gives up on its own
+	start := time.Now()
+	if _, err = a.Dial(context.Background(), "ufrag", "passwordpasswordpassword"); !errors.Is(err, ErrConnectionTimeout) {
+		t.Fatalf("Dial returned %v, expected %v", err, ErrConnectionTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < connectionTimeout {
+		t.Fatalf("Dial timed out after %s, before %s", elapsed, connectionTimeout)
+	}
+	<-failed
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestReadClosed(t *testing.T) {
 	// Check for leaking routines
 	report := test.CheckRoutines(t)
@@ -194,14 +242,14 @@ func gatherAndExchangeCandidates(aAgent, bAgent *Agent) {
 			wg.Done()
 		}
 	}))
-	check(aAgent.GatherCandidates())
+	check(aAgent.GatherCandidates(context.Background()))
 
 	check(bAgent.OnCandidate(func(candidate Candidate) {
 		if candidate == nil {
 			wg.Done()
 		}
 	}))
-	check(bAgent.GatherCandidates())
+	check(bAgent.GatherCandidates(context.Background()))
 
 	wg.Wait()
 
@@ -256,6 +304,7 @@ func pipe(defaultConfig *AgentConfig) (*Conn, *Conn) {
 
 	cfg.Urls = urls
 	cfg.NetworkTypes = supportedNetworkTypes
+	cfg.AllowPrivateRemoteCandidates = true
 
 	aAgent, err := NewAgent(cfg)
 	check(err)
@@ -287,6 +336,8 @@ func pipeWithTimeout(disconnectTimeout time.Duration, iceKeepalive time.Duration
 		DisconnectedTimeout: &disconnectTimeout,
 		KeepaliveInterval:   &iceKeepalive,
 		NetworkTypes:        supportedNetworkTypes,
+
+		AllowPrivateRemoteCandidates: true,
 	}
 
 	aAgent, err := NewAgent(cfg)
@@ -314,10 +365,11 @@ func copyCandidate(o Candidate) (c Candidate) {
 	case *CandidateHost:
 		config := CandidateHostConfig{
 			CandidateID: candidateID,
-			Network:     udp,
+			Network:     orig.NetworkType().NetworkShort(),
 			Address:     orig.address,
 			Port:        orig.port,
 			Component:   orig.component,
+			TCPType:     orig.tcpType,
 		}
 		c, err = NewCandidateHost(&config)
 	case *CandidateServerReflexive:
@@ -425,3 +477,1407 @@ func TestConnStats(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestConnRTT(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt := newConn(a, ComponentRTP).RTT(); rtt != 0 {
+		t.Fatalf("Expected no RTT before a pair is selected, got %v", rtt)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Consent checks keep the RTT of the selected pair up to date
+	consentCheckInterval := 50 * time.Millisecond
+	ca, cb := pipe(&AgentConfig{ConsentCheckInterval: &consentCheckInterval})
+	for ca.RTT() == 0 || cb.RTT() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPacketTrace(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	type tracedPacket struct {
+		dir           Direction
+		data          string
+		local, remote string
+	}
+	var mu sync.Mutex
+	var traced []tracedPacket
+	ca, cb := pipe(&AgentConfig{
+		PacketTrace: func(dir Direction, data []byte, local, remote net.Addr) {
+			mu.Lock()
+			traced = append(traced, tracedPacket{dir, string(data), local.String(), remote.String()})
+			mu.Unlock()
+		},
+	})
+
+	if _, err := ca.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cb.Read(make([]byte, receiveMTU)); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := ca.agent.GetSelectedCandidatePair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aAddr := net.JoinHostPort(pair.Local.Address(), strconv.Itoa(pair.Local.Port()))
+	bAddr := net.JoinHostPort(pair.Remote.Address(), strconv.Itoa(pair.Remote.Port()))
+
+	mu.Lock()
+	var stunPackets int
+	expected := map[tracedPacket]bool{
+		{DirectionOutbound, "hello", aAddr, bAddr}: false,
+		{DirectionInbound, "hello", bAddr, aAddr}:  false,
+	}
+	for _, p := range traced {
+		if _, ok := expected[p]; ok {
+			expected[p] = true
+		} else if stun.IsMessage([]byte(p.data)) {
+			stunPackets++
+		}
+	}
+	mu.Unlock()
+
+	for p, seen := range expected {
+		if !seen {
+			t.Fatalf("%s packet from %s to %s not traced", p.dir, p.local, p.remote)
+		}
+	}
+	if stunPackets == 0 {
+		t.Fatal("Expected the connectivity checks to be traced")
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnLinkLocal(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	addrs, err := localAddrs(vnet.NewNet(nil), nil, isIPv6LinkLocal, []NetworkType{NetworkTypeUDP6})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addrs) == 0 {
+		t.Skip("no IPv6 link-local address to gather host candidates on")
+	}
+
+	// Only the link-local candidates are gathered, with the zone of their interface
+	ca, cb := pipe(&AgentConfig{IPFilter: isIPv6LinkLocal})
+	pair, err := ca.GetSelectedCandidatePair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pair.Local.Address(), "%") || !strings.Contains(pair.Remote.Address(), "%") {
+		t.Fatalf("Expected a pair of link-local candidates with zones, got %s", pair)
+	}
+
+	if _, err = ca.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	n, err := cb.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(buf[:n]) != "hello" {
+		t.Fatalf("Expected hello, got %q", buf[:n])
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnResetCounters(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	ca, cb := pipe(nil)
+	buf := make([]byte, receiveMTU)
+
+	exchange := func(n int) {
+		if _, err := ca.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cb.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exchange(10)
+	counters, err := ca.ResetCounters()
+	if err != nil {
+		t.Fatal(err)
+	} else if counters != (ConnCounters{BytesSent: 10}) {
+		t.Fatalf("unexpected counters before reset %+v", counters)
+	} else if counters = ca.Counters(); counters != (ConnCounters{}) {
+		t.Fatalf("expected counters to be reset, got %+v", counters)
+	}
+
+	exchange(20)
+	if counters = ca.Counters(); counters.BytesSent != 20 {
+		t.Fatalf("expected 20 bytes sent since reset, got %+v", counters)
+	} else if counters = cb.Counters(); counters.BytesReceived != 30 {
+		t.Fatalf("expected 30 bytes received, got %+v", counters)
+	}
+
+	// All the traffic flowed over the selected pair
+	for _, c := range []*Conn{ca, cb} {
+		pairs, err := c.PairCounters()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		selectedPair := c.agent.getSelectedPair()
+		var total ConnCounters
+		for _, p := range pairs {
+			total.BytesSent += p.BytesSent
+			total.BytesReceived += p.BytesReceived
+			if (p.BytesSent != 0 || p.BytesReceived != 0) && (p.Local != selectedPair.local || p.Remote != selectedPair.remote) {
+				t.Fatalf("traffic counted on %s which is not selected", p.CandidatePair)
+			}
+		}
+
+		if c == ca && total != (ConnCounters{BytesSent: 20}) {
+			t.Fatalf("unexpected pair counters since reset %+v", total)
+		} else if c == cb && total != (ConnCounters{BytesReceived: 30}) {
+			t.Fatalf("unexpected pair counters %+v", total)
+		}
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnDSCP(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	ca, cb := pipe(nil)
+
+	if err := ca.agent.SetDSCP(64); !errors.Is(err, ErrInvalidDSCP) {
+		t.Fatalf("SetDSCP(64) returned %v, expected %v", err, ErrInvalidDSCP)
+	}
+	if err := ca.agent.SetDSCP(46); err != nil {
+		t.Fatal(err)
+	}
+
+	host, ok := ca.agent.getSelectedPair().local.(*CandidateHost)
+	if !ok {
+		t.Fatal("the selected local candidate must be a host candidate")
+	}
+
+	var tos int
+	var err error
+	if host.NetworkType().IsIPv6() {
+		tos, err = ipv6.NewPacketConn(host.conn).TrafficClass()
+	} else {
+		tos, err = ipv4.NewPacketConn(host.conn).TOS()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tos != 46<<2 {
+		t.Fatalf("TOS is %d, expected %d", tos, 46<<2)
+	}
+
+	// Writes keep working on the marked socket
+	if _, err = ca.Write([]byte("marked")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, receiveMTU)
+	n, err := cb.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "marked" {
+		t.Fatalf("received %q", buf[:n])
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnSyscallConn(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newConn(a, ComponentRTP).SyscallConn(); !errors.Is(err, ErrNoCandidatePairs) {
+		t.Fatalf("SyscallConn returned %v before a pair is selected, expected %v", err, ErrNoCandidatePairs)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, cb := pipe(nil)
+
+	fd := func(rawConn syscall.RawConn) (fd uintptr) {
+		if controlErr := rawConn.Control(func(f uintptr) { fd = f }); controlErr != nil {
+			t.Fatal(controlErr)
+		}
+		return fd
+	}
+
+	rawConn, err := ca.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, ok := ca.agent.getSelectedPair().local.(*CandidateHost).conn.(syscall.Conn)
+	if !ok {
+		t.Fatal("the selected local candidate must have an OS socket")
+	}
+	socketRawConn, err := socket.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd(rawConn) != fd(socketRawConn) {
+		t.Fatal("SyscallConn must return the socket of the selected local candidate")
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnMTU(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	for _, size := range []int{-1, receiveMTU + 1} {
+		if _, err := NewAgent(&AgentConfig{MaxPacketSize: size}); !errors.Is(err, ErrInvalidMaxPacketSize) {
+			t.Fatalf("NewAgent returned %v for a max packet size of %d, expected %v", err, size, ErrInvalidMaxPacketSize)
+		}
+	}
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu := newConn(a, ComponentRTP).MTU(); mtu != defaultMaxPacketSize {
+		t.Fatalf("MTU is %d before a pair is selected, expected %d", mtu, defaultMaxPacketSize)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, cb := pipe(&AgentConfig{MaxPacketSize: 1000})
+	if mtu := ca.MTU(); mtu != 1000 {
+		t.Fatalf("MTU of a host pair is %d, expected the max packet size", mtu)
+	}
+
+	if _, err = ca.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if n, readErr := cb.Read(make([]byte, receiveMTU)); readErr != nil || n != 1000 {
+		t.Fatalf("read %d bytes (%v), expected the 1000 bytes packet", n, readErr)
+	}
+
+	if _, err = ca.Write(make([]byte, 1001)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("Write returned %v for a packet larger than the MTU, expected %v", err, ErrPacketTooLarge)
+	}
+	if n, batchErr := ca.WriteBatch([][]byte{make([]byte, 10), make([]byte, 1001)}); n != 0 || !errors.Is(batchErr, ErrPacketTooLarge) {
+		t.Fatalf("WriteBatch wrote %d packets (%v), expected none and %v", n, batchErr, ErrPacketTooLarge)
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnFile(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newConn(a, ComponentRTP).File(); !errors.Is(err, ErrNoCandidatePairs) {
+		t.Fatalf("File returned %v before a pair is selected, expected %v", err, ErrNoCandidatePairs)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	relay, err := NewCandidateRelay(&CandidateRelayConfig{Network: "udp", Address: "1.2.3.4", Port: 5000, Component: ComponentRTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = relay.file(); !errors.Is(err, ErrFileNotSupported) {
+		t.Fatalf("file of a relay candidate returned %v, expected %v", err, ErrFileNotSupported)
+	}
+
+	ca, cb := pipe(nil)
+
+	f, err := ca.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The address of the file carries the zone of a link-local IP
+	fileAddr, localAddr := pc.LocalAddr().(*net.UDPAddr), ca.LocalAddr().(*net.UDPAddr)
+	if !fileAddr.IP.Equal(localAddr.IP) || fileAddr.Port != localAddr.Port {
+		t.Fatalf("File is bound to %s, expected the selected local address %s", pc.LocalAddr(), ca.LocalAddr())
+	}
+
+	// The remote receives the packets sent on the duplicate, and the Agent
+	// keeps its socket once it is closed
+	read := func(expected string) {
+		buf := make([]byte, receiveMTU)
+		n, readErr := cb.Read(buf)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("read %q, expected %q", buf[:n], expected)
+		}
+	}
+	pair := ca.agent.getSelectedPair()
+	if _, err = pc.WriteTo([]byte("from the file"), pair.local.(*CandidateHost).dstAddr(pair.remote)); err != nil {
+		t.Fatal(err)
+	}
+	read("from the file")
+	if err = pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ca.Write([]byte("from the agent")); err != nil {
+		t.Fatal(err)
+	}
+	read("from the agent")
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConn(a, ComponentRTP)
+
+	// A deadline in the past must fail the next Read immediately
+	if err = c.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Read(make([]byte, 10)); !os.IsTimeout(err) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	// A future deadline must unblock a pending Read
+	if err = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Read(make([]byte, 10))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected net.Error with Timeout(), got %v", err)
+	}
+
+	// Clearing the deadline lets buffered data be read again
+	if err = c.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeInboundPacket(a.getBuffer(ComponentRTP), []byte{0x01}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Read(make([]byte, 10)); err != nil || n != 1 {
+		t.Fatalf("expected to read 1 byte, got %d %v", n, err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnWriteDeadline(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConn(a, ComponentRTP)
+
+	// A deadline in the past must fail the next Write immediately
+	if err = c.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte{0x01}); !os.IsTimeout(err) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	// Hold the agent lock so Write blocks looking up a valid pair
+	a.muChan <- struct{}{}
+	if err = c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write([]byte{0x01})
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected net.Error with Timeout(), got %v", err)
+	}
+	<-a.muChan
+
+	// SetDeadline applies to both directions and each can be cleared independently
+	if err = c.SetDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte{0x01}); os.IsTimeout(err) {
+		t.Fatalf("write deadline should have been cleared, got %v", err)
+	}
+	if _, err = c.Read(make([]byte, 10)); !os.IsTimeout(err) {
+		t.Fatalf("read deadline should still be set, got %v", err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnAddrs(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 5)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.startOnConnectionStateChangeRoutine()
+	c := newConn(a, ComponentRTP)
+
+	if addr := c.LocalAddr(); addr == nil || addr.String() != "0.0.0.0:0" {
+		t.Fatalf("expected unspecified local address before selection, got %v", addr)
+	}
+	if addr := c.RemoteAddr(); addr == nil || addr.String() != "0.0.0.0:0" {
+		t.Fatalf("expected unspecified remote address before selection, got %v", addr)
+	}
+
+	local, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.168.1.1",
+		Port:      19216,
+		Component: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   "tcp",
+		Address:   "10.0.0.1",
+		Port:      10000,
+		Component: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.run(func(agent *Agent) {
+		agent.setSelectedPair(newCandidatePair(local, remote, false))
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := c.LocalAddr(); addr.Network() != udp || addr.String() != "192.168.1.1:19216" {
+		t.Fatalf("unexpected local address %s %s", addr.Network(), addr)
+	}
+	if addr := c.RemoteAddr(); addr.Network() != tcp || addr.String() != "10.0.0.1:10000" {
+		t.Fatalf("unexpected remote address %s %s", addr.Network(), addr)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultipleComponents(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	cfg := &AgentConfig{
+		Components:       2,
+		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:   []CandidateType{CandidateTypeHost},
+		MulticastDNSMode: MulticastDNSModeDisabled,
+
+		AllowPrivateRemoteCandidates: true,
+	}
+
+	aAgent, err := NewAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bAgent, err := NewAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gatherAndExchangeCandidates(aAgent, bAgent)
+
+	candidates, err := aAgent.GetLocalCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := map[uint16]int{}
+	for _, c := range candidates {
+		gathered[c.Component()]++
+	}
+	if len(gathered) != 2 || gathered[1] != gathered[2] {
+		t.Fatalf("expected the same candidates for both components, got %v", gathered)
+	}
+
+	accepted := make(chan []*Conn)
+	go func() {
+		bUfrag, bPwd, acceptErr := bAgent.GetLocalUserCredentials()
+		check(acceptErr)
+		conns, acceptErr := aAgent.AcceptComponents(context.TODO(), bUfrag, bPwd)
+		check(acceptErr)
+		accepted <- conns
+	}()
+
+	aUfrag, aPwd, err := aAgent.GetLocalUserCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bConns, err := bAgent.DialComponents(context.TODO(), aUfrag, aPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aConns := <-accepted
+
+	if len(aConns) != 2 || len(bConns) != 2 {
+		t.Fatalf("expected a Conn per component, got %d and %d", len(aConns), len(bConns))
+	}
+
+	for i, conns := range [][]*Conn{aConns, bConns} {
+		for _, conn := range conns {
+			pair := conn.agent.getComponentSelectedPair(conn.Component())
+			if pair == nil {
+				t.Fatalf("agent %d has no selected pair for component %d", i, conn.Component())
+			} else if pair.local.Component() != conn.Component() || pair.remote.Component() != conn.Component() {
+				t.Fatalf("pair %s selected for component %d", pair, conn.Component())
+			}
+		}
+	}
+
+	// Every component delivers its own data
+	for component := 1; component >= 0; component-- {
+		msg := []byte{byte(component)}
+		if _, err = bConns[component].Write(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, receiveMTU)
+		n, readErr := aConns[component].Read(buf)
+		if readErr != nil {
+			t.Fatal(readErr)
+		} else if n != 1 || buf[0] != msg[0] {
+			t.Fatalf("component %d read %v", component+1, buf[:n])
+		}
+	}
+
+	if err = aAgent.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = bAgent.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidComponents(t *testing.T) {
+	if _, err := NewAgent(&AgentConfig{Components: maxComponents + 1}); err != ErrInvalidComponents {
+		t.Fatalf("expected ErrInvalidComponents, got %v", err)
+	}
+}
+
+func TestGetSelectedCandidatePair(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair, pairErr := a.GetSelectedCandidatePair(); pairErr != nil || pair != nil {
+		t.Fatalf("expected no selected pair before connecting, got %v %v", pair, pairErr)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.GetSelectedCandidatePair(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	ca, cb := pipe(nil)
+	for _, c := range []*Conn{ca, cb} {
+		pair, pairErr := c.agent.GetSelectedCandidatePair()
+		if pairErr != nil {
+			t.Fatal(pairErr)
+		}
+
+		selectedPair := c.agent.getSelectedPair()
+		if pair == nil || pair.Local != selectedPair.local || pair.Remote != selectedPair.remote {
+			t.Fatalf("expected %s, got %v", selectedPair, pair)
+		}
+
+		connPair, pairErr := c.GetSelectedCandidatePair()
+		if pairErr != nil {
+			t.Fatal(pairErr)
+		} else if connPair.Local != pair.Local || connPair.Remote != pair.Remote {
+			t.Fatalf("Conn and Agent disagree on the selected pair: %s %s", connPair, pair)
+		}
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnReadDatagrams(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	ca, cb := pipe(nil)
+
+	// Packets written before reading are read one at a time
+	packets := []string{"first", "second packet", "3"}
+	for _, p := range packets {
+		if _, err := ca.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, receiveMTU)
+	for _, p := range packets {
+		n, err := cb.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != p {
+			t.Fatalf("expected %q, got %q", p, buf[:n])
+		}
+	}
+
+	if err := ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnReadFromWriteTo(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	var _ net.PacketConn = (*Conn)(nil)
+
+	ca, cb := pipe(nil)
+
+	if _, err := ca.WriteTo([]byte("hello"), cb.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, receiveMTU)
+	n, addr, err := cb.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(buf[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q", buf[:n])
+	} else if !addrEqual(addr, cb.RemoteAddr()) {
+		t.Fatalf("expected packet from %s, got %s", cb.RemoteAddr(), addr)
+	}
+
+	// A packet too large for p stays buffered
+	if _, err = cb.WriteTo([]byte("world"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ca.ReadFrom(make([]byte, 1)); err != io.ErrShortBuffer {
+		t.Fatalf("expected io.ErrShortBuffer, got %v", err)
+	}
+	if n, err = ca.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("expected world, got %q %v", buf[:n], err)
+	}
+
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 250), Port: 9}
+	if _, err = ca.WriteTo([]byte("hello"), other); !errors.Is(err, ErrWriteToUnselectedRemote) {
+		t.Fatalf("expected ErrWriteToUnselectedRemote, got %v", err)
+	}
+	if _, err = ca.WriteTo([]byte("hello"), nil); !errors.Is(err, ErrWriteToUnselectedRemote) {
+		t.Fatalf("expected ErrWriteToUnselectedRemote, got %v", err)
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnReadFromPair(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	ca, cb := pipe(nil)
+
+	if _, err := ca.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := cb.agent.GetSelectedCandidatePair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, receiveMTU)
+	n, local, remote, err := cb.ReadFromPair(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(buf[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q", buf[:n])
+	} else if local != pair.Local {
+		t.Fatalf("expected packet on local %s, got %v", pair.Local, local)
+	} else if remote != pair.Remote {
+		t.Fatalf("expected packet from remote %s, got %v", pair.Remote, remote)
+	}
+
+	// Read keeps working on the same buffer
+	if _, err = ca.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = cb.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("expected world, got %q %v", buf[:n], err)
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = cb.ReadFromPair(buf); err == nil {
+		t.Fatal("expected an error once closed")
+	}
+}
+
+func TestTryExistingPair(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.TryExistingPair(context.Background(), nil, nil); err != ErrAgentNotStarted {
+		t.Fatalf("expected ErrAgentNotStarted, got %v", err)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, cb := pipe(nil)
+	for _, conns := range [][2]*Conn{{ca, cb}, {cb, ca}} {
+		pair, pairErr := conns[0].GetSelectedCandidatePair()
+		if pairErr != nil {
+			t.Fatal(pairErr)
+		}
+
+		// Nothing to check, the Agent is already connected
+		if _, err = conns[0].agent.TryExistingPair(context.Background(), pair.Remote, pair.Local); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, tryErr := conns[0].agent.TryExistingPair(context.Background(), pair.Local, pair.Remote)
+		if tryErr != nil {
+			t.Fatal(tryErr)
+		} else if conn.Component() != ComponentRTP {
+			t.Fatalf("expected a Conn of component %d, got %d", ComponentRTP, conn.Component())
+		}
+
+		if _, err = conn.Write([]byte("resumed")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, receiveMTU)
+		n, readErr := conns[1].Read(buf)
+		if readErr != nil {
+			t.Fatal(readErr)
+		} else if string(buf[:n]) != "resumed" {
+			t.Fatalf("expected %q, got %q", "resumed", buf[:n])
+		}
+	}
+
+	// The pair selected before the restart is not gathered again, the
+	// connectivity checks connect on the new candidates
+	pair, err := cb.GetSelectedCandidatePair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restartAgents(t, ca.agent, cb.agent)
+
+	tried := make(chan error, 1)
+	go func() {
+		_, tryErr := cb.agent.TryExistingPair(context.Background(), pair.Local, pair.Remote)
+		tried <- tryErr
+	}()
+	gatherAndExchangeCandidates(ca.agent, cb.agent)
+	if err = <-tried; err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTryExistingPairAfterRestart(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	// Each Agent binds the same port again after the restart
+	newAgent := func() *Agent {
+		udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := udpConn.LocalAddr().(*net.UDPAddr).Port
+		if err = udpConn.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		agent, err := NewAgent(&AgentConfig{
+			NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+			CandidateTypes:   []CandidateType{CandidateTypeHost},
+			MulticastDNSMode: MulticastDNSModeDisabled,
+			PortMin:          uint16(port),
+			PortMax:          uint16(port),
+
+			AllowPrivateRemoteCandidates: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return agent
+	}
+	ca, cb := connect(newAgent(), newAgent())
+
+	pair, err := cb.GetSelectedCandidatePair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restartAgents(t, ca.agent, cb.agent)
+	for _, agent := range []*Agent{ca.agent, cb.agent} {
+		gathered := make(chan struct{})
+		if err = agent.OnCandidate(func(c Candidate) {
+			if c == nil {
+				close(gathered)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err = agent.GatherCandidates(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		<-gathered
+	}
+
+	// No candidates are signaled, the old pair is checked with the new credentials
+	conn, err := cb.agent.TryExistingPair(context.Background(), pair.Local, pair.Remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected, err := conn.GetSelectedCandidatePair()
+	if err != nil {
+		t.Fatal(err)
+	} else if !selected.Local.Equal(pair.Local) || !selected.Remote.Equal(pair.Remote) {
+		t.Fatalf("expected %s <-> %s to be selected, got %s <-> %s", pair.Local, pair.Remote, selected.Local, selected.Remote)
+	}
+
+	if _, err = conn.Write([]byte("resumed")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, receiveMTU)
+	n, err := ca.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(buf[:n]) != "resumed" {
+		t.Fatalf("expected %q, got %q", "resumed", buf[:n])
+	}
+
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restartAgents restarts both Agents, and signals their new credentials
+func restartAgents(t *testing.T, aAgent, bAgent *Agent) {
+	for _, agent := range []*Agent{aAgent, bAgent} {
+		// The handler of pipe must not be notified again
+		if err := agent.OnConnectionStateChange(func(ConnectionState) {}); err != nil {
+			t.Fatal(err)
+		}
+		if err := agent.Restart("", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, agents := range [][2]*Agent{{aAgent, bAgent}, {bAgent, aAgent}} {
+		ufrag, pwd, err := agents[0].GetLocalUserCredentials()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = agents[1].SetRemoteCredentials(ufrag, pwd); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnWriteBatch(t *testing.T) {
+	// Check for leaking routines
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// Limit runtime in case of deadlocks
+	lim := test.TimeOut(time.Second * 20)
+	defer lim.Stop()
+
+	for _, batchWrites := range []bool{false, true} {
+		ca, cb := pipe(&AgentConfig{BatchWrites: batchWrites})
+
+		packets := [][]byte{{1}, {2, 2}, {3, 3, 3}}
+		n, err := ca.WriteBatch(packets)
+		if err != nil {
+			t.Fatal(err)
+		} else if n != len(packets) {
+			t.Fatalf("wrote %d packets instead of %d", n, len(packets))
+		}
+
+		buf := make([]byte, 10)
+		for _, packet := range packets {
+			n, err := cb.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(packet, buf[:n]) {
+				t.Fatalf("read %v instead of %v", buf[:n], packet)
+			}
+		}
+
+		if ca.BytesSent() != 6 {
+			t.Fatalf("sent %d bytes instead of 6", ca.BytesSent())
+		}
+
+		if _, err := ca.WriteBatch([][]byte{{1}, stun.MustBuild(stun.BindingRequest, stun.TransactionID).Raw}); err == nil {
+			t.Fatal("STUN messages must not be written")
+		}
+
+		if err := ca.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	packets := make([][]byte, 64)
+	for i := range packets {
+		packets[i] = make([]byte, 128)
+	}
+
+	for _, batchWrites := range []bool{false, true} {
+		b.Run(fmt.Sprintf("BatchWrites=%t", batchWrites), func(b *testing.B) {
+			ca, cb := pipe(&AgentConfig{BatchWrites: batchWrites})
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, err := ca.WriteBatch(packets)
+				check(err)
+			}
+
+			b.StopTimer()
+			check(ca.Close())
+			check(cb.Close())
+		})
+	}
+}
+
+func TestConnTryWrite(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	ca, cb := pipe(nil)
+
+	if n, err := ca.TryWrite([]byte("hello")); err != nil || n != 5 {
+		t.Fatalf("TryWrite wrote %d bytes (%v), expected the 5 bytes packet", n, err)
+	}
+	buf := make([]byte, receiveMTU)
+	if n, err := cb.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("read %q (%v), expected the packet of TryWrite", buf[:n], err)
+	}
+	if sent := ca.BytesSent(); sent != 5 {
+		t.Fatalf("%d bytes sent, expected the packet of TryWrite", sent)
+	}
+	if _, err := ca.TryWrite(make([]byte, defaultMaxPacketSize+1)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("TryWrite returned %v for a packet larger than the MTU, expected %v", err, ErrPacketTooLarge)
+	}
+
+	// The handler is called once the socket is writable, which it already is
+	writable := make(chan struct{}, 1)
+	ca.OnWritable(func() {
+		writable <- struct{}{}
+	})
+	ca.watchWritable(ca.agent.getSelectedPair())
+	<-writable
+
+	if err := ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnInboundStats(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	// Packets arriving at a steady rate have no jitter
+	steady := &inboundStats{}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		steady.packetArrived(start.Add(time.Duration(i) * 20 * time.Millisecond))
+	}
+	if count, jitter := steady.packetCount(), steady.jitterEstimate(); count != 10 || jitter != 0 {
+		t.Fatalf("%d packets with a jitter of %s, expected 10 packets without jitter", count, jitter)
+	}
+
+	// Intervals alternating between 10ms and 30ms vary by 20ms
+	bursty := &inboundStats{}
+	arrival := start
+	for i := 0; i < 200; i++ {
+		arrival = arrival.Add(time.Duration(10+20*(i%2)) * time.Millisecond)
+		bursty.packetArrived(arrival)
+	}
+	if jitter := bursty.jitterEstimate(); jitter < 19*time.Millisecond || jitter > 20*time.Millisecond {
+		t.Fatalf("jitter is %s, expected it to converge to 20ms", jitter)
+	}
+
+	ca, cb := pipe(nil)
+	for i := 0; i < 5; i++ {
+		if _, err := ca.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cb.Read(make([]byte, receiveMTU)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := cb.InboundPacketCount(); count != 5 {
+		t.Fatalf("%d inbound packets, expected 5", count)
+	}
+	if count := ca.InboundPacketCount(); count != 0 {
+		t.Fatalf("%d inbound packets on the sending side, expected none", count)
+	}
+
+	if err := ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartConnectivityChecks(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	newAgent := func() *Agent {
+		a, err := NewAgent(&AgentConfig{NetworkTypes: supportedNetworkTypes, AllowPrivateRemoteCandidates: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	aAgent, bAgent := newAgent(), newAgent()
+	aUfrag, aPwd, err := aAgent.GetLocalUserCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bUfrag, bPwd, err := bAgent.GetLocalUserCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The checks start before any candidate is known
+	if err = aAgent.StartConnectivityChecks(true, bUfrag, bPwd); err != nil {
+		t.Fatal(err)
+	}
+	if err = bAgent.StartConnectivityChecks(false, aUfrag, aPwd); err != nil {
+		t.Fatal(err)
+	}
+
+	gatherAndExchangeCandidates(aAgent, bAgent)
+
+	// Calling again checks the new pairs, with the same credentials only
+	if err = aAgent.StartConnectivityChecks(true, bUfrag, bPwd); err != nil {
+		t.Fatal(err)
+	}
+	if err = aAgent.StartConnectivityChecks(true, bUfrag, "anotherPasswordWith128Bits"); !errors.Is(err, ErrRemoteCredentialsConflict) {
+		t.Fatalf("StartConnectivityChecks returned %v for other credentials, expected %v", err, ErrRemoteCredentialsConflict)
+	}
+	if _, err = aAgent.Dial(context.Background(), bUfrag, bPwd); !errors.Is(err, ErrMultipleStart) {
+		t.Fatalf("Dial returned %v once the checks started, expected %v", err, ErrMultipleStart)
+	}
+
+	for _, a := range []*Agent{aAgent, bAgent} {
+		if err = a.WaitUntilConnected(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = aAgent.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = bAgent.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unavailablePacketConn fails the writes like the socket of an interface that
+// went down
+type unavailablePacketConn struct {
+	mockPacketConn
+}
+
+func (c *unavailablePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: udp, Addr: addr, Err: os.NewSyscallError("sendto", syscall.EADDRNOTAVAIL)}
+}
+
+func TestConnWriteFailover(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	a, err := NewAgent(&AgentConfig{NetworkTypes: []NetworkType{NetworkTypeUDP4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := make(chan Candidate, 10)
+	if err = a.OnSelectedCandidatePairChange(func(local, remote Candidate) {
+		selected <- local
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	newLocal := func(address string, conn net.PacketConn) *CandidateHost {
+		c, hostErr := NewCandidateHost(&CandidateHostConfig{
+			Network:   udp,
+			Address:   address,
+			Port:      777,
+			Component: 1,
+		})
+		if hostErr != nil {
+			t.Fatal(hostErr)
+		}
+		c.conn = conn
+		return c
+	}
+	sent := make(chan []byte, 10)
+	wifi := newLocal("192.168.0.2", &unavailablePacketConn{})
+	ethernet := newLocal("10.0.0.2", &recordingPacketConn{sent: sent})
+	remote, err := NewCandidateHost(&CandidateHostConfig{
+		Network:   udp,
+		Address:   "172.17.0.3",
+		Port:      999,
+		Component: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both pairs are valid and nominated, the one of the wifi is selected
+	var wifiPair, ethernetPair *candidatePair
+	if err = a.run(func(agent *Agent) {
+		agent.startOnConnectionStateChangeRoutine()
+		agent.startSelector()
+		wifiPair, ethernetPair = agent.addPair(wifi, remote), agent.addPair(ethernet, remote)
+		for _, p := range []*candidatePair{wifiPair, ethernetPair} {
+			p.state = CandidatePairStateSucceeded
+			p.nominated = true
+		}
+		agent.setSelectedPair(wifiPair)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if local := <-selected; local != wifi {
+		t.Fatalf("%s was selected, expected %s", local, wifi)
+	}
+
+	// The write fails on the wifi, the ethernet pair carries it and is selected
+	conn := newConn(a, ComponentRTP)
+	if n, writeErr := conn.Write([]byte("data")); writeErr != nil || n != 4 {
+		t.Fatalf("Write wrote %d bytes (%v), expected the packet to be sent on another pair", n, writeErr)
+	}
+	if packet := <-sent; string(packet) != "data" {
+		t.Fatalf("%q was sent on the ethernet pair, expected the packet of Write", packet)
+	}
+	if local := <-selected; local != ethernet {
+		t.Fatalf("%s was selected, expected %s", local, ethernet)
+	}
+	if err = a.run(func(agent *Agent) {
+		if wifiPair.state != CandidatePairStateFailed {
+			t.Errorf("the wifi pair is %s, expected it failed", wifiPair.state)
+		}
+		if p := agent.getSelectedPair(); p != ethernetPair {
+			t.Errorf("%s is selected, expected the ethernet pair", p)
+		}
+
+		// The ethernet goes down too
+		ethernet.conn = &unavailablePacketConn{}
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// No pair is left, the error is returned
+	if _, err = conn.Write([]byte("data")); !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Fatalf("Write returned %v without a usable pair, expected %v", err, syscall.EADDRNOTAVAIL)
+	}
+	if _, err = conn.WriteBatch([][]byte{[]byte("data")}); err != nil {
+		t.Fatalf("WriteBatch returned %v without a valid pair, expected nothing to be sent", err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,70 @@
+package ice
+
+import (
+	"errors"
+)
+
+// TryWrite writes p like Write, but doesn't block when the send buffer of the
+// socket of the selected pair is full. It returns ErrWouldBlock instead, and
+// the handler of OnWritable is called once the socket can send again. Relay,
+// TCP and UDPMux candidates don't have a UDP socket of their own, TryWrite
+// writes like Write on their pairs, and on the platforms other than Unix. A
+// packet over the bandwidth of SetMaxBandwidth returns ErrRateLimited, whatever
+// its RateLimitPolicy.
+func (c *Conn) TryWrite(p []byte) (int, error) {
+	pair, err := c.writePair([][]byte{p}, nil)
+	if pair == nil {
+		return 0, err
+	}
+	if err = c.limit(len(p), false); err != nil {
+		return 0, err
+	}
+
+	n, err := pair.tryWrite(p)
+	if errors.Is(err, ErrWouldBlock) {
+		c.watchWritable(pair)
+		return 0, err
+	} else if err != nil {
+		return n, err
+	}
+
+	c.addPacketSent(n)
+	return n, nil
+}
+
+// OnWritable sets a handler that is called when the socket a TryWrite returned
+// ErrWouldBlock for can send again. It is called once per ErrWouldBlock streak,
+// from a goroutine of the Conn, and not when the socket is closed.
+func (c *Conn) OnWritable(f func()) {
+	c.writableMu.Lock()
+	c.onWritable = f
+	c.writableMu.Unlock()
+}
+
+// watchWritable waits for the socket of the local candidate of pair to drain
+// and calls the OnWritable handler, a single wait is in flight at a time
+func (c *Conn) watchWritable(pair *candidatePair) {
+	c.writableMu.Lock()
+	defer c.writableMu.Unlock()
+	if c.waitingWritable {
+		return
+	}
+	c.waitingWritable = true
+
+	go func() {
+		err := pair.local.waitWritable()
+
+		c.writableMu.Lock()
+		c.waitingWritable = false
+		onWritable := c.onWritable
+		c.writableMu.Unlock()
+
+		if err != nil {
+			c.agent.log.Debugf("Stopped waiting for %s to be writable: %v", pair.local, err)
+			return
+		}
+		if onWritable != nil {
+			onWritable()
+		}
+	}()
+}
@@ -0,0 +1,17 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package ice
+
+import (
+	"net"
+)
+
+// trySendTo writes like WriteTo, it never returns ErrWouldBlock
+func trySendTo(conn *net.UDPConn, p []byte, addr *net.UDPAddr) (int, error) {
+	return conn.WriteTo(p, addr)
+}
+
+// waitWritable returns at once, trySendTo doesn't fail on a full send buffer
+func waitWritable(conn *net.UDPConn) error {
+	return nil
+}
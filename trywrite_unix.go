@@ -0,0 +1,83 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ice
+
+import (
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// trySendTo sends p to addr with a single sendto call. The sockets of the
+// net package are non-blocking, a full send buffer fails with EAGAIN instead
+// of waiting for the poller like WriteTo does.
+func trySendTo(conn *net.UDPConn, p []byte, addr *net.UDPAddr) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	sa := sockaddr(conn, addr)
+	var sendErr error
+	if err = rawConn.Write(func(fd uintptr) bool {
+		sendErr = unix.Sendto(int(fd), p, 0, sa)
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	switch sendErr {
+	case nil:
+		return len(p), nil
+	case unix.EAGAIN:
+		return 0, ErrWouldBlock
+	default:
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: conn.LocalAddr(), Addr: addr, Err: sendErr}
+	}
+}
+
+// sockaddr is addr in the address family of the socket of conn, IPv4
+// addresses are mapped on IPv6 sockets
+func sockaddr(conn *net.UDPConn, addr *net.UDPAddr) unix.Sockaddr {
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() != nil {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To4())
+		return sa
+	}
+
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		} else if index, err := strconv.ParseUint(addr.Zone, 10, 32); err == nil {
+			sa.ZoneId = uint32(index)
+		}
+	}
+	return sa
+}
+
+// waitWritable blocks until the send buffer of conn has room, or conn is
+// closed. The poller only wakes up on a transition to writable, the socket is
+// polled first in case it drained since the last send.
+func waitWritable(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var pollErr error
+	if err = rawConn.Write(func(fd uintptr) bool {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+		n, err := unix.Poll(fds, 0)
+		if err != nil && err != unix.EINTR {
+			pollErr = err
+			return true
+		}
+		return n > 0
+	}); err != nil {
+		return err
+	}
+	return pollErr
+}
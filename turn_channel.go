@@ -0,0 +1,213 @@
+package ice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+)
+
+const (
+	// turnChannelLifetime is how long a channel binding lasts without a refresh
+	// https://tools.ietf.org/html/rfc5766#section-11
+	turnChannelLifetime = 10 * time.Minute
+
+	// channelDataHeaderSize is the size of the header of a ChannelData message,
+	// its data is padded to 4 bytes over TCP
+	// https://tools.ietf.org/html/rfc5766#section-11.4
+	channelDataHeaderSize = 4
+
+	// minChannelNumber and maxChannelNumber bound the channel numbers of
+	// ChannelData, the first two bits of which are 0b01
+	// https://tools.ietf.org/html/rfc5766#section-11
+	minChannelNumber = 0x4000
+	maxChannelNumber = 0x7FFF
+)
+
+var (
+	channelBindRequest = stun.NewType(stun.MethodChannelBind, stun.ClassRequest)
+	channelBindSuccess = stun.NewType(stun.MethodChannelBind, stun.ClassSuccessResponse)
+	channelBindError   = stun.NewType(stun.MethodChannelBind, stun.ClassErrorResponse)
+	allocateError      = stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse)
+)
+
+// turnChannelConn is the socket of a relay candidate to its TURN server, it
+// tracks the channels bound to the peers. The turn.Client binds a channel to
+// every peer it writes to, refreshes it halfway through its lifetime when
+// writing to the peer again, and frames the packets sent on a bound channel
+// as ChannelData. The 4 byte header replaces the 36 bytes of a Send indication.
+// The keepalives and consent checks of the selected pair keep its channel bound.
+// It also records the ALTERNATE-SERVER of an Allocate the server redirected, the
+// turn.Client only reports the error code of the response.
+// The malformed packets read from the server are discarded before they reach the
+// turn.Client, which stops reading the socket on the first one it fails to handle.
+type turnChannelConn struct {
+	net.PacketConn
+	log logging.LeveledLogger
+
+	mu sync.Mutex
+	// requests are the peers of the ChannelBind requests in flight by
+	// transaction ID, bound has the time their binding succeeded by peer
+	requests map[[stun.TransactionIDSize]byte]string
+	bound    map[string]time.Time
+	// channels are the channel numbers the turn.Client requested a binding of
+	channels map[uint16]bool
+
+	alternate *net.UDPAddr
+}
+
+func newTURNChannelConn(conn net.PacketConn, log logging.LeveledLogger) *turnChannelConn {
+	return &turnChannelConn{
+		PacketConn: conn,
+		log:        log,
+		requests:   map[[stun.TransactionIDSize]byte]string{},
+		bound:      map[string]time.Time{},
+		channels:   map[uint16]bool{},
+	}
+}
+
+// messageType returns the message type of p if it is a STUN message
+func messageType(p []byte) (stun.MessageType, bool) {
+	if !stun.IsMessage(p) {
+		return stun.MessageType{}, false
+	}
+
+	var t stun.MessageType
+	t.ReadValue(binary.BigEndian.Uint16(p[0:2]))
+	return t, true
+}
+
+// channelBindType returns the message type of p if it is a ChannelBind message
+func channelBindType(p []byte) (stun.MessageType, bool) {
+	t, ok := messageType(p)
+	return t, ok && t.Method == stun.MethodChannelBind
+}
+
+func (c *turnChannelConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if t, ok := channelBindType(p); ok && t == channelBindRequest {
+		msg := &stun.Message{Raw: append([]byte{}, p...)}
+		var peer stun.XORMappedAddress
+		if msg.Decode() == nil && peer.GetFromAs(msg, stun.AttrXORPeerAddress) == nil {
+			peerAddr := net.UDPAddr{IP: peer.IP, Port: peer.Port}
+			c.mu.Lock()
+			c.requests[msg.TransactionID] = peerAddr.String()
+			if number, err := msg.Get(stun.AttrChannelNumber); err == nil && len(number) >= 2 {
+				c.channels[binary.BigEndian.Uint16(number)] = true
+			}
+			c.mu.Unlock()
+		}
+	}
+
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *turnChannelConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
+	}
+	for {
+		malformedErr := c.malformed(p[:n])
+		if malformedErr == nil {
+			break
+		}
+		c.log.Warnf("Discarding malformed packet of %d bytes from TURN server %s: %v", n, addr, malformedErr)
+		if n, addr, err = c.PacketConn.ReadFrom(p); err != nil {
+			return n, addr, err
+		}
+	}
+
+	if t, ok := channelBindType(p[:n]); ok && (t == channelBindSuccess || t == channelBindError) {
+		msg := &stun.Message{Raw: append([]byte{}, p[:n]...)}
+		if msg.Decode() == nil {
+			c.mu.Lock()
+			if peer, ok := c.requests[msg.TransactionID]; ok {
+				delete(c.requests, msg.TransactionID)
+				if t == channelBindSuccess {
+					c.bound[peer] = time.Now()
+				} else {
+					delete(c.bound, peer)
+				}
+			}
+			c.mu.Unlock()
+		}
+	} else if t, ok := messageType(p[:n]); ok && t == allocateError {
+		msg := &stun.Message{Raw: append([]byte{}, p[:n]...)}
+		if msg.Decode() == nil {
+			if alternate, ok := alternateServer(msg); ok {
+				c.mu.Lock()
+				c.alternate = alternate
+				c.mu.Unlock()
+			}
+		}
+	}
+
+	return n, addr, nil
+}
+
+// malformed returns why p must not be handled by the turn.Client: that it is
+// neither a STUN message nor ChannelData, that a STUN message can't be decoded,
+// is a request or a Data indication without peer or data, or that ChannelData
+// is shorter than its length field or on a channel that was never bound.
+func (c *turnChannelConn) malformed(p []byte) error {
+	if stun.IsMessage(p) {
+		msg := &stun.Message{Raw: append([]byte{}, p...)}
+		if err := msg.Decode(); err != nil {
+			return fmt.Errorf("invalid STUN message: %w", err)
+		}
+		switch {
+		case msg.Type.Class == stun.ClassRequest:
+			return fmt.Errorf("unexpected STUN request %s", msg.Type)
+		case msg.Type == stun.NewType(stun.MethodData, stun.ClassIndication):
+			var peer stun.XORMappedAddress
+			if err := peer.GetFromAs(msg, stun.AttrXORPeerAddress); err != nil {
+				return fmt.Errorf("data indication without peer: %w", err)
+			}
+			if _, err := msg.Get(stun.AttrData); err != nil {
+				return fmt.Errorf("data indication without data: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if len(p) < channelDataHeaderSize {
+		return errors.New("too short for ChannelData")
+	}
+	number := binary.BigEndian.Uint16(p[0:2])
+	if number < minChannelNumber || number > maxChannelNumber {
+		return errors.New("neither a STUN message nor ChannelData")
+	}
+	if length := int(binary.BigEndian.Uint16(p[2:4])); length > len(p)-channelDataHeaderSize {
+		return fmt.Errorf("ChannelData length %d over its %d bytes", length, len(p)-channelDataHeaderSize)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.channels[number] {
+		return fmt.Errorf("ChannelData on unbound channel 0x%x", number)
+	}
+	return nil
+}
+
+// alternateServer returns the ALTERNATE-SERVER the TURN server redirected the
+// Allocate to, if any
+func (c *turnChannelConn) alternateServer() (*net.UDPAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.alternate, c.alternate != nil
+}
+
+// isBound returns true if a channel is bound to peer on the TURN server
+func (c *turnChannelConn) isBound(peer net.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	boundAt, ok := c.bound[peer.String()]
+	return ok && time.Since(boundAt) < turnChannelLifetime
+}
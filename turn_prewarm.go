@@ -0,0 +1,151 @@
+package ice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pion/stun"
+)
+
+// PrewarmRelay makes the TURN allocations of the relay candidates ahead of
+// GatherCandidates, which then gathers them without waiting for the TURN
+// servers. It must be called before gathering starts. Failing to allocate is
+// not fatal, the first error is returned and the allocations that failed are
+// made by GatherCandidates as if PrewarmRelay was not called.
+func (a *Agent) PrewarmRelay(ctx context.Context) error {
+	var urls []URL
+	var count map[string]int
+	if err := a.run(func(agent *Agent) {
+		if agent.gatheringState != GatheringStateNew {
+			return
+		}
+		count = map[string]int{}
+		for _, t := range agent.candidateTypes {
+			if t != CandidateTypeRelay {
+				continue
+			}
+			for _, url := range agent.urls {
+				if url.Scheme == SchemeTypeTURN || url.Scheme == SchemeTypeTURNS {
+					urls = append(urls, *url)
+					count[url.String()] = len(agent.prewarmedRelays[url.String()])
+				}
+			}
+		}
+	}, nil); err != nil {
+		return err
+	} else if count == nil {
+		return ErrRelayPrewarmAfterGathering
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-a.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		allocs   = map[string][]*relayAllocation{}
+	)
+	for _, url := range urls {
+		switch {
+		case url.Username == "":
+			return ErrUsernameEmpty
+		case url.Password == "":
+			return ErrPasswordEmpty
+		}
+
+		// Every component gathers its own relay candidate
+		for i := count[url.String()]; i < int(a.components); i++ {
+			wg.Add(1)
+			go func(url URL) {
+				defer wg.Done()
+
+				alloc, err := a.allocateRelay(ctx, url)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					a.log.Warnf("Failed to prewarm allocation on %s: %v", url.String(), err)
+					if firstErr == nil {
+						firstErr = err
+					}
+					return
+				}
+				allocs[url.String()] = append(allocs[url.String()], alloc)
+			}(url)
+		}
+	}
+	wg.Wait()
+
+	stored := false
+	if err := a.run(func(agent *Agent) {
+		if agent.gatheringState != GatheringStateNew {
+			return
+		}
+		if agent.prewarmedRelays == nil {
+			agent.prewarmedRelays = map[string][]*relayAllocation{}
+		}
+		for url, list := range allocs {
+			agent.prewarmedRelays[url] = append(agent.prewarmedRelays[url], list...)
+		}
+		stored = true
+	}, nil); err != nil {
+		if closeErr := a.closePrewarmedRelays(allocs); closeErr != nil {
+			a.log.Warnf("Failed to close prewarmed allocations: %v", closeErr)
+		}
+		return err
+	} else if !stored {
+		if closeErr := a.closePrewarmedRelays(allocs); closeErr != nil {
+			a.log.Warnf("Failed to close prewarmed allocations: %v", closeErr)
+		}
+		return ErrRelayPrewarmAfterGathering
+	}
+
+	return firstErr
+}
+
+// takePrewarmedRelay removes an allocation made by PrewarmRelay on url, it
+// returns nil if there is none
+func (a *Agent) takePrewarmedRelay(url URL) (alloc *relayAllocation) {
+	if err := a.run(func(agent *Agent) {
+		list := agent.prewarmedRelays[url.String()]
+		if len(list) == 0 {
+			return
+		}
+		alloc = list[len(list)-1]
+		agent.prewarmedRelays[url.String()] = list[:len(list)-1]
+	}, nil); err != nil {
+		return nil
+	}
+	return alloc
+}
+
+// refreshPrewarmedRelay refreshes an allocation made by PrewarmRelay before it
+// is gathered, the server may have released it while the Agent was waiting
+func (a *Agent) refreshPrewarmedRelay(alloc *relayAllocation, url URL) error {
+	r := newTURNRefresher(a, alloc.client, url)
+	if a.onTURNCredentialRefresh != nil {
+		return r.refresh()
+	}
+	return r.transact(stun.MethodRefresh, url.Username, url.Password, turnLifetime(turnAllocationLifetime))
+}
+
+// closePrewarmedRelays releases allocations that are never gathered
+func (a *Agent) closePrewarmedRelays(allocs map[string][]*relayAllocation) error {
+	var errs []error
+	for _, list := range allocs {
+		for _, alloc := range list {
+			if err := alloc.close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to close prewarmed allocation: %w", err))
+			}
+		}
+	}
+	return joinErrors(errs...)
+}
@@ -0,0 +1,195 @@
+package ice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+const (
+	// defaultTURNRefreshInterval is how often the allocation and permissions of
+	// a relay candidate are refreshed when OnTURNCredentialRefresh is set, it is
+	// well below the 5 minutes lifetime of a permission
+	// https://tools.ietf.org/html/rfc5766#section-8
+	defaultTURNRefreshInterval = 2 * time.Minute
+
+	// turnAllocationLifetime is the LIFETIME requested when refreshing an allocation
+	turnAllocationLifetime = 10 * time.Minute
+
+	// turnRefreshAttempts bounds the retries on 401 and 438 responses, the
+	// second attempt carries the NONCE of the first response
+	turnRefreshAttempts = 3
+)
+
+// turnLifetime is the LIFETIME attribute of a Refresh request
+// https://tools.ietf.org/html/rfc5766#section-14.2
+type turnLifetime time.Duration
+
+func (l turnLifetime) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+	m.Add(stun.AttrLifetime, v)
+	return nil
+}
+
+// turnPeerAddress is the XOR-PEER-ADDRESS attribute of a CreatePermission request
+// https://tools.ietf.org/html/rfc5766#section-14.3
+type turnPeerAddress net.UDPAddr
+
+func (a turnPeerAddress) AddTo(m *stun.Message) error {
+	return stun.XORMappedAddress{IP: a.IP, Port: a.Port}.AddToAs(m, stun.AttrXORPeerAddress)
+}
+
+// turnRefresher keeps the allocation of a relay candidate alive with the
+// credentials returned by OnTURNCredentialRefresh. The turn.Client keeps using
+// the credentials the allocation was created with, so its own refreshes fail
+// once they expired and the refresher sends them instead.
+type turnRefresher struct {
+	agent     *Agent
+	client    *turn.Client
+	url       string
+	candidate *CandidateRelay
+
+	// realm and nonce are the ones of the last error response, the loop
+	// goroutine is the only one using them
+	realm stun.Realm
+	nonce stun.Nonce
+
+	done chan struct{}
+}
+
+func newTURNRefresher(a *Agent, client *turn.Client, url URL) *turnRefresher {
+	return &turnRefresher{
+		agent:  a,
+		client: client,
+		url:    url.String(),
+		realm:  client.Realm(),
+		done:   make(chan struct{}),
+	}
+}
+
+// start refreshes candidate until stop is called
+func (r *turnRefresher) start(candidate *CandidateRelay) {
+	r.candidate = candidate
+	go r.loop()
+}
+
+// stop must be called once, before the turn.Client is closed
+func (r *turnRefresher) stop() {
+	close(r.done)
+}
+
+func (r *turnRefresher) loop() {
+	ticker := time.NewTicker(r.agent.turnRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := r.refresh()
+		if err == nil {
+			continue
+		}
+
+		select {
+		case <-r.done:
+			// The candidate was closed during the refresh
+			return
+		default:
+		}
+
+		r.agent.log.Warnf("Failed to refresh relay candidate %s on %s, removing it: %v", r.candidate, r.url, err)
+		if err := r.agent.run(func(agent *Agent) {
+			agent.removeLocalCandidate(r.candidate)
+		}, nil); err != nil {
+			r.agent.log.Warnf("Failed to remove relay candidate %s: %v", r.candidate, err)
+		}
+		return
+	}
+}
+
+// refresh gets new credentials, and refreshes the allocation and the
+// permissions of the remote candidates paired with the relay candidate
+func (r *turnRefresher) refresh() error {
+	username, password, err := r.agent.onTURNCredentialRefresh(r.url)
+	if err != nil {
+		return err
+	}
+
+	if err := r.transact(stun.MethodRefresh, username, password, turnLifetime(turnAllocationLifetime)); err != nil {
+		return err
+	}
+
+	var peers []stun.Setter
+	if err := r.agent.run(func(agent *Agent) {
+		seen := map[string]bool{}
+		for _, p := range agent.checklist {
+			addr := p.remote.addr()
+			if p.local != r.candidate || addr == nil || seen[addr.IP.String()] {
+				continue
+			}
+			seen[addr.IP.String()] = true
+			peers = append(peers, turnPeerAddress(*addr))
+		}
+	}, nil); err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	return r.transact(stun.MethodCreatePermission, username, password, peers...)
+}
+
+// transact sends a request authenticated with the long-term credentials
+// username and password, and retries with the NONCE and REALM of the error
+// response when the server requires them
+func (r *turnRefresher) transact(method stun.Method, username, password string, attrs ...stun.Setter) error {
+	for i := 0; i < turnRefreshAttempts; i++ {
+		setters := append([]stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}, attrs...)
+		setters = append(setters, stun.NewUsername(username), r.agent.softwareName)
+		if len(r.nonce) > 0 {
+			setters = append(setters, r.realm, r.nonce, stun.NewLongTermIntegrity(username, r.realm.String(), password))
+		}
+		setters = append(setters, stun.Fingerprint)
+
+		msg, err := stun.Build(setters...)
+		if err != nil {
+			return err
+		}
+
+		res, err := r.client.PerformTransaction(msg, r.client.TURNServerAddr(), false)
+		if err != nil {
+			return err
+		}
+		if res.Msg.Type.Class != stun.ClassErrorResponse {
+			return nil
+		}
+
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res.Msg); err != nil {
+			return fmt.Errorf("%w: %s", ErrTURNRefreshFailed, res.Msg.Type)
+		}
+		if code.Code != stun.CodeUnauthorized && code.Code != stun.CodeStaleNonce {
+			return fmt.Errorf("%w: %s (error %s)", ErrTURNRefreshFailed, res.Msg.Type, code)
+		}
+
+		if err := r.nonce.GetFrom(res.Msg); err != nil {
+			return fmt.Errorf("%w: %s without NONCE", ErrTURNRefreshFailed, res.Msg.Type)
+		}
+		var realm stun.Realm
+		if err := realm.GetFrom(res.Msg); err == nil {
+			r.realm = realm
+		}
+	}
+
+	return fmt.Errorf("%w: %s was rejected %d times", ErrTURNRefreshFailed, method, turnRefreshAttempts)
+}
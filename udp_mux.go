@@ -0,0 +1,386 @@
+package ice
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/deadline"
+)
+
+// udpMuxConnBufferSize is how many packets are queued for an Agent before
+// packets are dropped, so a slow Agent never stalls the other ones
+const udpMuxConnBufferSize = 128
+
+// UDPMux allows multiple Agents to share a single UDP socket. Agents created
+// with a UDPMux gather a single host UDP candidate on the shared port.
+type UDPMux interface {
+	io.Closer
+
+	// GetConn returns the conn of the Agent identified by its local ufrag,
+	// it is created if it does not exist yet
+	GetConn(ufrag string) (net.PacketConn, error)
+
+	// RemoveConnByUfrag closes the conn of the Agent identified by ufrag
+	RemoveConnByUfrag(ufrag string)
+
+	// LocalAddr returns the address of the shared socket
+	LocalAddr() net.Addr
+}
+
+// UDPMuxParams are the arguments of NewUDPMuxDefault
+type UDPMuxParams struct {
+	Logger logging.LeveledLogger
+
+	// UDPConn is the shared socket, it is closed when the UDPMux is closed
+	UDPConn net.PacketConn
+}
+
+// UDPMuxDefault is a UDPMux that forwards inbound packets to the Agent whose
+// local ufrag is in the USERNAME of a Binding request. The remote address is
+// then remembered, and any later packet from it is forwarded to the same Agent.
+// When UDPConn is a *net.UDPConn bound to an unspecified address, the packets
+// sent to a remote address leave from the local IP its packets were sent to,
+// using IP_PKTINFO where the platform supports it.
+type UDPMuxDefault struct {
+	params  UDPMuxParams
+	pktInfo *pktInfoPacketConn
+
+	mu sync.Mutex
+	// conns is keyed by local ufrag
+	conns map[string]*udpMuxedConn
+	// addressMap is keyed by remote address
+	addressMap map[string]*udpMuxedConn
+	// localIPs are the local IPs the remote addresses sent to, keyed by
+	// remote address, when pktInfo is set
+	localIPs map[string]net.IP
+	// onUnknownUfrag is called with the Binding requests for a local ufrag
+	// that has no conn, a Listener creates the Agent of the peer then
+	onUnknownUfrag func(ufrag string, msg *stun.Message, addr net.Addr)
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewUDPMuxDefault creates a UDPMuxDefault reading from params.UDPConn
+func NewUDPMuxDefault(params UDPMuxParams) *UDPMuxDefault {
+	if params.Logger == nil {
+		params.Logger = logging.NewDefaultLoggerFactory().NewLogger("ice")
+	}
+
+	m := &UDPMuxDefault{
+		params:     params,
+		conns:      map[string]*udpMuxedConn{},
+		addressMap: map[string]*udpMuxedConn{},
+		localIPs:   map[string]net.IP{},
+		closed:     make(chan struct{}),
+	}
+	if udpConn, ok := params.UDPConn.(*net.UDPConn); ok {
+		if udpAddr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok && udpAddr.IP.IsUnspecified() {
+			if pc, err := newPktInfoPacketConn(udpConn); err == nil {
+				m.pktInfo = pc
+			} else {
+				params.Logger.Debugf("IP_PKTINFO is not supported on %s, the OS picks the source IP of the packets: %v", udpAddr, err)
+			}
+		}
+	}
+
+	m.wg.Add(1)
+	go m.readLoop()
+
+	return m
+}
+
+// LocalAddr returns the address of the shared socket
+func (m *UDPMuxDefault) LocalAddr() net.Addr {
+	return m.params.UDPConn.LocalAddr()
+}
+
+// GetConn returns the conn of the Agent identified by ufrag
+func (m *UDPMuxDefault) GetConn(ufrag string) (net.PacketConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.closed:
+		return nil, io.ErrClosedPipe
+	default:
+	}
+
+	if c, ok := m.conns[ufrag]; ok {
+		return c, nil
+	}
+
+	c := &udpMuxedConn{
+		mux:          m,
+		ufrag:        ufrag,
+		recvCh:       make(chan addrPacket, udpMuxConnBufferSize),
+		readDeadline: deadline.New(),
+		closed:       make(chan struct{}),
+	}
+	m.conns[ufrag] = c
+	return c, nil
+}
+
+// RemoveConnByUfrag closes the conn of the Agent identified by ufrag
+func (m *UDPMuxDefault) RemoveConnByUfrag(ufrag string) {
+	m.mu.Lock()
+	c, ok := m.conns[ufrag]
+	m.mu.Unlock()
+
+	if ok {
+		if err := c.Close(); err != nil {
+			m.params.Logger.Warnf("Failed to close muxed conn for %s: %v", ufrag, err)
+		}
+	}
+}
+
+// Close closes every conn, and the shared socket
+func (m *UDPMuxDefault) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		close(m.closed)
+		conns := make([]*udpMuxedConn, 0, len(m.conns))
+		for _, c := range m.conns {
+			conns = append(conns, c)
+		}
+		m.mu.Unlock()
+
+		for _, c := range conns {
+			if closeErr := c.Close(); closeErr != nil {
+				m.params.Logger.Warnf("Failed to close muxed conn for %s: %v", c.ufrag, closeErr)
+			}
+		}
+
+		err = m.params.UDPConn.Close()
+		m.wg.Wait()
+	})
+	return err
+}
+
+// registerAddr forwards the future packets from addr to c
+func (m *UDPMuxDefault) registerAddr(addr net.Addr, c *udpMuxedConn) {
+	key := addr.String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conns[c.ufrag] != c {
+		return // c has been closed
+	}
+
+	if old, ok := m.addressMap[key]; ok && old != c {
+		old.removeAddr(key)
+	}
+	if m.addressMap[key] != c {
+		m.addressMap[key] = c
+		c.addresses = append(c.addresses, key)
+	}
+}
+
+func (m *UDPMuxDefault) removeConn(c *udpMuxedConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conns[c.ufrag] == c {
+		delete(m.conns, c.ufrag)
+	}
+	for _, key := range c.addresses {
+		if m.addressMap[key] == c {
+			delete(m.addressMap, key)
+			delete(m.localIPs, key)
+		}
+	}
+	c.addresses = nil
+}
+
+func (m *UDPMuxDefault) readLoop() {
+	defer m.wg.Done()
+
+	buf := make([]byte, receiveMTU)
+	for {
+		var (
+			n       int
+			localIP net.IP
+			addr    net.Addr
+			err     error
+		)
+		if m.pktInfo != nil {
+			n, localIP, addr, err = m.pktInfo.readFrom(buf)
+		} else {
+			n, addr, err = m.params.UDPConn.ReadFrom(buf)
+		}
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		c := m.addressMap[addr.String()]
+		if c != nil && localIP != nil {
+			m.localIPs[addr.String()] = localIP
+		}
+		m.mu.Unlock()
+
+		if c == nil {
+			if c = m.connForBindingRequest(buf[:n], addr); c == nil {
+				m.params.Logger.Tracef("dropping packet from %s, no Agent to forward it to", addr)
+				continue
+			}
+			m.registerAddr(addr, c)
+			if localIP != nil {
+				m.mu.Lock()
+				if m.addressMap[addr.String()] == c {
+					m.localIPs[addr.String()] = localIP
+				}
+				m.mu.Unlock()
+			}
+		}
+
+		c.push(addrPacket{data: append([]byte{}, buf[:n]...), addr: addr})
+	}
+}
+
+// connForBindingRequest returns the conn of the Agent whose local ufrag is in
+// the USERNAME of the Binding request in buf, received from addr
+func (m *UDPMuxDefault) connForBindingRequest(buf []byte, addr net.Addr) *udpMuxedConn {
+	if !stun.IsMessage(buf) {
+		return nil
+	}
+
+	msg := &stun.Message{Raw: append([]byte{}, buf...)}
+	if err := msg.Decode(); err != nil || msg.Type != stun.BindingRequest {
+		return nil
+	}
+
+	var username stun.Username
+	if err := username.GetFrom(msg); err != nil {
+		return nil
+	}
+
+	// USERNAME is the local ufrag of the receiving Agent, a colon, and the
+	// ufrag of the sender
+	ufrag := strings.Split(string(username), ":")[0]
+
+	m.mu.Lock()
+	c, onUnknownUfrag := m.conns[ufrag], m.onUnknownUfrag
+	m.mu.Unlock()
+
+	if c == nil && onUnknownUfrag != nil {
+		onUnknownUfrag(ufrag, msg, addr)
+	}
+	return c
+}
+
+// setOnUnknownUfrag sets the callback of the Binding requests that are
+// dropped because no conn is registered for their local ufrag. It is called
+// from the read loop, so it must not block.
+func (m *UDPMuxDefault) setOnUnknownUfrag(f func(ufrag string, msg *stun.Message, addr net.Addr)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onUnknownUfrag = f
+}
+
+// udpMuxedConn is the net.PacketConn of a single Agent on a UDPMuxDefault
+type udpMuxedConn struct {
+	mux   *UDPMuxDefault
+	ufrag string
+
+	// addresses are the keys of mux.addressMap pointing at this conn,
+	// guarded by the lock of mux
+	addresses []string
+
+	recvCh       chan addrPacket
+	readDeadline *deadline.Deadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *udpMuxedConn) push(pkt addrPacket) {
+	select {
+	case c.recvCh <- pkt:
+	case <-c.closed:
+	default:
+		c.mux.params.Logger.Warnf("dropping packet from %s, %s is not reading fast enough", pkt.addr, c.ufrag)
+	}
+}
+
+// removeAddr must be called with the lock of mux held
+func (c *udpMuxedConn) removeAddr(key string) {
+	for i := range c.addresses {
+		if c.addresses[i] == key {
+			c.addresses = append(c.addresses[:i], c.addresses[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReadFrom reads a packet forwarded by the mux
+func (c *udpMuxedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.recvCh:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.readDeadline.Done():
+		return 0, nil, &timeoutError{}
+	case <-c.closed:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+// WriteTo sends p over the shared socket, replies from addr are forwarded to this conn
+func (c *udpMuxedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	c.mux.mu.Lock()
+	_, known := c.mux.addressMap[addr.String()]
+	localIP := c.mux.localIPs[addr.String()]
+	c.mux.mu.Unlock()
+	if !known {
+		c.mux.registerAddr(addr, c)
+	}
+
+	if c.mux.pktInfo != nil {
+		return c.mux.pktInfo.writeTo(p, localIP, addr)
+	}
+	return c.mux.params.UDPConn.WriteTo(p, addr)
+}
+
+// Close unregisters the conn from the mux, the shared socket stays open
+func (c *udpMuxedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mux.removeConn(c)
+		close(c.closed)
+	})
+	return nil
+}
+
+// LocalAddr returns the address of the shared socket
+func (c *udpMuxedConn) LocalAddr() net.Addr {
+	return c.mux.LocalAddr()
+}
+
+// SetDeadline sets the read deadline, write deadlines are not supported
+func (c *udpMuxedConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future ReadFrom calls
+func (c *udpMuxedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, it exists to implement net.PacketConn
+func (c *udpMuxedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,175 @@
+// +build !js
+
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPMux(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP(udp, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		return conn
+	}
+
+	bindingRequest := func(username string) []byte {
+		msg, err := stun.Build(stun.BindingRequest, stun.TransactionID, stun.NewUsername(username))
+		assert.NoError(t, err)
+		return msg.Raw
+	}
+
+	read := func(conn net.PacketConn) (string, net.Addr) {
+		buf := make([]byte, receiveMTU)
+		n, addr, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		return string(buf[:n]), addr
+	}
+
+	mux := NewUDPMuxDefault(UDPMuxParams{UDPConn: listen()})
+	aConn, err := mux.GetConn("aUfrag")
+	assert.NoError(t, err)
+	bConn, err := mux.GetConn("bUfrag")
+	assert.NoError(t, err)
+
+	// GetConn returns the conn already registered for the ufrag
+	sameConn, err := mux.GetConn("aUfrag")
+	assert.NoError(t, err)
+	assert.Equal(t, aConn, sameConn)
+
+	aRemote, bRemote := listen(), listen()
+
+	// Binding requests are forwarded by USERNAME
+	_, err = aRemote.WriteTo(bindingRequest("aUfrag:remote"), mux.LocalAddr())
+	assert.NoError(t, err)
+	_, addr := read(aConn)
+	assert.Equal(t, aRemote.LocalAddr().String(), addr.String())
+
+	_, err = bRemote.WriteTo(bindingRequest("bUfrag:remote"), mux.LocalAddr())
+	assert.NoError(t, err)
+	_, addr = read(bConn)
+	assert.Equal(t, bRemote.LocalAddr().String(), addr.String())
+
+	// Any later packet from the same address goes to the same conn
+	_, err = aRemote.WriteTo([]byte("data"), mux.LocalAddr())
+	assert.NoError(t, err)
+	data, _ := read(aConn)
+	assert.Equal(t, "data", data)
+
+	_, err = aConn.WriteTo([]byte("reply"), aRemote.LocalAddr())
+	assert.NoError(t, err)
+	data, addr = read(aRemote)
+	assert.Equal(t, "reply", data)
+	assert.Equal(t, mux.LocalAddr().String(), addr.String())
+
+	// Once removed, packets of the Agent are dropped and the other conns keep working
+	mux.RemoveConnByUfrag("aUfrag")
+	_, _, err = aConn.ReadFrom(make([]byte, receiveMTU))
+	assert.Error(t, err)
+
+	_, err = aRemote.WriteTo([]byte("dropped"), mux.LocalAddr())
+	assert.NoError(t, err)
+	_, err = bRemote.WriteTo([]byte("data"), mux.LocalAddr())
+	assert.NoError(t, err)
+	data, _ = read(bConn)
+	assert.Equal(t, "data", data)
+
+	assert.NoError(t, mux.Close())
+	_, _, err = bConn.ReadFrom(make([]byte, receiveMTU))
+	assert.Error(t, err)
+
+	_, err = mux.GetConn("cUfrag")
+	assert.Error(t, err)
+
+	assert.NoError(t, aRemote.Close())
+	assert.NoError(t, bRemote.Close())
+}
+
+func TestUDPMuxAgents(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	localIPs, err := localInterfaces(vnet.NewNet(nil), nil, nil, []NetworkType{NetworkTypeUDP4})
+	assert.NoError(t, err)
+	if len(localIPs) == 0 {
+		t.Skip("no non-loopback IPv4 interface to gather host candidates on")
+	}
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	assert.NoError(t, err)
+	mux := NewUDPMuxDefault(UDPMuxParams{UDPConn: udpConn})
+	muxPort := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	cfg := &AgentConfig{
+		NetworkTypes:     []NetworkType{NetworkTypeUDP4},
+		CandidateTypes:   []CandidateType{CandidateTypeHost},
+		MulticastDNSMode: MulticastDNSModeDisabled,
+
+		AllowPrivateRemoteCandidates: true,
+	}
+	muxCfg := *cfg
+	muxCfg.UDPMux = mux
+
+	// Two Agents on the mux, each connected to a peer with its own socket
+	type peers struct {
+		muxConn, peerConn *Conn
+	}
+	results := make(chan peers, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			muxNotifier, muxConnected := onConnected()
+			peerNotifier, peerConnected := onConnected()
+
+			muxAgent, newErr := NewAgent(&muxCfg)
+			check(newErr)
+			check(muxAgent.OnConnectionStateChange(muxNotifier))
+
+			peerAgent, newErr := NewAgent(cfg)
+			check(newErr)
+			check(peerAgent.OnConnectionStateChange(peerNotifier))
+
+			muxConn, peerConn := connect(muxAgent, peerAgent)
+			<-muxConnected
+			<-peerConnected
+			results <- peers{muxConn, peerConn}
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		p := <-results
+
+		localCandidates, err := p.muxConn.agent.GetLocalCandidates()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(localCandidates))
+		assert.Equal(t, muxPort, localCandidates[0].Port())
+
+		_, err = p.peerConn.Write([]byte("hello"))
+		assert.NoError(t, err)
+
+		buf := make([]byte, receiveMTU)
+		n, err := p.muxConn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+
+		assert.NoError(t, p.muxConn.Close())
+		assert.NoError(t, p.peerConn.Close())
+	}
+
+	assert.NoError(t, mux.Close())
+}
@@ -3,6 +3,7 @@ package ice
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -53,6 +54,16 @@ func parseAddr(in net.Addr) (net.IP, int, NetworkType, bool) {
 	return nil, 0, 0, false
 }
 
+// createAddr returns a net.Addr whose Network() matches the transport of networkType
+func createAddr(network NetworkType, ip net.IP, port int) net.Addr {
+	switch network {
+	case NetworkTypeTCP4, NetworkTypeTCP6:
+		return &net.TCPAddr{IP: ip, Port: port}
+	default:
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+}
+
 func addrEqual(a, b net.Addr) bool {
 	aIP, aPort, aType, aOk := parseAddr(a)
 	if !aOk {
@@ -67,11 +78,36 @@ func addrEqual(a, b net.Addr) bool {
 	return aType == bType && aIP.Equal(bIP) && aPort == bPort
 }
 
+// maxAlternateServerRedirects is how many 300 (Try Alternate) responses are
+// followed when gathering from a STUN or TURN server, it stops redirect loops
+// https://tools.ietf.org/html/rfc5389#section-11
+const maxAlternateServerRedirects = 1
+
+// alternateServer returns the ALTERNATE-SERVER of resp if it is a 300 (Try
+// Alternate) error response
+func alternateServer(resp *stun.Message) (*net.UDPAddr, bool) {
+	if resp.Type.Class != stun.ClassErrorResponse {
+		return nil, false
+	}
+
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(resp); err != nil || code.Code != stun.CodeTryAlternate {
+		return nil, false
+	}
+
+	var alternate stun.AlternateServer
+	if err := alternate.GetFrom(resp); err != nil {
+		return nil, false
+	}
+	return &net.UDPAddr{IP: alternate.IP, Port: alternate.Port}, true
+}
+
 // getXORMappedAddr initiates a stun requests to serverAddr using conn, reads the response and returns
-// the XORMappedAddress returned by the stun server.
+// the XORMappedAddress returned by the stun server. A redirect to an ALTERNATE-SERVER is followed,
+// the deadline covers every request.
 //
 // Adapted from stun v0.2.
-func getXORMappedAddr(conn net.PacketConn, serverAddr net.Addr, deadline time.Duration) (*stun.XORMappedAddress, error) {
+func getXORMappedAddr(conn net.PacketConn, serverAddr net.Addr, deadline time.Duration, setters ...stun.Setter) (*stun.XORMappedAddress, error) {
 	if deadline > 0 {
 		if err := conn.SetReadDeadline(time.Now().Add(deadline)); err != nil {
 			return nil, err
@@ -82,27 +118,42 @@ func getXORMappedAddr(conn net.PacketConn, serverAddr net.Addr, deadline time.Du
 			_ = conn.SetReadDeadline(time.Time{})
 		}
 	}()
-	resp, err := stunRequest(
-		func(p []byte) (int, error) {
-			n, _, errr := conn.ReadFrom(p)
-			return n, errr
-		},
-		func(b []byte) (int, error) {
-			return conn.WriteTo(b, serverAddr)
-		},
-	)
-	if err != nil {
-		return nil, err
+
+	var resp *stun.Message
+	for redirects := 0; ; redirects++ {
+		var err error
+		resp, err = stunRequest(
+			func(p []byte) (int, error) {
+				n, _, errr := conn.ReadFrom(p)
+				return n, errr
+			},
+			func(b []byte) (int, error) {
+				return conn.WriteTo(b, serverAddr)
+			},
+			setters...,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		alternate, ok := alternateServer(resp)
+		if !ok {
+			break
+		} else if redirects == maxAlternateServerRedirects {
+			return nil, fmt.Errorf("%w: %s redirected to %s", ErrTooManyRedirects, serverAddr, alternate)
+		}
+		serverAddr = alternate
 	}
+
 	var addr stun.XORMappedAddress
-	if err = addr.GetFrom(resp); err != nil {
+	if err := addr.GetFrom(resp); err != nil {
 		return nil, fmt.Errorf("failed to get XOR-MAPPED-ADDRESS response: %v", err)
 	}
 	return &addr, nil
 }
 
-func stunRequest(read func([]byte) (int, error), write func([]byte) (int, error)) (*stun.Message, error) {
-	req, err := stun.Build(stun.BindingRequest, stun.TransactionID)
+func stunRequest(read func([]byte) (int, error), write func([]byte) (int, error), setters ...stun.Setter) (*stun.Message, error) {
+	req, err := stun.Build(append([]stun.Setter{stun.BindingRequest, stun.TransactionID}, setters...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -122,11 +173,26 @@ func stunRequest(read func([]byte) (int, error), write func([]byte) (int, error)
 	return res, nil
 }
 
-func localInterfaces(vnet *vnet.Net, interfaceFilter func(string) bool, networkTypes []NetworkType) ([]net.IP, error) {
-	ips := []net.IP{}
-	ifaces, err := vnet.Interfaces()
+// localInterfaces returns the IPs of localAddrs that can be used without a zone
+func localInterfaces(n Net, interfaceFilter func(string) bool, ipFilter func(net.IP) bool, networkTypes []NetworkType) ([]net.IP, error) {
+	addrs, err := localAddrs(n, interfaceFilter, ipFilter, networkTypes)
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Zone == "" {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips, err
+}
+
+// localAddrs returns the addresses host candidates are gathered on. IPv6
+// link-local addresses are only usable on their interface, so their Zone is
+// the name of the interface.
+func localAddrs(n Net, interfaceFilter func(string) bool, ipFilter func(net.IP) bool, networkTypes []NetworkType) ([]net.IPAddr, error) {
+	addrs := []net.IPAddr{}
+	ifaces, err := n.Interfaces()
 	if err != nil {
-		return ips, err
+		return addrs, err
 	}
 
 	var IPv4Requested, IPv6Requested bool
@@ -152,12 +218,12 @@ func localInterfaces(vnet *vnet.Net, interfaceFilter func(string) bool, networkT
 			continue
 		}
 
-		addrs, err := iface.Addrs()
+		ifaceAddrs, err := iface.Addrs()
 		if err != nil {
 			continue
 		}
 
-		for _, addr := range addrs {
+		for _, addr := range ifaceAddrs {
 			var ip net.IP
 			switch addr := addr.(type) {
 			case *net.IPNet:
@@ -169,25 +235,67 @@ func localInterfaces(vnet *vnet.Net, interfaceFilter func(string) bool, networkT
 				continue
 			}
 
+			if ipFilter != nil && !ipFilter(ip) {
+				continue
+			}
+
+			var zone string
 			if ipv4 := ip.To4(); ipv4 == nil {
-				if !IPv6Requested {
+				switch {
+				case !IPv6Requested:
 					continue
-				} else if !isSupportedIPv6(ip) {
+				case ip.IsLinkLocalUnicast():
+					if iface.Name == "" {
+						continue // no zone to use it with
+					}
+					zone = iface.Name
+				case !isSupportedIPv6(ip):
 					continue
 				}
 			} else if !IPv4Requested {
 				continue
 			}
 
-			ips = append(ips, ip)
+			addrs = append(addrs, net.IPAddr{IP: ip, Zone: zone})
 		}
 	}
-	return ips, nil
+	return addrs, nil
+}
+
+// parseIPZone parses address, the IP of a candidate. It can have a zone when
+// it is an IPv6 link local IP, like "fe80::1%eth0".
+func parseIPZone(address string) (net.IP, string, error) {
+	zone := ""
+	if i := strings.LastIndexByte(address, '%'); i >= 0 {
+		address, zone = address[:i], address[i+1:]
+	}
+
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return nil, "", ErrAddressParseFailed
+	case zone != "" && (ip.To4() != nil || !ip.IsLinkLocalUnicast()):
+		return nil, "", ErrAddressParseFailed
+	}
+	return ip, zone, nil
+}
+
+// joinIPZone is the inverse of parseIPZone
+func joinIPZone(ip net.IP, zone string) string {
+	if zone == "" {
+		return ip.String()
+	}
+	return ip.String() + "%" + zone
 }
 
-func listenUDPInPortRange(vnet *vnet.Net, log logging.LeveledLogger, portMax, portMin int, network string, laddr *net.UDPAddr) (vnet.UDPPacketConn, error) {
+// errPortRangeExhausted wraps ErrPort with the range in which no port could be bound
+func errPortRangeExhausted(portMin, portMax int) error {
+	return fmt.Errorf("%w: no port available between %d and %d", ErrPort, portMin, portMax)
+}
+
+func listenUDPInPortRange(n Net, log logging.LeveledLogger, portMax, portMin int, network string, laddr *net.UDPAddr) (vnet.UDPPacketConn, error) {
 	if (laddr.Port != 0) || ((portMin == 0) && (portMax == 0)) {
-		return vnet.ListenUDP(network, laddr)
+		return n.ListenUDP(network, laddr)
 	}
 	var i, j int
 	i = portMin
@@ -205,8 +313,8 @@ func listenUDPInPortRange(vnet *vnet.Net, log logging.LeveledLogger, portMax, po
 	portStart := globalMathRandomGenerator.Intn(j-i+1) + i
 	portCurrent := portStart
 	for {
-		laddr = &net.UDPAddr{IP: laddr.IP, Port: portCurrent}
-		c, e := vnet.ListenUDP(network, laddr)
+		laddr = &net.UDPAddr{IP: laddr.IP, Port: portCurrent, Zone: laddr.Zone}
+		c, e := n.ListenUDP(network, laddr)
 		if e == nil {
 			return c, e
 		}
@@ -219,7 +327,44 @@ func listenUDPInPortRange(vnet *vnet.Net, log logging.LeveledLogger, portMax, po
 			break
 		}
 	}
-	return nil, ErrPort
+	return nil, errPortRangeExhausted(i, j)
+}
+
+func listenTCPInPortRange(log logging.LeveledLogger, portMax, portMin int, network string, laddr *net.TCPAddr) (*net.TCPListener, error) {
+	if (laddr.Port != 0) || ((portMin == 0) && (portMax == 0)) {
+		return net.ListenTCP(network, laddr)
+	}
+	var i, j int
+	i = portMin
+	if i == 0 {
+		i = 1
+	}
+	j = portMax
+	if j == 0 {
+		j = 0xFFFF
+	}
+	if i > j {
+		return nil, ErrPort
+	}
+
+	portStart := globalMathRandomGenerator.Intn(j-i+1) + i
+	portCurrent := portStart
+	for {
+		laddr = &net.TCPAddr{IP: laddr.IP, Port: portCurrent}
+		l, e := net.ListenTCP(network, laddr)
+		if e == nil {
+			return l, e
+		}
+		log.Debugf("failed to listen %s: %v", laddr.String(), e)
+		portCurrent++
+		if portCurrent > j {
+			portCurrent = i
+		}
+		if portCurrent == portStart {
+			break
+		}
+	}
+	return nil, errPortRangeExhausted(i, j)
 }
 
 func addrIPAndPort(addr net.Addr) (net.IP, int, error) {